@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rx3lixir/laba/internal/udp"
+)
+
+// defaultNameTemplate matches the names the client always used
+const defaultNameTemplate = "message_{id8}.{ext}"
+
+// expandFileName fills a file name template for a message. Supported placeholders:
+// {id}, {id8} (first 8 characters of the ID), {sender}, {time} and {ext} (from the audio format)
+func expandFileName(template string, msg udp.MessageInfo) string {
+	id := msg.ID.String()
+
+	sender := msg.SenderName
+	if sender == "" {
+		sender = msg.SenderID.String()
+	}
+
+	timestamp := msg.CreatedAt
+	if created, err := time.Parse(time.RFC3339, msg.CreatedAt); err == nil {
+		timestamp = created.Format("20060102-150405")
+	}
+
+	ext := msg.AudioFormat
+	if ext == "" {
+		ext = "opus"
+	}
+
+	name := strings.NewReplacer(
+		"{id}", id,
+		"{id8}", id[:8],
+		"{sender}", sender,
+		"{time}", timestamp,
+		"{ext}", ext,
+	).Replace(template)
+
+	return sanitizeFileName(name)
+}
+
+// sanitizeFileName keeps a name from escaping the output directory
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', 0:
+			return '_'
+		}
+		return r
+	}, name)
+
+	if name == "" || name == "." || name == ".." {
+		return "message"
+	}
+	return name
+}
+
+// uniquePath returns path, or path with a _1, _2, ... suffix before the
+// extension if a file with that name already exists or is in taken
+func uniquePath(path string, taken map[string]bool) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	candidate := path
+	for i := 1; ; i++ {
+		_, err := os.Stat(candidate)
+		if errors.Is(err, fs.ErrNotExist) && !taken[candidate] {
+			return candidate, nil
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("failed to check %s: %w", candidate, err)
+		}
+		candidate = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+// outputPathFor builds where a message is saved and makes sure the directory exists.
+// taken holds paths promised to downloads that haven't written their file yet, it may be nil
+func (c *Client) outputPathFor(dir string, msg udp.MessageInfo, taken map[string]bool) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return uniquePath(filepath.Join(dir, expandFileName(c.nameTemplate, msg)), taken)
+}
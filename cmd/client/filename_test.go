@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/udp"
+)
+
+func TestExpandFileName(t *testing.T) {
+	msg := udp.MessageInfo{
+		ID:          uuid.MustParse("0123abcd-1111-2222-3333-444455556666"),
+		SenderID:    uuid.MustParse("99999999-8888-7777-6666-555544443333"),
+		SenderName:  "alice",
+		CreatedAt:   "2025-03-04T05:06:07Z",
+		AudioFormat: "wav",
+	}
+
+	tests := []struct {
+		template string
+		msg      func(udp.MessageInfo) udp.MessageInfo
+		want     string
+	}{
+		{defaultNameTemplate, nil, "message_0123abcd.wav"},
+		{"{sender}-{time}.{ext}", nil, "alice-20250304-050607.wav"},
+		{"{id}.{ext}", nil, "0123abcd-1111-2222-3333-444455556666.wav"},
+		// Falls back to the sender ID and opus when the list leaves them out
+		{"{sender}.{ext}", func(m udp.MessageInfo) udp.MessageInfo { m.SenderName, m.AudioFormat = "", ""; return m }, "99999999-8888-7777-6666-555544443333.opus"},
+		// A timestamp that doesn't parse is used as is
+		{"{time}", func(m udp.MessageInfo) udp.MessageInfo { m.CreatedAt = "yesterday"; return m }, "yesterday"},
+		// Nothing may point outside the output directory
+		{"{sender}.{ext}", func(m udp.MessageInfo) udp.MessageInfo { m.SenderName = "../../etc/passwd"; return m }, ".._.._etc_passwd.wav"},
+		{"..", nil, "message"},
+		{"unknown {placeholder}", nil, "unknown {placeholder}"},
+	}
+
+	for _, tt := range tests {
+		m := msg
+		if tt.msg != nil {
+			m = tt.msg(msg)
+		}
+		if got := expandFileName(tt.template, m); got != tt.want {
+			t.Errorf("expandFileName(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestUniquePath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "message.opus")
+
+	if got, err := uniquePath(path, nil); err != nil || got != path {
+		t.Fatalf("free name became %s, %v", got, err)
+	}
+
+	// Taken on disk
+	if err := os.WriteFile(path, []byte("voice"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "message_1.opus"), []byte("voice"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := uniquePath(path, nil); err != nil || got != filepath.Join(dir, "message_2.opus") {
+		t.Fatalf("got %s, %v, want message_2.opus", got, err)
+	}
+
+	// Promised to a download still in flight
+	taken := map[string]bool{filepath.Join(dir, "message_2.opus"): true}
+	if got, err := uniquePath(path, taken); err != nil || got != filepath.Join(dir, "message_3.opus") {
+		t.Fatalf("got %s, %v, want message_3.opus", got, err)
+	}
+}
+
+func TestOutputPathForCreatesDirectory(t *testing.T) {
+	client := &Client{nameTemplate: "{id8}.{ext}"}
+	dir := filepath.Join(t.TempDir(), "voice", "inbox")
+	msg := udp.MessageInfo{ID: uuid.New(), AudioFormat: "ogg"}
+
+	path, err := client.outputPathFor(dir, msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, msg.ID.String()[:8]+".ogg"); path != want {
+		t.Fatalf("path %s, want %s", path, want)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("output directory was not created: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/internal/session"
+	"github.com/rx3lixir/laba/internal/udp"
+	"github.com/rx3lixir/laba/pkg/jwt"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+)
+
+// stubMessageStore keeps message records in memory in place of postgres.
+// Methods the server doesn't reach in these tests are left to the embedded nil interface
+type stubMessageStore struct {
+	db.MessageStore
+
+	mu       sync.Mutex
+	messages map[uuid.UUID]db.VoiceMessage
+}
+
+func (m *stubMessageStore) CreateMessage(ctx context.Context, msg *db.VoiceMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.messages[msg.ID]; ok {
+		return fmt.Errorf("message already exists")
+	}
+	msg.CreatedAt = time.Now()
+	m.messages[msg.ID] = *msg
+	return nil
+}
+
+func (m *stubMessageStore) GetMessageByID(ctx context.Context, id uuid.UUID) (*db.VoiceMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.messages[id]
+	if !ok {
+		return nil, fmt.Errorf("message not found")
+	}
+	return &msg, nil
+}
+
+func (m *stubMessageStore) GetMessagesByRecipient(ctx context.Context, recipientID uuid.UUID, folder string, limit, offset int) ([]*db.VoiceMessage, error) {
+	return m.find(func(msg db.VoiceMessage) bool { return msg.RecipientID == recipientID && !msg.Archived }), nil
+}
+
+func (m *stubMessageStore) GetUndeliveredMessages(ctx context.Context, recipientID uuid.UUID, limit int) ([]*db.VoiceMessage, error) {
+	return m.find(func(msg db.VoiceMessage) bool {
+		return msg.RecipientID == recipientID && msg.Status == db.MessageStatusTransmitted
+	}), nil
+}
+
+func (m *stubMessageStore) UpdateMessage(ctx context.Context, msg *db.VoiceMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.messages[msg.ID]
+	if !ok {
+		return fmt.Errorf("message not found")
+	}
+	// Same columns as the postgres update
+	stored.ChunksReceived = msg.ChunksReceived
+	stored.Status = msg.Status
+	stored.TransmittedAt = msg.TransmittedAt
+	stored.DeliveredAt = msg.DeliveredAt
+	stored.ListenedAt = msg.ListenedAt
+	m.messages[msg.ID] = stored
+	return nil
+}
+
+func (m *stubMessageStore) MarkMessageDelivered(ctx context.Context, id uuid.UUID, deliveredAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.messages[id]
+	if !ok {
+		return fmt.Errorf("message not found")
+	}
+	stored.Status = db.MessageStatusDelivered
+	stored.DeliveredAt = &deliveredAt
+	m.messages[id] = stored
+	return nil
+}
+
+func (m *stubMessageStore) RecordFailedMessage(ctx context.Context, msg *db.FailedMessage) error {
+	return fmt.Errorf("message %s failed: %s", msg.MessageID, msg.Reason)
+}
+
+func (m *stubMessageStore) WithTx(ctx context.Context, fn func(tx db.MessageStore) error) error {
+	return fn(m)
+}
+
+func (m *stubMessageStore) find(match func(db.VoiceMessage) bool) []*db.VoiceMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var found []*db.VoiceMessage
+	for _, msg := range m.messages {
+		if match(msg) {
+			copied := msg
+			found = append(found, &copied)
+		}
+	}
+	return found
+}
+
+// stubUserStore names every sender after their ID
+type stubUserStore struct {
+	db.UserStore
+}
+
+func (stubUserStore) GetUsername(ctx context.Context, id uuid.UUID) (string, error) {
+	return "user-" + id.String()[:8], nil
+}
+
+// stubBlockStore blocks nobody
+type stubBlockStore struct {
+	db.BlockStore
+}
+
+func (stubBlockStore) IsBlocked(ctx context.Context, blockerID, blockedID uuid.UUID) (bool, error) {
+	return false, nil
+}
+
+// testServer is a UDP server on loopback with everything it stores kept in memory
+type testServer struct {
+	addr     string
+	jwt      *jwt.Service
+	messages *stubMessageStore
+	objects  *s3storage.MemoryStore
+}
+
+// startServer runs a UDP server until the test ends
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+
+	// Take a free port and hand it over to the server
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr := probe.LocalAddr().(*net.UDPAddr)
+	addr := udpAddr.String()
+	probe.Close()
+
+	ts := &testServer{
+		addr:     addr,
+		jwt:      jwt.NewService("integration-secret", time.Hour, time.Hour),
+		messages: &stubMessageStore{messages: make(map[uuid.UUID]db.VoiceMessage)},
+		objects:  s3storage.NewMemoryStore(),
+	}
+
+	server := udp.New(
+		addr,
+		udp.Options{},
+		session.NewMemoryStore(session.TTLOptions{}),
+		ts.jwt,
+		stubUserStore{},
+		ts.messages,
+		nil,
+		stubBlockStore{},
+		ts.objects,
+		nil,
+		nil,
+		log.New(io.Discard),
+	)
+
+	started := make(chan error, 1)
+	go func() { started <- server.Start() }()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		if err := <-started; err != nil {
+			t.Errorf("server: %v", err)
+		}
+	})
+
+	// The port is taken once the server listens
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		probe, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			break
+		}
+		probe.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return ts
+}
+
+// connect starts a client for a new user, authenticated over a secure channel
+func (ts *testServer) connect(t *testing.T, username string) *Client {
+	t.Helper()
+
+	token, err := ts.jwt.GenerateAccessToken(uuid.New(), username+"@example.com", username, db.RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(ts.addr, "", token, true, 0, log.New(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	setOutputDir(client, t.TempDir())
+
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// waitForMessage waits until a message to recipientID is stored and delivered
+func (ts *testServer) waitForMessage(t *testing.T, recipientID uuid.UUID) db.VoiceMessage {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, msg := range ts.messages.find(func(msg db.VoiceMessage) bool { return msg.RecipientID == recipientID }) {
+			if msg.Status == db.MessageStatusDelivered {
+				return *msg
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("message was never stored and delivered")
+	return db.VoiceMessage{}
+}
+
+func TestSendStoreListDownload(t *testing.T) {
+	ts := startServer(t)
+
+	alice := ts.connect(t, "alice")
+	bob := ts.connect(t, "bob")
+
+	// A few chunks, with a short last one
+	data := bytes.Repeat([]byte("integration voice "), 5*udp.MaxPayloadSize/18)
+	input := filepath.Join(t.TempDir(), "message.opus")
+	if err := os.WriteFile(input, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.SendVoiceMessage(bob.UserID(), input, func(done, total uint32) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob is online, so the message is stored and pushed to him
+	stored := ts.waitForMessage(t, bob.UserID())
+	if stored.SenderID != alice.UserID() || stored.FileSize != len(data) {
+		t.Fatalf("stored %+v, want %d bytes from alice", stored, len(data))
+	}
+
+	object, err := ts.objects.DownloadVoiceMessage(context.Background(), stored.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(object, data) {
+		t.Fatal("stored audio differs from what was sent")
+	}
+
+	messages, err := bob.ListMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID != stored.ID {
+		t.Fatalf("listed %v, want the one message sent", messages)
+	}
+
+	output := filepath.Join(t.TempDir(), "downloaded.opus")
+	if err := bob.DownloadMessage(stored.ID, output, func(done, total uint32) {}); err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Fatalf("downloaded %d bytes, want the %d sent", len(downloaded), len(data))
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -17,30 +19,82 @@ import (
 )
 
 type Client struct {
-	conn          *net.UDPConn
-	serverAddr    *net.UDPAddr
+	conn       atomic.Pointer[net.UDPConn]
+	serverAddr *net.UDPAddr
+	localAddr  *net.UDPAddr
+	jwtToken   string
+	encrypt    bool
+	secure     atomic.Pointer[udp.SecureChannel]
+	sendSeq    atomic.Uint32
+	logger     *log.Logger
+	ackChan    chan *udp.Packet
+	listChan   chan *udp.Packet
+	statusChan chan *udp.Packet
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// authMu serializes (re)authentication between the user and the keepalive
+	authMu sync.Mutex
+
+	// authenticated and userID are set by Authenticate, which the keepalive
+	// may run at any time, and read by every request
+	authenticated atomic.Bool
+	userMu        sync.RWMutex
 	userID        uuid.UUID
-	jwtToken      string
-	authenticated bool
-	logger        *log.Logger
-	ackChan       chan *udp.Packet
-	dataChan      chan *udp.Packet
-	listChan      chan *udp.Packet
-	ctx           context.Context
-	cancel        context.CancelFunc
 
-	downloadChunks map[uuid.UUID]map[uint32][]byte
-	downloadTotal  map[uuid.UUID]uint32
+	// expiredChan signals that the server dropped our session
+	expiredChan chan struct{}
+
+	// refusedChan carries the IDs of messages the server refused over the send quota
+	refusedChan chan uuid.UUID
+
+	// reconnecting is set while a broken socket is being replaced
+	reconnecting atomic.Bool
+
+	// Heartbeat replies are routed apart from chunk ACKs by message ID
+	heartbeatID   atomic.Pointer[uuid.UUID]
+	heartbeatChan chan *udp.Packet
+
+	// Likewise the reply to the delete request in flight, ACK or error
+	deleteID   atomic.Pointer[uuid.UUID]
+	deleteChan chan *udp.Packet
+
+	stats packetStats
+
+	// Messages being received, by ID, and those recently saved, see receiveChunk
+	incomingMu sync.Mutex
+	incoming   map[uuid.UUID]*incoming
+	received   map[uuid.UUID]time.Time
+
+	// Where downloads go and how they are named, see expandFileName
+	outputDir    string
+	nameTemplate string
+
+	// printStats prints transfer stats to the terminal, see reportTransfer
+	printStats bool
 }
 
 func main() {
 	serverAddr := flag.String("server", "localhost:9090", "UDP server address")
 	jwtToken := flag.String("token", "", "JWT authentication token")
+	secure := flag.Bool("secure", true, "Encrypt the session after authenticating")
+	heartbeat := flag.Duration("heartbeat", 2*time.Minute, "Keepalive heartbeat interval, 0 disables it")
+	localAddr := flag.String("local", "", "Local UDP address to send from, e.g. :40000 for a stable source port")
+	outputDir := flag.String("output-dir", ".", "Directory downloaded messages are saved to")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	nameTemplate := flag.String("name", defaultNameTemplate, "Downloaded file name, placeholders: {id} {id8} {sender} {time} {ext}")
+	printStats := flag.Bool("stats", false, "Print transfer stats after every send and download, and totals on exit")
 	flag.Parse()
 
 	if *jwtToken == "" {
 		fmt.Println("Error: JWT token is required")
-		fmt.Println("Usage: client -token YOUR_JWT_TOKEN [-server localhost:9090]")
+		fmt.Println("Usage: client -token YOUR_JWT_TOKEN [-server localhost:9090] [-secure=false] [-heartbeat 2m] [-local :40000]")
+		os.Exit(1)
+	}
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Println("Error: invalid log level:", *logLevel)
 		os.Exit(1)
 	}
 
@@ -49,26 +103,31 @@ func main() {
 		ReportCaller:    false,
 		ReportTimestamp: true,
 		TimeFormat:      "15:04:05",
-		Level:           log.InfoLevel,
+		Level:           level,
 	})
 
 	// Create client
-	client, err := NewClient(*serverAddr, *jwtToken, logger)
+	client, err := NewClient(*serverAddr, *localAddr, *jwtToken, *secure, *heartbeat, logger)
 	if err != nil {
 		logger.Fatal("Failed to create client", "error", err)
 	}
 	defer client.Close()
 
+	client.outputDir = *outputDir
+	client.nameTemplate = *nameTemplate
+	client.printStats = *printStats
+
 	logger.Info("UDP Voice Chat Client started")
 	logger.Info("Server address", "addr", *serverAddr)
+	logger.Info("Local address", "addr", client.conn.Load().LocalAddr())
 
 	// Authenticate with server
 	logger.Info("Authenticating...")
-	if err := client.Authenticate(); err != nil {
+	if err := client.Connect(); err != nil {
 		logger.Fatal("Authentication failed", "error", err)
 	}
 
-	logger.Info("✓ Authentication successful", "user_id", client.userID)
+	logger.Info("✓ Authentication successful", "user_id", client.UserID(), "secure", *secure)
 
 	// Check for messages after auth
 	if err := client.CheckMessages(); err != nil {
@@ -79,69 +138,210 @@ func main() {
 	client.InteractiveMode()
 }
 
-func NewClient(serverAddr, jwtToken string, logger *log.Logger) (*Client, error) {
+// NewClient creates a client and starts listening for packets.
+// An empty localAddr lets the OS pick an ephemeral port.
+// With a positive heartbeatInterval it also keeps the session alive in the background
+func NewClient(serverAddr, localAddr, jwtToken string, encrypt bool, heartbeatInterval time.Duration, logger *log.Logger) (*Client, error) {
 	// Resolve server address
 	udpAddr, err := net.ResolveUDPAddr("udp", serverAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve server address: %w", err)
 	}
 
-	// Create UDP connection
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create UDP connection: %w", err)
+	// A fixed local address keeps the source port stable for NAT mappings
+	var laddr *net.UDPAddr
+	if localAddr != "" {
+		laddr, err = net.ResolveUDPAddr("udp", localAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local address %q: %w", localAddr, err)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	client := &Client{
-		conn:           conn,
-		serverAddr:     udpAddr,
-		jwtToken:       jwtToken,
-		logger:         logger,
-		ackChan:        make(chan *udp.Packet, 100),
-		dataChan:       make(chan *udp.Packet, 100),
-		listChan:       make(chan *udp.Packet, 100),
-		ctx:            ctx,
-		cancel:         cancel,
-		downloadChunks: make(map[uuid.UUID]map[uint32][]byte),
-		downloadTotal:  make(map[uuid.UUID]uint32),
+		serverAddr:    udpAddr,
+		localAddr:     laddr,
+		jwtToken:      jwtToken,
+		encrypt:       encrypt,
+		logger:        logger,
+		heartbeatChan: make(chan *udp.Packet, 1),
+		deleteChan:    make(chan *udp.Packet, 1),
+		expiredChan:   make(chan struct{}, 1),
+		refusedChan:   make(chan uuid.UUID, 1),
+		ackChan:       make(chan *udp.Packet, 100),
+		listChan:      make(chan *udp.Packet, 100),
+		statusChan:    make(chan *udp.Packet, 10),
+		ctx:           ctx,
+		cancel:        cancel,
+		incoming:      make(map[uuid.UUID]*incoming),
+		received:      make(map[uuid.UUID]time.Time),
+		outputDir:     ".",
+		nameTemplate:  defaultNameTemplate,
 	}
 
+	// Create UDP connection
+	conn, err := client.dial()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	client.conn.Store(conn)
+
 	// Start listening for responses
 	go client.listen()
 
+	if heartbeatInterval > 0 {
+		go client.keepalive(heartbeatInterval)
+	}
+
 	return client, nil
 }
 
+// Connect authenticates and, if enabled, sets up the secure channel
+func (c *Client) Connect() error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	// A fresh session makes any pending expiry signal stale
+	select {
+	case <-c.expiredChan:
+	default:
+	}
+
+	if err := c.Authenticate(); err != nil {
+		return err
+	}
+
+	if c.encrypt {
+		if err := c.Handshake(); err != nil {
+			return fmt.Errorf("secure handshake failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// dial opens a UDP socket to the server, from the local address if one was given
+func (c *Client) dial() (*net.UDPConn, error) {
+	conn, err := net.DialUDP("udp", c.localAddr, c.serverAddr)
+	if err != nil {
+		if c.localAddr != nil {
+			return nil, fmt.Errorf("failed to bind local address %s: %w", c.localAddr, err)
+		}
+		return nil, fmt.Errorf("failed to create UDP connection: %w", err)
+	}
+	return conn, nil
+}
+
+// keepalive sends a heartbeat every interval while authenticated
+// and reconnects when the server no longer knows the session
+func (c *Client) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if !c.authenticated.Load() {
+				continue
+			}
+
+			if err := c.Heartbeat(); err != nil {
+				c.logger.Warn("Heartbeat failed, re-authenticating", "error", err)
+
+				if err := c.Connect(); err != nil {
+					c.logger.Error("Re-authentication failed", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// Heartbeat keeps the session alive and waits for the server to confirm it
+func (c *Client) Heartbeat() error {
+	packet := udp.NewPacket(udp.PacketTypeHeartbeat, c.UserID(), uuid.Nil, uuid.New())
+	c.heartbeatID.Store(&packet.MessageID)
+	defer c.heartbeatID.Store(nil)
+
+	if err := c.sendPacket(packet); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
+	defer cancel()
+
+	select {
+	case reply := <-c.heartbeatChan:
+		if reply.Type == udp.PacketTypeError {
+			if string(reply.Payload) == udp.ErrorSessionExpired {
+				return fmt.Errorf("session expired")
+			}
+			return fmt.Errorf("server error: %s", string(reply.Payload))
+		}
+		return nil
+
+	case <-ctx.Done():
+		return fmt.Errorf("heartbeat timeout")
+	}
+}
+
+// reauthenticate restores a session the server dropped so the caller can retry
+func (c *Client) reauthenticate() error {
+	c.logger.Info("Re-authenticating...")
+
+	if err := c.Connect(); err != nil {
+		return fmt.Errorf("re-authentication failed: %w", err)
+	}
+
+	return nil
+}
+
+// isHeartbeatReply reports whether a packet answers the heartbeat in flight
+func (c *Client) isHeartbeatReply(packet *udp.Packet) bool {
+	id := c.heartbeatID.Load()
+	return id != nil && *id == packet.MessageID
+}
+
 // listen is listens idk
 func (c *Client) listen() {
-	buffer := make([]byte, 2048)
+	buffer := make([]byte, udp.MaxPacketSize)
 
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
 		default:
-			c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-			n, err := c.conn.Read(buffer)
+			conn := c.conn.Load()
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, err := conn.Read(buffer)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
+				if c.ctx.Err() != nil {
+					return
+				}
+				if isFatalReadError(err) {
+					if !c.reconnect(err) {
+						return
+					}
+					continue
+				}
 				c.logger.Error("Error reading from UDP", "error", err)
 				continue
 			}
 
-			// Make sure we have enough data
-			if n < 48 {
-				c.logger.Warn("Received packet too small", "bytes", n)
+			packet, ok := c.readPacket(buffer[:n])
+			if !ok {
 				continue
 			}
 
-			packet, err := udp.Unmarshal(buffer[:n])
+			packet, err = c.openPacket(packet)
 			if err != nil {
-				c.logger.Error("Failed to unmarshal packet", "error", err, "bytes", n)
+				c.logger.Warn("Dropping packet", "error", err)
 				continue
 			}
 			c.handlePacket(packet)
@@ -149,44 +349,156 @@ func (c *Client) listen() {
 	}
 }
 
+// openPacket decrypts secure packets. Once the channel is up, plaintext is only
+// accepted for errors, which the server may send before it knows who we are
+func (c *Client) openPacket(packet *udp.Packet) (*udp.Packet, error) {
+	channel := c.secure.Load()
+
+	if packet.Type == udp.PacketTypeSecure {
+		if channel == nil {
+			return nil, fmt.Errorf("secure packet without a secure channel")
+		}
+		return channel.Open(packet)
+	}
+
+	if channel != nil && packet.Type != udp.PacketTypeError {
+		return nil, fmt.Errorf("plaintext packet on a secure channel: type %d", packet.Type)
+	}
+
+	return packet, nil
+}
+
 func (c *Client) handlePacket(packet *udp.Packet) {
+	if c.isHeartbeatReply(packet) {
+		select {
+		case c.heartbeatChan <- packet:
+		default:
+		}
+		return
+	}
+
+	if c.isDeleteReply(packet) {
+		select {
+		case c.deleteChan <- packet:
+		default:
+		}
+		return
+	}
+
 	switch packet.Type {
 	case udp.PacketTypeAuthAck:
 		c.logger.Debug("Received auth ACK")
-		c.ackChan <- packet
+		c.deliver(c.ackChan, packet)
+
+	case udp.PacketTypeHandshakeAck:
+		c.logger.Debug("Received handshake ACK")
+		c.deliver(c.ackChan, packet)
 
 	case udp.PacketTypeAck:
 		c.logger.Debug("Received ACK",
 			"message_id", packet.MessageID,
 			"chunk", packet.ChunkIndex,
 		)
-		c.ackChan <- packet
+		c.deliver(c.ackChan, packet)
 
 	case udp.PacketTypeError:
+		if string(packet.Payload) == udp.ErrorSessionExpired {
+			c.logger.Warn("Session expired on the server")
+			select {
+			case c.expiredChan <- struct{}{}:
+			default:
+			}
+			return
+		}
+		if string(packet.Payload) == udp.ErrorRateLimited {
+			// Every chunk of a refused message gets one, only the first matters
+			select {
+			case c.refusedChan <- packet.MessageID:
+			default:
+			}
+			return
+		}
 		c.logger.Error("Received error from server", "error", string(packet.Payload))
 
 	case udp.PacketTypeVoiceData:
-		c.logger.Info("Received voice message",
+		c.logger.Debug("Received voice chunk",
 			"message_id", packet.MessageID,
 			"chunk", fmt.Sprintf("%d/%d", packet.ChunkIndex, packet.TotalChunks),
 			"from", packet.SenderID,
 		)
-		c.dataChan <- packet
+		c.receiveChunk(packet)
 
 	case udp.PacketTypeMessageList:
 		c.logger.Debug("Received message list")
-		c.listChan <- packet
+		c.deliver(c.listChan, packet)
+
+	case udp.PacketTypeStatusResponse:
+		c.logger.Debug("Received message status")
+		c.deliver(c.statusChan, packet)
+
+	case udp.PacketTypeNewMessage:
+		info, err := udp.ParseMessageInfo(packet.Payload)
+		if err != nil {
+			c.logger.Warn("Invalid new message notification", "error", err)
+			return
+		}
+		c.logger.Info("New voice message, use 'check' or 'download' to get it",
+			"message_id", info.ID,
+			"from", info.SenderName,
+			"size", info.FileSize,
+		)
+
+	case udp.PacketTypeRecordingIndicator:
+		recording, err := udp.ParseRecordingIndicator(packet.Payload)
+		if err != nil {
+			c.logger.Warn("Invalid recording indicator", "error", err)
+			return
+		}
+		if recording {
+			c.logger.Info("User is recording a voice message", "from", packet.SenderID)
+		} else {
+			c.logger.Info("User stopped recording", "from", packet.SenderID)
+		}
 
 	default:
 		c.logger.Warn("Unknown packet type", "type", packet.Type)
 	}
 }
 
+// deliver hands a reply to whoever waits for it. The listener never blocks on
+// a full channel, nobody is reading then and the reply is stale anyway
+func (c *Client) deliver(ch chan *udp.Packet, packet *udp.Packet) {
+	select {
+	case ch <- packet:
+	default:
+		c.logger.Debug("Dropping unclaimed reply", "type", packet.Type, "message_id", packet.MessageID)
+	}
+}
+
+// UserID returns the ID the server assigned us on auth, uuid.Nil before that
+func (c *Client) UserID() uuid.UUID {
+	c.userMu.RLock()
+	defer c.userMu.RUnlock()
+	return c.userID
+}
+
+func (c *Client) setUserID(userID uuid.UUID) {
+	c.userMu.Lock()
+	defer c.userMu.Unlock()
+	c.userID = userID
+}
+
 func (c *Client) Authenticate() error {
 	c.logger.Info("Authenticating with server...")
 
+	// The server drops the old keys on auth, so do we
+	c.secure.Store(nil)
+
 	// Create auth packet
-	authPacket := udp.NewAuthPacket(uuid.Nil, c.jwtToken)
+	authPacket, err := udp.NewAuthPacket(uuid.Nil, c.jwtToken)
+	if err != nil {
+		return err
+	}
 
 	// Send auth packet
 	if err := c.sendPacket(authPacket); err != nil {
@@ -200,8 +512,8 @@ func (c *Client) Authenticate() error {
 	select {
 	case ack := <-c.ackChan:
 		if ack.Type == udp.PacketTypeAuthAck {
-			c.authenticated = true
-			c.userID = ack.RecipientID // Server sends our ID back
+			c.setUserID(ack.RecipientID) // Server sends our ID back
+			c.authenticated.Store(true)
 			return nil
 		}
 		return fmt.Errorf("unexpected response type: %d", ack.Type)
@@ -211,158 +523,394 @@ func (c *Client) Authenticate() error {
 	}
 }
 
-func (c *Client) CheckMessages() error {
-	if !c.authenticated {
+// Handshake agrees on session keys with the server, after which
+// every packet in both directions is encrypted
+func (c *Client) Handshake() error {
+	if !c.authenticated.Load() {
 		return fmt.Errorf("not authenticated")
 	}
 
-	c.logger.Info("Checking for messages...")
+	key, err := udp.NewHandshakeKey()
+	if err != nil {
+		return err
+	}
 
-	packet := udp.NewListMessagesPacket(c.userID)
+	packet := udp.NewHandshakePacket(c.UserID(), key.PublicKey().Bytes(), c.jwtToken)
 	if err := c.sendPacket(packet); err != nil {
-		return fmt.Errorf("failed to send list request: %w", err)
+		return fmt.Errorf("failed to send handshake packet: %w", err)
 	}
 
 	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
 	defer cancel()
 
 	select {
-	case listPacket := <-c.listChan:
-		messages, err := udp.ParseMessageList(listPacket.Payload)
-		if err != nil {
-			return fmt.Errorf("failed to parse message list: %w", err)
+	case ack := <-c.ackChan:
+		if ack.Type != udp.PacketTypeHandshakeAck {
+			return fmt.Errorf("unexpected response type: %d", ack.Type)
 		}
 
-		if len(messages) == 0 {
-			fmt.Println("\n No unread messages")
-		} else {
-			fmt.Printf("\n You have %d unread message(s):\n", len(messages))
-			fmt.Println(strings.Repeat("=", 70))
-			for i, msg := range messages {
-				fmt.Printf("%d. From: %s (%s)\n", i+1, msg.SenderName, msg.SenderID)
-				fmt.Printf("   Size: %d bytes | Format: %s | Status: %s\n",
-					msg.FileSize, msg.AudioFormat, msg.Status)
-				fmt.Printf("   Received: %s\n", msg.CreatedAt)
-				fmt.Printf("   Message ID: %s\n", msg.ID)
-				fmt.Println(strings.Repeat("-", 70))
-			}
-			fmt.Println("Use 'download <message_id>' to download a message")
+		channel, err := udp.NewSecureChannel(key, ack.Payload, c.UserID(), false)
+		if err != nil {
+			return err
 		}
+
+		c.secure.Store(channel)
 		return nil
 
 	case <-ctx.Done():
-		return fmt.Errorf("timeout waiting for message list")
+		return fmt.Errorf("handshake timeout")
 	}
 }
 
-func (c *Client) DownloadMessage(messageID uuid.UUID, outputPath string) error {
-	c.logger.Info("Requesting message download", "message_id", messageID)
-
-	// Initialize chunk tracking
-	c.downloadChunks[messageID] = make(map[uint32][]byte)
-	c.downloadTotal[messageID] = 0
-
-	packet := udp.NewDownloadMessagePacket(c.userID, messageID)
-	if err := c.sendPacket(packet); err != nil {
-		return fmt.Errorf("failed to send download request: %w", err)
+// ListMessages requests the list of unread messages from the server
+func (c *Client) ListMessages() ([]udp.MessageInfo, error) {
+	if !c.authenticated.Load() {
+		return nil, fmt.Errorf("not authenticated")
 	}
 
-	// Wait for chunks
-	timeout := time.After(30 * time.Second)
-	var totalChunks uint32
+	// One retry after re-authenticating if the session turns out to be gone
+	for attempt := 0; attempt < 2; attempt++ {
+		packet := udp.NewListMessagesPacket(c.UserID())
+		if err := c.sendPacket(packet); err != nil {
+			return nil, fmt.Errorf("failed to send list request: %w", err)
+		}
+
+		ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
 
-	for {
 		select {
-		case dataPacket := <-c.dataChan:
-			if dataPacket.MessageID != messageID {
-				continue
+		case listPacket := <-c.listChan:
+			cancel()
+			messages, err := udp.ParseMessageList(listPacket.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse message list: %w", err)
 			}
+			return messages, nil
 
-			totalChunks = dataPacket.TotalChunks
-			c.downloadChunks[messageID][dataPacket.ChunkIndex] = dataPacket.Payload
+		case <-c.expiredChan:
+			cancel()
+			if err := c.reauthenticate(); err != nil {
+				return nil, err
+			}
 
-			fmt.Printf("\rDownloading... %d/%d chunks",
-				len(c.downloadChunks[messageID]), totalChunks)
+		case <-ctx.Done():
+			cancel()
+			return nil, fmt.Errorf("timeout waiting for message list")
+		}
+	}
 
-			// Check if we have all chunks
-			if uint32(len(c.downloadChunks[messageID])) == totalChunks {
-				fmt.Println("\n✓ All chunks received, assembling file...")
+	return nil, fmt.Errorf("session expired")
+}
 
-				// Assemble file
-				var assembled []byte
-				for i := uint32(0); i < totalChunks; i++ {
-					chunk, ok := c.downloadChunks[messageID][i]
-					if !ok {
-						return fmt.Errorf("missing chunk %d", i)
-					}
-					assembled = append(assembled, chunk...)
+// QueryStatus asks the server how far a message we sent got
+func (c *Client) QueryStatus(messageID uuid.UUID) (*udp.MessageStatus, error) {
+	if !c.authenticated.Load() {
+		return nil, fmt.Errorf("not authenticated")
+	}
+
+	// One retry after re-authenticating if the session turns out to be gone
+	for attempt := 0; attempt < 2; attempt++ {
+		packet := udp.NewStatusQueryPacket(c.UserID(), messageID)
+		if err := c.sendPacket(packet); err != nil {
+			return nil, fmt.Errorf("failed to send status query: %w", err)
+		}
+
+		ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
+
+	wait:
+		for {
+			select {
+			case statusPacket := <-c.statusChan:
+				// A late reply to an earlier query
+				if statusPacket.MessageID != messageID {
+					continue
+				}
+				cancel()
+				status, err := udp.ParseMessageStatus(statusPacket.Payload)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse message status: %w", err)
 				}
+				return status, nil
 
-				// Save to file
-				if err := os.WriteFile(outputPath, assembled, 0o644); err != nil {
-					return fmt.Errorf("failed to save file: %w", err)
+			case <-c.expiredChan:
+				cancel()
+				if err := c.reauthenticate(); err != nil {
+					return nil, err
 				}
+				break wait
+
+			case <-ctx.Done():
+				cancel()
+				return nil, fmt.Errorf("timeout waiting for message status")
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("session expired")
+}
+
+// DeleteMessage deletes a message we received, on the server and in storage
+func (c *Client) DeleteMessage(messageID uuid.UUID) error {
+	if !c.authenticated.Load() {
+		return fmt.Errorf("not authenticated")
+	}
 
-				// Clean up
-				delete(c.downloadChunks, messageID)
-				delete(c.downloadTotal, messageID)
+	c.deleteID.Store(&messageID)
+	defer c.deleteID.Store(nil)
 
-				c.logger.Info("Message downloaded successfully",
-					"path", outputPath,
-					"size", len(assembled),
-				)
-				fmt.Printf("✓ Message saved to: %s (%d bytes)\n", outputPath, len(assembled))
+	// One retry after re-authenticating if the session turns out to be gone
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := c.sendPacket(udp.NewDeleteMessagePacket(c.UserID(), messageID)); err != nil {
+			return fmt.Errorf("failed to send delete request: %w", err)
+		}
+
+		ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
+
+		select {
+		case reply := <-c.deleteChan:
+			cancel()
+			if reply.IsDeleteAck() {
+				c.logger.Info("Message deleted", "message_id", messageID)
 				return nil
 			}
+			if string(reply.Payload) != udp.ErrorSessionExpired {
+				return fmt.Errorf("server error: %s", string(reply.Payload))
+			}
+			if err := c.reauthenticate(); err != nil {
+				return err
+			}
 
-		case <-timeout:
-			delete(c.downloadChunks, messageID)
-			delete(c.downloadTotal, messageID)
-			return fmt.Errorf("download timeout")
+		case <-ctx.Done():
+			cancel()
+			return fmt.Errorf("timeout waiting for delete confirmation")
 		}
 	}
+
+	return fmt.Errorf("session expired")
 }
 
-func (c *Client) sendPacket(packet *udp.Packet) error {
-	data, err := packet.Marshal()
-	if err != nil {
-		return fmt.Errorf("failed to marshal packet: %w", err)
+// isDeleteReply reports whether a packet answers the delete request in flight
+func (c *Client) isDeleteReply(packet *udp.Packet) bool {
+	id := c.deleteID.Load()
+	if id == nil || *id != packet.MessageID {
+		return false
 	}
+	return packet.IsDeleteAck() || packet.Type == udp.PacketTypeError
+}
 
-	_, err = c.conn.Write(data)
+func (c *Client) CheckMessages() error {
+	c.logger.Info("Checking for messages...")
+
+	messages, err := c.ListMessages()
 	if err != nil {
-		return fmt.Errorf("failed to send packet: %w", err)
+		return err
 	}
 
+	if len(messages) == 0 {
+		fmt.Println("\n No unread messages")
+		return nil
+	}
+
+	fmt.Printf("\n You have %d unread message(s):\n", len(messages))
+	fmt.Println(strings.Repeat("=", 70))
+	for i, msg := range messages {
+		fmt.Printf("%d. From: %s (%s)\n", i+1, msg.SenderName, msg.SenderID)
+		fmt.Printf("   Size: %d bytes | Format: %s | Status: %s\n",
+			msg.FileSize, msg.AudioFormat, msg.Status)
+		fmt.Printf("   Received: %s\n", msg.CreatedAt)
+		fmt.Printf("   Message ID: %s\n", msg.ID)
+		fmt.Println(strings.Repeat("-", 70))
+	}
+	fmt.Println("Use 'download <message_id>' to download a message")
+
 	return nil
 }
 
-func (c *Client) sendWithRetry(packet *udp.Packet, maxRetries int) error {
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if err := c.sendPacket(packet); err != nil {
+// maxConcurrentDownloads caps how many messages DownloadAll fetches at once
+const maxConcurrentDownloads = 4
+
+// DownloadAll downloads every unread message into outputDir.
+// At most maxConcurrentDownloads run at once
+func (c *Client) DownloadAll(outputDir string) error {
+	messages, err := c.ListMessages()
+	if err != nil {
+		return err
+	}
+
+	if len(messages) == 0 {
+		fmt.Println("No unread messages to download")
+		return nil
+	}
+
+	fmt.Printf("Downloading %d message(s) to %s\n", len(messages), outputDir)
+
+	// Paths are picked up front, nothing is written until a download completes
+	// so two messages with the same name would otherwise get the same path
+	paths := make([]string, len(messages))
+	taken := make(map[string]bool)
+	for i, msg := range messages {
+		paths[i], err = c.outputPathFor(outputDir, msg, taken)
+		if err != nil {
 			return err
 		}
+		taken[paths[i]] = true
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+	)
+	sem := make(chan struct{}, maxConcurrentDownloads)
 
-		// Wait for ACK
-		ctx, cancel := context.WithTimeout(c.ctx, 2*time.Second)
+	for i, msg := range messages {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem }()
+			defer wg.Done()
 
+			// Progress lines of parallel downloads would overwrite each other
+			err := c.DownloadMessage(msg.ID, paths[i], func(done, total uint32) {})
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				c.logger.Error("Failed to download message", "message_id", msg.ID, "error", err)
+				fmt.Printf("✗ [%d/%d] %s from %s failed: %v\n", i+1, len(messages), msg.ID, msg.SenderName, err)
+				return
+			}
+			fmt.Printf("✓ [%d/%d] %s from %s\n", i+1, len(messages), msg.ID, msg.SenderName)
+			succeeded++
+		}()
+	}
+	wg.Wait()
+
+	fmt.Println(strings.Repeat("=", 70))
+	fmt.Printf("Downloaded %d/%d message(s), %d failed\n",
+		succeeded, len(messages), len(messages)-succeeded)
+
+	if succeeded != len(messages) {
+		return fmt.Errorf("%d message(s) failed to download", len(messages)-succeeded)
+	}
+
+	return nil
+}
+
+// messageInfo looks a message up in the unread list for naming its file.
+// Messages that aren't listed only get their ID filled in
+func (c *Client) messageInfo(messageID uuid.UUID) udp.MessageInfo {
+	messages, err := c.ListMessages()
+	if err != nil {
+		c.logger.Warn("Failed to look up message details", "message_id", messageID, "error", err)
+	}
+	for _, msg := range messages {
+		if msg.ID == messageID {
+			return msg
+		}
+	}
+	return udp.MessageInfo{ID: messageID}
+}
+
+// DownloadMessage downloads a message into outputPath. A nil progress redraws a progress line
+func (c *Client) DownloadMessage(messageID uuid.UUID, outputPath string, progress ProgressFunc) error {
+	if progress == nil {
+		progress = printDownloadProgress
+	}
+
+	c.logger.Info("Requesting message download", "message_id", messageID)
+
+	// The listener collects the chunks and saves the file, see receiveChunk
+	done := c.expectMessage(messageID, outputPath, progress)
+	defer c.forgetMessage(messageID)
+
+	packet := udp.NewDownloadMessagePacket(c.UserID(), messageID)
+	if err := c.sendPacket(packet); err != nil {
+		return fmt.Errorf("failed to send download request: %w", err)
+	}
+
+	timeout := time.After(30 * time.Second)
+	retried := false
+
+	for {
 		select {
-		case ack := <-c.ackChan:
-			cancel()
-			if ack.MessageID == packet.MessageID && ack.ChunkIndex == packet.ChunkIndex {
-				return nil
+		case <-c.expiredChan:
+			if retried {
+				return fmt.Errorf("session expired")
 			}
-		case <-ctx.Done():
-			cancel()
-			c.logger.Warn("ACK timeout retrying...", "attempt", attempt+1, "chunk", packet.ChunkIndex)
-			continue
+			retried = true
+
+			if err := c.reauthenticate(); err != nil {
+				return err
+			}
+
+			if err := c.sendPacket(packet); err != nil {
+				return fmt.Errorf("failed to send download request: %w", err)
+			}
+
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+
+			c.logger.Info("Message downloaded successfully", "path", outputPath)
+			fmt.Printf("\n✓ Message saved to: %s\n", outputPath)
+			return nil
+
+		case <-timeout:
+			return fmt.Errorf("download timeout")
+		}
+	}
+}
+
+func (c *Client) sendPacket(packet *udp.Packet) error {
+	packet.Sequence = c.sendSeq.Add(1)
+
+	if channel := c.secure.Load(); channel != nil {
+		sealed, err := channel.Seal(packet)
+		if err != nil {
+			return fmt.Errorf("failed to seal packet: %w", err)
 		}
+		packet = sealed
+	}
+
+	data, err := packet.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal packet: %w", err)
+	}
+
+	if c.reconnecting.Load() {
+		return errReconnecting
+	}
+
+	_, err = c.conn.Load().Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to send packet: %w", err)
 	}
 
-	return fmt.Errorf("max retries exceeded")
+	return nil
+}
+
+// ProgressFunc is called with how many chunks of a message are done out of total.
+// It runs whenever more chunks are confirmed, so done never decreases and reaches total once the transfer completes
+type ProgressFunc func(done, total uint32)
+
+// logSendProgress is the default send progress, logging every chunk
+func (c *Client) logSendProgress(done, total uint32) {
+	c.logger.Info("Chunk sent", "progress", fmt.Sprintf("%d/%d", done, total))
+}
+
+// printDownloadProgress is the default download progress, redrawing a single line
+func printDownloadProgress(done, total uint32) {
+	fmt.Printf("\rDownloading... %d/%d chunks", done, total)
 }
 
-func (c *Client) SendVoiceMessage(recipientID uuid.UUID, filePath string) error {
+// SendVoiceMessage sends a file in chunks. A nil progress logs every chunk
+func (c *Client) SendVoiceMessage(recipientID uuid.UUID, filePath string, progress ProgressFunc) error {
+	if progress == nil {
+		progress = c.logSendProgress
+	}
+
 	c.logger.Info("Sending voice message", "file", filePath, "to", recipientID)
 
 	data, err := os.ReadFile(filePath)
@@ -370,8 +918,15 @@ func (c *Client) SendVoiceMessage(recipientID uuid.UUID, filePath string) error
 		return fmt.Errorf("failed to read file: %w", err)
 	}
 
+	if len(data) == 0 {
+		return fmt.Errorf("file is empty: %s", filePath)
+	}
+
 	c.logger.Info("File loaded", "size", len(data), "bytes")
 
+	c.setRecording(recipientID, true)
+	defer c.setRecording(recipientID, false)
+
 	// Generate message ID
 	messageID := uuid.New()
 
@@ -384,49 +939,27 @@ func (c *Client) SendVoiceMessage(recipientID uuid.UUID, filePath string) error
 		"chunk_size", chunkSize,
 	)
 
-	// Send each chunk
-	successfulChunks := 0
-	for i := 0; i < totalChunks; i++ {
-		start := i * chunkSize
-		end := start + chunkSize
-		if end > len(data) {
-			end = len(data)
-		}
-
-		chunkData := data[start:end]
-
-		// Create packet
-		packet := udp.NewVoiceDataPacket(
-			c.userID,
-			recipientID,
-			messageID,
-			uint32(i),
-			uint32(totalChunks),
-			chunkData,
-		)
+	stats := TransferStats{Chunks: uint32(totalChunks), Bytes: len(data)}
+	started := time.Now()
+	err = c.sendChunks(messageID, recipientID, data, uint32(totalChunks), progress, &stats)
+	stats.Elapsed = time.Since(started)
+	c.reportTransfer("send", stats)
 
-		// Send with retry
-		if err := c.sendWithRetry(packet, 3); err != nil {
-			c.logger.Error("Failed to send chunk", "chunk", i, "error", err)
-			continue
-		}
-
-		successfulChunks++
-		c.logger.Info(
-			"Chunk sent",
-			"progress", fmt.Sprintf("%d/%d", i+1, totalChunks),
-		)
-
-		// To not overwhelm the network
-		time.Sleep(10 * time.Millisecond)
+	if err != nil {
+		c.logger.Error("Failed to send message", "message_id", messageID, "error", err)
+		return err
 	}
 
-	if successfulChunks == totalChunks {
-		c.logger.Info("✓ All chunks sent successfully", "message_id", messageID)
-		return nil
-	}
+	c.logger.Info("✓ All chunks sent successfully", "message_id", messageID)
+	return nil
+}
 
-	return fmt.Errorf("only %d/%d chunks sent successfylly", successfulChunks, totalChunks)
+// setRecording tells the recipient whether we are recording for them.
+// Indicators are best effort and never retried
+func (c *Client) setRecording(recipientID uuid.UUID, recording bool) {
+	if err := c.sendPacket(udp.NewRecordingIndicatorPacket(c.UserID(), recipientID, recording)); err != nil {
+		c.logger.Debug("Failed to send recording indicator", "error", err)
+	}
 }
 
 func (c *Client) InteractiveMode() {
@@ -437,7 +970,11 @@ func (c *Client) InteractiveMode() {
 	fmt.Println("send <recipient_id> <file_path>      - Send a voice message")
 	fmt.Println("check                                - Check for new messages")
 	fmt.Println("download <message_id> [output_path]  - Download a message")
+	fmt.Println("download-all [output_dir]            - Download all unread messages")
+	fmt.Println("status <message_id>                  - Show the status of a sent message")
+	fmt.Println("delete <message_id>                  - Delete a received message")
 	fmt.Println("heartbeat                            - Send heartbeat to server")
+	fmt.Println("stats                                - Show packet and transfer counters")
 	fmt.Println("quit                                 - Exit the client")
 	fmt.Println()
 
@@ -473,7 +1010,7 @@ func (c *Client) InteractiveMode() {
 
 			filePath := parts[2]
 
-			if err := c.SendVoiceMessage(recipientID, filePath); err != nil {
+			if err := c.SendVoiceMessage(recipientID, filePath, nil); err != nil {
 				fmt.Println("Error sending message:", err)
 			}
 
@@ -494,33 +1031,100 @@ func (c *Client) InteractiveMode() {
 				continue
 			}
 
-			outputPath := fmt.Sprintf("message_%s.opus", messageID.String()[:8])
+			var outputPath string
 			if len(parts) >= 3 {
 				outputPath = parts[2]
-			}
 
-			// Ensure directory exists
-			dir := filepath.Dir(outputPath)
-			if dir != "." && dir != "" {
-				if err := os.MkdirAll(dir, 0o755); err != nil {
-					fmt.Println("Error creating directory:", err)
+				// Ensure directory exists
+				dir := filepath.Dir(outputPath)
+				if dir != "." && dir != "" {
+					if err := os.MkdirAll(dir, 0o755); err != nil {
+						fmt.Println("Error creating directory:", err)
+						continue
+					}
+				}
+			} else {
+				outputPath, err = c.outputPathFor(c.outputDir, c.messageInfo(messageID), nil)
+				if err != nil {
+					fmt.Println("Error choosing output file:", err)
 					continue
 				}
 			}
 
-			if err := c.DownloadMessage(messageID, outputPath); err != nil {
+			if err := c.DownloadMessage(messageID, outputPath, nil); err != nil {
 				fmt.Println("Error downloading message:", err)
 			}
 
+		case "download-all":
+			outputDir := c.outputDir
+			if len(parts) >= 2 {
+				outputDir = parts[1]
+			}
+
+			if err := c.DownloadAll(outputDir); err != nil {
+				fmt.Println("Error downloading messages:", err)
+			}
+
+		case "delete":
+			if len(parts) != 2 {
+				fmt.Println("Usage: delete <message_id>")
+				continue
+			}
+
+			messageID, err := uuid.Parse(parts[1])
+			if err != nil {
+				fmt.Println("Invalid message ID:", err)
+				continue
+			}
+
+			if err := c.DeleteMessage(messageID); err != nil {
+				fmt.Println("Error deleting message:", err)
+				continue
+			}
+
+			fmt.Println("✓ Message deleted")
+
+		case "status":
+			if len(parts) != 2 {
+				fmt.Println("Usage: status <message_id>")
+				continue
+			}
+
+			messageID, err := uuid.Parse(parts[1])
+			if err != nil {
+				fmt.Println("Invalid message ID:", err)
+				continue
+			}
+
+			status, err := c.QueryStatus(messageID)
+			if err != nil {
+				fmt.Println("Error getting message status:", err)
+				continue
+			}
+
+			fmt.Printf("Status: %s\n", status.Status)
+			fmt.Printf("Sent: %s\n", status.CreatedAt.Format(time.DateTime))
+			if status.DeliveredAt != nil {
+				fmt.Printf("Delivered: %s\n", status.DeliveredAt.Format(time.DateTime))
+			}
+			if status.ListenedAt != nil {
+				fmt.Printf("Listened: %s\n", status.ListenedAt.Format(time.DateTime))
+			}
+
 		case "heartbeat":
-			packet := udp.NewPacket(udp.PacketTypeHeartbeat, c.userID, uuid.Nil, uuid.New())
-			if err := c.sendPacket(packet); err != nil {
+			if err := c.Heartbeat(); err != nil {
 				fmt.Println("Error sending heartbeat:", err)
 			} else {
-				fmt.Println("Heartbeat sent")
+				fmt.Println("Heartbeat acknowledged")
 			}
 
+		case "stats":
+			c.printTotals()
+
 		case "quit", "exit":
+			if c.printStats {
+				c.printTotals()
+			}
 			fmt.Println("Goodbye!")
 			return
 
@@ -533,7 +1137,7 @@ func (c *Client) InteractiveMode() {
 
 func (c *Client) Close() {
 	c.cancel()
-	if c.conn != nil {
-		c.conn.Close()
+	if conn := c.conn.Load(); conn != nil {
+		conn.Close()
 	}
 }
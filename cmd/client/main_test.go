@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/udp"
+)
+
+func TestReauthenticateWhileSending(t *testing.T) {
+	client, server := newTestClient(t)
+
+	// The fake server answers every auth, and ignores everything else
+	go func() {
+		for {
+			packet := server.read(2 * time.Second)
+			if packet == nil {
+				return
+			}
+			if packet.Type == udp.PacketTypeAuth {
+				server.send(udp.NewPacket(udp.PacketTypeAuthAck, uuid.Nil, uuid.New(), packet.MessageID))
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			client.setRecording(uuid.New(), true)
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		if err := client.Authenticate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	if !client.authenticated.Load() || client.UserID() == uuid.Nil {
+		t.Fatal("client is not authenticated")
+	}
+}
+
+func TestListMessagesReauthenticatesOnExpiredSession(t *testing.T) {
+	client, server := newTestClient(t)
+	client.authenticated.Store(true)
+
+	// The first list request finds the session gone, the one after re-auth succeeds
+	var auths, lists int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			packet := server.read(2 * time.Second)
+			if packet == nil {
+				return
+			}
+
+			switch packet.Type {
+			case udp.PacketTypeAuth:
+				auths++
+				server.send(udp.NewPacket(udp.PacketTypeAuthAck, uuid.Nil, uuid.New(), packet.MessageID))
+
+			case udp.PacketTypeListMessages:
+				lists++
+				if auths == 0 {
+					expired := udp.NewPacket(udp.PacketTypeError, uuid.Nil, uuid.Nil, packet.MessageID)
+					expired.Payload = []byte(udp.ErrorSessionExpired)
+					server.send(expired)
+					continue
+				}
+				list, err := udp.NewMessageListPacket(packet.SenderID, []udp.MessageInfo{{ID: uuid.New(), SenderName: "alice"}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				server.send(list)
+			}
+		}
+	}()
+
+	messages, err := client.ListMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.conn.Close()
+	<-done
+
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	if auths != 1 || lists != 2 {
+		t.Fatalf("%d auths and %d list requests, want 1 and 2", auths, lists)
+	}
+}
+
+// mockMessageServer answers list and download requests for messages, sending each
+// download after delay. It tracks how many downloads were in flight at once
+type mockMessageServer struct {
+	server   *fakeServer
+	messages map[uuid.UUID][]byte
+	delay    time.Duration
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (m *mockMessageServer) serve(userID uuid.UUID) {
+	var sends sync.WaitGroup
+	defer sends.Wait()
+
+	for {
+		packet := m.server.read(2 * time.Second)
+		if packet == nil {
+			return
+		}
+
+		switch packet.Type {
+		case udp.PacketTypeListMessages:
+			var infos []udp.MessageInfo
+			for id := range m.messages {
+				infos = append(infos, udp.MessageInfo{ID: id, SenderID: uuid.New(), SenderName: "alice", AudioFormat: "opus"})
+			}
+			list, err := udp.NewMessageListPacket(userID, infos)
+			if err != nil {
+				m.server.t.Error(err)
+				return
+			}
+			m.server.send(list)
+
+		case udp.PacketTypeDownloadMsg:
+			m.mu.Lock()
+			m.inFlight++
+			m.maxInFlight = max(m.maxInFlight, m.inFlight)
+			m.mu.Unlock()
+
+			data := m.messages[packet.MessageID]
+			sends.Add(1)
+			go func() {
+				defer sends.Done()
+				time.Sleep(m.delay)
+				m.server.send(udp.NewVoiceDataPacket(uuid.New(), userID, packet.MessageID, 0, 1, data))
+			}()
+
+		case udp.PacketTypeAck:
+			// The only chunk is ACKed once the client saved the message
+			m.mu.Lock()
+			m.inFlight--
+			m.mu.Unlock()
+		}
+	}
+}
+
+func TestDownloadAllIsBounded(t *testing.T) {
+	client, server := newTestClient(t)
+	client.authenticated.Store(true)
+
+	mock := &mockMessageServer{server: server, messages: make(map[uuid.UUID][]byte), delay: 50 * time.Millisecond}
+	for i := 0; i < maxConcurrentDownloads+2; i++ { // as many as fit one list packet
+		mock.messages[uuid.New()] = []byte(fmt.Sprintf("message %d", i))
+	}
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		mock.serve(client.UserID())
+	}()
+
+	dir := t.TempDir()
+	if err := client.DownloadAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every message ends up in its own file
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(mock.messages) {
+		t.Fatalf("got %d files, want %d", len(files), len(mock.messages))
+	}
+	saved := make(map[string]bool)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved[string(data)] = true
+	}
+	for _, data := range mock.messages {
+		if !saved[string(data)] {
+			t.Fatalf("%q was not saved", data)
+		}
+	}
+
+	<-served
+	if mock.maxInFlight > maxConcurrentDownloads {
+		t.Fatalf("%d downloads ran at once, the cap is %d", mock.maxInFlight, maxConcurrentDownloads)
+	}
+	if mock.maxInFlight < 2 {
+		t.Fatal("downloads ran one at a time")
+	}
+}
+
+func TestClientWithFixedLocalPort(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	// Find a port nothing is bound to
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := probe.LocalAddr().String()
+	probe.Close()
+
+	client, err := NewClient(server.LocalAddr().String(), local, "token", false, 0, log.New(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	if got := client.conn.Load().LocalAddr().String(); got != local {
+		t.Fatalf("client bound to %s, want %s", got, local)
+	}
+
+	// The server sees packets coming from the fixed port
+	if err := client.sendPacket(udp.NewPacket(udp.PacketTypeHeartbeat, uuid.New(), uuid.Nil, uuid.Nil)); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, from, err := server.ReadFromUDP(make([]byte, udp.MaxPacketSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != local {
+		t.Fatalf("packet came from %s, want %s", from, local)
+	}
+
+	// A second client can't take the same port
+	if _, err := NewClient(server.LocalAddr().String(), local, "token", false, 0, log.New(io.Discard)); err == nil || !strings.Contains(err.Error(), "failed to bind local address") {
+		t.Fatalf("second bind to %s: %v", local, err)
+	}
+}
+
+func TestClientWithInvalidLocalAddress(t *testing.T) {
+	_, err := NewClient("127.0.0.1:9090", "not an address", "token", false, 0, log.New(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "invalid local address") {
+		t.Fatalf("got %v, want an invalid local address error", err)
+	}
+}
+
+// progressLog records every progress callback
+type progressLog struct {
+	mu    sync.Mutex
+	calls [][2]uint32
+}
+
+func (p *progressLog) record(done, total uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, [2]uint32{done, total})
+}
+
+// check fails the test unless progress only went up and ended at total
+func (p *progressLog) check(t *testing.T, total uint32) {
+	t.Helper()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.calls) == 0 {
+		t.Fatal("progress was never reported")
+	}
+	var last uint32
+	for _, call := range p.calls {
+		if call[1] != total {
+			t.Fatalf("progress %d/%d, want a total of %d", call[0], call[1], total)
+		}
+		if call[0] <= last {
+			t.Fatalf("progress went from %d to %d: %v", last, call[0], p.calls)
+		}
+		last = call[0]
+	}
+	if last != total {
+		t.Fatalf("progress ended at %d/%d", last, total)
+	}
+}
+
+func TestSendProgressIsMonotonic(t *testing.T) {
+	client, server := newTestClient(t)
+
+	const total = 12
+	path := filepath.Join(t.TempDir(), "voice.opus")
+	if err := os.WriteFile(path, make([]byte, total*udp.MaxPayloadSize), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every third chunk is confirmed by a cumulative ACK, so progress jumps as well as steps
+	go func() {
+		for {
+			packet := server.read(2 * time.Second)
+			if packet == nil {
+				return
+			}
+			if packet.Type != udp.PacketTypeVoiceData {
+				continue
+			}
+			if packet.ChunkIndex%3 == 2 {
+				server.send(udp.NewCumulativeAckPacket(packet, packet.ChunkIndex+1))
+			} else if packet.ChunkIndex%3 == 0 {
+				server.send(udp.NewAckPacket(packet))
+			}
+		}
+	}()
+
+	var progress progressLog
+	if err := client.SendVoiceMessage(uuid.New(), path, progress.record); err != nil {
+		t.Fatal(err)
+	}
+	progress.check(t, total)
+}
+
+func TestSendEmptyFileIsRefused(t *testing.T) {
+	client, server := newTestClient(t)
+
+	path := filepath.Join(t.TempDir(), "empty.opus")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.SendVoiceMessage(uuid.New(), path, func(done, total uint32) {}); err == nil || !strings.Contains(err.Error(), "file is empty") {
+		t.Fatalf("error %v, want file is empty", err)
+	}
+	if packet := server.read(100 * time.Millisecond); packet != nil {
+		t.Fatalf("sent a %d packet for an empty file", packet.Type)
+	}
+}
+
+func TestDownloadProgressIsMonotonic(t *testing.T) {
+	client, server := newTestClient(t)
+
+	const total = 6
+	data := bytes.Repeat([]byte("v"), total*udp.MaxPayloadSize)
+
+	// The server answers the download with every chunk, one of them twice
+	go func() {
+		for {
+			packet := server.read(2 * time.Second)
+			if packet == nil {
+				return
+			}
+			if packet.Type != udp.PacketTypeDownloadMsg {
+				continue
+			}
+			senderID := uuid.New()
+			for _, i := range []uint32{0, 1, 2, 2, 3, 4, 5} {
+				chunk := data[i*udp.MaxPayloadSize : (i+1)*udp.MaxPayloadSize]
+				server.send(udp.NewVoiceDataPacket(senderID, client.UserID(), packet.MessageID, i, total, chunk))
+			}
+		}
+	}()
+
+	var progress progressLog
+	path := filepath.Join(t.TempDir(), "message.opus")
+	if err := client.DownloadMessage(uuid.New(), path, progress.record); err != nil {
+		t.Fatal(err)
+	}
+	progress.check(t, total)
+
+	if saved, err := os.ReadFile(path); err != nil || !bytes.Equal(saved, data) {
+		t.Fatalf("saved file differs: %v", err)
+	}
+}
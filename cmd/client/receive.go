@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/udp"
+)
+
+// receivedRetention is how long a saved message is remembered so late retransmits
+// of it are still ACKed, and how long an unfinished push may sit idle
+const receivedRetention = time.Minute
+
+// incoming collects the chunks of a message the server sends us,
+// either a download we asked for or a message pushed on its own
+type incoming struct {
+	chunks map[uint32][]byte
+	total  uint32
+
+	// path is where a download is saved, pushes get theirs once complete
+	path     string
+	progress ProgressFunc
+
+	// done receives the outcome of a download, nil for pushes
+	done chan error
+
+	stats   TransferStats
+	started time.Time
+	updated time.Time
+}
+
+// expectMessage registers a download, its chunks are saved to path and the
+// outcome is sent on the returned channel
+func (c *Client) expectMessage(messageID uuid.UUID, path string, progress ProgressFunc) <-chan error {
+	c.incomingMu.Lock()
+	defer c.incomingMu.Unlock()
+
+	now := time.Now()
+	in := &incoming{
+		chunks:   make(map[uint32][]byte),
+		path:     path,
+		progress: progress,
+		done:     make(chan error, 1),
+		started:  now,
+		updated:  now,
+	}
+	c.incoming[messageID] = in
+	delete(c.received, messageID)
+
+	return in.done
+}
+
+// forgetMessage stops collecting a download nobody waits for anymore
+func (c *Client) forgetMessage(messageID uuid.UUID) {
+	c.incomingMu.Lock()
+	defer c.incomingMu.Unlock()
+
+	if in := c.incoming[messageID]; in != nil && in.done != nil {
+		delete(c.incoming, messageID)
+	}
+}
+
+// receiveChunk stores a chunk of a downloaded or pushed message and saves the message once complete.
+// The chunk completing a message is only ACKed after the file is written, so the server
+// marks a message delivered only once it is stored here. Runs on the listener
+func (c *Client) receiveChunk(packet *udp.Packet) {
+	c.incomingMu.Lock()
+	defer c.incomingMu.Unlock()
+
+	now := time.Now()
+	c.pruneIncoming(now)
+
+	messageID := packet.MessageID
+
+	// Our ACK for the last chunk got lost and the server sent it again
+	if _, ok := c.received[messageID]; ok {
+		c.ackChunk(packet)
+		return
+	}
+
+	if packet.TotalChunks == 0 || packet.ChunkIndex >= packet.TotalChunks {
+		c.logger.Warn("Dropping chunk out of range",
+			"message_id", messageID,
+			"chunk", fmt.Sprintf("%d/%d", packet.ChunkIndex, packet.TotalChunks),
+		)
+		return
+	}
+
+	in := c.incoming[messageID]
+	if in == nil {
+		c.logger.Info("Receiving voice message", "message_id", messageID, "from", packet.SenderID, "chunks", packet.TotalChunks)
+		in = &incoming{chunks: make(map[uint32][]byte), started: now}
+		c.incoming[messageID] = in
+	}
+	if in.total == 0 {
+		in.total = packet.TotalChunks
+	}
+	if packet.TotalChunks != in.total {
+		c.logger.Warn("Dropping chunk with inconsistent total", "message_id", messageID, "total", packet.TotalChunks, "expected", in.total)
+		return
+	}
+
+	in.updated = now
+	in.stats.Packets++
+
+	if _, ok := in.chunks[packet.ChunkIndex]; ok {
+		in.stats.Retransmits++
+		c.ackChunk(packet)
+		return
+	}
+
+	in.chunks[packet.ChunkIndex] = packet.Payload
+	c.stats.bytesReceived.Add(uint64(len(packet.Payload)))
+
+	done := uint32(len(in.chunks))
+	if in.progress != nil {
+		in.progress(done, in.total)
+	}
+	if done < in.total {
+		c.ackChunk(packet)
+		return
+	}
+
+	path, size, err := c.saveIncoming(messageID, packet.SenderID, in)
+	if err != nil {
+		// Left unACKed, the server sends the chunk again and saving is retried
+		delete(in.chunks, packet.ChunkIndex)
+		c.logger.Error("Failed to save message", "message_id", messageID, "error", err)
+		if in.done != nil {
+			select {
+			case in.done <- err:
+			default:
+			}
+		}
+		return
+	}
+
+	c.ackChunk(packet)
+	delete(c.incoming, messageID)
+	c.received[messageID] = now
+
+	in.stats.Chunks = in.total
+	in.stats.Bytes = size
+	in.stats.Elapsed = time.Since(in.started)
+
+	if in.done != nil {
+		c.reportTransfer("download", in.stats)
+		in.done <- nil
+		return
+	}
+
+	c.reportTransfer("push", in.stats)
+	c.logger.Info("Voice message saved", "message_id", messageID, "from", packet.SenderID, "path", path, "size", size)
+	fmt.Printf("\n✓ New message from %s saved to: %s (%d bytes)\n", packet.SenderID, path, size)
+}
+
+// saveIncoming assembles a complete message and writes it out.
+// Pushes are named like downloads and saved to the output directory
+func (c *Client) saveIncoming(messageID, senderID uuid.UUID, in *incoming) (string, int, error) {
+	var assembled []byte
+	for i := uint32(0); i < in.total; i++ {
+		assembled = append(assembled, in.chunks[i]...)
+	}
+
+	path := in.path
+	if path == "" {
+		var err error
+		path, err = c.outputPathFor(c.outputDir, udp.MessageInfo{ID: messageID, SenderID: senderID}, nil)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	if err := os.WriteFile(path, assembled, 0o644); err != nil {
+		return "", 0, fmt.Errorf("failed to save file: %w", err)
+	}
+
+	return path, len(assembled), nil
+}
+
+// ackChunk confirms a chunk to the server, which paces and retransmits by these ACKs
+func (c *Client) ackChunk(packet *udp.Packet) {
+	if err := c.sendPacket(udp.NewAckPacket(packet)); err != nil {
+		c.logger.Warn("Failed to ACK chunk", "message_id", packet.MessageID, "chunk", packet.ChunkIndex, "error", err)
+	}
+}
+
+// pruneIncoming forgets saved messages past their retention and pushes that stopped arriving.
+// Downloads are left to their caller. Needs incomingMu
+func (c *Client) pruneIncoming(now time.Time) {
+	for id, at := range c.received {
+		if now.Sub(at) > receivedRetention {
+			delete(c.received, id)
+		}
+	}
+	for id, in := range c.incoming {
+		if in.done == nil && now.Sub(in.updated) > receivedRetention {
+			c.logger.Warn("Dropping incomplete voice message", "message_id", id, "chunks", fmt.Sprintf("%d/%d", len(in.chunks), in.total))
+			delete(c.incoming, id)
+		}
+	}
+}
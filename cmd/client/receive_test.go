@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/udp"
+)
+
+// fakeServer is the server end of a client under test
+type fakeServer struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	client *net.UDPAddr
+}
+
+// newTestClient starts a client without encryption or keepalive, talking to a fake server on loopback
+func newTestClient(t *testing.T) (*Client, *fakeServer) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := NewClient(conn.LocalAddr().String(), "", "token", false, 0, log.New(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	client.setUserID(uuid.New())
+	setOutputDir(client, t.TempDir())
+
+	return client, &fakeServer{
+		t:      t,
+		conn:   conn,
+		client: client.conn.Load().LocalAddr().(*net.UDPAddr),
+	}
+}
+
+// setOutputDir changes where pushes are saved while the listener runs
+func setOutputDir(c *Client, dir string) {
+	c.incomingMu.Lock()
+	defer c.incomingMu.Unlock()
+	c.outputDir = dir
+}
+
+func (s *fakeServer) send(packet *udp.Packet) {
+	s.t.Helper()
+
+	data, err := packet.Marshal()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if _, err := s.conn.WriteToUDP(data, s.client); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// read returns the next packet from the client, nil once nothing arrives for timeout
+func (s *fakeServer) read(timeout time.Duration) *udp.Packet {
+	s.t.Helper()
+
+	buf := make([]byte, udp.MaxPacketSize)
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := s.conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil
+	}
+
+	packet, err := udp.Unmarshal(buf[:n])
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return packet
+}
+
+// pushMessage sends data to the client as an unrequested voice message
+// and returns the chunk indexes the client ACKed
+func pushMessage(s *fakeServer, recipientID, messageID uuid.UUID, data []byte) map[uint32]bool {
+	senderID := uuid.New()
+	total := uint32((len(data) + udp.MaxPayloadSize - 1) / udp.MaxPayloadSize)
+
+	acked := make(map[uint32]bool)
+	for i := uint32(0); i < total; i++ {
+		start := int(i) * udp.MaxPayloadSize
+		end := min(start+udp.MaxPayloadSize, len(data))
+		s.send(udp.NewVoiceDataPacket(senderID, recipientID, messageID, i, total, data[start:end]))
+
+		if ack := s.read(time.Second); ack != nil && ack.Type == udp.PacketTypeAck && ack.MessageID == messageID {
+			acked[ack.ChunkIndex] = true
+		}
+	}
+	return acked
+}
+
+func TestPushedMessageIsSaved(t *testing.T) {
+	client, server := newTestClient(t)
+
+	data := bytes.Repeat([]byte("voice"), udp.MaxPayloadSize) // 5 chunks
+	messageID := uuid.New()
+
+	acked := pushMessage(server, client.UserID(), messageID, data)
+	if len(acked) != 5 {
+		t.Fatalf("got %d ACKs, want 5", len(acked))
+	}
+
+	files, err := filepath.Glob(filepath.Join(client.outputDir, "*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("want one saved file, got %v (%v)", files, err)
+	}
+	saved, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, data) {
+		t.Fatalf("saved %d bytes, want the %d sent", len(saved), len(data))
+	}
+}
+
+func TestLateRetransmitOfSavedMessageIsAcked(t *testing.T) {
+	client, server := newTestClient(t)
+
+	messageID := uuid.New()
+	pushMessage(server, client.UserID(), messageID, []byte("short"))
+
+	// The server missed our ACK and sends the only chunk again
+	acked := pushMessage(server, client.UserID(), messageID, []byte("short"))
+	if !acked[0] {
+		t.Fatal("retransmit of a saved message was not ACKed")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(client.outputDir, "*"))
+	if len(files) != 1 {
+		t.Fatalf("message saved %d times, want once", len(files))
+	}
+}
+
+func TestUnsavedMessageIsNotAcked(t *testing.T) {
+	client, server := newTestClient(t)
+
+	// A file where the output directory should be makes saving fail
+	blocked := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocked, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setOutputDir(client, blocked)
+
+	data := bytes.Repeat([]byte("a"), 2*udp.MaxPayloadSize)
+	acked := pushMessage(server, client.UserID(), uuid.New(), data)
+
+	if !acked[0] {
+		t.Fatal("first chunk was not ACKed")
+	}
+	if acked[1] {
+		t.Fatal("completing chunk was ACKed although the message could not be saved")
+	}
+}
+
+func TestLargePushDoesNotBlockListener(t *testing.T) {
+	client, server := newTestClient(t)
+
+	// More chunks than any reply channel holds
+	data := bytes.Repeat([]byte("x"), 150*udp.MaxPayloadSize)
+	acked := pushMessage(server, client.UserID(), uuid.New(), data)
+	if len(acked) != 150 {
+		t.Fatalf("got %d ACKs, want 150", len(acked))
+	}
+
+	// The listener still answers afterwards
+	server.send(udp.NewPacket(udp.PacketTypeAuthAck, uuid.Nil, client.UserID(), uuid.New()))
+	select {
+	case <-client.ackChan:
+	case <-time.After(time.Second):
+		t.Fatal("listener stopped handling packets")
+	}
+}
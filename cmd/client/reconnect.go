@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Backoff between attempts to replace a broken socket
+const (
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// errReconnecting is returned for packets sent while the socket is being replaced
+var errReconnecting = errors.New("connection lost, reconnecting")
+
+// isFatalReadError reports whether a read error means the socket itself is broken.
+// A refused connection only means the server isn't listening right now,
+// the socket keeps working once it is back
+func isFatalReadError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return !errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// reconnect replaces a broken socket, retrying with backoff until it succeeds
+// or the client is closed, and then restores the session in the background.
+// It reports whether a new socket is in place
+func (c *Client) reconnect(cause error) bool {
+	c.reconnecting.Store(true)
+
+	c.logger.Warn("Connection lost, reconnecting", "error", cause)
+
+	// A fixed local port can only be bound again once the old socket is gone
+	c.conn.Load().Close()
+
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.ctx.Done():
+			c.reconnecting.Store(false)
+			return false
+		case <-time.After(backoff):
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			backoff = min(backoff*2, reconnectMaxBackoff)
+			c.logger.Warn("Reconnect failed", "attempt", attempt, "retry_in", backoff, "error", err)
+			continue
+		}
+
+		c.conn.Store(conn)
+		c.reconnecting.Store(false)
+		c.logger.Info("Reconnected", "attempt", attempt, "local", conn.LocalAddr())
+		break
+	}
+
+	// Authenticating waits for replies read by the caller, so it can't happen here
+	if c.authenticated.Load() {
+		go func() {
+			if err := c.reauthenticate(); err != nil {
+				c.logger.Error("Failed to restore session after reconnecting", "error", err)
+			}
+		}()
+	}
+
+	return true
+}
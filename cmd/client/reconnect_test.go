@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/udp"
+)
+
+func TestIsFatalReadError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		fatal bool
+	}{
+		{"timeout", os.ErrDeadlineExceeded, false},
+		{"server not listening", &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ECONNREFUSED)}, false},
+		{"closed socket", net.ErrClosed, true},
+		{"interface down", &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ENETDOWN)}, true},
+		{"wrapped", fmt.Errorf("read: %w", errors.New("broken")), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isFatalReadError(tt.err); got != tt.fatal {
+				t.Fatalf("fatal %v, want %v", got, tt.fatal)
+			}
+		})
+	}
+}
+
+func TestReconnectAfterSocketBreaks(t *testing.T) {
+	client, server := newTestClient(t)
+	client.authenticated.Store(true)
+
+	broken := client.conn.Load()
+	broken.Close()
+
+	// Sends fail fast while the socket is replaced instead of writing to the dead one
+	deadline := time.Now().Add(time.Second)
+	for !client.reconnecting.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not notice the broken socket")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := client.sendPacket(udp.NewPacket(udp.PacketTypeHeartbeat, client.UserID(), uuid.Nil, uuid.New())); !errors.Is(err, errReconnecting) {
+		t.Fatalf("send while reconnecting: %v, want %v", err, errReconnecting)
+	}
+
+	// The restored socket authenticates again on its own
+	for {
+		packet := server.read(3 * reconnectMinBackoff)
+		if packet == nil {
+			t.Fatal("no auth from the reconnected client")
+		}
+		if packet.Type == udp.PacketTypeAuth {
+			break
+		}
+	}
+
+	if client.conn.Load() == broken {
+		t.Fatal("broken socket was not replaced")
+	}
+	if client.reconnecting.Load() {
+		t.Fatal("still reconnecting after the new socket is up")
+	}
+}
+
+func TestReconnectStopsOnClose(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	done := make(chan bool)
+	go func() { done <- client.reconnect(net.ErrClosed) }()
+	client.Close()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("reconnected after the client was closed")
+		}
+	case <-time.After(2 * reconnectMinBackoff):
+		t.Fatal("reconnect kept going after the client was closed")
+	}
+}
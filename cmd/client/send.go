@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/udp"
+)
+
+const (
+	// sendWindow is how many chunks may be in flight without an ACK
+	sendWindow = 16
+
+	// sendAckTimeout is how long to wait for any new ACK before resending
+	sendAckTimeout = 2 * time.Second
+
+	// sendRetries is how many resend rounds without progress are tried before giving up
+	sendRetries = 3
+)
+
+// sendChunks sends data as voice chunks through a sliding window.
+// The server may ACK every chunk or, with batching, confirm a run of chunks in
+// one cumulative ACK, both are accepted. Unconfirmed chunks are resent once no
+// new ACK arrived for a while. Packets, retransmits and ACKs are counted into stats
+func (c *Client) sendChunks(messageID, recipientID uuid.UUID, data []byte, totalChunks uint32, progress ProgressFunc, stats *TransferStats) error {
+	acked := make([]bool, totalChunks)
+	var ackedCount, base, next uint32
+
+	send := func(i uint32) error {
+		start := int(i) * udp.MaxPayloadSize
+		end := min(start+udp.MaxPayloadSize, len(data))
+
+		packet := udp.NewVoiceDataPacket(c.UserID(), recipientID, messageID, i, totalChunks, data[start:end])
+		if err := c.sendPacket(packet); err != nil {
+			return err
+		}
+
+		stats.Packets++
+		c.stats.chunksSent.Add(1)
+		c.stats.bytesSent.Add(uint64(end - start))
+		return nil
+	}
+
+	resend := func() error {
+		for i := base; i < next; i++ {
+			if acked[i] {
+				continue
+			}
+			if err := send(i); err != nil {
+				return err
+			}
+			stats.Retransmits++
+			c.stats.retransmits.Add(1)
+		}
+		return nil
+	}
+
+	ack := func(i uint32) {
+		if i < totalChunks && !acked[i] {
+			acked[i] = true
+			ackedCount++
+		}
+	}
+
+	retries := 0
+	for ackedCount < totalChunks {
+		for next < totalChunks && next < base+sendWindow {
+			if err := send(next); err != nil {
+				return err
+			}
+			next++
+
+			// To not overwhelm the network
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		timer := time.NewTimer(sendAckTimeout)
+
+		select {
+		case packet := <-c.ackChan:
+			timer.Stop()
+			if packet.MessageID != messageID {
+				// Late ACK of an earlier message
+				continue
+			}
+
+			stats.Acks++
+			c.stats.acksReceived.Add(1)
+
+			before := ackedCount
+			if packet.IsCumulativeAck() {
+				for i := uint32(0); i < packet.ChunkIndex && i < totalChunks; i++ {
+					ack(i)
+				}
+			} else {
+				ack(packet.ChunkIndex)
+			}
+
+			for base < totalChunks && acked[base] {
+				base++
+			}
+
+			if ackedCount > before {
+				retries = 0
+				progress(ackedCount, totalChunks)
+			}
+
+		case <-c.expiredChan:
+			timer.Stop()
+			if err := c.reauthenticate(); err != nil {
+				return err
+			}
+			if err := resend(); err != nil {
+				return err
+			}
+
+		case id := <-c.refusedChan:
+			timer.Stop()
+			if id == messageID {
+				return fmt.Errorf("message refused: sending too often, try again later")
+			}
+
+		case <-c.ctx.Done():
+			timer.Stop()
+			return c.ctx.Err()
+
+		case <-timer.C:
+			if retries == sendRetries {
+				return fmt.Errorf("only %d/%d chunks acknowledged", ackedCount, totalChunks)
+			}
+			retries++
+
+			c.logger.Warn("ACK timeout retrying...", "attempt", retries, "acknowledged", ackedCount, "total", totalChunks)
+			if err := resend(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
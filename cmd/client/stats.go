@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/rx3lixir/laba/internal/udp"
+)
+
+// Stats counts what the listener read off the socket, for diagnostics
+type Stats struct {
+	// Received is how many packets were read intact
+	Received uint64
+	// Malformed is how many were too short, truncated or otherwise unreadable
+	Malformed uint64
+	// ChecksumFailures is how many arrived whole but with a corrupted payload
+	ChecksumFailures uint64
+
+	// Totals over every transfer, see TransferStats
+	ChunksSent    uint64
+	Retransmits   uint64
+	AcksReceived  uint64
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// packetStats are the live counters behind Stats
+type packetStats struct {
+	received         atomic.Uint64
+	malformed        atomic.Uint64
+	checksumFailures atomic.Uint64
+
+	chunksSent    atomic.Uint64
+	retransmits   atomic.Uint64
+	acksReceived  atomic.Uint64
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+}
+
+// Stats returns a snapshot of the client counters
+func (c *Client) Stats() Stats {
+	return Stats{
+		Received:         c.stats.received.Load(),
+		Malformed:        c.stats.malformed.Load(),
+		ChecksumFailures: c.stats.checksumFailures.Load(),
+		ChunksSent:       c.stats.chunksSent.Load(),
+		Retransmits:      c.stats.retransmits.Load(),
+		AcksReceived:     c.stats.acksReceived.Load(),
+		BytesSent:        c.stats.bytesSent.Load(),
+		BytesReceived:    c.stats.bytesReceived.Load(),
+	}
+}
+
+// TransferStats describes a single send or download
+type TransferStats struct {
+	// Chunks is how many chunks the message has
+	Chunks uint32
+	// Packets is how many data packets went out on a send or came in on a download
+	Packets uint64
+	// Retransmits is how many of those repeated a chunk
+	Retransmits uint64
+	// Acks is how many ACKs a send got back
+	Acks uint64
+	// Bytes is the size of the message
+	Bytes   int
+	Elapsed time.Duration
+}
+
+// Throughput is the effective rate in bytes per second, retransmits don't count
+func (t TransferStats) Throughput() float64 {
+	if t.Elapsed <= 0 {
+		return 0
+	}
+	return float64(t.Bytes) / t.Elapsed.Seconds()
+}
+
+// Loss is the share of data packets that had to be repeated
+func (t TransferStats) Loss() float64 {
+	if t.Packets == 0 {
+		return 0
+	}
+	return float64(t.Retransmits) / float64(t.Packets)
+}
+
+func (t TransferStats) String() string {
+	return fmt.Sprintf(
+		"%d chunks, %d packets, %d retransmits (%.1f%%), %d ACKs, %d bytes in %s, %.1f KB/s",
+		t.Chunks, t.Packets, t.Retransmits, t.Loss()*100, t.Acks, t.Bytes,
+		t.Elapsed.Round(time.Millisecond), t.Throughput()/1024,
+	)
+}
+
+// reportTransfer logs the stats of a finished transfer, and prints them with -stats
+func (c *Client) reportTransfer(kind string, stats TransferStats) {
+	c.logger.Info(
+		"Transfer stats",
+		"transfer", kind,
+		"chunks", stats.Chunks,
+		"packets", stats.Packets,
+		"retransmits", stats.Retransmits,
+		"acks", stats.Acks,
+		"bytes", stats.Bytes,
+		"elapsed", stats.Elapsed,
+		"throughput_kbps", fmt.Sprintf("%.1f", stats.Throughput()/1024),
+	)
+
+	if c.printStats {
+		fmt.Printf("%s: %s\n", kind, stats)
+	}
+}
+
+// printTotals prints the counters of the whole session
+func (c *Client) printTotals() {
+	stats := c.Stats()
+	fmt.Printf("Received: %d\n", stats.Received)
+	fmt.Printf("Malformed: %d\n", stats.Malformed)
+	fmt.Printf("Checksum failures: %d\n", stats.ChecksumFailures)
+	fmt.Printf("Chunks sent: %d\n", stats.ChunksSent)
+	fmt.Printf("Retransmits: %d\n", stats.Retransmits)
+	fmt.Printf("ACKs received: %d\n", stats.AcksReceived)
+	fmt.Printf("Bytes sent: %d\n", stats.BytesSent)
+	fmt.Printf("Bytes received: %d\n", stats.BytesReceived)
+}
+
+// readPacket parses a datagram and counts the outcome.
+// Unreadable datagrams are logged and dropped, the listener moves on
+func (c *Client) readPacket(data []byte) (*udp.Packet, bool) {
+	if len(data) < udp.HeaderSize {
+		c.stats.malformed.Add(1)
+		c.logger.Warn("Received packet too small", "bytes", len(data))
+		return nil, false
+	}
+
+	packet, err := udp.Unmarshal(data)
+	if err != nil {
+		if errors.Is(err, udp.ErrChecksumMismatch) {
+			c.stats.checksumFailures.Add(1)
+		} else {
+			c.stats.malformed.Add(1)
+		}
+		c.logger.Warn("Dropping malformed packet", "error", err, "bytes", len(data))
+		return nil, false
+	}
+
+	c.stats.received.Add(1)
+	return packet, true
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/udp"
+)
+
+func TestListenerCountsMalformedPackets(t *testing.T) {
+	client, server := newTestClient(t)
+
+	valid, err := udp.NewPacket(udp.PacketTypeError, uuid.Nil, client.UserID(), uuid.New()).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := udp.NewVoiceDataPacket(uuid.New(), client.UserID(), uuid.New(), 0, 1, []byte("voice")).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte(nil), payload...)
+	corrupted[len(corrupted)-1] ^= 0xFF
+	truncated := append([]byte(nil), payload...)
+	binary.BigEndian.PutUint16(truncated[udp.HeaderSize-2:], 0xFFFF)
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		want     Stats
+	}{
+		{"too short", valid[:udp.HeaderSize-1], Stats{Malformed: 1}},
+		{"payload shorter than declared", truncated, Stats{Malformed: 2}},
+		{"checksum mismatch", corrupted, Stats{Malformed: 2, ChecksumFailures: 1}},
+		// The listener is still reading after all of that
+		{"valid", valid, Stats{Received: 1, Malformed: 2, ChecksumFailures: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := server.conn.WriteToUDP(tt.datagram, server.client); err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for {
+				got := client.Stats()
+				if got.Received == tt.want.Received && got.Malformed == tt.want.Malformed && got.ChecksumFailures == tt.want.ChecksumFailures {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("stats %+v, want %+v", got, tt.want)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestTransferStats(t *testing.T) {
+	tests := []struct {
+		name           string
+		stats          TransferStats
+		wantThroughput float64
+		wantLoss       float64
+	}{
+		{"no time elapsed", TransferStats{Bytes: 1024}, 0, 0},
+		{"nothing sent", TransferStats{Elapsed: time.Second}, 0, 0},
+		{"clean", TransferStats{Packets: 4, Bytes: 4096, Elapsed: 2 * time.Second}, 2048, 0},
+		{"lossy", TransferStats{Packets: 5, Retransmits: 1, Bytes: 4096, Elapsed: 2 * time.Second}, 2048, 0.2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.stats.Throughput(); got != tt.wantThroughput {
+				t.Errorf("throughput %v, want %v", got, tt.wantThroughput)
+			}
+			if got := tt.stats.Loss(); got != tt.wantLoss {
+				t.Errorf("loss %v, want %v", got, tt.wantLoss)
+			}
+		})
+	}
+}
+
+func TestSendCountsRetransmits(t *testing.T) {
+	tests := []struct {
+		name string
+		// dropped chunks get no ACK the first time they arrive
+		dropped         map[uint32]bool
+		wantRetransmits uint64
+	}{
+		{"no loss", nil, 0},
+		{"lossy", map[uint32]bool{1: true, 3: true}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTestClient(t)
+
+			const total = 4
+			path := filepath.Join(t.TempDir(), "voice.opus")
+			if err := os.WriteFile(path, make([]byte, total*udp.MaxPayloadSize), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			go func() {
+				seen := make(map[uint32]bool)
+				for {
+					packet := server.read(sendAckTimeout + time.Second)
+					if packet == nil {
+						return
+					}
+					if packet.Type != udp.PacketTypeVoiceData {
+						continue
+					}
+					first := !seen[packet.ChunkIndex]
+					seen[packet.ChunkIndex] = true
+					if first && tt.dropped[packet.ChunkIndex] {
+						continue
+					}
+					server.send(udp.NewAckPacket(packet))
+				}
+			}()
+
+			if err := client.SendVoiceMessage(uuid.New(), path, func(done, total uint32) {}); err != nil {
+				t.Fatal(err)
+			}
+
+			stats := client.Stats()
+			if stats.Retransmits != tt.wantRetransmits {
+				t.Fatalf("retransmits %d, want %d", stats.Retransmits, tt.wantRetransmits)
+			}
+			if stats.ChunksSent != total+tt.wantRetransmits || stats.AcksReceived != total {
+				t.Fatalf("sent %d chunks and got %d ACKs, want %d and %d", stats.ChunksSent, stats.AcksReceived, total+tt.wantRetransmits, total)
+			}
+			if stats.BytesSent != (total+tt.wantRetransmits)*udp.MaxPayloadSize {
+				t.Fatalf("sent %d bytes", stats.BytesSent)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -11,10 +12,16 @@ import (
 	"github.com/rx3lixir/laba/internal/config"
 	"github.com/rx3lixir/laba/internal/db"
 	"github.com/rx3lixir/laba/internal/http-server"
+	"github.com/rx3lixir/laba/internal/orphans"
 	"github.com/rx3lixir/laba/internal/session"
+	"github.com/rx3lixir/laba/internal/tracing"
 	"github.com/rx3lixir/laba/internal/udp"
+	"github.com/rx3lixir/laba/pkg/audio"
 	"github.com/rx3lixir/laba/pkg/jwt"
+	"github.com/rx3lixir/laba/pkg/mailer"
+	"github.com/rx3lixir/laba/pkg/password"
 	"github.com/rx3lixir/laba/pkg/s3storage"
+	"github.com/rx3lixir/laba/pkg/webhook"
 )
 
 func main() {
@@ -45,6 +52,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Components log with their name as prefix and may override the level
+	componentLoggers := map[string]*log.Logger{
+		"http":    logger.WithPrefix("http"),
+		"udp":     logger.WithPrefix("udp"),
+		"orphans": logger.WithPrefix("orphans"),
+		"mail":    logger.WithPrefix("mail"),
+		"webhook": logger.WithPrefix("webhook"),
+	}
+	configureLogger(logger, componentLoggers, c)
+
 	logger.Info(
 		"Configuration loaded",
 		"env", c.GeneralParams.Env,
@@ -52,10 +69,27 @@ func main() {
 		"udp_addr", c.UDPParams.GetAddress(),
 		"database", c.MainDBParams.Name,
 		"auth", c.AuthDBParams.Host,
+		"tls", c.TLSParams.Enabled,
 	)
 
+	// Tracing is optional, without it spans are dropped by the global no-op provider
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Enabled:     c.TracingParams.Enabled,
+		Endpoint:    c.TracingParams.Endpoint,
+		Insecure:    c.TracingParams.Insecure,
+		ServiceName: c.TracingParams.ServiceName,
+		SampleRatio: c.TracingParams.SampleRatio,
+	})
+	if err != nil {
+		logger.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	if c.TracingParams.Enabled {
+		logger.Info("Tracing enabled", "endpoint", c.TracingParams.Endpoint, "sample_ratio", c.TracingParams.SampleRatio)
+	}
+
 	// Creating database connection pool
-	pool, err := db.CreatePostgresPool(ctx, c.MainDBParams.GetDSN())
+	pool, err := db.CreatePostgresPool(ctx, c.MainDBParams.GetDSN(), tracing.QueryTracer{})
 	if err != nil {
 		logger.Error(
 			"Failed to create postgres pool",
@@ -72,7 +106,7 @@ func main() {
 	)
 
 	// Creates database store
-	store := db.NewPostgresStore(pool)
+	store := db.NewPostgresStore(pool, time.Duration(c.MainDBParams.QueryTimeout)*time.Second)
 
 	// Initializing JWT service
 	jwtService := jwt.NewService(
@@ -83,10 +117,21 @@ func main() {
 
 	logger.Info("JWT service initialized")
 
+	passwordHasher, err := password.NewHasher(c.GeneralParams.PasswordCost)
+	if err != nil {
+		logger.Error("Failed to create password hasher", "error", err)
+		os.Exit(1)
+	}
+
 	// Initialize Key-value storage
 	sessionManager, err := session.NewManager(
 		c.AuthDBParams.Host,
 		c.AuthDBParams.Password,
+		session.PoolOptions{
+			BlockingPoolSize:  c.AuthDBParams.BlockingPoolSize,
+			PipelineMultiplex: c.AuthDBParams.PipelineMultiplex,
+		},
+		sessionTTLs(c),
 	)
 	if err != nil {
 		logger.Error("Failed to create session manager", "error", err)
@@ -96,38 +141,116 @@ func main() {
 
 	logger.Info("Key-Value session manger initialized")
 
-	// Initialize S3 client
-	s3Client, err := s3storage.NewMinIOClient(
-		c.S3Params.Endpoint,
-		c.S3Params.AccessKeyID,
-		c.S3Params.SecretAccessKey,
-		c.S3Params.BucketName,
-		c.S3Params.UseSSL,
-	)
+	// Watching valkey health. While it is down UDP sessions fall back to process memory
+	// and HTTP keeps serving everything that doesn't need valkey
+	go sessionManager.Monitor(ctx, 5*time.Second, func(healthy bool, err error) {
+		if healthy {
+			logger.Info("Valkey is reachable again, leaving degraded mode")
+			return
+		}
+		logger.Warn("Valkey is unreachable, running in degraded mode", "error", err)
+	})
+
+	// Initialize object storage
+	s3Client, err := newObjectStore(c)
 	if err != nil {
-		logger.Error("Failed to create S3 client", "error", err)
+		logger.Error("Failed to create object storage", "backend", c.S3Params.Backend, "error", err)
 		os.Exit(1)
 	}
+	s3Client = tracing.ObjectStore(s3Client)
 
-	logger.Info("S3 storage client initialized", "bucket", c.S3Params.BucketName)
+	logger.Info("Object storage initialized", "backend", c.S3Params.Backend, "bucket", c.S3Params.BucketName, "sse", c.S3Params.SSEMode, "key_prefix", c.S3Params.KeyPrefix)
 
-	// Creates HTTP server
-	HTTPserver := httpserver.New(
-		c.GeneralParams.HTTPaddress,
-		store,
-		jwtService,
-		logger,
+	// Initialize email delivery
+	mail := newMailer(c, componentLoggers["mail"])
+	logger.Info("Mailer initialized", "backend", c.MailParams.Backend)
+
+	// Starting the webhook dispatcher
+	webhooks := webhook.New(
+		c.WebhookParams.URLs,
+		c.WebhookParams.Secret,
+		time.Duration(c.WebhookParams.Timeout)*time.Second,
+		c.WebhookParams.MaxAttempts,
+		componentLoggers["webhook"],
 	)
+	if webhooks.Enabled() {
+		go webhooks.Run(ctx)
+		logger.Info("Webhook dispatcher started", "endpoints", len(c.WebhookParams.URLs))
+	}
+
+	// Starting the orphaned voice file sweeper
+	if c.S3Params.OrphanSweepInterval > 0 {
+		sweeper := orphans.New(
+			store, // MessageStore
+			s3Client,
+			c.S3Params.OrphanPrefix,
+			time.Duration(c.S3Params.OrphanGracePeriod)*time.Minute,
+			time.Duration(c.S3Params.OrphanSweepInterval)*time.Minute,
+			componentLoggers["orphans"],
+		)
+		go sweeper.Run(ctx)
+
+		logger.Info("Orphan sweeper started", "prefix", c.S3Params.OrphanPrefix)
+	}
+
+	// Transcoding is opt-in and needs ffmpeg, without it messages are stored as uploaded
+	var transcoder audio.Transcoder
+	if c.AudioParams.Transcode {
+		ffmpeg, err := audio.NewFFmpeg(c.AudioParams.FFmpegPath)
+		if err != nil {
+			logger.Warn("Audio transcoding disabled", "error", err)
+		} else {
+			transcoder = ffmpeg
+			logger.Info("Audio transcoding enabled", "format", audio.CanonicalFormat)
+		}
+	}
 
 	// Creates UDP server
 	udpServer := udp.New(
 		c.UDPParams.GetAddress(),
-		sessionManager,
+		udpOptions(c),
+		tracing.SessionStore(session.NewFailoverStore(sessionManager, session.NewMemoryStore(sessionTTLs(c)))),
 		jwtService,
 		store, // UserStore
 		store, // MessageStore
+		store, // ContactStore
+		store, // BlockStore
+		s3Client,
+		transcoder,
+		webhooks,
+		componentLoggers["udp"],
+	)
+
+	// Creates HTTP server
+	HTTPserver := httpserver.New(
+		c.GeneralParams.HTTPaddress,
+		httpOptions(c),
+		store, // UserStore
+		store, // MessageStore
+		store, // ContactStore
+		store, // BlockStore
+		sessionManager,
 		s3Client,
-		logger,
+		udpServer, // forwards HTTP uploads to online recipients
+		jwtService,
+		passwordHasher,
+		mail,
+		webhooks,
+		componentLoggers["http"],
+	)
+
+	// Reloading runtime tunables when the config file changes.
+	// Addresses, credentials, UDP workers and read buffer still require a restart
+	cm.Watch(
+		func(c *config.Config) {
+			configureLogger(logger, componentLoggers, c)
+			logger.Info("Configuration reloaded")
+			udpServer.SetOptions(udpOptions(c))
+			HTTPserver.SetOptions(httpOptions(c))
+		},
+		func(err error) {
+			logger.Warn("Ignoring config reload", "error", err)
+		},
 	)
 
 	// Channel to listen for errors coming from the servers
@@ -171,7 +294,164 @@ func main() {
 		if err := udpServer.Shutdown(ctx); err != nil {
 			logger.Error("UDP server graceful shutdown failed", "error", err)
 		}
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush traces", "error", err)
+		}
 
 		logger.Info("All servers stopped gracefully")
 	}
 }
+
+// configureLogger applies the configured log format and levels to the root and component loggers.
+// Until the config is loaded the logger writes text at debug level
+func configureLogger(logger *log.Logger, components map[string]*log.Logger, c *config.Config) {
+	formatter := log.TextFormatter
+	if c.GeneralParams.LogFormat == "json" {
+		formatter = log.JSONFormatter
+	}
+
+	// Validate only lets through levels log knows
+	level, err := log.ParseLevel(c.GeneralParams.LogLevel)
+	if err != nil {
+		logger.Warn("Keeping log level", "level", logger.GetLevel(), "error", err)
+		level = logger.GetLevel()
+	}
+
+	logger.SetFormatter(formatter)
+	logger.SetLevel(level)
+
+	for name, componentLogger := range components {
+		componentLevel := level
+		if override, ok := c.GeneralParams.LogLevels[name]; ok {
+			if parsed, err := log.ParseLevel(override); err == nil {
+				componentLevel = parsed
+			}
+		}
+
+		componentLogger.SetFormatter(formatter)
+		componentLogger.SetLevel(componentLevel)
+	}
+
+	for name := range c.GeneralParams.LogLevels {
+		if _, ok := components[name]; !ok {
+			logger.Warn("Ignoring log level of unknown component", "component", name)
+		}
+	}
+}
+
+// udpOptions maps config onto UDP server tunables
+func udpOptions(c *config.Config) udp.Options {
+	return udp.Options{
+		AutoMarkListened:     c.UDPParams.AutoMarkListened,
+		ChunkGracePeriod:     time.Duration(c.UDPParams.ChunkGracePeriod) * time.Second,
+		ContactPolicy:        c.UDPParams.ContactPolicy,
+		Workers:              c.UDPParams.Workers,
+		ReadBufferSize:       c.UDPParams.ReadBufferSize,
+		MaxPacketSize:        c.UDPParams.MaxPacketSize,
+		MaxUploadSize:        c.GeneralParams.MaxUploadSize,
+		RequireEncryption:    c.UDPParams.RequireEncryption,
+		PendingTimeout:       time.Duration(c.UDPParams.PendingTimeout) * time.Second,
+		ForwardBitrate:       c.UDPParams.ForwardBitrate * 1000,
+		ForwardMinBitrate:    c.UDPParams.ForwardMinBitrate * 1000,
+		ForwardAckWindow:     c.UDPParams.ForwardAckWindow,
+		ForwardAckTimeout:    time.Duration(c.UDPParams.ForwardAckTimeout) * time.Millisecond,
+		ForwardRetries:       c.UDPParams.ForwardRetries,
+		AckBatchSize:         c.UDPParams.AckBatchSize,
+		AckBatchDelay:        time.Duration(c.UDPParams.AckBatchDelay) * time.Millisecond,
+		AuthMaxFailures:      c.UDPParams.AuthMaxFailures,
+		AuthCooldown:         time.Duration(c.UDPParams.AuthCooldown) * time.Second,
+		CompressAudio:        c.UDPParams.CompressAudio,
+		StrictAudio:          c.AudioParams.StrictValidation,
+		RequireVerifiedEmail: c.GeneralParams.RequireVerifiedEmail,
+		SendQuota: session.SendQuota{
+			PerMinute:       c.UDPParams.MaxMessagesPerMinute,
+			PerHour:         c.UDPParams.MaxMessagesPerHour,
+			Recipients:      c.UDPParams.MaxRecipients,
+			RecipientWindow: time.Duration(c.UDPParams.RecipientWindow) * time.Second,
+		},
+	}
+}
+
+// newMailer creates the mail backend selected in config
+func newMailer(c *config.Config, logger *log.Logger) mailer.Mailer {
+	if c.MailParams.Backend == mailer.BackendSMTP {
+		return mailer.NewSMTPMailer(
+			c.MailParams.Host,
+			c.MailParams.Port,
+			c.MailParams.Username,
+			c.MailParams.Password,
+			c.MailParams.From,
+		)
+	}
+	return mailer.NewLogMailer(logger)
+}
+
+// newObjectStore creates the storage backend selected in config
+func newObjectStore(c *config.Config) (s3storage.ObjectStore, error) {
+	if c.S3Params.Backend == s3storage.BackendFilesystem {
+		store, err := s3storage.NewFileStore(c.S3Params.LocalDir, c.S3Params.KeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	// Server-side encryption for stored objects, nil disables it
+	sse, err := s3storage.NewSSE(c.S3Params.SSEMode, c.S3Params.SSEKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 encryption settings: %w", err)
+	}
+
+	client, err := s3storage.NewMinIOClient(
+		c.S3Params.Endpoint,
+		c.S3Params.AccessKeyID,
+		c.S3Params.SecretAccessKey,
+		c.S3Params.BucketName,
+		c.S3Params.UseSSL,
+		sse,
+		c.S3Params.KeyPrefix,
+		c.S3Params.ContentDisposition,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// sessionTTLs maps config to the session store expirations
+func sessionTTLs(c *config.Config) session.TTLOptions {
+	return session.TTLOptions{
+		Session: time.Duration(c.AuthDBParams.SessionTTL) * time.Second,
+		Pending: time.Duration(c.AuthDBParams.ChunkTTL) * time.Second,
+	}
+}
+
+// httpOptions maps config onto HTTP server tunables
+func httpOptions(c *config.Config) httpserver.Options {
+	return httpserver.Options{
+		AuthRateLimit: session.RateLimit{
+			Rate:  float64(c.RateLimitParams.AuthRequestsPerMinute) / 60,
+			Burst: c.RateLimitParams.AuthBurst,
+		},
+		MaxUploadSize:        c.GeneralParams.MaxUploadSize,
+		AutoMarkListened:     c.UDPParams.AutoMarkListened,
+		StrictAudio:          c.AudioParams.StrictValidation,
+		PublicURL:            c.GeneralParams.PublicURL,
+		VerificationTTL:      time.Duration(c.GeneralParams.VerificationTTL) * time.Hour,
+		RequireVerifiedEmail: c.GeneralParams.RequireVerifiedEmail,
+		TLS:                  tlsOptions(c),
+	}
+}
+
+// tlsOptions maps config onto HTTPS settings, zero value keeps plain HTTP
+func tlsOptions(c *config.Config) httpserver.TLSOptions {
+	if !c.TLSParams.Enabled {
+		return httpserver.TLSOptions{}
+	}
+
+	return httpserver.TLSOptions{
+		CertFile:     c.TLSParams.CertFile,
+		KeyFile:      c.TLSParams.KeyFile,
+		RedirectAddr: c.TLSParams.RedirectHTTPAddress,
+	}
+}
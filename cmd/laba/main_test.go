@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/rx3lixir/laba/internal/config"
+)
+
+func TestConfigureLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewWithOptions(&buf, log.Options{Level: log.DebugLevel})
+
+	configureLogger(logger, nil, &config.Config{GeneralParams: config.GeneralParams{LogFormat: "json", LogLevel: "info"}})
+
+	logger.Debug("Not at this level")
+	logger.Info("Message stored", "message_id", "42", "size", 1024)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log output %q is not one JSON object: %v", buf.String(), err)
+	}
+	if line["msg"] != "Message stored" || line["level"] != "info" {
+		t.Fatalf("logged %v", line)
+	}
+	if line["message_id"] != "42" || line["size"] != float64(1024) {
+		t.Fatalf("fields %v, want message_id and size as structured fields", line)
+	}
+}
+
+func TestConfigureLoggerComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf)
+	components := map[string]*log.Logger{
+		"udp":  logger.WithPrefix("udp"),
+		"http": logger.WithPrefix("http"),
+		"mail": logger.WithPrefix("mail"),
+	}
+
+	configureLogger(logger, components, &config.Config{GeneralParams: config.GeneralParams{
+		LogFormat: "text",
+		LogLevel:  "info",
+		LogLevels: map[string]string{"udp": "debug", "http": "warn"},
+	}})
+
+	tests := []struct {
+		logger *log.Logger
+		level  log.Level
+		logged bool
+	}{
+		{logger, log.DebugLevel, false},
+		{logger, log.InfoLevel, true},
+		{components["udp"], log.DebugLevel, true},
+		{components["http"], log.InfoLevel, false},
+		{components["http"], log.WarnLevel, true},
+		// No override, the global level applies
+		{components["mail"], log.DebugLevel, false},
+		{components["mail"], log.InfoLevel, true},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		tt.logger.Log(tt.level, "probe")
+		if logged := buf.Len() > 0; logged != tt.logged {
+			t.Errorf("%q at %s: logged = %v, want %v", tt.logger.GetPrefix(), tt.level, logged, tt.logged)
+		}
+	}
+}
@@ -2,23 +2,44 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
+	"sync"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	GeneralParams GeneralParams
-	MainDBParams  MainDBParams
-	AuthDBParams  AuthDBParams
-	UDPParams     UDPParams
-	S3Params      S3Params
+	GeneralParams   GeneralParams
+	MainDBParams    MainDBParams
+	AuthDBParams    AuthDBParams
+	UDPParams       UDPParams
+	S3Params        S3Params
+	RateLimitParams RateLimitParams
+	TLSParams       TLSParams
+	AudioParams     AudioParams
+	TracingParams   TracingParams
+	MailParams      MailParams
+	WebhookParams   WebhookParams
 }
 
 type GeneralParams struct {
-	Env         string
-	SecretKey   string
-	HTTPaddress string
+	Env           string
+	SecretKey     string
+	HTTPaddress   string
+	MaxUploadSize int64
+	PasswordCost  int
+	LogFormat     string
+	LogLevel      string
+	// Per component level overrides, e.g. udp: debug
+	LogLevels map[string]string
+	// Externally reachable base URL, used in links sent by email
+	PublicURL string
+	// Hours an email verification link stays valid
+	VerificationTTL int
+	// Refuse messages from users who haven't verified their email
+	RequireVerifiedEmail bool
 }
 
 type MainDBParams struct {
@@ -28,96 +49,521 @@ type MainDBParams struct {
 	Port     int
 	Host     string
 	Timeout  int
+	// Seconds a single query may run
+	QueryTimeout int
 }
 
 type AuthDBParams struct {
 	Host     string
 	Username string
 	Password string
+	// Connections for blocking commands, pipelined commands share the multiplexed ones
+	BlockingPoolSize int
+	// Pipelined connections are 2^PipelineMultiplex
+	PipelineMultiplex int
+	// Seconds a session lives without a packet from its user
+	SessionTTL int
+	// Seconds received chunks are kept while their message is incomplete
+	ChunkTTL int
 }
 
 type UDPParams struct {
-	Address string
-	Port    int
+	Address          string
+	Port             int
+	AutoMarkListened bool
+	ChunkGracePeriod int
+	ContactPolicy    string
+	Workers          int
+	ReadBufferSize   int
+	// Bytes, zero uses the protocol maximum
+	MaxPacketSize     int
+	RequireEncryption bool
+	PendingTimeout    int
+	// Kbit/s when sending chunks to clients
+	ForwardBitrate    int
+	ForwardMinBitrate int
+	ForwardAckWindow  int
+	// Milliseconds without an ACK before unACKed chunks are resent
+	ForwardAckTimeout int
+	ForwardRetries    int
+	AckBatchSize      int
+	AckBatchDelay     int
+	AuthMaxFailures   int
+	AuthCooldown      int
+	CompressAudio     bool
+	// Send quotas per sender, zero disables a limit
+	MaxMessagesPerMinute int
+	MaxMessagesPerHour   int
+	MaxRecipients        int
+	// Seconds the distinct recipients are counted over
+	RecipientWindow int
 }
 
 type S3Params struct {
+	// Backend is minio or filesystem. LocalDir is where the filesystem backend keeps objects
+	Backend  string
+	LocalDir string
+
 	Endpoint        string
 	AccessKeyID     string
 	SecretAccessKey string
 	UseSSL          bool
 	BucketName      string
+
+	// Encryption at rest: "", sse-s3 or sse-c. SSEKey is a base64 32 byte key for sse-c
+	SSEMode string
+	SSEKey  string
+
+	// KeyPrefix namespaces every object name, e.g. env/tenant/. Empty keeps names as they are
+	KeyPrefix string
+
+	// ContentDisposition for downloads: attachment, inline or "" to leave it out
+	ContentDisposition string
+
+	// Orphan sweeper, intervals in minutes. A zero interval disables it
+	OrphanPrefix        string
+	OrphanGracePeriod   int
+	OrphanSweepInterval int
+}
+
+type RateLimitParams struct {
+	AuthRequestsPerMinute int
+	AuthBurst             int
+}
+
+type TLSParams struct {
+	Enabled             bool
+	CertFile            string
+	KeyFile             string
+	RedirectHTTPAddress string
+}
+
+type AudioParams struct {
+	Transcode        bool
+	FFmpegPath       string
+	StrictValidation bool
+}
+
+type TracingParams struct {
+	Enabled bool
+	// OTLP/HTTP collector, host:port
+	Endpoint    string
+	Insecure    bool
+	ServiceName string
+	SampleRatio float64
+}
+
+type MailParams struct {
+	// Backend is log or smtp. The log backend only logs emails, for development
+	Backend  string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Sender address of every email
+	From string
+}
+
+type WebhookParams struct {
+	// Endpoints receiving message events, none disables webhooks
+	URLs []string
+	// Shared secret the payloads are signed with
+	Secret string
+	// Seconds a single delivery attempt may take
+	Timeout     int
+	MaxAttempts int
 }
 
 type ConfigManager struct {
 	v      *viper.Viper
+	mu     sync.RWMutex
 	config *Config
 }
 
+// envKeys lists every config key that can be overridden from the environment.
+// Viper only resolves env vars for keys it already knows about, so nested keys
+// that are missing from the yaml have to be bound explicitly
+var envKeys = []string{
+	"general_params.env",
+	"general_params.secret_key",
+	"general_params.http_server_address",
+	"general_params.max_upload_size",
+	"general_params.password_cost",
+	"general_params.log_format",
+	"general_params.log_level",
+	"general_params.public_url",
+	"general_params.verification_ttl",
+	"general_params.require_verified_email",
+
+	"main_db_params.db_username",
+	"main_db_params.db_password",
+	"main_db_params.db_name",
+	"main_db_params.db_port",
+	"main_db_params.db_host",
+	"main_db_params.db_timeout",
+	"main_db_params.db_query_timeout",
+
+	"auth_db_params.db_host",
+	"auth_db_params.db_username",
+	"auth_db_params.db_password",
+	"auth_db_params.db_blocking_pool_size",
+	"auth_db_params.db_pipeline_multiplex",
+	"auth_db_params.session_ttl",
+	"auth_db_params.chunk_ttl",
+
+	"udp_params.udp_server_address",
+	"udp_params.udp_server_port",
+	"udp_params.auto_mark_listened",
+	"udp_params.chunk_grace_period",
+	"udp_params.contact_policy",
+	"udp_params.workers",
+	"udp_params.read_buffer_size",
+	"udp_params.max_packet_size",
+	"udp_params.require_encryption",
+	"udp_params.pending_timeout",
+	"udp_params.forward_bitrate",
+	"udp_params.forward_min_bitrate",
+	"udp_params.forward_ack_window",
+	"udp_params.forward_ack_timeout",
+	"udp_params.forward_retries",
+	"udp_params.ack_batch_size",
+	"udp_params.ack_batch_delay",
+	"udp_params.auth_max_failures",
+	"udp_params.auth_cooldown",
+	"udp_params.compress_audio",
+	"udp_params.max_messages_per_minute",
+	"udp_params.max_messages_per_hour",
+	"udp_params.max_recipients",
+	"udp_params.recipient_window",
+
+	"s3_params.backend",
+	"s3_params.local_dir",
+	"s3_params.endpoint",
+	"s3_params.access_key_id",
+	"s3_params.secret_access_key",
+	"s3_params.use_ssl",
+	"s3_params.bucket_name",
+	"s3_params.sse_mode",
+	"s3_params.sse_key",
+	"s3_params.key_prefix",
+	"s3_params.content_disposition",
+	"s3_params.orphan_prefix",
+	"s3_params.orphan_grace_period",
+	"s3_params.orphan_sweep_interval",
+
+	"rate_limit_params.auth_requests_per_minute",
+	"rate_limit_params.auth_burst",
+
+	"tls_params.enabled",
+	"tls_params.cert_file",
+	"tls_params.key_file",
+	"tls_params.redirect_http_address",
+
+	"audio_params.transcode",
+	"audio_params.ffmpeg_path",
+	"audio_params.strict_validation",
+
+	"tracing_params.enabled",
+	"tracing_params.endpoint",
+	"tracing_params.insecure",
+	"tracing_params.service_name",
+	"tracing_params.sample_ratio",
+
+	"mail_params.backend",
+	"mail_params.host",
+	"mail_params.port",
+	"mail_params.username",
+	"mail_params.password",
+	"mail_params.from",
+
+	"webhook_params.urls",
+	"webhook_params.secret",
+	"webhook_params.timeout",
+	"webhook_params.max_attempts",
+}
+
+// setDefaults registers fallback values for every key that has a sane default.
+// Secrets and credentials deliberately have none
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("general_params.env", "dev")
+	v.SetDefault("general_params.http_server_address", "localhost:8080")
+	v.SetDefault("general_params.max_upload_size", 10<<20) // 10 MB
+	v.SetDefault("general_params.password_cost", 10)       // bcrypt cost
+	v.SetDefault("general_params.log_format", "text")
+	v.SetDefault("general_params.log_level", "debug")
+	v.SetDefault("general_params.public_url", "http://localhost:8080")
+	v.SetDefault("general_params.verification_ttl", 24) // hours
+	v.SetDefault("general_params.require_verified_email", false)
+
+	v.SetDefault("main_db_params.db_host", "localhost")
+	v.SetDefault("main_db_params.db_port", 5432)
+	v.SetDefault("main_db_params.db_timeout", 5)
+	v.SetDefault("main_db_params.db_query_timeout", 3)
+
+	v.SetDefault("auth_db_params.db_host", "localhost:6379")
+	v.SetDefault("auth_db_params.db_blocking_pool_size", 1000) // valkey-go default
+	v.SetDefault("auth_db_params.db_pipeline_multiplex", 2)    // 4 pipelined connections
+	v.SetDefault("auth_db_params.session_ttl", 300)
+	v.SetDefault("auth_db_params.chunk_ttl", 600)
+
+	v.SetDefault("udp_params.udp_server_address", "localhost")
+	v.SetDefault("udp_params.udp_server_port", 9090)
+	v.SetDefault("udp_params.auto_mark_listened", false)
+	v.SetDefault("udp_params.chunk_grace_period", 30)
+	v.SetDefault("udp_params.contact_policy", "open")
+	v.SetDefault("udp_params.workers", 64)
+	v.SetDefault("udp_params.read_buffer_size", 4<<20) // 4 MB
+	v.SetDefault("udp_params.max_packet_size", 0)
+	v.SetDefault("udp_params.require_encryption", false)
+	v.SetDefault("udp_params.pending_timeout", 120)
+	v.SetDefault("udp_params.forward_bitrate", 2000)     // kbit/s
+	v.SetDefault("udp_params.forward_min_bitrate", 128)  // kbit/s
+	v.SetDefault("udp_params.forward_ack_window", 32)    // chunks
+	v.SetDefault("udp_params.forward_ack_timeout", 1000) // ms
+	v.SetDefault("udp_params.forward_retries", 3)
+	v.SetDefault("udp_params.ack_batch_size", 1)
+	v.SetDefault("udp_params.ack_batch_delay", 20) // ms
+	v.SetDefault("udp_params.auth_max_failures", 5)
+	v.SetDefault("udp_params.auth_cooldown", 60) // seconds
+	v.SetDefault("udp_params.compress_audio", false)
+	v.SetDefault("udp_params.max_messages_per_minute", 30)
+	v.SetDefault("udp_params.max_messages_per_hour", 500)
+	v.SetDefault("udp_params.max_recipients", 100)
+	v.SetDefault("udp_params.recipient_window", 3600) // seconds
+
+	v.SetDefault("s3_params.backend", "minio")
+	v.SetDefault("s3_params.local_dir", "./data/objects")
+	v.SetDefault("s3_params.use_ssl", false)
+	v.SetDefault("s3_params.key_prefix", "")
+	v.SetDefault("s3_params.content_disposition", "attachment")
+	v.SetDefault("s3_params.orphan_prefix", "messages/")
+	v.SetDefault("s3_params.orphan_grace_period", 60)
+	v.SetDefault("s3_params.orphan_sweep_interval", 60)
+
+	v.SetDefault("rate_limit_params.auth_requests_per_minute", 10)
+	v.SetDefault("rate_limit_params.auth_burst", 5)
+
+	v.SetDefault("tls_params.enabled", false)
+
+	v.SetDefault("audio_params.transcode", false)
+	v.SetDefault("audio_params.ffmpeg_path", "ffmpeg")
+	v.SetDefault("audio_params.strict_validation", false)
+
+	v.SetDefault("tracing_params.enabled", false)
+	v.SetDefault("tracing_params.endpoint", "localhost:4318")
+	v.SetDefault("tracing_params.insecure", false)
+	v.SetDefault("tracing_params.service_name", "laba")
+	v.SetDefault("tracing_params.sample_ratio", 1.0)
+
+	v.SetDefault("mail_params.backend", "log")
+	v.SetDefault("mail_params.port", 587)
+
+	v.SetDefault("webhook_params.timeout", 5)
+	v.SetDefault("webhook_params.max_attempts", 3)
+}
+
 // NewConfigManager creates new config manager that handles
-// all viper config options and loads a config from yaml
+// all viper config options and loads a config from yaml.
+//
+// Precedence, highest first:
+//  1. environment variables: APP_ + the upper-cased key with dots
+//     replaced by underscores, e.g. APP_MAIN_DB_PARAMS_DB_HOST
+//  2. values from the yaml file
+//  3. defaults from setDefaults
 func NewConfigManager(configPath string) (*ConfigManager, error) {
 	v := viper.New()
 
 	v.SetConfigFile(configPath)
 	v.SetConfigType("yaml")
 
-	v.AutomaticEnv()
+	setDefaults(v)
+
 	v.SetEnvPrefix("APP")
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	for _, key := range envKeys {
+		if err := v.BindEnv(key); err != nil {
+			return nil, fmt.Errorf("failed to bind env for %s: %w", key, err)
+		}
+	}
 
 	if err := v.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
 
 	cm := &ConfigManager{v: v}
-
-	if err := cm.loadConfig(); err != nil {
-		return nil, err
-	}
+	cm.config = cm.loadConfig()
 
 	return cm, nil
 }
 
 // Extracting data from yaml file and loading into Config
-func (cm *ConfigManager) loadConfig() error {
-	cm.config = &Config{
+func (cm *ConfigManager) loadConfig() *Config {
+	return &Config{
 		GeneralParams: GeneralParams{
-			Env:         cm.v.GetString("general_params.env"),
-			SecretKey:   cm.v.GetString("general_params.secret_key"),
-			HTTPaddress: cm.v.GetString("general_params.http_server_address"),
+			Env:           cm.v.GetString("general_params.env"),
+			SecretKey:     cm.v.GetString("general_params.secret_key"),
+			HTTPaddress:   cm.v.GetString("general_params.http_server_address"),
+			MaxUploadSize: cm.v.GetInt64("general_params.max_upload_size"),
+			PasswordCost:  cm.v.GetInt("general_params.password_cost"),
+			LogFormat:     cm.v.GetString("general_params.log_format"),
+			LogLevel:      cm.v.GetString("general_params.log_level"),
+			LogLevels:     cm.v.GetStringMapString("general_params.log_levels"),
+
+			PublicURL:            cm.v.GetString("general_params.public_url"),
+			VerificationTTL:      cm.v.GetInt("general_params.verification_ttl"),
+			RequireVerifiedEmail: cm.v.GetBool("general_params.require_verified_email"),
 		},
 		MainDBParams: MainDBParams{
-			Username: cm.v.GetString("main_db_params.db_username"),
-			Password: cm.v.GetString("main_db_params.db_password"),
-			Name:     cm.v.GetString("main_db_params.db_name"),
-			Port:     cm.v.GetInt("main_db_params.db_port"),
-			Host:     cm.v.GetString("main_db_params.db_host"),
-			Timeout:  cm.v.GetInt("main_db_params.db_timeout"),
+			Username:     cm.v.GetString("main_db_params.db_username"),
+			Password:     cm.v.GetString("main_db_params.db_password"),
+			Name:         cm.v.GetString("main_db_params.db_name"),
+			Port:         cm.v.GetInt("main_db_params.db_port"),
+			Host:         cm.v.GetString("main_db_params.db_host"),
+			Timeout:      cm.v.GetInt("main_db_params.db_timeout"),
+			QueryTimeout: cm.v.GetInt("main_db_params.db_query_timeout"),
 		},
 		AuthDBParams: AuthDBParams{
 			Host:     cm.v.GetString("auth_db_params.db_host"),
 			Username: cm.v.GetString("auth_db_params.db_username"),
 			Password: cm.v.GetString("auth_db_params.db_password"),
+
+			BlockingPoolSize:  cm.v.GetInt("auth_db_params.db_blocking_pool_size"),
+			PipelineMultiplex: cm.v.GetInt("auth_db_params.db_pipeline_multiplex"),
+			SessionTTL:        cm.v.GetInt("auth_db_params.session_ttl"),
+			ChunkTTL:          cm.v.GetInt("auth_db_params.chunk_ttl"),
 		},
 		UDPParams: UDPParams{
-			Address: cm.v.GetString("udp_params.udp_server_address"),
-			Port:    cm.v.GetInt("udp_params.udp_server_port"),
+			Address:           cm.v.GetString("udp_params.udp_server_address"),
+			Port:              cm.v.GetInt("udp_params.udp_server_port"),
+			AutoMarkListened:  cm.v.GetBool("udp_params.auto_mark_listened"),
+			ChunkGracePeriod:  cm.v.GetInt("udp_params.chunk_grace_period"),
+			ContactPolicy:     cm.v.GetString("udp_params.contact_policy"),
+			Workers:           cm.v.GetInt("udp_params.workers"),
+			ReadBufferSize:    cm.v.GetInt("udp_params.read_buffer_size"),
+			MaxPacketSize:     cm.v.GetInt("udp_params.max_packet_size"),
+			RequireEncryption: cm.v.GetBool("udp_params.require_encryption"),
+			PendingTimeout:    cm.v.GetInt("udp_params.pending_timeout"),
+			ForwardBitrate:    cm.v.GetInt("udp_params.forward_bitrate"),
+			ForwardMinBitrate: cm.v.GetInt("udp_params.forward_min_bitrate"),
+			ForwardAckWindow:  cm.v.GetInt("udp_params.forward_ack_window"),
+			ForwardAckTimeout: cm.v.GetInt("udp_params.forward_ack_timeout"),
+			ForwardRetries:    cm.v.GetInt("udp_params.forward_retries"),
+			AckBatchSize:      cm.v.GetInt("udp_params.ack_batch_size"),
+			AckBatchDelay:     cm.v.GetInt("udp_params.ack_batch_delay"),
+			AuthMaxFailures:   cm.v.GetInt("udp_params.auth_max_failures"),
+			AuthCooldown:      cm.v.GetInt("udp_params.auth_cooldown"),
+			CompressAudio:     cm.v.GetBool("udp_params.compress_audio"),
+
+			MaxMessagesPerMinute: cm.v.GetInt("udp_params.max_messages_per_minute"),
+			MaxMessagesPerHour:   cm.v.GetInt("udp_params.max_messages_per_hour"),
+			MaxRecipients:        cm.v.GetInt("udp_params.max_recipients"),
+			RecipientWindow:      cm.v.GetInt("udp_params.recipient_window"),
 		},
 		S3Params: S3Params{
+			Backend:  cm.v.GetString("s3_params.backend"),
+			LocalDir: cm.v.GetString("s3_params.local_dir"),
+
 			Endpoint:        cm.v.GetString("s3_params.endpoint"),
 			AccessKeyID:     cm.v.GetString("s3_params.access_key_id"),
 			SecretAccessKey: cm.v.GetString("s3_params.secret_access_key"),
 			UseSSL:          cm.v.GetBool("s3_params.use_ssl"),
 			BucketName:      cm.v.GetString("s3_params.bucket_name"),
+
+			SSEMode: cm.v.GetString("s3_params.sse_mode"),
+			SSEKey:  cm.v.GetString("s3_params.sse_key"),
+
+			KeyPrefix:          cm.v.GetString("s3_params.key_prefix"),
+			ContentDisposition: cm.v.GetString("s3_params.content_disposition"),
+
+			OrphanPrefix:        cm.v.GetString("s3_params.orphan_prefix"),
+			OrphanGracePeriod:   cm.v.GetInt("s3_params.orphan_grace_period"),
+			OrphanSweepInterval: cm.v.GetInt("s3_params.orphan_sweep_interval"),
+		},
+		RateLimitParams: RateLimitParams{
+			AuthRequestsPerMinute: cm.v.GetInt("rate_limit_params.auth_requests_per_minute"),
+			AuthBurst:             cm.v.GetInt("rate_limit_params.auth_burst"),
+		},
+		TLSParams: TLSParams{
+			Enabled:             cm.v.GetBool("tls_params.enabled"),
+			CertFile:            cm.v.GetString("tls_params.cert_file"),
+			KeyFile:             cm.v.GetString("tls_params.key_file"),
+			RedirectHTTPAddress: cm.v.GetString("tls_params.redirect_http_address"),
+		},
+		AudioParams: AudioParams{
+			Transcode:        cm.v.GetBool("audio_params.transcode"),
+			FFmpegPath:       cm.v.GetString("audio_params.ffmpeg_path"),
+			StrictValidation: cm.v.GetBool("audio_params.strict_validation"),
+		},
+		TracingParams: TracingParams{
+			Enabled:     cm.v.GetBool("tracing_params.enabled"),
+			Endpoint:    cm.v.GetString("tracing_params.endpoint"),
+			Insecure:    cm.v.GetBool("tracing_params.insecure"),
+			ServiceName: cm.v.GetString("tracing_params.service_name"),
+			SampleRatio: cm.v.GetFloat64("tracing_params.sample_ratio"),
+		},
+		MailParams: MailParams{
+			Backend:  cm.v.GetString("mail_params.backend"),
+			Host:     cm.v.GetString("mail_params.host"),
+			Port:     cm.v.GetInt("mail_params.port"),
+			Username: cm.v.GetString("mail_params.username"),
+			Password: cm.v.GetString("mail_params.password"),
+			From:     cm.v.GetString("mail_params.from"),
+		},
+		WebhookParams: WebhookParams{
+			URLs:        cm.v.GetStringSlice("webhook_params.urls"),
+			Secret:      cm.v.GetString("webhook_params.secret"),
+			Timeout:     cm.v.GetInt("webhook_params.timeout"),
+			MaxAttempts: cm.v.GetInt("webhook_params.max_attempts"),
 		},
 	}
-	return nil
 }
 
-// Geting config instance
+// Geting config instance. Returns a copy, so callers never observe a reload half way
 func (cm *ConfigManager) GetConfig() *Config {
-	return cm.config
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	c := *cm.config
+	return &c
+}
+
+// Watch starts watching the config file and reloads it on every write.
+// A reloaded config only replaces the current one if it passes Validate,
+// then onChange is called with it. Invalid configs are reported to onError, which may be nil
+func (cm *ConfigManager) Watch(onChange func(*Config), onError func(error)) {
+	cm.v.OnConfigChange(func(e fsnotify.Event) {
+		c := cm.loadConfig()
+
+		if err := c.Validate(); err != nil {
+			if onError != nil {
+				onError(fmt.Errorf("reloaded config from %s is invalid: %w", e.Name, err))
+			}
+			return
+		}
+
+		cm.mu.Lock()
+		cm.config = c
+		cm.mu.Unlock()
+
+		onChange(c)
+	})
+
+	cm.v.WatchConfig()
+}
+
+// minChunkTTL is the shortest chunk_ttl accepted, in seconds. A slow
+// client needs at least this long to get a typical message across
+const minChunkTTL = 60
+
+// validLogLevel reports whether level is one of the levels the logger understands
+func validLogLevel(level string) bool {
+	switch level {
+	case "debug", "info", "warn", "error", "fatal":
+		return true
+	}
+	return false
 }
 
 // Compiling a string to connect to main db
@@ -148,6 +594,34 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("parameter http_server_address is requred")
 	}
 
+	// Checking bcrypt cost
+	if c.GeneralParams.PasswordCost < 4 || c.GeneralParams.PasswordCost > 31 {
+		return fmt.Errorf("parameter password_cost must be between 4 and 31")
+	}
+
+	// Checking email verification
+	if c.GeneralParams.PublicURL == "" {
+		return fmt.Errorf("parameter public_url is required")
+	}
+	if c.GeneralParams.VerificationTTL <= 0 {
+		return fmt.Errorf("parameter verification_ttl must be positive")
+	}
+
+	// Checking logging
+	switch c.GeneralParams.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("parameter log_format is invalid: %s. try text/json instead", c.GeneralParams.LogFormat)
+	}
+	if !validLogLevel(c.GeneralParams.LogLevel) {
+		return fmt.Errorf("parameter log_level is invalid: %s. try debug/info/warn/error/fatal instead", c.GeneralParams.LogLevel)
+	}
+	for component, level := range c.GeneralParams.LogLevels {
+		if !validLogLevel(level) {
+			return fmt.Errorf("parameter log_levels.%s is invalid: %s. try debug/info/warn/error/fatal instead", component, level)
+		}
+	}
+
 	// Checking out enviroment variable
 	switch c.GeneralParams.Env {
 	case "dev", "prod", "test":
@@ -168,8 +642,11 @@ func (c *Config) Validate() error {
 		if mainDbConf.Password == "" {
 			return fmt.Errorf("%s: password is requred", name)
 		}
-		if mainDbConf.Port != 5432 {
-			return fmt.Errorf("%s: port is invalid", name)
+		if mainDbConf.Port <= 0 || mainDbConf.Port > 65535 {
+			return fmt.Errorf("%s: port must be between 1 and 65535", name)
+		}
+		if mainDbConf.QueryTimeout < 0 {
+			return fmt.Errorf("%s: query_timeout must not be negative", name)
 		}
 	}
 
@@ -186,6 +663,24 @@ func (c *Config) Validate() error {
 		if authDbConf.Password == "" {
 			return fmt.Errorf("%s: password is required", name)
 		}
+		if authDbConf.BlockingPoolSize <= 0 {
+			return fmt.Errorf("%s: blocking_pool_size must be positive", name)
+		}
+		if authDbConf.PipelineMultiplex < 0 || authDbConf.PipelineMultiplex > 8 {
+			return fmt.Errorf("%s: pipeline_multiplex must be between 0 and 8", name)
+		}
+		if authDbConf.SessionTTL <= 0 {
+			return fmt.Errorf("%s: session_ttl must be positive", name)
+		}
+		if authDbConf.ChunkTTL < minChunkTTL {
+			return fmt.Errorf("%s: chunk_ttl must be at least %d seconds", name, minChunkTTL)
+		}
+	}
+
+	// Chunks of a stalled message must still be there when the sweeper gives up on it,
+	// with room to spare for the transfer itself
+	if c.UDPParams.PendingTimeout > 0 && c.AuthDBParams.ChunkTTL < 2*c.UDPParams.PendingTimeout {
+		return fmt.Errorf("AuthDB: chunk_ttl must be at least twice the UDP pending_timeout")
 	}
 
 	// Checking UDP params
@@ -195,19 +690,166 @@ func (c *Config) Validate() error {
 	if c.UDPParams.Port <= 0 || c.UDPParams.Port > 65535 {
 		return fmt.Errorf("UDP port must be between 1 and 65535")
 	}
+	if c.UDPParams.ChunkGracePeriod < 0 {
+		return fmt.Errorf("UDP chunk_grace_period must not be negative")
+	}
+	if c.UDPParams.Workers <= 0 {
+		return fmt.Errorf("UDP workers must be positive")
+	}
+	if c.UDPParams.PendingTimeout < 0 {
+		return fmt.Errorf("UDP pending_timeout must not be negative")
+	}
+	if c.UDPParams.ForwardBitrate <= 0 || c.UDPParams.ForwardMinBitrate <= 0 {
+		return fmt.Errorf("UDP forward_bitrate and forward_min_bitrate must be positive")
+	}
+	if c.UDPParams.ForwardMinBitrate > c.UDPParams.ForwardBitrate {
+		return fmt.Errorf("UDP forward_min_bitrate must not exceed forward_bitrate")
+	}
+	if c.UDPParams.ForwardAckWindow <= 0 {
+		return fmt.Errorf("UDP forward_ack_window must be positive")
+	}
+	if c.UDPParams.ForwardAckTimeout <= 0 || c.UDPParams.ForwardRetries <= 0 {
+		return fmt.Errorf("UDP forward_ack_timeout and forward_retries must be positive")
+	}
+
+	if c.UDPParams.AckBatchSize < 1 {
+		return fmt.Errorf("UDP ack_batch_size must be at least 1")
+	}
+
+	// Without a delay a batch that never fills up would never be ACKed
+	if c.UDPParams.AckBatchSize > 1 && c.UDPParams.AckBatchDelay <= 0 {
+		return fmt.Errorf("UDP ack_batch_delay must be positive when ACKs are batched")
+	}
+
+	if c.UDPParams.AuthMaxFailures < 0 {
+		return fmt.Errorf("UDP auth_max_failures cannot be negative")
+	}
+
+	if c.UDPParams.AuthMaxFailures > 0 && c.UDPParams.AuthCooldown <= 0 {
+		return fmt.Errorf("UDP auth_cooldown must be positive when auth throttling is enabled")
+	}
+
+	if c.UDPParams.MaxMessagesPerMinute < 0 || c.UDPParams.MaxMessagesPerHour < 0 || c.UDPParams.MaxRecipients < 0 {
+		return fmt.Errorf("UDP send quotas cannot be negative")
+	}
+
+	if c.UDPParams.MaxRecipients > 0 && c.UDPParams.RecipientWindow <= 0 {
+		return fmt.Errorf("UDP recipient_window must be positive when max_recipients is set")
+	}
+	if c.UDPParams.ReadBufferSize < 0 {
+		return fmt.Errorf("UDP read_buffer_size must not be negative")
+	}
+	if c.UDPParams.MaxPacketSize < 0 {
+		return fmt.Errorf("UDP max_packet_size must not be negative")
+	}
+	switch c.UDPParams.ContactPolicy {
+	case "", "open", "reject", "quarantine":
+	default:
+		return fmt.Errorf("UDP contact_policy is invalid: %s. try open/reject/quarantine instead", c.UDPParams.ContactPolicy)
+	}
 
 	// Checking S3 params
-	if c.S3Params.Endpoint == "" {
-		return fmt.Errorf("S3 endpoint is required")
+	switch c.S3Params.Backend {
+	case "minio":
+		if c.S3Params.Endpoint == "" {
+			return fmt.Errorf("S3 endpoint is required")
+		}
+		if c.S3Params.AccessKeyID == "" {
+			return fmt.Errorf("S3 access_key id is required")
+		}
+		if c.S3Params.SecretAccessKey == "" {
+			return fmt.Errorf("S3 secret_access_key is required")
+		}
+		if c.S3Params.BucketName == "" {
+			return fmt.Errorf("S3 bucket name is required")
+		}
+	case "filesystem":
+		if c.S3Params.LocalDir == "" {
+			return fmt.Errorf("S3 local_dir is required for the filesystem backend")
+		}
+	default:
+		return fmt.Errorf("S3 backend is invalid: %s. try minio/filesystem instead", c.S3Params.Backend)
 	}
-	if c.S3Params.AccessKeyID == "" {
-		return fmt.Errorf("S3 access_key id is required")
+	switch c.S3Params.SSEMode {
+	case "", "sse-s3":
+	case "sse-c":
+		if c.S3Params.SSEKey == "" {
+			return fmt.Errorf("S3 sse_key is required for sse-c")
+		}
+		// S3 refuses customer keys over plain HTTP
+		if !c.S3Params.UseSSL {
+			return fmt.Errorf("S3 sse-c requires use_ssl")
+		}
+	default:
+		return fmt.Errorf("S3 sse_mode is invalid: %s. try sse-s3/sse-c instead", c.S3Params.SSEMode)
 	}
-	if c.S3Params.SecretAccessKey == "" {
-		return fmt.Errorf("S3 secret_access_key is required")
+	switch c.S3Params.ContentDisposition {
+	case "", "attachment", "inline":
+	default:
+		return fmt.Errorf("S3 content_disposition is invalid: %s. try attachment/inline instead", c.S3Params.ContentDisposition)
+	}
+	if c.S3Params.OrphanGracePeriod < 0 || c.S3Params.OrphanSweepInterval < 0 {
+		return fmt.Errorf("S3 orphan sweeper params must not be negative")
+	}
+
+	// Checking rate limit params, zero disables limiting
+	if c.RateLimitParams.AuthRequestsPerMinute < 0 || c.RateLimitParams.AuthBurst < 0 {
+		return fmt.Errorf("rate limit params must not be negative")
 	}
-	if c.S3Params.BucketName == "" {
-		return fmt.Errorf("S3 bucket name is required")
+
+	// Checking TLS params
+	if c.TLSParams.Enabled {
+		if c.TLSParams.CertFile == "" || c.TLSParams.KeyFile == "" {
+			return fmt.Errorf("TLS: both cert_file and key_file are required when TLS is enabled")
+		}
+	} else if c.TLSParams.RedirectHTTPAddress != "" {
+		return fmt.Errorf("TLS: redirect_http_address requires TLS to be enabled")
+	}
+
+	// Checking tracing params
+	if c.TracingParams.Enabled {
+		if c.TracingParams.Endpoint == "" {
+			return fmt.Errorf("tracing: endpoint is required when tracing is enabled")
+		}
+		if c.TracingParams.SampleRatio < 0 || c.TracingParams.SampleRatio > 1 {
+			return fmt.Errorf("tracing: sample_ratio must be between 0 and 1")
+		}
+	}
+
+	// Checking mail params
+	switch c.MailParams.Backend {
+	case "log":
+	case "smtp":
+		if c.MailParams.Host == "" {
+			return fmt.Errorf("mail host is required for the smtp backend")
+		}
+		if c.MailParams.Port <= 0 || c.MailParams.Port > 65535 {
+			return fmt.Errorf("mail port is invalid: %d", c.MailParams.Port)
+		}
+		if c.MailParams.From == "" {
+			return fmt.Errorf("mail from address is required for the smtp backend")
+		}
+	default:
+		return fmt.Errorf("mail backend is invalid: %s. try log/smtp instead", c.MailParams.Backend)
+	}
+
+	// Checking webhook params
+	if len(c.WebhookParams.URLs) > 0 {
+		if c.WebhookParams.Secret == "" {
+			return fmt.Errorf("webhook secret is required when webhook urls are set")
+		}
+		for _, raw := range c.WebhookParams.URLs {
+			u, err := url.Parse(raw)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("webhook url is invalid: %s", raw)
+			}
+		}
+		if c.WebhookParams.Timeout <= 0 {
+			return fmt.Errorf("webhook timeout must be positive")
+		}
+		if c.WebhookParams.MaxAttempts < 1 {
+			return fmt.Errorf("webhook max_attempts must be at least 1")
+		}
 	}
 
 	return nil
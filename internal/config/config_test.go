@@ -0,0 +1,221 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfig writes yaml to a config file in a temporary directory and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	path := writeConfig(t, `
+main_db_params:
+  db_host: file-host
+  db_port: 5433
+`)
+
+	t.Setenv("APP_MAIN_DB_PARAMS_DB_HOST", "env-host")
+	// Keys missing from the file are bound too
+	t.Setenv("APP_UDP_PARAMS_WORKERS", "7")
+
+	cm, err := NewConfigManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := cm.GetConfig()
+
+	if cfg.MainDBParams.Host != "env-host" {
+		t.Errorf("db host %q, want the env value", cfg.MainDBParams.Host)
+	}
+	if cfg.MainDBParams.Port != 5433 {
+		t.Errorf("db port %d, want the file value", cfg.MainDBParams.Port)
+	}
+	if cfg.UDPParams.Workers != 7 {
+		t.Errorf("workers %d, want the env value", cfg.UDPParams.Workers)
+	}
+}
+
+func TestMinimalConfigGetsDefaults(t *testing.T) {
+	path := writeConfig(t, `
+general_params:
+  secret_key: test-secret
+`)
+
+	cm, err := NewConfigManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := cm.GetConfig()
+
+	if cfg.GeneralParams.HTTPaddress != "localhost:8080" {
+		t.Errorf("http address %q", cfg.GeneralParams.HTTPaddress)
+	}
+	if cfg.GeneralParams.PasswordCost != 10 {
+		t.Errorf("password cost %d", cfg.GeneralParams.PasswordCost)
+	}
+	if cfg.MainDBParams.Host != "localhost" || cfg.MainDBParams.Port != 5432 {
+		t.Errorf("db %s:%d", cfg.MainDBParams.Host, cfg.MainDBParams.Port)
+	}
+	if cfg.UDPParams.Port != 9090 || cfg.UDPParams.ContactPolicy != "open" {
+		t.Errorf("udp port %d, contact policy %q", cfg.UDPParams.Port, cfg.UDPParams.ContactPolicy)
+	}
+	if cfg.S3Params.Backend != "minio" {
+		t.Errorf("s3 backend %q", cfg.S3Params.Backend)
+	}
+
+	// Secrets have no defaults
+	if cfg.GeneralParams.SecretKey != "test-secret" || cfg.MainDBParams.Password != "" {
+		t.Error("secrets were defaulted")
+	}
+}
+
+// validConfig is the least a config needs to pass Validate, with the contact policy left to fill in
+const validConfig = `
+general_params:
+  secret_key: test-secret
+main_db_params:
+  db_username: laba
+  db_password: laba
+auth_db_params:
+  db_username: laba
+  db_password: laba
+udp_params:
+  contact_policy: %s
+s3_params:
+  backend: filesystem
+`
+
+func TestWatchReloadsConfig(t *testing.T) {
+	path := writeConfig(t, fmt.Sprintf(validConfig, "open"))
+
+	cm, err := NewConfigManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.GetConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan *Config, 1)
+	invalid := make(chan error, 1)
+	cm.Watch(func(c *Config) {
+		select {
+		case changed <- c:
+		default:
+		}
+	}, func(err error) {
+		select {
+		case invalid <- err:
+		default:
+		}
+	})
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(validConfig, "reject")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case c := <-changed:
+		if c.UDPParams.ContactPolicy != "reject" {
+			t.Fatalf("callback got contact policy %q", c.UDPParams.ContactPolicy)
+		}
+	case err := <-invalid:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload after the file was rewritten")
+	}
+
+	if got := cm.GetConfig().UDPParams.ContactPolicy; got != "reject" {
+		t.Fatalf("current config has contact policy %q", got)
+	}
+}
+
+func TestValidateLogLevels(t *testing.T) {
+	cm, err := NewConfigManager(writeConfig(t, fmt.Sprintf(validConfig, "open")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		level     string
+		overrides map[string]string
+		wantErr   bool
+	}{
+		{"info", map[string]string{"udp": "debug", "http": "warn"}, false},
+		{"verbose", nil, true},
+		{"info", map[string]string{"udp": "loud"}, true},
+	}
+
+	for _, tt := range tests {
+		cfg := *cm.GetConfig()
+		cfg.GeneralParams.LogLevel = tt.level
+		cfg.GeneralParams.LogLevels = tt.overrides
+
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("level %q, overrides %v: error = %v, want error %v", tt.level, tt.overrides, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateTTLs(t *testing.T) {
+	cm, err := NewConfigManager(writeConfig(t, fmt.Sprintf(validConfig, "open")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		sessionTTL     int
+		chunkTTL       int
+		pendingTimeout int
+		wantErr        bool
+	}{
+		{"defaults", 300, 600, 0, false},
+		{"long recordings", 300, 3600, 1800, false},
+		{"no session ttl", 0, 600, 0, true},
+		{"chunk ttl too short", 300, minChunkTTL - 1, 0, true},
+		// Chunks must outlive the sweeper giving up on a stalled message
+		{"chunk ttl below twice the pending timeout", 300, 600, 301, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := *cm.GetConfig()
+			cfg.AuthDBParams.SessionTTL = tt.sessionTTL
+			cfg.AuthDBParams.ChunkTTL = tt.chunkTTL
+			cfg.UDPParams.PendingTimeout = tt.pendingTimeout
+
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateMaxPacketSize(t *testing.T) {
+	cm, err := NewConfigManager(writeConfig(t, fmt.Sprintf(validConfig, "open")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for size, wantErr := range map[int]bool{0: false, 9000: false, -1: true} {
+		cfg := *cm.GetConfig()
+		cfg.UDPParams.MaxPacketSize = size
+
+		if err := cfg.Validate(); (err != nil) != wantErr {
+			t.Errorf("max_packet_size %d: error = %v, want error %v", size, err, wantErr)
+		}
+	}
+}
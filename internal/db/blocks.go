@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Block makes blockerID stop receiving anything from blockedID.
+// Blocking is one-directional
+func (s *PostgresStore) Block(ctx context.Context, blockerID, blockedID uuid.UUID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO blocked_users (blocker_id, blocked_id, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (blocker_id, blocked_id) DO NOTHING
+	`
+
+	_, err := s.db.Exec(ctx, query, blockerID, blockedID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to block user: %w", err)
+	}
+
+	return nil
+}
+
+// Unblock lifts a block previously set by blockerID
+func (s *PostgresStore) Unblock(ctx context.Context, blockerID, blockedID uuid.UUID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM blocked_users WHERE blocker_id = $1 AND blocked_id = $2`
+
+	result, err := s.db.Exec(ctx, query, blockerID, blockedID)
+	if err != nil {
+		return fmt.Errorf("failed to unblock user: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("block not found")
+	}
+
+	return nil
+}
+
+// IsBlocked checks whether blockerID has blocked blockedID
+func (s *PostgresStore) IsBlocked(ctx context.Context, blockerID, blockedID uuid.UUID) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM blocked_users WHERE blocker_id = $1 AND blocked_id = $2
+		)
+	`
+
+	var exists bool
+	if err := s.db.QueryRow(ctx, query, blockerID, blockedID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check block: %w", err)
+	}
+
+	return exists, nil
+}
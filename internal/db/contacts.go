@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AddContact adds contactID to the contacts of userID
+func (s *PostgresStore) AddContact(ctx context.Context, userID, contactID uuid.UUID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO contacts (user_id, contact_id, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, contact_id) DO NOTHING
+	`
+
+	_, err := s.db.Exec(ctx, query, userID, contactID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to add contact: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveContact removes contactID from the contacts of userID
+func (s *PostgresStore) RemoveContact(ctx context.Context, userID, contactID uuid.UUID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM contacts WHERE user_id = $1 AND contact_id = $2`
+
+	result, err := s.db.Exec(ctx, query, userID, contactID)
+	if err != nil {
+		return fmt.Errorf("failed to remove contact: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("contact not found")
+	}
+
+	return nil
+}
+
+// IsContact checks whether contactID is in the contacts of userID
+func (s *PostgresStore) IsContact(ctx context.Context, userID, contactID uuid.UUID) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM contacts WHERE user_id = $1 AND contact_id = $2
+		)
+	`
+
+	var exists bool
+	if err := s.db.QueryRow(ctx, query, userID, contactID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check contact: %w", err)
+	}
+
+	return exists, nil
+}
+
+// ListContacts retrieves the contacts of a user with pagination
+func (s *PostgresStore) ListContacts(ctx context.Context, userID uuid.UUID, limit, offset int) ([]*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT u.id, u.username, u.email, u.created_at, u.updated_at
+		FROM contacts c
+		JOIN users u ON u.id = c.contact_id
+		WHERE c.user_id = $1 AND u.deleted_at IS NULL
+		ORDER BY u.username
+		LIMIT $2 OFFSET $3
+	`
+
+	rows, err := s.db.Query(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get contacts: %w", err)
+	}
+	defer rows.Close()
+
+	contacts := []*User{}
+	for rows.Next() {
+		user := &User{}
+		err := rows.Scan(
+			&user.ID,
+			&user.Username,
+			&user.Email,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan contact: %w", err)
+		}
+		contacts = append(contacts, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating contacts: %w", err)
+	}
+
+	return contacts, nil
+}
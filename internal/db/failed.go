@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// RecordFailedMessage dead-letters a message. Failing again replaces the earlier reason
+func (s *PostgresStore) RecordFailedMessage(ctx context.Context, msg *FailedMessage) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO failed_messages (message_id, sender_id, recipient_id, total_chunks, reason, failed_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (message_id) DO UPDATE
+		SET reason = EXCLUDED.reason, failed_at = EXCLUDED.failed_at
+	`
+
+	if msg.FailedAt.IsZero() {
+		msg.FailedAt = time.Now()
+	}
+
+	_, err := s.db.Exec(ctx, query,
+		msg.MessageID,
+		msg.SenderID,
+		msg.RecipientID,
+		msg.TotalChunks,
+		msg.Reason,
+		msg.FailedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record failed message: %w", err)
+	}
+
+	return nil
+}
+
+// scanFailedMessage reads a dead-lettered message row, in the order the queries below list its columns
+func scanFailedMessage(row pgx.Row) (*FailedMessage, error) {
+	msg := &FailedMessage{}
+	err := row.Scan(
+		&msg.MessageID,
+		&msg.SenderID,
+		&msg.RecipientID,
+		&msg.TotalChunks,
+		&msg.Reason,
+		&msg.FailedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// GetFailedMessage retrieves a dead-lettered message by ID
+func (s *PostgresStore) GetFailedMessage(ctx context.Context, messageID uuid.UUID) (*FailedMessage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT message_id, sender_id, recipient_id, total_chunks, reason, failed_at
+		FROM failed_messages
+		WHERE message_id = $1
+	`
+
+	msg, err := scanFailedMessage(s.db.QueryRow(ctx, query, messageID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("failed message not found")
+		}
+		return nil, fmt.Errorf("failed to get failed message: %w", err)
+	}
+
+	return msg, nil
+}
+
+// GetFailedMessagesBySender retrieves the dead-lettered messages of a sender, newest first
+func (s *PostgresStore) GetFailedMessagesBySender(ctx context.Context, senderID uuid.UUID, limit, offset int) ([]*FailedMessage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT message_id, sender_id, recipient_id, total_chunks, reason, failed_at
+		FROM failed_messages
+		WHERE sender_id = $1
+		ORDER BY failed_at DESC
+		LIMIT $2 OFFSET $3
+	`
+
+	rows, err := s.db.Query(ctx, query, senderID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get failed messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []*FailedMessage{}
+	for rows.Next() {
+		msg, err := scanFailedMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan failed message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating failed messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// DeleteFailedMessage takes a message off the dead-letter table
+func (s *PostgresStore) DeleteFailedMessage(ctx context.Context, messageID uuid.UUID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM failed_messages WHERE message_id = $1`
+
+	result, err := s.db.Exec(ctx, query, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to delete failed message: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("failed message not found")
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,13 +13,16 @@ import (
 
 // CreateMessage creates a new voice message record
 func (s *PostgresStore) CreateMessage(ctx context.Context, msg *VoiceMessage) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		INSERT INTO voice_messages (
 			id, sender_id, recipient_id, file_path, file_size,
 			duration_seconds, audio_format, total_chunks, chunks_received,
-			status, created_at
+			status, created_at, original_file_path, compressed
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 	`
 
 	if msg.ID == uuid.Nil {
@@ -40,6 +44,8 @@ func (s *PostgresStore) CreateMessage(ctx context.Context, msg *VoiceMessage) er
 		msg.ChunksReceived,
 		msg.Status,
 		msg.CreatedAt,
+		msg.OriginalFilePath,
+		msg.Compressed,
 	)
 	if err != nil {
 		if ctx.Err() != nil {
@@ -51,19 +57,10 @@ func (s *PostgresStore) CreateMessage(ctx context.Context, msg *VoiceMessage) er
 	return nil
 }
 
-// GetMessageByID retrieves a message by ID
-func (s *PostgresStore) GetMessageByID(ctx context.Context, id uuid.UUID) (*VoiceMessage, error) {
-	query := `
-		SELECT
-			id, sender_id, recipient_id, file_path, file_size,
-			duration_seconds, audio_format, total_chunks, chunks_received,
-			status, created_at, transmitted_at, delivered_at, listened_at
-		FROM voice_messages
-		WHERE id = $1
-	`
-
+// scanVoiceMessage reads a message row selected with every column, in the order the queries below list them
+func scanVoiceMessage(row pgx.Row) (*VoiceMessage, error) {
 	msg := &VoiceMessage{}
-	err := s.db.QueryRow(ctx, query, id).Scan(
+	err := row.Scan(
 		&msg.ID,
 		&msg.SenderID,
 		&msg.RecipientID,
@@ -78,7 +75,32 @@ func (s *PostgresStore) GetMessageByID(ctx context.Context, id uuid.UUID) (*Voic
 		&msg.TransmittedAt,
 		&msg.DeliveredAt,
 		&msg.ListenedAt,
+		&msg.OriginalFilePath,
+		&msg.Archived,
+		&msg.Compressed,
 	)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// GetMessageByID retrieves a message by ID
+func (s *PostgresStore) GetMessageByID(ctx context.Context, id uuid.UUID) (*VoiceMessage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT
+			id, sender_id, recipient_id, file_path, file_size,
+			duration_seconds, audio_format, total_chunks, chunks_received,
+			status, created_at, transmitted_at, delivered_at, listened_at,
+			original_file_path, archived, compressed
+		FROM voice_messages
+		WHERE id = $1
+	`
+
+	msg, err := scanVoiceMessage(s.db.QueryRow(ctx, query, id))
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, fmt.Errorf("message not found")
@@ -91,11 +113,15 @@ func (s *PostgresStore) GetMessageByID(ctx context.Context, id uuid.UUID) (*Voic
 
 // GetMessagesBySender
 func (s *PostgresStore) GetMessagesBySender(ctx context.Context, senderID uuid.UUID, limit, offset int) ([]*VoiceMessage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		SELECT 
 			id, sender_id, recipient_id, file_path, file_size,
 			duration_seconds, audio_format, total_chunks, chunks_received,
-			status, created_at, transmitted_at, delivered_at, listened_at
+			status, created_at, transmitted_at, delivered_at, listened_at,
+			original_file_path, archived, compressed
 		FROM voice_messages
 		WHERE sender_id = $1
 		ORDER BY created_at DESC
@@ -110,23 +136,7 @@ func (s *PostgresStore) GetMessagesBySender(ctx context.Context, senderID uuid.U
 
 	messages := []*VoiceMessage{}
 	for rows.Next() {
-		msg := &VoiceMessage{}
-		err := rows.Scan(
-			&msg.ID,
-			&msg.SenderID,
-			&msg.RecipientID,
-			&msg.FilePath,
-			&msg.FileSize,
-			&msg.DurationSecs,
-			&msg.AudioFormat,
-			&msg.TotalChunks,
-			&msg.ChunksReceived,
-			&msg.Status,
-			&msg.CreatedAt,
-			&msg.TransmittedAt,
-			&msg.DeliveredAt,
-			&msg.ListenedAt,
-		)
+		msg, err := scanVoiceMessage(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan message: %w", err)
 		}
@@ -139,20 +149,25 @@ func (s *PostgresStore) GetMessagesBySender(ctx context.Context, senderID uuid.U
 	return messages, nil
 }
 
-// GetMessagesByRecipient retrieves all messages received by a user
-func (s *PostgresStore) GetMessagesByRecipient(ctx context.Context, recipientID uuid.UUID, limit, offset int) ([]*VoiceMessage, error) {
+// GetMessagesByRecipient retrieves the messages received by a user in one folder.
+// Messages still being uploaded or held back by the contact policy are never listed
+func (s *PostgresStore) GetMessagesByRecipient(ctx context.Context, recipientID uuid.UUID, folder string, limit, offset int) ([]*VoiceMessage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		SELECT 
 			id, sender_id, recipient_id, file_path, file_size,
 			duration_seconds, audio_format, total_chunks, chunks_received,
-			status, created_at, transmitted_at, delivered_at, listened_at
+			status, created_at, transmitted_at, delivered_at, listened_at,
+			original_file_path, archived, compressed
 		FROM voice_messages
-		WHERE recipient_id = $1
+		WHERE recipient_id = $1 AND archived = $2 AND status NOT IN ($3, $4)
 		ORDER BY created_at DESC
-		LIMIT $2 OFFSET $3
+		LIMIT $5 OFFSET $6
 	`
 
-	rows, err := s.db.Query(ctx, query, recipientID, limit, offset)
+	rows, err := s.db.Query(ctx, query, recipientID, folder == FolderArchived, MessageStatusPending, MessageStatusQuarantined, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get messages: %w", err)
 	}
@@ -160,23 +175,111 @@ func (s *PostgresStore) GetMessagesByRecipient(ctx context.Context, recipientID
 
 	messages := []*VoiceMessage{}
 	for rows.Next() {
-		msg := &VoiceMessage{}
-		err := rows.Scan(
-			&msg.ID,
-			&msg.SenderID,
-			&msg.RecipientID,
-			&msg.FilePath,
-			&msg.FileSize,
-			&msg.DurationSecs,
-			&msg.AudioFormat,
-			&msg.TotalChunks,
-			&msg.ChunksReceived,
-			&msg.Status,
-			&msg.CreatedAt,
-			&msg.TransmittedAt,
-			&msg.DeliveredAt,
-			&msg.ListenedAt,
-		)
+		msg, err := scanVoiceMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// GetUndeliveredMessages retrieves the inbox messages stored for a user
+// that never reached them, oldest first
+func (s *PostgresStore) GetUndeliveredMessages(ctx context.Context, recipientID uuid.UUID, limit int) ([]*VoiceMessage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT
+			id, sender_id, recipient_id, file_path, file_size,
+			duration_seconds, audio_format, total_chunks, chunks_received,
+			status, created_at, transmitted_at, delivered_at, listened_at,
+			original_file_path, archived, compressed
+		FROM voice_messages
+		WHERE recipient_id = $1 AND status = $2 AND NOT archived
+		ORDER BY created_at ASC
+		LIMIT $3
+	`
+
+	rows, err := s.db.Query(ctx, query, recipientID, MessageStatusTransmitted, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get undelivered messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []*VoiceMessage{}
+	for rows.Next() {
+		msg, err := scanVoiceMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// SearchMessages retrieves the messages received by a user that match filter, newest first.
+// Archived messages are searched too, held back ones are hidden like in GetMessagesByRecipient
+func (s *PostgresStore) SearchMessages(ctx context.Context, recipientID uuid.UUID, filter SearchFilter) ([]*VoiceMessage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// Only placeholders are added to the query, every value goes in as an argument
+	conditions := []string{"recipient_id = $1", "status NOT IN ($2, $3)"}
+	args := []any{recipientID, MessageStatusPending, MessageStatusQuarantined}
+
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.SenderID != nil {
+		addCondition("sender_id = $%d", *filter.SenderID)
+	}
+	if filter.Status != "" {
+		addCondition("status = $%d", filter.Status)
+	}
+	if filter.CreatedAfter != nil {
+		addCondition("created_at >= $%d", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		addCondition("created_at < $%d", *filter.CreatedBefore)
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+
+	query := fmt.Sprintf(`
+		SELECT
+			id, sender_id, recipient_id, file_path, file_size,
+			duration_seconds, audio_format, total_chunks, chunks_received,
+			status, created_at, transmitted_at, delivered_at, listened_at,
+			original_file_path, archived, compressed
+		FROM voice_messages
+		WHERE %s
+		ORDER BY created_at DESC
+		LIMIT $%d OFFSET $%d
+	`, strings.Join(conditions, " AND "), len(args)-1, len(args))
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []*VoiceMessage{}
+	for rows.Next() {
+		msg, err := scanVoiceMessage(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan message: %w", err)
 		}
@@ -192,6 +295,9 @@ func (s *PostgresStore) GetMessagesByRecipient(ctx context.Context, recipientID
 
 // UpdateMessage updates a message
 func (s *PostgresStore) UpdateMessage(ctx context.Context, msg *VoiceMessage) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		UPDATE voice_messages
 		SET 
@@ -224,6 +330,9 @@ func (s *PostgresStore) UpdateMessage(ctx context.Context, msg *VoiceMessage) er
 
 // UpdateMessageStatus updates just the status of a message
 func (s *PostgresStore) UpdateMessageStatus(ctx context.Context, id uuid.UUID, status string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `UPDATE voice_messages SET status = $2 WHERE id = $1`
 
 	result, err := s.db.Exec(ctx, query, id, status)
@@ -238,8 +347,98 @@ func (s *PostgresStore) UpdateMessageStatus(ctx context.Context, id uuid.UUID, s
 	return nil
 }
 
+// MarkMessageDelivered sets a message delivered, leaving its other columns as they are
+func (s *PostgresStore) MarkMessageDelivered(ctx context.Context, id uuid.UUID, deliveredAt time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE voice_messages SET status = $2, delivered_at = $3 WHERE id = $1`
+
+	result, err := s.db.Exec(ctx, query, id, MessageStatusDelivered, deliveredAt)
+	if err != nil {
+		return fmt.Errorf("failed to mark message delivered: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("message not found")
+	}
+
+	return nil
+}
+
+// FinalizeMessage marks a pending message as transmitted once its file is in place.
+// Only pending messages are touched, so a message can't be finalized twice
+func (s *PostgresStore) FinalizeMessage(ctx context.Context, id uuid.UUID, fileSize int, audioFormat string, totalChunks int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE voice_messages
+		SET
+			file_size = $2,
+			audio_format = $3,
+			total_chunks = $4,
+			chunks_received = $4,
+			status = $5,
+			transmitted_at = $6
+		WHERE id = $1 AND status = $7
+	`
+
+	result, err := s.db.Exec(ctx, query,
+		id,
+		fileSize,
+		audioFormat,
+		totalChunks,
+		MessageStatusTransmitted,
+		time.Now(),
+		MessageStatusPending,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to finalize message: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("pending message not found")
+	}
+
+	return nil
+}
+
+// ArchiveMessage moves a received message out of the inbox
+func (s *PostgresStore) ArchiveMessage(ctx context.Context, id, recipientID uuid.UUID) error {
+	return s.setArchived(ctx, id, recipientID, true)
+}
+
+// UnarchiveMessage moves an archived message back to the inbox
+func (s *PostgresStore) UnarchiveMessage(ctx context.Context, id, recipientID uuid.UUID) error {
+	return s.setArchived(ctx, id, recipientID, false)
+}
+
+// setArchived files a message in a folder. Only its recipient can,
+// for anyone else the message is not found
+func (s *PostgresStore) setArchived(ctx context.Context, id, recipientID uuid.UUID, archived bool) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE voice_messages SET archived = $3 WHERE id = $1 AND recipient_id = $2`
+
+	result, err := s.db.Exec(ctx, query, id, recipientID, archived)
+	if err != nil {
+		return fmt.Errorf("failed to update message folder: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("message not found")
+	}
+
+	return nil
+}
+
 // DeleteMessage deletes a message
 func (s *PostgresStore) DeleteMessage(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `DELETE FROM voice_messages WHERE id = $1`
 
 	result, err := s.db.Exec(ctx, query, id)
@@ -253,3 +452,77 @@ func (s *PostgresStore) DeleteMessage(ctx context.Context, id uuid.UUID) error {
 
 	return nil
 }
+
+// GetMessagesByIDs retrieves the messages among ids that were sent to recipientID.
+// IDs of other people's messages are skipped
+func (s *PostgresStore) GetMessagesByIDs(ctx context.Context, ids []uuid.UUID, recipientID uuid.UUID) ([]*VoiceMessage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT
+			id, sender_id, recipient_id, file_path, file_size,
+			duration_seconds, audio_format, total_chunks, chunks_received,
+			status, created_at, transmitted_at, delivered_at, listened_at,
+			original_file_path, archived, compressed
+		FROM voice_messages
+		WHERE id = ANY($1) AND recipient_id = $2
+	`
+
+	rows, err := s.db.Query(ctx, query, ids, recipientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []*VoiceMessage{}
+	for rows.Next() {
+		msg, err := scanVoiceMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// DeleteMessages deletes the messages among ids that were sent to ownerID in one statement
+// and returns how many were deleted. IDs of other people's messages are skipped
+func (s *PostgresStore) DeleteMessages(ctx context.Context, ids []uuid.UUID, ownerID uuid.UUID) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM voice_messages WHERE id = ANY($1) AND recipient_id = $2`
+
+	result, err := s.db.Exec(ctx, query, ids, ownerID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete messages: %w", err)
+	}
+
+	return int(result.RowsAffected()), nil
+}
+
+// MessageFileExists checks whether any message points at the given storage object,
+// either as its stored file or as the original it was transcoded from
+func (s *PostgresStore) MessageFileExists(ctx context.Context, filePath string) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM voice_messages WHERE file_path = $1 OR original_file_path = $1
+		)
+	`
+
+	var exists bool
+	if err := s.db.QueryRow(ctx, query, filePath).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check message file: %w", err)
+	}
+
+	return exists, nil
+}
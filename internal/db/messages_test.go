@@ -0,0 +1,348 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+// messageColumns are the columns every message query selects, in scan order
+var messageColumns = []string{
+	"id", "sender_id", "recipient_id", "file_path", "file_size",
+	"duration_seconds", "audio_format", "total_chunks", "chunks_received",
+	"status", "created_at", "transmitted_at", "delivered_at", "listened_at",
+	"original_file_path", "archived", "compressed",
+}
+
+func newMockStore(t *testing.T) (*PostgresStore, pgxmock.PgxPoolIface) {
+	t.Helper()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		mock.Close()
+	})
+
+	return NewPostgresStore(mock, time.Second), mock
+}
+
+// messageRow returns the row of a stored message as the columns above
+func messageRow(msg *VoiceMessage) []any {
+	return []any{
+		msg.ID, msg.SenderID, msg.RecipientID, msg.FilePath, msg.FileSize,
+		msg.DurationSecs, msg.AudioFormat, msg.TotalChunks, msg.ChunksReceived,
+		msg.Status, msg.CreatedAt, msg.TransmittedAt, msg.DeliveredAt, msg.ListenedAt,
+		msg.OriginalFilePath, msg.Archived, msg.Compressed,
+	}
+}
+
+func TestCreateMessage(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	duration := 12
+	msg := &VoiceMessage{
+		ID:           uuid.New(),
+		SenderID:     uuid.New(),
+		RecipientID:  uuid.New(),
+		FilePath:     "voice/2026/16/10/message.opus",
+		FileSize:     4096,
+		DurationSecs: &duration,
+		AudioFormat:  "opus",
+		TotalChunks:  3,
+		Status:       MessageStatusTransmitted,
+		CreatedAt:    time.Now(),
+	}
+
+	mock.ExpectExec("INSERT INTO voice_messages").
+		WithArgs(
+			msg.ID, msg.SenderID, msg.RecipientID, msg.FilePath, msg.FileSize,
+			msg.DurationSecs, msg.AudioFormat, msg.TotalChunks, msg.ChunksReceived,
+			msg.Status, msg.CreatedAt, msg.OriginalFilePath, msg.Compressed,
+		).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	if err := store.CreateMessage(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateMessageFillsIDAndCreatedAt(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectExec("INSERT INTO voice_messages").
+		WithArgs(
+			pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(),
+			pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(),
+			pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(),
+		).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	msg := &VoiceMessage{SenderID: uuid.New(), RecipientID: uuid.New()}
+	if err := store.CreateMessage(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID == uuid.Nil || msg.CreatedAt.IsZero() {
+		t.Fatal("ID and creation time were not filled in")
+	}
+}
+
+func TestGetMessageByID(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	// Delivered but not listened, so one nullable timestamp of each kind
+	created := time.Now().Add(-time.Hour).UTC().Truncate(time.Microsecond)
+	delivered := created.Add(time.Minute)
+	want := &VoiceMessage{
+		ID:             uuid.New(),
+		SenderID:       uuid.New(),
+		RecipientID:    uuid.New(),
+		FilePath:       "voice/message.opus",
+		FileSize:       2048,
+		AudioFormat:    "opus",
+		TotalChunks:    2,
+		ChunksReceived: 2,
+		Status:         MessageStatusDelivered,
+		CreatedAt:      created,
+		TransmittedAt:  &created,
+		DeliveredAt:    &delivered,
+	}
+
+	mock.ExpectQuery("SELECT .+ FROM voice_messages WHERE id = \\$1").
+		WithArgs(want.ID).
+		WillReturnRows(pgxmock.NewRows(messageColumns).AddRow(messageRow(want)...))
+
+	got, err := store.GetMessageByID(context.Background(), want.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID != want.ID || got.Status != want.Status || got.FileSize != want.FileSize || !got.CreatedAt.Equal(created) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got.DeliveredAt == nil || !got.DeliveredAt.Equal(delivered) {
+		t.Fatalf("delivered_at = %v, want %v", got.DeliveredAt, delivered)
+	}
+	if got.ListenedAt != nil || got.DurationSecs != nil || got.OriginalFilePath != nil {
+		t.Fatal("NULL columns scanned as values")
+	}
+}
+
+func TestGetMessageByIDNotFound(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	id := uuid.New()
+	mock.ExpectQuery("SELECT .+ FROM voice_messages WHERE id = \\$1").
+		WithArgs(id).
+		WillReturnError(pgx.ErrNoRows)
+
+	_, err := store.GetMessageByID(context.Background(), id)
+	if err == nil || err.Error() != "message not found" {
+		t.Fatalf("got %v, want message not found", err)
+	}
+}
+
+func TestGetMessagesByRecipient(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	recipientID := uuid.New()
+	newer := &VoiceMessage{ID: uuid.New(), RecipientID: recipientID, Status: MessageStatusTransmitted, CreatedAt: time.Now()}
+	older := &VoiceMessage{ID: uuid.New(), RecipientID: recipientID, Status: MessageStatusListened, CreatedAt: time.Now().Add(-time.Hour)}
+
+	mock.ExpectQuery("FROM voice_messages\\s+WHERE recipient_id = \\$1 AND archived = \\$2").
+		WithArgs(recipientID, true, MessageStatusPending, MessageStatusQuarantined, 20, 40).
+		WillReturnRows(pgxmock.NewRows(messageColumns).
+			AddRow(messageRow(newer)...).
+			AddRow(messageRow(older)...))
+
+	messages, err := store.GetMessagesByRecipient(context.Background(), recipientID, FolderArchived, 20, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID != newer.ID || messages[1].ID != older.ID {
+		t.Fatalf("got %d messages out of order", len(messages))
+	}
+}
+
+func TestGetMessagesByRecipientEmpty(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	recipientID := uuid.New()
+	mock.ExpectQuery("FROM voice_messages\\s+WHERE recipient_id = \\$1 AND archived = \\$2").
+		WithArgs(recipientID, false, MessageStatusPending, MessageStatusQuarantined, 20, 0).
+		WillReturnRows(pgxmock.NewRows(messageColumns))
+
+	messages, err := store.GetMessagesByRecipient(context.Background(), recipientID, FolderInbox, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Encoded as [] rather than null by the API
+	if messages == nil || len(messages) != 0 {
+		t.Fatalf("got %v, want an empty list", messages)
+	}
+}
+
+func TestGetMessagesByRecipientHidesHeldBackMessages(t *testing.T) {
+	for _, folder := range []string{FolderInbox, FolderArchived} {
+		t.Run(folder, func(t *testing.T) {
+			store, mock := newMockStore(t)
+
+			// Quarantined and half-uploaded messages never reach the recipient, in either folder
+			recipientID := uuid.New()
+			mock.ExpectQuery("WHERE recipient_id = \\$1 AND archived = \\$2 AND status NOT IN \\(\\$3, \\$4\\)").
+				WithArgs(recipientID, folder == FolderArchived, MessageStatusPending, MessageStatusQuarantined, 20, 0).
+				WillReturnRows(pgxmock.NewRows(messageColumns))
+
+			if _, err := store.GetMessagesByRecipient(context.Background(), recipientID, folder, 20, 0); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	recipientID, senderID := uuid.New(), uuid.New()
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 7)
+
+	// Held back messages are hidden whatever the filter, the rest goes in as numbered arguments
+	const hidden = "recipient_id = \\$1 AND status NOT IN \\(\\$2, \\$3\\)"
+
+	tests := []struct {
+		name   string
+		filter SearchFilter
+		where  string
+		args   []any
+	}{
+		{"no filter", SearchFilter{Limit: 20}, hidden + "\\s+ORDER BY created_at DESC\\s+LIMIT \\$4 OFFSET \\$5", nil},
+		{"sender", SearchFilter{SenderID: &senderID, Limit: 20}, hidden + " AND sender_id = \\$4\\s", []any{senderID}},
+		{"status", SearchFilter{Status: MessageStatusListened, Limit: 20}, hidden + " AND status = \\$4\\s", []any{MessageStatusListened}},
+		{"range", SearchFilter{CreatedAfter: &from, CreatedBefore: &to, Limit: 20}, hidden + " AND created_at >= \\$4 AND created_at < \\$5\\s", []any{from, to}},
+		{
+			"everything",
+			SearchFilter{SenderID: &senderID, Status: MessageStatusDelivered, CreatedAfter: &from, CreatedBefore: &to, Limit: 20, Offset: 40},
+			hidden + " AND sender_id = \\$4 AND status = \\$5 AND created_at >= \\$6 AND created_at < \\$7\\s+ORDER BY created_at DESC\\s+LIMIT \\$8 OFFSET \\$9",
+			[]any{senderID, MessageStatusDelivered, from, to},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, mock := newMockStore(t)
+
+			args := append([]any{recipientID, MessageStatusPending, MessageStatusQuarantined}, tt.args...)
+			args = append(args, tt.filter.Limit, tt.filter.Offset)
+
+			found := &VoiceMessage{ID: uuid.New(), SenderID: senderID, RecipientID: recipientID, Status: MessageStatusDelivered, CreatedAt: from}
+			mock.ExpectQuery(tt.where).
+				WithArgs(args...).
+				WillReturnRows(pgxmock.NewRows(messageColumns).AddRow(messageRow(found)...))
+
+			messages, err := store.SearchMessages(context.Background(), recipientID, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 || messages[0].ID != found.ID {
+				t.Fatalf("got %d messages, want the one found", len(messages))
+			}
+		})
+	}
+}
+
+func TestUpdateMessage(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	now := time.Now()
+	msg := &VoiceMessage{
+		ID:             uuid.New(),
+		ChunksReceived: 4,
+		Status:         MessageStatusListened,
+		TransmittedAt:  &now,
+		DeliveredAt:    &now,
+		ListenedAt:     &now,
+	}
+
+	mock.ExpectExec("UPDATE voice_messages").
+		WithArgs(msg.ID, msg.ChunksReceived, msg.Status, msg.TransmittedAt, msg.DeliveredAt, msg.ListenedAt).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	if err := store.UpdateMessage(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateMessageNotFound(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	msg := &VoiceMessage{ID: uuid.New(), Status: MessageStatusDelivered}
+	mock.ExpectExec("UPDATE voice_messages").
+		WithArgs(msg.ID, 0, msg.Status, msg.TransmittedAt, msg.DeliveredAt, msg.ListenedAt).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+
+	err := store.UpdateMessage(context.Background(), msg)
+	if err == nil || err.Error() != "message not found" {
+		t.Fatalf("got %v, want message not found", err)
+	}
+}
+
+func TestUpdateMessageStatus(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	id := uuid.New()
+	mock.ExpectExec("UPDATE voice_messages SET status = \\$2 WHERE id = \\$1").
+		WithArgs(id, MessageStatusFailed).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec("UPDATE voice_messages SET status = \\$2 WHERE id = \\$1").
+		WithArgs(id, MessageStatusFailed).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+
+	if err := store.UpdateMessageStatus(context.Background(), id, MessageStatusFailed); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateMessageStatus(context.Background(), id, MessageStatusFailed); err == nil || err.Error() != "message not found" {
+		t.Fatalf("got %v, want message not found", err)
+	}
+}
+
+func TestMarkMessageDelivered(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	id := uuid.New()
+	deliveredAt := time.Now()
+	// Only status and delivered_at are written, chunks_received, transmitted_at and listened_at stay as stored
+	mock.ExpectExec("UPDATE voice_messages SET status = \\$2, delivered_at = \\$3 WHERE id = \\$1$").
+		WithArgs(id, MessageStatusDelivered, deliveredAt).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec("UPDATE voice_messages SET status = \\$2, delivered_at = \\$3 WHERE id = \\$1$").
+		WithArgs(id, MessageStatusDelivered, deliveredAt).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+
+	if err := store.MarkMessageDelivered(context.Background(), id, deliveredAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkMessageDelivered(context.Background(), id, deliveredAt); err == nil || err.Error() != "message not found" {
+		t.Fatalf("got %v, want message not found", err)
+	}
+}
+
+func TestFinalizeMessageOnlyTouchesPending(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	id := uuid.New()
+	mock.ExpectExec("UPDATE voice_messages").
+		WithArgs(id, 4096, "opus", 3, MessageStatusTransmitted, pgxmock.AnyArg(), MessageStatusPending).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+
+	err := store.FinalizeMessage(context.Background(), id, 4096, "opus", 3)
+	if err == nil || err.Error() != "pending message not found" {
+		t.Fatalf("got %v, want pending message not found", err)
+	}
+}
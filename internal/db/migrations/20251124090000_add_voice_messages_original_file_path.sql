@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE voice_messages ADD COLUMN original_file_path TEXT;
+CREATE INDEX idx_voice_messages_original_file_path ON voice_messages(original_file_path);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_voice_messages_original_file_path;
+ALTER TABLE voice_messages DROP COLUMN IF EXISTS original_file_path;
+-- +goose StatementEnd
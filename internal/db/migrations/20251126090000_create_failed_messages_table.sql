@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE failed_messages (
+  message_id UUID PRIMARY KEY,
+  sender_id UUID NOT NULL,
+  recipient_id UUID NOT NULL,
+  total_chunks INTEGER NOT NULL,
+  reason TEXT NOT NULL,
+  failed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+
+  CONSTRAINT fk_failed_messages_sender FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+  CONSTRAINT fk_failed_messages_recipient FOREIGN KEY (recipient_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_failed_messages_sender ON failed_messages(sender_id, failed_at DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_failed_messages_sender;
+DROP TABLE IF EXISTS failed_messages;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE voice_messages ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE INDEX idx_voice_messages_recipient_archived ON voice_messages(recipient_id, archived, created_at DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_voice_messages_recipient_archived;
+ALTER TABLE voice_messages DROP COLUMN IF EXISTS archived;
+-- +goose StatementEnd
@@ -7,12 +7,17 @@ import (
 )
 
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        uuid.UUID  `json:"id"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email"`
+	Password  string     `json:"password"`
+	Role      string     `json:"role"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// EmailVerified is set once the user followed the link sent on signup
+	EmailVerified bool `json:"email_verified"`
 }
 
 type VoiceMessage struct {
@@ -30,12 +35,57 @@ type VoiceMessage struct {
 	TransmittedAt  *time.Time `json:"transmitted_at,omitempty"`
 	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
 	ListenedAt     *time.Time `json:"listened_at,omitempty"`
+
+	// OriginalFilePath is set when the stored file was transcoded from an upload in another format
+	OriginalFilePath *string `json:"original_file_path,omitempty"`
+
+	// Archived messages are kept out of the inbox
+	Archived bool `json:"archived"`
+
+	// Compressed files are stored zstd-compressed and must be decompressed before use
+	Compressed bool `json:"compressed"`
 }
 
+// User roles, carried in access tokens
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 const (
 	MessageStatusPending     = "pending"
 	MessageStatusTransmitted = "transmitted"
 	MessageStatusDelivered   = "delivered"
 	MessageStatusListened    = "listened"
 	MessageStatusFailed      = "failed"
+
+	// MessageStatusQuarantined marks messages from non-contacts
+	// held back by the contact policy
+	MessageStatusQuarantined = "quarantined"
 )
+
+// SearchFilter narrows down a search over received messages. Zero fields don't filter
+type SearchFilter struct {
+	SenderID      *uuid.UUID
+	Status        string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Limit         int
+	Offset        int
+}
+
+// Folders a recipient's messages are listed from
+const (
+	FolderInbox    = "inbox"
+	FolderArchived = "archived"
+)
+
+// FailedMessage is a dead-lettered message that could not be processed
+type FailedMessage struct {
+	MessageID   uuid.UUID `json:"message_id"`
+	SenderID    uuid.UUID `json:"sender_id"`
+	RecipientID uuid.UUID `json:"recipient_id"`
+	TotalChunks int       `json:"total_chunks"`
+	Reason      string    `json:"reason"`
+	FailedAt    time.Time `json:"failed_at"`
+}
@@ -2,14 +2,32 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rx3lixir/laba/pkg/retry"
 )
 
+// connectPolicy retries reaching the database, which may still be starting up
+var connectPolicy = retry.Policy{
+	MaxAttempts: 5,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+// beginPolicy retries starting a transaction when the connection failed before anything was sent
+var beginPolicy = retry.Policy{
+	MaxAttempts: 3,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    500 * time.Millisecond,
+	Retryable:   pgconn.SafeToRetry,
+}
+
 // DBTX is an interface for database operations
 // it allows to swap between pool and transactions
 type DBTX interface {
@@ -23,9 +41,15 @@ type UserStore interface {
 	CreateUser(ctx context.Context, user *User) error
 	GetUserByID(ctx context.Context, id uuid.UUID) (*User, error)
 	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
 	GetUsers(ctx context.Context, limit, offset int) ([]*User, error)
+	CountUsers(ctx context.Context) (int, error)
 	UpdateUser(ctx context.Context, user *User) error
+	UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error
+	MarkEmailVerified(ctx context.Context, id uuid.UUID, email string) error
 	DeleteUser(ctx context.Context, id uuid.UUID) error
+	RestoreUser(ctx context.Context, id uuid.UUID) error
+	GetUsername(ctx context.Context, id uuid.UUID) (string, error)
 }
 
 // MessageStore defines all voice message-related database operations
@@ -33,35 +57,132 @@ type MessageStore interface {
 	CreateMessage(ctx context.Context, msg *VoiceMessage) error
 	GetMessageByID(ctx context.Context, id uuid.UUID) (*VoiceMessage, error)
 	GetMessagesBySender(ctx context.Context, senderID uuid.UUID, limit, offset int) ([]*VoiceMessage, error)
-	GetMessagesByRecipient(ctx context.Context, recipientID uuid.UUID, limit, offset int) ([]*VoiceMessage, error)
+	GetMessagesByRecipient(ctx context.Context, recipientID uuid.UUID, folder string, limit, offset int) ([]*VoiceMessage, error)
+	GetUndeliveredMessages(ctx context.Context, recipientID uuid.UUID, limit int) ([]*VoiceMessage, error)
+	SearchMessages(ctx context.Context, recipientID uuid.UUID, filter SearchFilter) ([]*VoiceMessage, error)
 	UpdateMessage(ctx context.Context, msg *VoiceMessage) error
 	UpdateMessageStatus(ctx context.Context, id uuid.UUID, status string) error
+	MarkMessageDelivered(ctx context.Context, id uuid.UUID, deliveredAt time.Time) error
+	ArchiveMessage(ctx context.Context, id, recipientID uuid.UUID) error
+	UnarchiveMessage(ctx context.Context, id, recipientID uuid.UUID) error
+	FinalizeMessage(ctx context.Context, id uuid.UUID, fileSize int, audioFormat string, totalChunks int) error
 	DeleteMessage(ctx context.Context, id uuid.UUID) error
+	GetMessagesByIDs(ctx context.Context, ids []uuid.UUID, recipientID uuid.UUID) ([]*VoiceMessage, error)
+	DeleteMessages(ctx context.Context, ids []uuid.UUID, ownerID uuid.UUID) (int, error)
+	MessageFileExists(ctx context.Context, filePath string) (bool, error)
+	RecordFailedMessage(ctx context.Context, msg *FailedMessage) error
+	GetFailedMessage(ctx context.Context, messageID uuid.UUID) (*FailedMessage, error)
+	GetFailedMessagesBySender(ctx context.Context, senderID uuid.UUID, limit, offset int) ([]*FailedMessage, error)
+	DeleteFailedMessage(ctx context.Context, messageID uuid.UUID) error
+	WithTx(ctx context.Context, fn func(tx MessageStore) error) error
+}
+
+// ContactStore defines all contact-related database operations
+type ContactStore interface {
+	AddContact(ctx context.Context, userID, contactID uuid.UUID) error
+	RemoveContact(ctx context.Context, userID, contactID uuid.UUID) error
+	IsContact(ctx context.Context, userID, contactID uuid.UUID) (bool, error)
+	ListContacts(ctx context.Context, userID uuid.UUID, limit, offset int) ([]*User, error)
+}
+
+// BlockStore defines all block list database operations
+type BlockStore interface {
+	Block(ctx context.Context, blockerID, blockedID uuid.UUID) error
+	Unblock(ctx context.Context, blockerID, blockedID uuid.UUID) error
+	IsBlocked(ctx context.Context, blockerID, blockedID uuid.UUID) (bool, error)
 }
 
 // PostgresStore is a main database store
 type PostgresStore struct {
-	db DBTX
+	db      DBTX
+	timeout time.Duration
 }
 
-// NewPostgresStore creates a new store
-func NewPostgresStore(db DBTX) *PostgresStore {
+// NewPostgresStore creates a new store.
+// Every query is cut off after timeout, zero leaves only the caller's deadline
+func NewPostgresStore(db DBTX, timeout time.Duration) *PostgresStore {
 	return &PostgresStore{
-		db: db,
+		db:      db,
+		timeout: timeout,
+	}
+}
+
+// withTimeout bounds a single query by the store timeout.
+// The caller must defer cancel so it only runs once the query is done
+func (s *PostgresStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// txBeginner is implemented by pools and by transactions, the latter using savepoints
+type txBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// WithTx runs fn with a store bound to a single transaction.
+// The transaction is committed if fn succeeds and rolled back otherwise
+func (s *PostgresStore) WithTx(ctx context.Context, fn func(tx MessageStore) error) error {
+	beginner, ok := s.db.(txBeginner)
+	if !ok {
+		return fmt.Errorf("store does not support transactions")
 	}
+
+	var tx pgx.Tx
+	err := retry.Do(ctx, beginPolicy, func() error {
+		var err error
+		tx, err = beginner.Begin(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// No-op once the transaction is committed
+	defer tx.Rollback(ctx)
+
+	if err := fn(NewPostgresStore(tx, s.timeout)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
 }
 
-// CreatePostgresPool creates and pings a connection pool
-func CreatePostgresPool(parentCtx context.Context, dburl string) (*pgxpool.Pool, error) {
-	ctx, cancel := context.WithTimeout(parentCtx, time.Second*3)
-	defer cancel()
+// uniqueViolation reports whether err is a unique constraint violation
+// and returns the name of the violated constraint
+func uniqueViolation(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return pgErr.ConstraintName, true
+	}
+	return "", false
+}
+
+// CreatePostgresPool creates and pings a connection pool. A non-nil tracer sees every query.
+// The ping is retried for a while, each attempt bounded on its own
+func CreatePostgresPool(parentCtx context.Context, dburl string, tracer pgx.QueryTracer) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(dburl)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ConnConfig.Tracer = tracer
 
-	pool, err := pgxpool.New(ctx, dburl)
+	pool, err := pgxpool.NewWithConfig(parentCtx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = pool.Ping(ctx); err != nil {
+	err = retry.Do(parentCtx, connectPolicy, func() error {
+		ctx, cancel := context.WithTimeout(parentCtx, time.Second*3)
+		defer cancel()
+
+		return pool.Ping(ctx)
+	})
+	if err != nil {
 		pool.Close()
 		return nil, err
 	}
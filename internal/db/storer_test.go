@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+// anyArgs matches n arguments of any value
+func anyArgs(n int) []any {
+	args := make([]any, n)
+	for i := range args {
+		args[i] = pgxmock.AnyArg()
+	}
+	return args
+}
+
+func TestWithTxCommits(t *testing.T) {
+	store, mock := newMockStore(t)
+	id := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO voice_messages").WithArgs(anyArgs(13)...).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec("UPDATE voice_messages SET status").
+		WithArgs(id, MessageStatusDelivered).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectCommit()
+
+	err := store.WithTx(context.Background(), func(tx MessageStore) error {
+		if err := tx.CreateMessage(context.Background(), &VoiceMessage{ID: id, Status: MessageStatusTransmitted}); err != nil {
+			return err
+		}
+		return tx.UpdateMessageStatus(context.Background(), id, MessageStatusDelivered)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithTxRollsBackMidTransactionFailure(t *testing.T) {
+	store, mock := newMockStore(t)
+	id := uuid.New()
+	failure := errors.New("connection reset")
+
+	// The insert went through, the update after it fails: nothing may be committed
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO voice_messages").WithArgs(anyArgs(13)...).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec("UPDATE voice_messages SET status").
+		WithArgs(id, MessageStatusDelivered).
+		WillReturnError(failure)
+	mock.ExpectRollback()
+
+	err := store.WithTx(context.Background(), func(tx MessageStore) error {
+		if err := tx.CreateMessage(context.Background(), &VoiceMessage{ID: id, Status: MessageStatusTransmitted}); err != nil {
+			return err
+		}
+		return tx.UpdateMessageStatus(context.Background(), id, MessageStatusDelivered)
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("got %v, want the failed update", err)
+	}
+}
+
+func TestWithTxRollsBackFailedCommit(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO voice_messages").WithArgs(anyArgs(13)...).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit().WillReturnError(errors.New("serialization failure"))
+	mock.ExpectRollback()
+
+	err := store.WithTx(context.Background(), func(tx MessageStore) error {
+		return tx.CreateMessage(context.Background(), &VoiceMessage{ID: uuid.New()})
+	})
+	if err == nil {
+		t.Fatal("failed commit was reported as success")
+	}
+}
+
+func TestSlowQueryIsCancelledAtTimeout(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	const timeout = 50 * time.Millisecond
+	store := NewPostgresStore(mock, timeout)
+
+	id := uuid.New()
+	mock.ExpectExec("UPDATE voice_messages SET status").
+		WithArgs(id, MessageStatusFailed).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1)).
+		WillDelayFor(time.Second)
+
+	start := time.Now()
+	err = store.UpdateMessageStatus(context.Background(), id, MessageStatusFailed)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("slow query succeeded past the timeout")
+	}
+	if elapsed < timeout || elapsed > 10*timeout {
+		t.Fatalf("query gave up after %v, want about %v", elapsed, timeout)
+	}
+}
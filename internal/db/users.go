@@ -12,28 +12,41 @@ import (
 
 // CreateUser adds a new user to db
 func (s *PostgresStore) CreateUser(ctx context.Context, user *User) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-		INSERT INTO users (id, username, email, password, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO users (id, username, email, password)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, role, email_verified, created_at, updated_at
 	`
-	user.ID = uuid.New()
-	now := time.Now()
-
-	user.CreatedAt = now
-	user.UpdatedAt = now
 
-	_, err := s.db.Exec(ctx, query,
-		user.ID,
+	// Timestamps come back from the database so they match later reads exactly
+	err := s.db.QueryRow(ctx, query,
+		uuid.New(),
 		user.Username,
 		user.Email,
 		user.Password,
-		user.CreatedAt,
-		user.UpdatedAt,
+	).Scan(
+		&user.ID,
+		&user.Role,
+		&user.EmailVerified,
+		&user.CreatedAt,
+		&user.UpdatedAt,
 	)
 	if err != nil {
 		if ctx.Err() != nil {
 			return fmt.Errorf("operation cancelled: %w", ctx.Err())
 		}
+		if constraint, ok := uniqueViolation(err); ok {
+			switch constraint {
+			case "users_email_key":
+				return fmt.Errorf("user with this email already exists")
+			case "users_username_key":
+				return fmt.Errorf("user with this username already exists")
+			}
+			return fmt.Errorf("user already exists")
+		}
 		return fmt.Errorf("failed to create user: %w", err)
 	}
 
@@ -42,10 +55,13 @@ func (s *PostgresStore) CreateUser(ctx context.Context, user *User) error {
 
 // GetUserByID retrieves a user by ID
 func (s *PostgresStore) GetUserByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-		SELECT id, username, email, password, created_at, updated_at
+		SELECT id, username, email, password, role, email_verified, created_at, updated_at
 		FROM users
-		WHERE id = $1
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 	user := &User{}
 	err := s.db.QueryRow(ctx, query, id).Scan(
@@ -53,6 +69,8 @@ func (s *PostgresStore) GetUserByID(ctx context.Context, id uuid.UUID) (*User, e
 		&user.Username,
 		&user.Email,
 		&user.Password,
+		&user.Role,
+		&user.EmailVerified,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -68,10 +86,13 @@ func (s *PostgresStore) GetUserByID(ctx context.Context, id uuid.UUID) (*User, e
 
 // GetUserByEmail retrieves a user by email
 func (s *PostgresStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-		SELECT id, username, email, password, created_at, updated_at
+		SELECT id, username, email, password, role, email_verified, created_at, updated_at
 		FROM users
-		WHERE email = $1
+		WHERE email = $1 AND deleted_at IS NULL
 	`
 	user := &User{}
 	err := s.db.QueryRow(ctx, query, email).Scan(
@@ -79,6 +100,39 @@ func (s *PostgresStore) GetUserByEmail(ctx context.Context, email string) (*User
 		&user.Username,
 		&user.Email,
 		&user.Password,
+		&user.Role,
+		&user.EmailVerified,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return user, nil
+}
+
+// GetUserByUsername retrieves a user by username, ignoring case
+func (s *PostgresStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		SELECT id, username, email, password, role, email_verified, created_at, updated_at
+		FROM users
+		WHERE LOWER(username) = LOWER($1) AND deleted_at IS NULL
+	`
+	user := &User{}
+	err := s.db.QueryRow(ctx, query, username).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.Password,
+		&user.Role,
+		&user.EmailVerified,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -94,10 +148,14 @@ func (s *PostgresStore) GetUserByEmail(ctx context.Context, email string) (*User
 
 // GetUsers retrieves all users with pagination
 func (s *PostgresStore) GetUsers(ctx context.Context, limit, offset int) ([]*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		SELECT id, username, email, created_at, updated_at
 		FROM users
-		ORDER BY created_at DESC
+		WHERE deleted_at IS NULL
+		ORDER BY created_at DESC, id
 		LIMIT $1 OFFSET $2
 	`
 
@@ -130,25 +188,77 @@ func (s *PostgresStore) GetUsers(ctx context.Context, limit, offset int) ([]*Use
 	return users, nil
 }
 
-// UpdateUser updates an existing user
+// CountUsers returns the total number of users
+func (s *PostgresStore) CountUsers(ctx context.Context) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var count int
+	if err := s.db.QueryRow(ctx, `SELECT COUNT(*) FROM users WHERE deleted_at IS NULL`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	return count, nil
+}
+
+// UpdateUser updates an existing user.
+// Changing the email resets its verification, EmailVerified is refreshed from the row
 func (s *PostgresStore) UpdateUser(ctx context.Context, user *User) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 		UPDATE users
-		SET username = $2, email = $3, updated_at = $4
-		WHERE id = $1
+		SET username = $2,
+			email = $3,
+			email_verified = email_verified AND email = $3,
+			updated_at = $4
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING email_verified
 	`
 	user.UpdatedAt = time.Now()
 
-	result, err := s.db.Exec(ctx, query,
+	err := s.db.QueryRow(ctx, query,
 		user.ID,
 		user.Username,
 		user.Email,
 		user.UpdatedAt,
-	)
+	).Scan(&user.EmailVerified)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("user not found")
+		}
+		if constraint, ok := uniqueViolation(err); ok {
+			switch constraint {
+			case "users_email_key":
+				return fmt.Errorf("user with this email already exists")
+			case "users_username_key":
+				return fmt.Errorf("user with this username already exists")
+			}
+			return fmt.Errorf("user already exists")
+		}
 		return fmt.Errorf("failed to update user: %w", err)
 	}
 
+	return nil
+}
+
+// UpdatePassword replaces the password hash of a user
+func (s *PostgresStore) UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE users
+		SET password = $2, updated_at = $3
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+
+	result, err := s.db.Exec(ctx, query, id, passwordHash, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
 	if result.RowsAffected() == 0 {
 		return fmt.Errorf("user not found")
 	}
@@ -156,11 +266,43 @@ func (s *PostgresStore) UpdateUser(ctx context.Context, user *User) error {
 	return nil
 }
 
-// DeleteUser deletes a user by ID
+// MarkEmailVerified records that a user confirmed their email address.
+// It only applies while the user still has the email the confirmation was sent to
+func (s *PostgresStore) MarkEmailVerified(ctx context.Context, id uuid.UUID, email string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE users
+		SET email_verified = TRUE, updated_at = $3
+		WHERE id = $1 AND email = $2 AND deleted_at IS NULL
+	`
+
+	result, err := s.db.Exec(ctx, query, id, email, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("user not found or email changed since the token was issued")
+	}
+
+	return nil
+}
+
+// DeleteUser soft-deletes a user. The row is kept so their
+// messages stay intact and their username can still be shown
 func (s *PostgresStore) DeleteUser(ctx context.Context, id uuid.UUID) error {
-	query := `DELETE FROM users WHERE id = $1`
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 
-	result, err := s.db.Exec(ctx, query, id)
+	query := `
+		UPDATE users
+		SET deleted_at = $2
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+
+	result, err := s.db.Exec(ctx, query, id, time.Now())
 	if err != nil {
 		return fmt.Errorf("failed to delete user: %w", err)
 	}
@@ -171,3 +313,44 @@ func (s *PostgresStore) DeleteUser(ctx context.Context, id uuid.UUID) error {
 
 	return nil
 }
+
+// RestoreUser brings back a soft-deleted user
+func (s *PostgresStore) RestoreUser(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE users
+		SET deleted_at = NULL, updated_at = $2
+		WHERE id = $1 AND deleted_at IS NOT NULL
+	`
+
+	result, err := s.db.Exec(ctx, query, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to restore user: %w", err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("deleted user not found")
+	}
+
+	return nil
+}
+
+// GetUsername returns the username of a user, deleted or not.
+// It is meant for showing who sent older messages
+func (s *PostgresStore) GetUsername(ctx context.Context, id uuid.UUID) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var username string
+	err := s.db.QueryRow(ctx, `SELECT username FROM users WHERE id = $1`, id).Scan(&username)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", fmt.Errorf("user not found")
+		}
+		return "", fmt.Errorf("failed to get username: %w", err)
+	}
+
+	return username, nil
+}
@@ -0,0 +1,215 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+// userColumns are the columns every user query selects, in scan order
+var userColumns = []string{
+	"id", "username", "email", "password", "role", "email_verified", "created_at", "updated_at",
+}
+
+// userRow returns the row of a stored user as the columns above
+func userRow(user *User) []any {
+	return []any{
+		user.ID, user.Username, user.Email, user.Password, user.Role,
+		user.EmailVerified, user.CreatedAt, user.UpdatedAt,
+	}
+}
+
+func TestGetUserByUsernameIgnoresCase(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	user := &User{
+		ID:        uuid.New(),
+		Username:  "Alice",
+		Email:     "alice@example.com",
+		Role:      RoleUser,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	// Both sides are lowered in SQL, the name is passed as typed
+	mock.ExpectQuery(`WHERE LOWER\(username\) = LOWER\(\$1\) AND deleted_at IS NULL`).
+		WithArgs("aLICE").
+		WillReturnRows(pgxmock.NewRows(userColumns).AddRow(userRow(user)...))
+
+	got, err := store.GetUserByUsername(context.Background(), "aLICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID || got.Username != "Alice" {
+		t.Fatalf("got %s %q, want %s %q", got.ID, got.Username, user.ID, user.Username)
+	}
+}
+
+// liveContextDB fails the test if a query's context is already done when its row is read
+type liveContextDB struct {
+	DBTX
+	t *testing.T
+}
+
+func (d liveContextDB) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return liveContextRow{Row: d.DBTX.QueryRow(ctx, sql, args...), ctx: ctx, t: d.t}
+}
+
+type liveContextRow struct {
+	pgx.Row
+	ctx context.Context
+	t   *testing.T
+}
+
+func (r liveContextRow) Scan(dest ...any) error {
+	if err := r.ctx.Err(); err != nil {
+		r.t.Errorf("row read with a finished context: %v", err)
+	}
+	if _, ok := r.ctx.Deadline(); !ok {
+		r.t.Error("query runs without a timeout")
+	}
+	return r.Row.Scan(dest...)
+}
+
+func TestCreateUserIsNotCancelled(t *testing.T) {
+	_, mock := newMockStore(t)
+	store := NewPostgresStore(liveContextDB{DBTX: mock, t: t}, time.Second)
+
+	now := time.Now()
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs(pgxmock.AnyArg(), "alice", "alice@example.com", "hash").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "role", "email_verified", "created_at", "updated_at"}).
+			AddRow(uuid.New(), RoleUser, false, now, now))
+
+	user := &User{Username: "alice", Email: "alice@example.com", Password: "hash"}
+	if err := store.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == uuid.Nil || user.Role != RoleUser || !user.CreatedAt.Equal(now) {
+		t.Fatalf("created user %+v was not filled in", user)
+	}
+}
+
+func TestCreateUserRoundTripsUsername(t *testing.T) {
+	store, mock := newMockStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	id := uuid.New()
+
+	mock.ExpectQuery(`INSERT INTO users \(id, username, email, password\)`).
+		WithArgs(pgxmock.AnyArg(), "Alice_1", "alice@example.com", "hash").
+		WillReturnRows(pgxmock.NewRows([]string{"id", "role", "email_verified", "created_at", "updated_at"}).
+			AddRow(id, RoleUser, false, now, now))
+
+	user := &User{Username: "Alice_1", Email: "alice@example.com", Password: "hash"}
+	if err := store.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != id {
+		t.Fatalf("created user has id %v, want %v", user.ID, id)
+	}
+
+	mock.ExpectQuery(`SELECT id, username, email`).
+		WithArgs(id).
+		WillReturnRows(pgxmock.NewRows(userColumns).AddRow(userRow(user)...))
+
+	got, err := store.GetUserByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "Alice_1" {
+		t.Fatalf("username %q, want %q", got.Username, "Alice_1")
+	}
+}
+
+func TestCreateUserDuplicateUsername(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectQuery("INSERT INTO users").
+		WithArgs(pgxmock.AnyArg(), "alice", "alice@example.com", "hash").
+		WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "users_username_key"})
+
+	err := store.CreateUser(context.Background(), &User{Username: "alice", Email: "alice@example.com", Password: "hash"})
+	if err == nil || err.Error() != "user with this username already exists" {
+		t.Fatalf("got %v, want a duplicate username error", err)
+	}
+}
+
+func TestGetUsersPageAndCount(t *testing.T) {
+	store, mock := newMockStore(t)
+	ctx := context.Background()
+
+	mock.ExpectQuery(`LIMIT \$1 OFFSET \$2`).
+		WithArgs(2, 4).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "created_at", "updated_at"}).
+			AddRow(uuid.New(), "eve", "eve@example.com", time.Now(), time.Now()))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM users WHERE deleted_at IS NULL`).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(5))
+
+	users, err := store.GetUsers(ctx, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Username != "eve" {
+		t.Fatalf("got %v, want the last user", users)
+	}
+
+	count, err := store.CountUsers(ctx)
+	if err != nil || count != 5 {
+		t.Fatalf("count %d, %v, want 5", count, err)
+	}
+}
+
+func TestSoftDeletedUser(t *testing.T) {
+	store, mock := newMockStore(t)
+	ctx := context.Background()
+	id := uuid.New()
+
+	mock.ExpectExec(`UPDATE users\s+SET deleted_at = \$2\s+WHERE id = \$1 AND deleted_at IS NULL`).
+		WithArgs(id, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	if err := store.DeleteUser(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lookups and lists skip the deleted row
+	mock.ExpectQuery(`WHERE id = \$1 AND deleted_at IS NULL`).
+		WithArgs(id).
+		WillReturnError(pgx.ErrNoRows)
+	if _, err := store.GetUserByID(ctx, id); err == nil || err.Error() != "user not found" {
+		t.Fatalf("got %v, want user not found", err)
+	}
+	mock.ExpectQuery(`FROM users\s+WHERE deleted_at IS NULL`).
+		WithArgs(10, 0).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "username", "email", "created_at", "updated_at"}))
+	if users, err := store.GetUsers(ctx, 10, 0); err != nil || len(users) != 0 {
+		t.Fatalf("listed %v, %v", users, err)
+	}
+
+	// Older messages still show who sent them
+	mock.ExpectQuery(`SELECT username FROM users WHERE id = \$1$`).
+		WithArgs(id).
+		WillReturnRows(pgxmock.NewRows([]string{"username"}).AddRow("alice"))
+	if name, err := store.GetUsername(ctx, id); err != nil || name != "alice" {
+		t.Fatalf("username %q, %v", name, err)
+	}
+
+	// Deleting twice finds nothing, restoring brings it back once
+	mock.ExpectExec(`SET deleted_at = \$2`).
+		WithArgs(id, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	if err := store.DeleteUser(ctx, id); err == nil {
+		t.Fatal("deleted a user twice")
+	}
+	mock.ExpectExec(`SET deleted_at = NULL.*WHERE id = \$1 AND deleted_at IS NOT NULL`).
+		WithArgs(id, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	if err := store.RestoreUser(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Handles listing every user with a live UDP session. Admin only
+func (s *Server) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := GetUserIDFromContext(r.Context())
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleListSessions",
+		"admin_id", adminID,
+	)
+
+	// Sessions live only in valkey
+	if !s.sessionManager.Healthy() {
+		s.respondError(w, http.StatusServiceUnavailable, "Sessions are temporarily unavailable")
+		return
+	}
+
+	onlineUsers, err := s.sessionManager.GetOnlineUsers(r.Context())
+	if err != nil {
+		s.logFor(r).Error("Failed to list online users", "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to list sessions")
+		return
+	}
+
+	sessions := make([]SessionInfo, 0, len(onlineUsers))
+	for _, userID := range onlineUsers {
+		// The session may have expired since it was listed
+		sess, err := s.sessionManager.GetSession(r.Context(), userID)
+		if err != nil {
+			continue
+		}
+
+		info := SessionInfo{
+			UserID:      sess.UserID,
+			Username:    sess.Username,
+			Address:     sess.Address,
+			ConnectedAt: sess.ConnectAt,
+			Encrypted:   sess.Encrypted,
+		}
+
+		seen, err := s.sessionManager.GetLastSeen(r.Context(), userID)
+		if err != nil {
+			s.logFor(r).Warn("Failed to get last seen", "user_id", userID, "error", err)
+		} else {
+			info.LastSeen = seen
+		}
+
+		sessions = append(sessions, info)
+	}
+
+	s.respondJSON(w, http.StatusOK, ListSessionsResponse{Sessions: sessions})
+}
+
+// UserDisconnecter drops in-process connection state of a user whose session was deleted
+type UserDisconnecter interface {
+	DisconnectUser(userID uuid.UUID)
+}
+
+// Handles forcibly disconnecting a user: their session is dropped and
+// every token issued to them so far is revoked. Admin only
+func (s *Server) HandleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := GetUserIDFromContext(r.Context())
+
+	userID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid user ID format")
+		return
+	}
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleDeleteSession",
+		"admin_id", adminID,
+		"user_id", userID,
+	)
+
+	if err := s.sessionManager.DeleteSession(r.Context(), userID); err != nil {
+		s.logFor(r).Error("Failed to delete session", "user_id", userID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to delete session")
+		return
+	}
+
+	// Without this the user could sign straight back in with the tokens they hold
+	if err := s.sessionManager.RevokeUserTokens(r.Context(), userID, s.jwtService.RefreshTokenDuration()); err != nil {
+		s.logFor(r).Error("Failed to revoke tokens", "user_id", userID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to revoke tokens")
+		return
+	}
+
+	// The UDP server keeps secure channel keys in process, they would still open the user's packets
+	if disconnecter, ok := s.forwarder.(UserDisconnecter); ok {
+		disconnecter.DisconnectUser(userID)
+	}
+
+	s.logFor(r).Warn("Session purged by admin", "user_id", userID, "admin_id", adminID)
+
+	s.respondJSON(w, http.StatusOK, DeleteSessionResponse{
+		Message: "Session deleted",
+		UserID:  userID,
+	})
+}
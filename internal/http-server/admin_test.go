@@ -0,0 +1,109 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+)
+
+func TestAdminRoutesRequireAdmin(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	user := ts.addUser(t, "alice", db.RoleUser)
+
+	routes := []struct {
+		method, path string
+	}{
+		{http.MethodGet, "/api/admin/sessions"},
+		{http.MethodDelete, "/api/admin/sessions/" + user.ID.String()},
+		{http.MethodPost, "/api/admin/messages/failed/" + uuid.NewString() + "/retry"},
+	}
+
+	for _, route := range routes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			if rec := ts.do(route.method, route.path, "", nil, ts.token(t, user)); rec.Code != http.StatusForbidden {
+				t.Errorf("user: status %d, want %d", rec.Code, http.StatusForbidden)
+			}
+			if rec := ts.do(route.method, route.path, "", nil, ""); rec.Code != http.StatusUnauthorized {
+				t.Errorf("no token: status %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+
+	if _, err := ts.sessions.GetSession(t.Context(), user.ID); err == nil {
+		t.Fatal("a non-admin request created or kept a session")
+	}
+	if ts.valkey.Exists("tokens_revoked_at:" + user.ID.String()) {
+		t.Fatal("a non-admin request revoked tokens")
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	admin := ts.addUser(t, "admin", db.RoleAdmin)
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+
+	for i, user := range []*db.User{alice, bob} {
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000 + i}
+		if err := ts.sessions.CreateSession(t.Context(), user.ID, user.Username, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := ts.do(http.MethodGet, "/api/admin/sessions", "", nil, ts.token(t, admin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp ListSessionsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, sess := range resp.Sessions {
+		names = append(names, sess.Username)
+		if sess.Address == "" || sess.ConnectedAt.IsZero() {
+			t.Errorf("session of %s without address or connect time: %+v", sess.Username, sess)
+		}
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"alice", "bob"}) {
+		t.Fatalf("listed sessions of %v, want alice and bob", names)
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	admin := ts.addUser(t, "admin", db.RoleAdmin)
+	alice := ts.addUser(t, "alice", db.RoleUser)
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	if err := ts.sessions.CreateSession(t.Context(), alice.ID, alice.Username, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := ts.do(http.MethodDelete, "/api/admin/sessions/"+alice.ID.String(), "", nil, ts.token(t, admin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	if _, err := ts.sessions.GetSession(t.Context(), alice.ID); err == nil {
+		t.Fatal("session kept after an admin deleted it")
+	}
+	if !ts.valkey.Exists("tokens_revoked_at:" + alice.ID.String()) {
+		t.Fatal("tokens not revoked")
+	}
+	if !slices.Contains(ts.forwarder.disconnected, alice.ID) {
+		t.Fatal("UDP state of the user was not dropped")
+	}
+
+	if rec := ts.do(http.MethodDelete, "/api/admin/sessions/not-a-uuid", "", nil, ts.token(t, admin)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid user ID: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
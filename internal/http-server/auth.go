@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/google/uuid"
 	"github.com/rx3lixir/laba/internal/db"
 	"github.com/rx3lixir/laba/pkg/password"
 )
@@ -17,7 +18,7 @@ func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.log.Info(
+	s.logFor(r).Info(
 		"Signup attempt",
 		"handler", "HandleSignup",
 		"email", req.Email,
@@ -29,7 +30,7 @@ func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 		Password: req.Password,
 	}); err != nil {
 		s.handleError(w, err)
-		s.log.Error("Signup validation failed", "email", req.Email, "error", err)
+		s.logFor(r).Error("Signup validation failed", "email", req.Email, "error", err)
 		return
 	}
 
@@ -39,9 +40,9 @@ func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hashedPassword, err := password.Hash(req.Password)
+	hashedPassword, err := s.hasher.Hash(req.Password)
 	if err != nil {
-		s.log.Error("Failed to hash password", "error", err)
+		s.logFor(r).Error("Failed to hash password", "error", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to process password")
 		return
 	}
@@ -53,21 +54,26 @@ func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := s.userStore.CreateUser(r.Context(), newUser); err != nil {
-		s.log.Error("Failed to create user", "error", err)
-		s.respondError(w, http.StatusInternalServerError, "Failed to create user")
+		s.logFor(r).Error("Failed to create user", "error", err)
+		s.handleError(w, err)
 		return
 	}
 
-	accessToken, err := s.jwtService.GenerateAccessToken(newUser.ID, newUser.Email, newUser.Username)
+	// The account is usable without a verified email, so a mailing failure doesn't fail the signup
+	if err := s.sendVerification(r.Context(), newUser); err != nil {
+		s.logFor(r).Error("Failed to send verification email", "user_id", newUser.ID, "error", err)
+	}
+
+	accessToken, err := s.jwtService.GenerateAccessToken(newUser.ID, newUser.Email, newUser.Username, newUser.Role)
 	if err != nil {
-		s.log.Error("Failed to generate access token", "error", err)
+		s.logFor(r).Error("Failed to generate access token", "error", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to generate pair of tokens")
 		return
 	}
 
 	refreshToken, err := s.jwtService.GenerateRefreshToken(newUser.ID)
 	if err != nil {
-		s.log.Error("Failed to generate refresh token", "error", err)
+		s.logFor(r).Error("Failed to generate refresh token", "error", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to generate tokens")
 		return
 	}
@@ -85,7 +91,7 @@ func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 		TokenType:    "Bearer",
 	}
 
-	s.log.Info(
+	s.logFor(r).Info(
 		"User signed up successfully",
 		"user_id", newUser.ID,
 		"email", newUser.Email,
@@ -102,7 +108,7 @@ func (s *Server) HandleSignin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.log.Info(
+	s.logFor(r).Info(
 		"Signin attempt",
 		"handler", "HandleSignin",
 		"email", req.Email,
@@ -119,27 +125,35 @@ func (s *Server) HandleSignin(w http.ResponseWriter, r *http.Request) {
 
 	user, err := s.userStore.GetUserByEmail(r.Context(), strings.ToLower(strings.TrimSpace(req.Email)))
 	if err != nil {
-		s.log.Warn("Signin failed - user not found", "email", req.Email)
+		// Spend the same time as a real check so response times don't reveal which emails exist
+		s.hasher.CompareDummy(req.Password)
+
+		s.logFor(r).Warn("Signin failed - user not found", "email", req.Email)
 		s.respondError(w, http.StatusUnauthorized, "Invalid email or password")
 		return
 	}
 
-	if !password.Verify(req.Password, user.Password) {
-		s.log.Warn("Signin failed - password is invalid", "email", req.Email)
+	if err := password.Verify(user.Password, req.Password); err != nil {
+		s.logFor(r).Warn("Signin failed - password is invalid", "email", req.Email)
 		s.respondError(w, http.StatusUnauthorized, "Invalid email or password")
 		return
 	}
 
-	accessToken, err := s.jwtService.GenerateAccessToken(user.ID, user.Email, user.Username)
+	// Upgrade hashes made with an older cost while the plaintext is at hand
+	if s.hasher.NeedsRehash(user.Password) {
+		s.rehashPassword(r, user.ID, req.Password)
+	}
+
+	accessToken, err := s.jwtService.GenerateAccessToken(user.ID, user.Email, user.Username, user.Role)
 	if err != nil {
-		s.log.Error("Failed to generate access token", "error", err)
+		s.logFor(r).Error("Failed to generate access token", "error", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to generate tokens")
 		return
 	}
 
 	refreshToken, err := s.jwtService.GenerateRefreshToken(user.ID)
 	if err != nil {
-		s.log.Error("Failed to generate refresh token", "error", err)
+		s.logFor(r).Error("Failed to generate refresh token", "error", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to generate tokens")
 		return
 	}
@@ -157,10 +171,27 @@ func (s *Server) HandleSignin(w http.ResponseWriter, r *http.Request) {
 		TokenType:    "Bearer",
 	}
 
-	s.log.Info("User signed in successfully", "user_id", user.ID, "email", user.Email)
+	s.logFor(r).Info("User signed in successfully", "user_id", user.ID, "email", user.Email)
 	s.respondJSON(w, http.StatusOK, response)
 }
 
+// rehashPassword stores a fresh hash of a password. Failing here must not
+// block the login, the upgrade is simply tried again next time
+func (s *Server) rehashPassword(r *http.Request, userID uuid.UUID, plain string) {
+	hashedPassword, err := s.hasher.Hash(plain)
+	if err != nil {
+		s.logFor(r).Warn("Failed to rehash password", "user_id", userID, "error", err)
+		return
+	}
+
+	if err := s.userStore.UpdatePassword(r.Context(), userID, hashedPassword); err != nil {
+		s.logFor(r).Warn("Failed to store rehashed password", "user_id", userID, "error", err)
+		return
+	}
+
+	s.logFor(r).Info("Password hash upgraded", "user_id", userID)
+}
+
 // HandleRefreshToken generates new tokens using a refresh token
 func (s *Server) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
 	req := new(RefreshTokenRequest)
@@ -169,7 +200,7 @@ func (s *Server) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.log.Info("Token refresh attempt", "handler", "HandleRefreshToken")
+	s.logFor(r).Info("Token refresh attempt", "handler", "HandleRefreshToken")
 
 	if req.RefreshToken == "" {
 		s.respondError(w, http.StatusBadRequest, "Refresh token is required")
@@ -177,30 +208,43 @@ func (s *Server) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate refresh token
-	userID, err := s.jwtService.ValidateRefreshToken(req.RefreshToken)
+	refreshClaims, err := s.jwtService.ValidateRefreshToken(req.RefreshToken)
 	if err != nil {
-		s.log.Warn("Invalid refresh token", "error", err)
+		s.logFor(r).Warn("Invalid refresh token", "error", err)
+		s.respondError(w, http.StatusUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+
+	userID := refreshClaims.UserID
+
+	// Accepted when valkey is down, same as in AuthMiddleware
+	revoked, err := s.sessionManager.IsTokenRevoked(r.Context(), userID, refreshClaims.IssuedAt)
+	if err != nil {
+		s.logFor(r).Warn("Token revocation check unavailable, accepting refresh token", "user_id", userID, "error", err)
+	}
+	if revoked {
+		s.logFor(r).Warn("Revoked refresh token used", "user_id", userID)
 		s.respondError(w, http.StatusUnauthorized, "Invalid or expired refresh token")
 		return
 	}
 
 	user, err := s.userStore.GetUserByID(r.Context(), userID)
 	if err != nil {
-		s.log.Error("Failed to get user during token refresh operation", "user_id", userID, "error", err)
+		s.logFor(r).Error("Failed to get user during token refresh operation", "user_id", userID, "error", err)
 		s.respondError(w, http.StatusUnauthorized, "User not found")
 		return
 	}
 
-	newAccessToken, err := s.jwtService.GenerateAccessToken(userID, user.Email, user.Username)
+	newAccessToken, err := s.jwtService.GenerateAccessToken(userID, user.Email, user.Username, user.Role)
 	if err != nil {
-		s.log.Error("Failed to generate new access token", "error", err)
+		s.logFor(r).Error("Failed to generate new access token", "error", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to generate tokens")
 		return
 	}
 
 	newRefreshToken, err := s.jwtService.GenerateRefreshToken(userID)
 	if err != nil {
-		s.log.Error("Failed to generate new refresh token", "error", err)
+		s.logFor(r).Error("Failed to generate new refresh token", "error", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to generate tokens")
 		return
 	}
@@ -211,6 +255,6 @@ func (s *Server) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
 		TokenType:    "Bearer",
 	}
 
-	s.log.Info("Tokens refreshed successfully", "user_id", user.ID)
+	s.logFor(r).Info("Tokens refreshed successfully", "user_id", user.ID)
 	s.respondJSON(w, http.StatusOK, response)
 }
@@ -0,0 +1,140 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/pkg/password"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSignin(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+
+	rec := ts.doJSON(http.MethodPost, "/api/auth/signin", fmt.Sprintf(`{"email":" Alice@Example.com ","password":%q}`, testPassword), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp SigninResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.User.ID != alice.ID || resp.TokenType != "Bearer" {
+		t.Fatalf("signed in as %+v", resp.User)
+	}
+	claims, err := ts.jwt.ValidateToken(resp.AccessToken)
+	if err != nil || claims.UserID != alice.ID {
+		t.Fatalf("access token claims %+v, %v", claims, err)
+	}
+	refresh, err := ts.jwt.ValidateRefreshToken(resp.RefreshToken)
+	if err != nil || refresh.UserID != alice.ID {
+		t.Fatalf("refresh token claims %+v, %v", refresh, err)
+	}
+}
+
+func TestTokensCarryRole(t *testing.T) {
+	for _, role := range []string{db.RoleUser, db.RoleAdmin} {
+		t.Run(role, func(t *testing.T) {
+			ts := newTestServer(t, Options{})
+			ts.addUser(t, "alice", role)
+
+			rec := ts.doJSON(http.MethodPost, "/api/auth/signin", fmt.Sprintf(`{"email":"alice@example.com","password":%q}`, testPassword), "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("signin status %d: %s", rec.Code, rec.Body)
+			}
+			var signin SigninResponse
+			if err := json.NewDecoder(rec.Body).Decode(&signin); err != nil {
+				t.Fatal(err)
+			}
+			if claims, err := ts.jwt.ValidateToken(signin.AccessToken); err != nil || claims.Role != role {
+				t.Fatalf("signin token claims %+v, %v, want role %s", claims, err, role)
+			}
+
+			// A refreshed token keeps the role of the user record
+			rec = ts.doJSON(http.MethodPost, "/api/auth/refresh", fmt.Sprintf(`{"refresh_token":%q}`, signin.RefreshToken), "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("refresh status %d: %s", rec.Code, rec.Body)
+			}
+			var refreshed RefreshTokenResponse
+			if err := json.NewDecoder(rec.Body).Decode(&refreshed); err != nil {
+				t.Fatal(err)
+			}
+			if claims, err := ts.jwt.ValidateToken(refreshed.AccessToken); err != nil || claims.Role != role {
+				t.Fatalf("refreshed token claims %+v, %v, want role %s", claims, err, role)
+			}
+		})
+	}
+}
+
+func TestSigninBadCredentials(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	ts.addUser(t, "alice", db.RoleUser)
+
+	wrongPassword := ts.doJSON(http.MethodPost, "/api/auth/signin", `{"email":"alice@example.com","password":"Wrong123!"}`, "")
+	unknownEmail := ts.doJSON(http.MethodPost, "/api/auth/signin", fmt.Sprintf(`{"email":"nobody@example.com","password":%q}`, testPassword), "")
+
+	for name, code := range map[string]int{"wrong password": wrongPassword.Code, "unknown email": unknownEmail.Code} {
+		if code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want %d", name, code, http.StatusUnauthorized)
+		}
+	}
+
+	// Both answers look the same so signin can't be used to find accounts
+	if wrongPassword.Body.String() != unknownEmail.Body.String() {
+		t.Fatalf("wrong password says %s, unknown email says %s", wrongPassword.Body, unknownEmail.Body)
+	}
+}
+
+// failingPasswordStore can't store password changes
+type failingPasswordStore struct {
+	*fakeUserStore
+}
+
+func (s failingPasswordStore) UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	return errors.New("database is read-only")
+}
+
+func TestSigninRehashesWeakPassword(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+
+	// The deployment raised the cost after alice signed up
+	stronger, err := password.NewHasher(bcrypt.MinCost + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Server = New("", *ts.options(), ts.users, ts.messages, ts.contacts, nil, ts.sessions, ts.objects, ts.forwarder, ts.jwt, stronger, ts.mailer, nil, ts.log)
+
+	body := fmt.Sprintf(`{"email":"alice@example.com","password":%q}`, testPassword)
+	if rec := ts.doJSON(http.MethodPost, "/api/auth/signin", body, ""); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	stored := ts.users.user(alice.ID).Password
+	if cost, _ := bcrypt.Cost([]byte(stored)); cost != bcrypt.MinCost+1 {
+		t.Fatalf("stored hash has cost %d, want %d", cost, bcrypt.MinCost+1)
+	}
+	if err := password.Verify(stored, testPassword); err != nil {
+		t.Fatal("upgraded hash doesn't verify")
+	}
+
+	// A failed upgrade doesn't stand in the way of the login
+	bob := ts.addUser(t, "bob", db.RoleUser)
+	ts.Server = New("", *ts.options(), failingPasswordStore{ts.users}, ts.messages, ts.contacts, nil, ts.sessions, ts.objects, ts.forwarder, ts.jwt, stronger, ts.mailer, nil, ts.log)
+
+	body = fmt.Sprintf(`{"email":"bob@example.com","password":%q}`, testPassword)
+	if rec := ts.doJSON(http.MethodPost, "/api/auth/signin", body, ""); rec.Code != http.StatusOK {
+		t.Fatalf("status %d with a failing upgrade: %s", rec.Code, rec.Body)
+	}
+	if ts.users.user(bob.ID).Password != bob.Password {
+		t.Fatal("bob's hash changed")
+	}
+}
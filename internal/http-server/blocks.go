@@ -0,0 +1,65 @@
+package httpserver
+
+import (
+	"net/http"
+)
+
+// Handles blocking a user for the calling user
+func (s *Server) HandleBlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, blockedID, ok := s.parseTargetUserRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleBlockUser",
+		"user_id", userID,
+		"blocked_id", blockedID,
+	)
+
+	if userID == blockedID {
+		s.respondError(w, http.StatusBadRequest, "You can't block yourself")
+		return
+	}
+
+	if _, err := s.userStore.GetUserByID(r.Context(), blockedID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if err := s.blockStore.Block(r.Context(), userID, blockedID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.logFor(r).Info("User blocked", "user_id", userID, "blocked_id", blockedID)
+	s.respondJSON(w, http.StatusCreated, BlockResponse{
+		Message: "User blocked successfully",
+		UserID:  blockedID,
+	})
+}
+
+// Handles unblocking a user for the calling user
+func (s *Server) HandleUnblockUser(w http.ResponseWriter, r *http.Request) {
+	userID, blockedID, ok := s.parseTargetUserRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleUnblockUser",
+		"user_id", userID,
+		"blocked_id", blockedID,
+	)
+
+	if err := s.blockStore.Unblock(r.Context(), userID, blockedID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.logFor(r).Info("User unblocked", "user_id", userID, "blocked_id", blockedID)
+	s.respondJSON(w, http.StatusOK, BlockResponse{
+		Message: "User unblocked successfully",
+		UserID:  blockedID,
+	})
+}
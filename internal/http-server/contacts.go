@@ -0,0 +1,116 @@
+package httpserver
+
+import (
+	"net/http"
+)
+
+// Handles listing the contacts of the calling user
+func (s *Server) HandleListContacts(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	limit, offset := parsePagination(r)
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleListContacts",
+		"user_id", userID,
+	)
+
+	contacts, err := s.contactStore.ListContacts(r.Context(), userID, limit, offset)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	contactResponses := make([]ContactInfo, 0, len(contacts))
+	for _, contact := range contacts {
+		// Last seen is a nicety, a contact is still listed without it
+		lastSeen, err := s.sessionManager.GetLastSeen(r.Context(), contact.ID)
+		if err != nil {
+			s.logFor(r).Warn("Failed to get last seen", "user_id", contact.ID, "error", err)
+		}
+
+		contactResponses = append(contactResponses, ContactInfo{
+			UserResponse: UserResponse{
+				ID:        contact.ID,
+				Username:  contact.Username,
+				Email:     contact.Email,
+				CreatedAt: contact.CreatedAt,
+				UpdatedAt: contact.UpdatedAt,
+			},
+			LastSeen: lastSeen,
+		})
+	}
+
+	response := ListContactsResponse{
+		Contacts: contactResponses,
+		Limit:    limit,
+		Offset:   offset,
+	}
+
+	s.respondJSON(w, http.StatusOK, response)
+}
+
+// Handles adding a user to the contacts of the calling user
+func (s *Server) HandleAddContact(w http.ResponseWriter, r *http.Request) {
+	userID, contactID, ok := s.parseTargetUserRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleAddContact",
+		"user_id", userID,
+		"contact_id", contactID,
+	)
+
+	if userID == contactID {
+		s.respondError(w, http.StatusBadRequest, "You can't add yourself as a contact")
+		return
+	}
+
+	// Make sure the contact actually exists
+	if _, err := s.userStore.GetUserByID(r.Context(), contactID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if err := s.contactStore.AddContact(r.Context(), userID, contactID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.logFor(r).Info("Contact added", "user_id", userID, "contact_id", contactID)
+	s.respondJSON(w, http.StatusCreated, ContactResponse{
+		Message:   "Contact added successfully",
+		ContactID: contactID,
+	})
+}
+
+// Handles removing a user from the contacts of the calling user
+func (s *Server) HandleRemoveContact(w http.ResponseWriter, r *http.Request) {
+	userID, contactID, ok := s.parseTargetUserRequest(w, r)
+	if !ok {
+		return
+	}
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleRemoveContact",
+		"user_id", userID,
+		"contact_id", contactID,
+	)
+
+	if err := s.contactStore.RemoveContact(r.Context(), userID, contactID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.logFor(r).Info("Contact removed", "user_id", userID, "contact_id", contactID)
+	s.respondJSON(w, http.StatusOK, ContactResponse{
+		Message:   "Contact removed successfully",
+		ContactID: contactID,
+	})
+}
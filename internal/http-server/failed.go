@@ -0,0 +1,96 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// MessageRetrier processes a dead-lettered message again
+type MessageRetrier interface {
+	RetryMessage(ctx context.Context, messageID uuid.UUID) error
+}
+
+// Handles listing the caller's messages that failed processing
+func (s *Server) HandleListFailedMessages(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	limit, offset := parsePagination(r)
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleListFailedMessages",
+		"user_id", userID,
+	)
+
+	failed, err := s.messageStore.GetFailedMessagesBySender(r.Context(), userID, limit, offset)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	messages := make([]FailedMessageInfo, 0, len(failed))
+	for _, msg := range failed {
+		messages = append(messages, FailedMessageInfo{
+			MessageID:   msg.MessageID,
+			RecipientID: msg.RecipientID,
+			Reason:      msg.Reason,
+			FailedAt:    msg.FailedAt,
+		})
+	}
+
+	s.respondJSON(w, http.StatusOK, ListFailedMessagesResponse{
+		Messages: messages,
+		Limit:    limit,
+		Offset:   offset,
+	})
+}
+
+// Handles an operator retrying a failed message. This only works while its chunks
+// are still buffered, the result is reported to the sender like any other message
+func (s *Server) HandleRetryFailedMessage(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	messageID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid message ID format")
+		return
+	}
+
+	retrier, ok := s.forwarder.(MessageRetrier)
+	if !ok {
+		s.respondError(w, http.StatusNotImplemented, "Retrying messages is not supported")
+		return
+	}
+
+	failed, err := s.messageStore.GetFailedMessage(r.Context(), messageID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if err := retrier.RetryMessage(r.Context(), messageID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.logFor(r).Info("Failed message retried",
+		"message_id", messageID,
+		"sender_id", failed.SenderID,
+		"admin_id", adminID,
+	)
+
+	s.respondJSON(w, http.StatusAccepted, RetryMessageResponse{
+		Message:   "Message queued for processing",
+		MessageID: messageID,
+	})
+}
@@ -0,0 +1,93 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+)
+
+// storeFailedMessage dead-letters a message from sender to recipient
+func (ts *testServer) storeFailedMessage(t *testing.T, sender, recipient *db.User) *db.FailedMessage {
+	t.Helper()
+
+	failed := &db.FailedMessage{
+		MessageID:   uuid.New(),
+		SenderID:    sender.ID,
+		RecipientID: recipient.ID,
+		Reason:      "upload failed",
+		FailedAt:    time.Now(),
+	}
+	if err := ts.messages.RecordFailedMessage(t.Context(), failed); err != nil {
+		t.Fatal(err)
+	}
+	return failed
+}
+
+func TestListFailedMessages(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+
+	own := ts.storeFailedMessage(t, alice, bob)
+	ts.storeFailedMessage(t, bob, alice)
+
+	rec := ts.do(http.MethodGet, "/api/messages/failed", "", nil, ts.token(t, alice))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp ListFailedMessagesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Messages) != 1 || resp.Messages[0].MessageID != own.MessageID || resp.Messages[0].Reason != own.Reason {
+		t.Fatalf("listed %+v, want only the caller's failed message", resp.Messages)
+	}
+}
+
+func TestRetryFailedMessage(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+	admin := ts.addUser(t, "admin", db.RoleAdmin)
+
+	failed := ts.storeFailedMessage(t, alice, bob)
+
+	tests := []struct {
+		name      string
+		token     string
+		messageID uuid.UUID
+		want      int
+	}{
+		// Retrying is an operator action, not even the sender may do it
+		{"sender", ts.token(t, alice), failed.MessageID, http.StatusForbidden},
+		{"unauthenticated", "", failed.MessageID, http.StatusUnauthorized},
+		{"unknown message", ts.token(t, admin), uuid.New(), http.StatusNotFound},
+		{"admin", ts.token(t, admin), failed.MessageID, http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ts.do(http.MethodPost, "/api/admin/messages/failed/"+tt.messageID.String()+"/retry", "", nil, tt.token)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+
+			retried := slices.Contains(ts.forwarder.retried, tt.messageID)
+			if retried != (tt.want == http.StatusAccepted) {
+				t.Fatalf("retried %v, want the message retried only when accepted", ts.forwarder.retried)
+			}
+		})
+	}
+
+	// The old per-user route is gone
+	rec := ts.do(http.MethodPost, "/api/messages/failed/"+failed.MessageID.String()+"/retry", "", nil, ts.token(t, alice))
+	if rec.Code != http.StatusNotFound && rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status %d on the user route, want it gone", rec.Code)
+	}
+}
@@ -0,0 +1,623 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/internal/session"
+	"github.com/rx3lixir/laba/pkg/jwt"
+	"github.com/rx3lixir/laba/pkg/password"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+	"github.com/valkey-io/valkey-go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPassword satisfies the password rules, every test user has it
+const testPassword = "Secret123!"
+
+// fakeUserStore keeps users in memory. Methods the tests don't reach are left to the embedded nil interface
+type fakeUserStore struct {
+	db.UserStore
+
+	mu    sync.Mutex
+	users map[uuid.UUID]*db.User
+}
+
+func newFakeUserStore() *fakeUserStore {
+	return &fakeUserStore{users: make(map[uuid.UUID]*db.User)}
+}
+
+// conflict returns the error the Postgres store gives for a taken email or username
+func (f *fakeUserStore) conflict(user *db.User) error {
+	for _, other := range f.users {
+		if other.ID == user.ID {
+			continue
+		}
+		if other.Email == user.Email {
+			return fmt.Errorf("user with this email already exists")
+		}
+		if strings.EqualFold(other.Username, user.Username) {
+			return fmt.Errorf("user with this username already exists")
+		}
+	}
+	return nil
+}
+
+func (f *fakeUserStore) CreateUser(ctx context.Context, user *db.User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.conflict(user); err != nil {
+		return err
+	}
+
+	user.ID = uuid.New()
+	if user.Role == "" {
+		user.Role = db.RoleUser
+	}
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+
+	stored := *user
+	f.users[user.ID] = &stored
+	return nil
+}
+
+func (f *fakeUserStore) GetUserByID(ctx context.Context, id uuid.UUID) (*db.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.users[id]
+	if !ok || user.DeletedAt != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (f *fakeUserStore) GetUserByEmail(ctx context.Context, email string) (*db.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, user := range f.users {
+		if user.Email == email && user.DeletedAt == nil {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, fmt.Errorf("user not found")
+}
+
+// GetUsers pages through live users newest first, like the Postgres store
+func (f *fakeUserStore) GetUsers(ctx context.Context, limit, offset int) ([]*db.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	users := make([]*db.User, 0, len(f.users))
+	for _, user := range f.users {
+		if user.DeletedAt == nil {
+			copied := *user
+			users = append(users, &copied)
+		}
+	}
+	slices.SortFunc(users, func(a, b *db.User) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID.String(), b.ID.String())
+	})
+
+	if offset >= len(users) {
+		return []*db.User{}, nil
+	}
+	return users[offset:min(offset+limit, len(users))], nil
+}
+
+func (f *fakeUserStore) CountUsers(ctx context.Context) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	count := 0
+	for _, user := range f.users {
+		if user.DeletedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (f *fakeUserStore) UpdateUser(ctx context.Context, user *db.User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, ok := f.users[user.ID]
+	if !ok || stored.DeletedAt != nil {
+		return fmt.Errorf("user not found")
+	}
+	if err := f.conflict(user); err != nil {
+		return err
+	}
+
+	stored.EmailVerified = stored.EmailVerified && stored.Email == user.Email
+	stored.Username = user.Username
+	stored.Email = user.Email
+	stored.UpdatedAt = time.Now()
+	user.EmailVerified = stored.EmailVerified
+	user.UpdatedAt = stored.UpdatedAt
+	return nil
+}
+
+func (f *fakeUserStore) UpdatePassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.users[id]
+	if !ok || user.DeletedAt != nil {
+		return fmt.Errorf("user not found")
+	}
+	user.Password = passwordHash
+	user.UpdatedAt = time.Now()
+	return nil
+}
+
+func (f *fakeUserStore) MarkEmailVerified(ctx context.Context, id uuid.UUID, email string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.users[id]
+	if !ok || user.DeletedAt != nil || user.Email != email {
+		return fmt.Errorf("user not found or email changed since the token was issued")
+	}
+	user.EmailVerified = true
+	user.UpdatedAt = time.Now()
+	return nil
+}
+
+func (f *fakeUserStore) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.users[id]
+	if !ok || user.DeletedAt != nil {
+		return fmt.Errorf("user not found")
+	}
+	now := time.Now()
+	user.DeletedAt = &now
+	return nil
+}
+
+// user returns a copy of a stored user, deleted or not, nil if there is none
+func (f *fakeUserStore) user(id uuid.UUID) *db.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	user, ok := f.users[id]
+	if !ok {
+		return nil
+	}
+	copied := *user
+	return &copied
+}
+
+// fakeMessageStore keeps messages in memory. Methods the tests don't reach are left to the embedded nil interface
+type fakeMessageStore struct {
+	db.MessageStore
+
+	mu       sync.Mutex
+	messages map[uuid.UUID]*db.VoiceMessage
+	failed   map[uuid.UUID]*db.FailedMessage
+}
+
+func newFakeMessageStore() *fakeMessageStore {
+	return &fakeMessageStore{
+		messages: make(map[uuid.UUID]*db.VoiceMessage),
+		failed:   make(map[uuid.UUID]*db.FailedMessage),
+	}
+}
+
+func (f *fakeMessageStore) CreateMessage(ctx context.Context, msg *db.VoiceMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.messages[msg.ID]; ok {
+		return fmt.Errorf("message already exists")
+	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	stored := *msg
+	f.messages[msg.ID] = &stored
+	return nil
+}
+
+func (f *fakeMessageStore) GetMessageByID(ctx context.Context, id uuid.UUID) (*db.VoiceMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, ok := f.messages[id]
+	if !ok {
+		return nil, fmt.Errorf("message not found")
+	}
+	copied := *msg
+	return &copied, nil
+}
+
+func (f *fakeMessageStore) UpdateMessageStatus(ctx context.Context, id uuid.UUID, status string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, ok := f.messages[id]
+	if !ok {
+		return fmt.Errorf("message not found")
+	}
+	msg.Status = status
+	return nil
+}
+
+func (f *fakeMessageStore) UpdateMessage(ctx context.Context, msg *db.VoiceMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.messages[msg.ID]; !ok {
+		return fmt.Errorf("message not found")
+	}
+	stored := *msg
+	f.messages[msg.ID] = &stored
+	return nil
+}
+
+func (f *fakeMessageStore) FinalizeMessage(ctx context.Context, id uuid.UUID, fileSize int, audioFormat string, totalChunks int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, ok := f.messages[id]
+	if !ok || msg.Status != db.MessageStatusPending {
+		return fmt.Errorf("message not found")
+	}
+
+	now := time.Now()
+	msg.FileSize = fileSize
+	msg.AudioFormat = audioFormat
+	msg.TotalChunks = totalChunks
+	msg.ChunksReceived = totalChunks
+	msg.Status = db.MessageStatusTransmitted
+	msg.TransmittedAt = &now
+	return nil
+}
+
+func (f *fakeMessageStore) SearchMessages(ctx context.Context, recipientID uuid.UUID, filter db.SearchFilter) ([]*db.VoiceMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	messages := []*db.VoiceMessage{}
+	for _, msg := range f.messages {
+		switch {
+		case msg.RecipientID != recipientID,
+			msg.Status == db.MessageStatusPending || msg.Status == db.MessageStatusQuarantined,
+			filter.SenderID != nil && msg.SenderID != *filter.SenderID,
+			filter.Status != "" && msg.Status != filter.Status,
+			filter.CreatedAfter != nil && msg.CreatedAt.Before(*filter.CreatedAfter),
+			filter.CreatedBefore != nil && !msg.CreatedAt.Before(*filter.CreatedBefore):
+			continue
+		}
+		copied := *msg
+		messages = append(messages, &copied)
+	}
+	return messages, nil
+}
+
+func (f *fakeMessageStore) GetMessagesByIDs(ctx context.Context, ids []uuid.UUID, recipientID uuid.UUID) ([]*db.VoiceMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var messages []*db.VoiceMessage
+	for _, id := range ids {
+		if msg, ok := f.messages[id]; ok && msg.RecipientID == recipientID {
+			copied := *msg
+			messages = append(messages, &copied)
+		}
+	}
+	return messages, nil
+}
+
+func (f *fakeMessageStore) DeleteMessages(ctx context.Context, ids []uuid.UUID, ownerID uuid.UUID) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	deleted := 0
+	for _, id := range ids {
+		if msg, ok := f.messages[id]; ok && msg.RecipientID == ownerID {
+			delete(f.messages, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (f *fakeMessageStore) RecordFailedMessage(ctx context.Context, msg *db.FailedMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored := *msg
+	f.failed[msg.MessageID] = &stored
+	return nil
+}
+
+func (f *fakeMessageStore) GetFailedMessage(ctx context.Context, messageID uuid.UUID) (*db.FailedMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	failed, ok := f.failed[messageID]
+	if !ok {
+		return nil, fmt.Errorf("failed message not found")
+	}
+	copied := *failed
+	return &copied, nil
+}
+
+func (f *fakeMessageStore) GetFailedMessagesBySender(ctx context.Context, senderID uuid.UUID, limit, offset int) ([]*db.FailedMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var failed []*db.FailedMessage
+	for _, msg := range f.failed {
+		if msg.SenderID == senderID {
+			copied := *msg
+			failed = append(failed, &copied)
+		}
+	}
+	return failed, nil
+}
+
+// message returns a copy of a stored message, nil if there is none
+func (f *fakeMessageStore) message(id uuid.UUID) *db.VoiceMessage {
+	msg, err := f.GetMessageByID(context.Background(), id)
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// count returns the number of stored messages
+func (f *fakeMessageStore) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.messages)
+}
+
+// fakeContactStore keeps contact lists in memory. Methods the tests don't reach are left to the embedded nil interface
+type fakeContactStore struct {
+	db.ContactStore
+
+	mu       sync.Mutex
+	contacts map[uuid.UUID]map[uuid.UUID]bool
+}
+
+func newFakeContactStore() *fakeContactStore {
+	return &fakeContactStore{contacts: make(map[uuid.UUID]map[uuid.UUID]bool)}
+}
+
+func (f *fakeContactStore) AddContact(ctx context.Context, userID, contactID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.contacts[userID] == nil {
+		f.contacts[userID] = make(map[uuid.UUID]bool)
+	}
+	f.contacts[userID][contactID] = true
+	return nil
+}
+
+func (f *fakeContactStore) IsContact(ctx context.Context, userID, contactID uuid.UUID) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.contacts[userID][contactID], nil
+}
+
+// fakeForwarder records the messages it was asked to push or retry and the users it disconnected
+type fakeForwarder struct {
+	mu           sync.Mutex
+	forwarded    []uuid.UUID
+	retried      []uuid.UUID
+	disconnected []uuid.UUID
+}
+
+func (f *fakeForwarder) ForwardMessage(messageID, senderID, recipientID uuid.UUID, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.forwarded = append(f.forwarded, messageID)
+}
+
+func (f *fakeForwarder) DisconnectUser(userID uuid.UUID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.disconnected = append(f.disconnected, userID)
+}
+
+func (f *fakeForwarder) RetryMessage(ctx context.Context, messageID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.retried = append(f.retried, messageID)
+	return nil
+}
+
+// sentMail is an email a fakeMailer was asked to send
+type sentMail struct {
+	to, subject, body string
+}
+
+// fakeMailer records emails instead of sending them
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+func (m *fakeMailer) Send(ctx context.Context, to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, sentMail{to: to, subject: subject, body: body})
+	return nil
+}
+
+// mails returns the emails sent so far
+func (m *fakeMailer) mails() []sentMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]sentMail(nil), m.sent...)
+}
+
+// testServer is a Server on fakes, with handles to reach into them
+type testServer struct {
+	*Server
+
+	users     *fakeUserStore
+	messages  *fakeMessageStore
+	contacts  *fakeContactStore
+	objects   *s3storage.MemoryStore
+	forwarder *fakeForwarder
+	mailer    *fakeMailer
+	sessions  *session.Manager
+	valkey    *miniredis.Miniredis
+	jwt       *jwt.Service
+}
+
+// newTestServer returns a server on in-memory stores and an in-process valkey
+func newTestServer(t *testing.T, opts Options) *testServer {
+	t.Helper()
+
+	hasher, err := password.NewHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, mr := newTestSessionManager(t)
+	ts := &testServer{
+		users:     newFakeUserStore(),
+		messages:  newFakeMessageStore(),
+		contacts:  newFakeContactStore(),
+		objects:   s3storage.NewMemoryStore(),
+		forwarder: &fakeForwarder{},
+		mailer:    &fakeMailer{},
+		sessions:  sessions,
+		valkey:    mr,
+		jwt:       jwt.NewService("test-secret", time.Hour, 24*time.Hour),
+	}
+	ts.Server = New("", opts, ts.users, ts.messages, ts.contacts, nil, sessions, ts.objects, ts.forwarder, ts.jwt, hasher, ts.mailer, nil, log.New(io.Discard))
+
+	return ts
+}
+
+// addUser stores a verified user with testPassword
+func (ts *testServer) addUser(t *testing.T, username, role string) *db.User {
+	t.Helper()
+
+	hash, err := ts.hasher.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &db.User{
+		Username:      username,
+		Email:         username + "@example.com",
+		Password:      hash,
+		Role:          role,
+		EmailVerified: true,
+	}
+	if err := ts.users.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// token returns an access token for user
+func (ts *testServer) token(t *testing.T, user *db.User) string {
+	t.Helper()
+
+	token, err := ts.jwt.GenerateAccessToken(user.ID, user.Email, user.Username, user.Role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// do sends a request through the full router. An empty token sends none
+func (ts *testServer) do(method, path, contentType string, body io.Reader, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	ts.httpServer.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// doJSON sends a JSON body through the full router
+func (ts *testServer) doJSON(method, path, body, token string) *httptest.ResponseRecorder {
+	return ts.do(method, path, "application/json", strings.NewReader(body), token)
+}
+
+// newTestSessionManager returns a session manager backed by an in-process valkey
+func newTestSessionManager(t *testing.T) (*session.Manager, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client, err := valkey.NewClient(valkey.ClientOption{
+		InitAddress:       []string{mr.Addr()},
+		DisableCache:      true,
+		ForceSingleClient: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := session.NewManagerWithClient(client, session.TTLOptions{})
+	t.Cleanup(m.Close)
+
+	return m, mr
+}
+
+// wavFile returns a 16-bit mono PCM WAV holding samples
+func wavFile(samples []int16) []byte {
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, samples)
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+data.Len()))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1))     // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1))     // mono
+	binary.Write(&buf, binary.LittleEndian, uint32(8000))  // sample rate
+	binary.Write(&buf, binary.LittleEndian, uint32(16000)) // byte rate
+	binary.Write(&buf, binary.LittleEndian, uint16(2))     // block align
+	binary.Write(&buf, binary.LittleEndian, uint16(16))    // bits per sample
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(data.Len()))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
@@ -0,0 +1,22 @@
+package httpserver
+
+import (
+	"net/http"
+)
+
+const (
+	readinessOK       = "ok"
+	readinessDegraded = "degraded"
+)
+
+// Handles readiness checks. The server keeps serving while valkey is down,
+// so it reports degraded instead of failing and load balancers keep routing to it
+func (s *Server) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := ReadinessResponse{Status: readinessOK, Valkey: "up"}
+	if err := s.sessionManager.Ping(r.Context()); err != nil {
+		s.logFor(r).Warn("Readiness check: valkey unavailable", "error", err)
+		resp = ReadinessResponse{Status: readinessDegraded, Valkey: "down"}
+	}
+
+	s.respondJSON(w, http.StatusOK, resp)
+}
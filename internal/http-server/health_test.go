@@ -0,0 +1,40 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestReadyzReportsValkeyOutage(t *testing.T) {
+	ts := newTestServer(t, Options{})
+
+	readiness := func() ReadinessResponse {
+		t.Helper()
+
+		rec := ts.do(http.MethodGet, "/readyz", "", nil, "")
+		// Degraded still serves, so load balancers keep routing to it
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d", rec.Code)
+		}
+		var resp ReadinessResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if got := readiness(); got.Status != readinessOK || got.Valkey != "up" {
+		t.Fatalf("readiness %+v with valkey up", got)
+	}
+
+	ts.valkey.SetError("valkey is down")
+	if got := readiness(); got.Status != readinessDegraded || got.Valkey != "down" {
+		t.Fatalf("readiness %+v during the outage", got)
+	}
+
+	ts.valkey.SetError("")
+	if got := readiness(); got.Status != readinessOK {
+		t.Fatalf("readiness %+v after recovery", got)
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 )
 
 // APIError represents the structure of error responses
@@ -31,6 +35,59 @@ func (s *Server) respondError(w http.ResponseWriter, status int, message string)
 	})
 }
 
+// parsePagination reads limit and offset query params, falling back to
+// defaults on missing or invalid values and capping the limit
+func parsePagination(r *http.Request) (int, int) {
+	limitQuery := r.URL.Query().Get("limit")
+	offsetQuery := r.URL.Query().Get("offset")
+
+	// Default values
+	limit := 10
+	offset := 0
+
+	if limitQuery != "" {
+		if parsedLimit, err := strconv.Atoi(limitQuery); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+			// To prevent abuse
+			if limit > 100 {
+				limit = 100
+			}
+		}
+	}
+
+	if offsetQuery != "" {
+		if parsedOffset, err := strconv.Atoi(offsetQuery); err == nil && parsedOffset >= 0 {
+			offset = parsedOffset
+		}
+	}
+
+	return limit, offset
+}
+
+// parseTargetUserRequest extracts the caller and the {id} of the user they act on,
+// writing an error response and returning false if either is missing
+func (s *Server) parseTargetUserRequest(w http.ResponseWriter, r *http.Request) (uuid.UUID, uuid.UUID, bool) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		s.respondError(w, http.StatusBadRequest, "User ID is required")
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	targetID, err := uuid.Parse(id)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid user ID format")
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	return userID, targetID, true
+}
+
 // handleError processes an error and sends the appropriate HTTP response
 // This centralizes your error handling logic
 func (s *Server) handleError(w http.ResponseWriter, err error) {
@@ -63,6 +120,11 @@ func (s *Server) handleError(w http.ResponseWriter, err error) {
 		return
 	}
 
+	if strings.Contains(errMsg, "already exists") {
+		s.respondError(w, http.StatusConflict, err.Error())
+		return
+	}
+
 	if strings.Contains(errMsg, "not found") {
 		s.respondError(w, http.StatusNotFound, err.Error())
 		return
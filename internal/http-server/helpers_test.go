@@ -0,0 +1,29 @@
+package httpserver
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePagination(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantLimit  int
+		wantOffset int
+	}{
+		{"", 10, 0},
+		{"?limit=25&offset=50", 25, 50},
+		{"?limit=100", 100, 0},
+		{"?limit=101", 100, 0},
+		{"?limit=0", 10, 0},
+		{"?limit=-5&offset=-1", 10, 0},
+		{"?limit=ten&offset=two", 10, 0},
+	}
+
+	for _, tt := range tests {
+		limit, offset := parsePagination(httptest.NewRequest("GET", "/api/user/"+tt.query, nil))
+		if limit != tt.wantLimit || offset != tt.wantOffset {
+			t.Errorf("%q: limit %d offset %d, want %d and %d", tt.query, limit, offset, tt.wantLimit, tt.wantOffset)
+		}
+	}
+}
@@ -0,0 +1,751 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/internal/udp"
+	"github.com/rx3lixir/laba/pkg/audio"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+	"github.com/rx3lixir/laba/pkg/webhook"
+)
+
+// defaultMaxUploadSize is used when no upload limit is configured
+const defaultMaxUploadSize = 10 << 20 // 10 MB
+
+// uploadURLExpiry is how long a presigned upload link stays valid
+const uploadURLExpiry = 15 * time.Minute
+
+// downloadURLExpiry is how long a presigned download link stays valid
+const downloadURLExpiry = 15 * time.Minute
+
+// maxDeleteBatch caps how many messages one delete request may name
+const maxDeleteBatch = 100
+
+// HandleUploadMessage accepts a voice message as a multipart form,
+// stores it and forwards it to the recipient if they are online
+func (s *Server) HandleUploadMessage(w http.ResponseWriter, r *http.Request) {
+	senderID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if !s.requireVerified(w, r, senderID) {
+		return
+	}
+
+	maxSize := s.options().MaxUploadSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxUploadSize
+	}
+
+	// Leave some room for the rest of the multipart form
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+
+	if err := r.ParseMultipartForm(maxSize); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.respondError(w, http.StatusRequestEntityTooLarge, "Audio file is too large")
+			return
+		}
+		s.respondError(w, http.StatusBadRequest, "Invalid multipart form")
+		return
+	}
+
+	recipientID, err := uuid.Parse(r.FormValue("recipient_id"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid recipient ID format")
+		return
+	}
+
+	s.logFor(r).Info(
+		"Received request",
+		"handler", "HandleUploadMessage",
+		"sender_id", senderID,
+		"recipient_id", recipientID,
+	)
+
+	file, header, err := r.FormFile("audio")
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Audio file is required")
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxSize {
+		s.respondError(w, http.StatusRequestEntityTooLarge, "Audio file is too large")
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		s.logFor(r).Error("Failed to read uploaded file", "error", err)
+		s.respondError(w, http.StatusBadRequest, "Failed to read audio file")
+		return
+	}
+
+	if int64(len(data)) > maxSize {
+		s.respondError(w, http.StatusRequestEntityTooLarge, "Audio file is too large")
+		return
+	}
+
+	if len(data) == 0 {
+		s.respondError(w, http.StatusBadRequest, "Audio file is empty")
+		return
+	}
+
+	audioFormat, err := audio.DetectFormat(data)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Unsupported audio format")
+		return
+	}
+
+	if err := s.validateAudio(data, audioFormat); err != nil {
+		s.logFor(r).Warn("Rejected invalid audio", "error", err)
+		s.respondError(w, http.StatusBadRequest, "Invalid audio file")
+		return
+	}
+
+	if _, err := s.userStore.GetUserByID(r.Context(), recipientID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	messageID := uuid.New()
+
+	objectPath, err := s.s3Client.UploadVoiceMessage(r.Context(), messageID, senderID, recipientID, data, audioFormat)
+	if err != nil {
+		s.logFor(r).Error("Failed to upload to s3", "message_id", messageID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to store audio file")
+		return
+	}
+
+	now := time.Now()
+	totalChunks := (len(data) + udp.MaxPayloadSize - 1) / udp.MaxPayloadSize
+
+	msg := &db.VoiceMessage{
+		ID:             messageID,
+		SenderID:       senderID,
+		RecipientID:    recipientID,
+		FilePath:       objectPath,
+		FileSize:       len(data),
+		AudioFormat:    audioFormat,
+		TotalChunks:    totalChunks,
+		ChunksReceived: totalChunks,
+		Status:         db.MessageStatusTransmitted,
+		CreatedAt:      now,
+		TransmittedAt:  &now,
+	}
+
+	if err := s.messageStore.CreateMessage(r.Context(), msg); err != nil {
+		s.logFor(r).Error("Failed to create message record", "message_id", messageID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to create message")
+		return
+	}
+
+	s.webhooks.Dispatch(webhook.NewEvent(webhook.EventReceived, msg.ID, msg.SenderID, msg.RecipientID))
+
+	// Push it over UDP if the recipient is online
+	s.forwarder.ForwardMessage(msg.ID, msg.SenderID, msg.RecipientID, data)
+
+	response := UploadMessageResponse{
+		ID:          msg.ID,
+		Status:      msg.Status,
+		FileSize:    msg.FileSize,
+		AudioFormat: msg.AudioFormat,
+		CreatedAt:   msg.CreatedAt,
+	}
+
+	s.logFor(r).Info(
+		"Message uploaded successfully",
+		"message_id", msg.ID,
+		"size", msg.FileSize,
+		"format", msg.AudioFormat,
+	)
+
+	s.respondJSON(w, http.StatusCreated, response)
+}
+
+// HandleCreateUploadURL hands out a presigned link to upload a voice message
+// straight to storage and creates the message as pending until the upload is completed
+func (s *Server) HandleCreateUploadURL(w http.ResponseWriter, r *http.Request) {
+	senderID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if !s.requireVerified(w, r, senderID) {
+		return
+	}
+
+	var req UploadURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	s.logFor(r).Info(
+		"Received request",
+		"handler", "HandleCreateUploadURL",
+		"sender_id", senderID,
+		"recipient_id", req.RecipientID,
+	)
+
+	switch req.AudioFormat {
+	case audio.FormatOpus, audio.FormatOgg, audio.FormatMP3, audio.FormatWAV:
+	default:
+		s.respondError(w, http.StatusBadRequest, "Unsupported audio format")
+		return
+	}
+
+	if _, err := s.userStore.GetUserByID(r.Context(), req.RecipientID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	uploader, ok := s.s3Client.(s3storage.DirectUploader)
+	if !ok {
+		s.respondError(w, http.StatusNotImplemented, "Direct uploads are not supported by this storage backend")
+		return
+	}
+
+	messageID := uuid.New()
+
+	uploadURL, objectPath, err := uploader.GetPresignedPutURL(r.Context(), messageID, req.AudioFormat, uploadURLExpiry)
+	if err != nil {
+		s.logFor(r).Error("Failed to create upload url", "message_id", messageID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to create upload url")
+		return
+	}
+
+	msg := &db.VoiceMessage{
+		ID:          messageID,
+		SenderID:    senderID,
+		RecipientID: req.RecipientID,
+		FilePath:    objectPath,
+		AudioFormat: req.AudioFormat,
+		Status:      db.MessageStatusPending,
+	}
+
+	if err := s.messageStore.CreateMessage(r.Context(), msg); err != nil {
+		s.logFor(r).Error("Failed to create message record", "message_id", messageID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to create message")
+		return
+	}
+
+	s.respondJSON(w, http.StatusCreated, UploadURLResponse{
+		MessageID: messageID,
+		UploadURL: uploadURL,
+		ExpiresAt: time.Now().Add(uploadURLExpiry),
+	})
+}
+
+// HandleCompleteUpload finalizes a message uploaded through a presigned link.
+// The stored file is checked the same way a regular upload is
+func (s *Server) HandleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	senderID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	messageID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid message ID format")
+		return
+	}
+
+	msg, err := s.messageStore.GetMessageByID(r.Context(), messageID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if msg.SenderID != senderID {
+		s.respondError(w, http.StatusNotFound, "Message not found")
+		return
+	}
+
+	if msg.Status != db.MessageStatusPending {
+		s.respondError(w, http.StatusConflict, "Message is already completed")
+		return
+	}
+
+	info, err := s.s3Client.GetObjectInfo(r.Context(), msg.FilePath)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Audio file has not been uploaded")
+		return
+	}
+
+	maxSize := s.options().MaxUploadSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxUploadSize
+	}
+
+	if info.Size == 0 || info.Size > maxSize {
+		s.rejectUpload(r, msg, "audio file is empty or too large")
+		s.respondError(w, http.StatusRequestEntityTooLarge, "Audio file is empty or too large")
+		return
+	}
+
+	data, err := s.s3Client.DownloadVoiceMessage(r.Context(), msg.FilePath)
+	if err != nil {
+		s.logFor(r).Error("Failed to read uploaded file", "message_id", messageID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to read audio file")
+		return
+	}
+
+	audioFormat, err := audio.DetectFormat(data)
+	if err != nil {
+		s.rejectUpload(r, msg, "unsupported audio format")
+		s.respondError(w, http.StatusBadRequest, "Unsupported audio format")
+		return
+	}
+
+	if err := s.validateAudio(data, audioFormat); err != nil {
+		s.logFor(r).Warn("Rejected invalid audio", "message_id", messageID, "error", err)
+		s.rejectUpload(r, msg, "invalid audio")
+		s.respondError(w, http.StatusBadRequest, "Invalid audio file")
+		return
+	}
+
+	totalChunks := (len(data) + udp.MaxPayloadSize - 1) / udp.MaxPayloadSize
+
+	if err := s.messageStore.FinalizeMessage(r.Context(), messageID, len(data), audioFormat, totalChunks); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.webhooks.Dispatch(webhook.NewEvent(webhook.EventReceived, msg.ID, msg.SenderID, msg.RecipientID))
+
+	// Push it over UDP if the recipient is online
+	s.forwarder.ForwardMessage(msg.ID, msg.SenderID, msg.RecipientID, data)
+
+	s.logFor(r).Info(
+		"Direct upload completed",
+		"message_id", messageID,
+		"size", len(data),
+		"format", audioFormat,
+	)
+
+	s.respondJSON(w, http.StatusOK, UploadMessageResponse{
+		ID:          msg.ID,
+		Status:      db.MessageStatusTransmitted,
+		FileSize:    len(data),
+		AudioFormat: audioFormat,
+		CreatedAt:   msg.CreatedAt,
+	})
+}
+
+// rejectUpload drops an invalid direct upload and fails its message
+func (s *Server) rejectUpload(r *http.Request, msg *db.VoiceMessage, reason string) {
+	if err := s.s3Client.DeleteVoiceMessage(r.Context(), msg.FilePath); err != nil {
+		s.logFor(r).Warn("Failed to delete rejected upload", "message_id", msg.ID, "error", err)
+	}
+
+	if err := s.messageStore.UpdateMessageStatus(r.Context(), msg.ID, db.MessageStatusFailed); err != nil {
+		s.logFor(r).Warn("Failed to mark upload as failed", "message_id", msg.ID, "error", err)
+	}
+
+	event := webhook.NewEvent(webhook.EventFailed, msg.ID, msg.SenderID, msg.RecipientID)
+	event.Reason = reason
+	s.webhooks.Dispatch(event)
+}
+
+// validateAudio checks uploaded audio when strict validation is on
+func (s *Server) validateAudio(data []byte, format string) error {
+	if !s.options().StrictAudio {
+		return nil
+	}
+	return audio.Validate(data, format)
+}
+
+// HandleListMessages lists the caller's received messages in a folder,
+// the inbox unless folder=archived is asked for
+func (s *Server) HandleListMessages(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	folder := r.URL.Query().Get("folder")
+	if folder == "" {
+		folder = db.FolderInbox
+	}
+	if folder != db.FolderInbox && folder != db.FolderArchived {
+		s.respondError(w, http.StatusBadRequest, "Invalid folder, must be inbox or archived")
+		return
+	}
+
+	limit, offset := parsePagination(r)
+
+	s.logFor(r).Info(
+		"Received request",
+		"handler", "HandleListMessages",
+		"user_id", userID,
+		"folder", folder,
+	)
+
+	messages, err := s.messageStore.GetMessagesByRecipient(r.Context(), userID, folder, limit, offset)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, ListMessagesResponse{
+		Messages: receivedMessageInfos(messages),
+		Folder:   folder,
+		Limit:    limit,
+		Offset:   offset,
+	})
+}
+
+// HandleSearchMessages searches the caller's received messages.
+// Supported query params: sender (user ID), status (transmitted, delivered or listened),
+// from and to (RFC 3339, to is exclusive)
+func (s *Server) HandleSearchMessages(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	query := r.URL.Query()
+	limit, offset := parsePagination(r)
+	filter := db.SearchFilter{Limit: limit, Offset: offset}
+
+	if sender := query.Get("sender"); sender != "" {
+		senderID, err := uuid.Parse(sender)
+		if err != nil {
+			s.respondError(w, http.StatusBadRequest, "Invalid sender ID format")
+			return
+		}
+		filter.SenderID = &senderID
+	}
+
+	// Only statuses a recipient gets to see, held back and half-uploaded messages stay hidden
+	if status := query.Get("status"); status != "" {
+		switch status {
+		case db.MessageStatusTransmitted, db.MessageStatusDelivered, db.MessageStatusListened:
+			filter.Status = status
+		default:
+			s.respondError(w, http.StatusBadRequest, "Invalid status")
+			return
+		}
+	}
+
+	var err error
+	if filter.CreatedAfter, err = parseTimeParam(r, "from"); err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.CreatedBefore, err = parseTimeParam(r, "to"); err != nil {
+		s.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if filter.CreatedAfter != nil && filter.CreatedBefore != nil && !filter.CreatedAfter.Before(*filter.CreatedBefore) {
+		s.respondError(w, http.StatusBadRequest, "Invalid time range, from must be before to")
+		return
+	}
+
+	s.logFor(r).Info(
+		"Received request",
+		"handler", "HandleSearchMessages",
+		"user_id", userID,
+	)
+
+	messages, err := s.messageStore.SearchMessages(r.Context(), userID, filter)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, SearchMessagesResponse{
+		Messages: receivedMessageInfos(messages),
+		Limit:    limit,
+		Offset:   offset,
+	})
+}
+
+// parseTimeParam reads an optional RFC 3339 query param, nil if it is missing
+func parseTimeParam(r *http.Request, name string) (*time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s time format, use RFC 3339", name)
+	}
+	return &parsed, nil
+}
+
+// receivedMessageInfos converts messages for listing to their recipient
+func receivedMessageInfos(messages []*db.VoiceMessage) []ReceivedMessageInfo {
+	infos := make([]ReceivedMessageInfo, 0, len(messages))
+	for _, msg := range messages {
+		infos = append(infos, ReceivedMessageInfo{
+			ID:          msg.ID,
+			SenderID:    msg.SenderID,
+			FileSize:    msg.FileSize,
+			Duration:    msg.DurationSecs,
+			AudioFormat: msg.AudioFormat,
+			Status:      msg.Status,
+			Archived:    msg.Archived,
+			CreatedAt:   msg.CreatedAt,
+			DeliveredAt: msg.DeliveredAt,
+			ListenedAt:  msg.ListenedAt,
+		})
+	}
+	return infos
+}
+
+// HandleArchiveMessage moves one of the caller's received messages out of the inbox
+func (s *Server) HandleArchiveMessage(w http.ResponseWriter, r *http.Request) {
+	s.fileMessage(w, r, true)
+}
+
+// HandleUnarchiveMessage moves one of the caller's archived messages back to the inbox
+func (s *Server) HandleUnarchiveMessage(w http.ResponseWriter, r *http.Request) {
+	s.fileMessage(w, r, false)
+}
+
+// fileMessage archives or unarchives the message named in the URL
+func (s *Server) fileMessage(w http.ResponseWriter, r *http.Request, archive bool) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	messageID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid message ID format")
+		return
+	}
+
+	if archive {
+		err = s.messageStore.ArchiveMessage(r.Context(), messageID, userID)
+	} else {
+		err = s.messageStore.UnarchiveMessage(r.Context(), messageID, userID)
+	}
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.logFor(r).Info("Message filed", "message_id", messageID, "user_id", userID, "archived", archive)
+
+	s.respondJSON(w, http.StatusOK, ArchiveMessageResponse{
+		MessageID: messageID,
+		Archived:  archive,
+	})
+}
+
+// HandleDeleteMessages deletes a batch of the caller's received messages
+// along with their files. IDs of messages the caller didn't receive are skipped
+func (s *Server) HandleDeleteMessages(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var ids []uuid.UUID
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	s.logFor(r).Info(
+		"Received request",
+		"handler", "HandleDeleteMessages",
+		"user_id", userID,
+		"count", len(ids),
+	)
+
+	if len(ids) == 0 {
+		s.respondError(w, http.StatusBadRequest, "At least one message ID is required")
+		return
+	}
+	if len(ids) > maxDeleteBatch {
+		s.respondError(w, http.StatusBadRequest, fmt.Sprintf("At most %d messages can be deleted at once", maxDeleteBatch))
+		return
+	}
+
+	// Looked up first, the files can only be found while the records exist
+	messages, err := s.messageStore.GetMessagesByIDs(r.Context(), ids, userID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	deleted, err := s.messageStore.DeleteMessages(r.Context(), ids, userID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	// A file left behind here is picked up by the orphan sweeper
+	for _, msg := range messages {
+		paths := []string{msg.FilePath}
+		if msg.OriginalFilePath != nil {
+			paths = append(paths, *msg.OriginalFilePath)
+		}
+		for _, path := range paths {
+			if err := s.s3Client.DeleteVoiceMessage(r.Context(), path); err != nil {
+				s.logFor(r).Warn("Failed to delete message file", "message_id", msg.ID, "object", path, "error", err)
+			}
+		}
+		if err := s.s3Client.DeletePeaks(r.Context(), msg.ID); err != nil {
+			s.logFor(r).Warn("Failed to delete message peaks", "message_id", msg.ID, "error", err)
+		}
+	}
+
+	s.logFor(r).Info("Messages deleted", "user_id", userID, "requested", len(ids), "deleted", deleted)
+
+	s.respondJSON(w, http.StatusOK, DeleteMessagesResponse{
+		Message: "Messages deleted successfully",
+		Deleted: deleted,
+	})
+}
+
+// HandleGetDownloadURL returns a presigned link to a message's audio for its
+// sender or recipient. Browsers save it as voice_<sender>_<date>.<format>
+func (s *Server) HandleGetDownloadURL(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	messageID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid message ID format")
+		return
+	}
+
+	msg, err := s.messageStore.GetMessageByID(r.Context(), messageID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	// Same answer as a missing message, so IDs can't be probed. Held back
+	// and half-uploaded messages aren't handed out either
+	if msg.SenderID != userID && msg.RecipientID != userID ||
+		msg.Status == db.MessageStatusPending || msg.Status == db.MessageStatusQuarantined {
+		s.respondError(w, http.StatusNotFound, "Message not found")
+		return
+	}
+
+	// The link serves the object as stored, compressed audio keeps its .zst
+	format := msg.AudioFormat
+	if msg.Compressed {
+		format = audio.CompressedFormat(format)
+	}
+
+	filename := s3storage.DownloadFilename(msg.SenderID, msg.CreatedAt, format)
+	downloadURL, err := s.s3Client.GetPresignedURL(r.Context(), msg.FilePath, filename, downloadURLExpiry)
+	if err != nil {
+		s.logFor(r).Error("Failed to create download url", "message_id", messageID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to create download url")
+		return
+	}
+
+	if msg.RecipientID == userID && s.options().AutoMarkListened {
+		s.markListened(r, msg)
+	}
+
+	s.respondJSON(w, http.StatusOK, DownloadURLResponse{
+		MessageID:   messageID,
+		DownloadURL: downloadURL,
+		Filename:    filename,
+		Compressed:  msg.Compressed,
+		ExpiresAt:   time.Now().Add(downloadURLExpiry),
+	})
+}
+
+// markListened treats a download by the recipient as a listened receipt, the
+// same way the UDP server does. A failed update only costs the receipt
+func (s *Server) markListened(r *http.Request, msg *db.VoiceMessage) {
+	if msg.Status != db.MessageStatusTransmitted && msg.Status != db.MessageStatusDelivered || msg.ListenedAt != nil {
+		return
+	}
+
+	now := time.Now()
+	delivered := msg.Status == db.MessageStatusTransmitted
+	if delivered {
+		msg.DeliveredAt = &now
+	}
+	msg.Status = db.MessageStatusListened
+	msg.ListenedAt = &now
+
+	if err := s.messageStore.UpdateMessage(r.Context(), msg); err != nil {
+		s.logFor(r).Error("Failed to mark message listened", "message_id", msg.ID, "error", err)
+		return
+	}
+
+	if delivered {
+		s.webhooks.Dispatch(webhook.NewEvent(webhook.EventDelivered, msg.ID, msg.SenderID, msg.RecipientID))
+	}
+	s.webhooks.Dispatch(webhook.NewEvent(webhook.EventListened, msg.ID, msg.SenderID, msg.RecipientID))
+}
+
+// HandleGetMessagePeaks returns the waveform preview of a message
+// to its sender or recipient
+func (s *Server) HandleGetMessagePeaks(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	messageID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid message ID format")
+		return
+	}
+
+	msg, err := s.messageStore.GetMessageByID(r.Context(), messageID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if msg.SenderID != userID && msg.RecipientID != userID {
+		// Same answer as a missing message, so IDs can't be probed
+		s.respondError(w, http.StatusNotFound, "Message not found")
+		return
+	}
+
+	data, err := s.s3Client.DownloadPeaks(r.Context(), messageID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	var peaks []float32
+	if err := json.Unmarshal(data, &peaks); err != nil {
+		s.logFor(r).Error("Failed to decode stored peaks", "message_id", messageID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to read peaks")
+		return
+	}
+
+	s.respondJSON(w, http.StatusOK, MessagePeaksResponse{
+		MessageID: messageID,
+		Peaks:     peaks,
+	})
+}
@@ -0,0 +1,503 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+)
+
+// uploadForm builds a multipart upload of audio for recipientID
+func uploadForm(t *testing.T, recipientID uuid.UUID, audio []byte) (string, *bytes.Buffer) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("recipient_id", recipientID.String()); err != nil {
+		t.Fatal(err)
+	}
+	part, err := form.CreateFormFile("audio", "voice.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(audio)
+	form.Close()
+
+	return form.FormDataContentType(), &body
+}
+
+func TestUploadMessage(t *testing.T) {
+	ts := newTestServer(t, Options{StrictAudio: true})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+
+	contentType, body := uploadForm(t, bob.ID, wavFile(make([]int16, 4000)))
+	rec := ts.do(http.MethodPost, "/api/messages/", contentType, body, ts.token(t, alice))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp UploadMessageResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := ts.messages.message(resp.ID)
+	if msg == nil {
+		t.Fatal("uploaded message was not stored")
+	}
+	if msg.SenderID != alice.ID || msg.RecipientID != bob.ID {
+		t.Errorf("stored %v -> %v, want %v -> %v", msg.SenderID, msg.RecipientID, alice.ID, bob.ID)
+	}
+	if msg.AudioFormat != "wav" || msg.Status != db.MessageStatusTransmitted {
+		t.Errorf("stored as %s/%s", msg.AudioFormat, msg.Status)
+	}
+
+	data, err := ts.objects.DownloadVoiceMessage(t.Context(), msg.FilePath)
+	if err != nil || len(data) != msg.FileSize {
+		t.Fatalf("stored object: %d bytes, %v", len(data), err)
+	}
+	if len(ts.forwarder.forwarded) != 1 || ts.forwarder.forwarded[0] != msg.ID {
+		t.Errorf("forwarded %v, want the uploaded message", ts.forwarder.forwarded)
+	}
+}
+
+func TestUploadMessageRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		audio []byte
+		want  int
+	}{
+		{"oversized", wavFile(make([]int16, 1024)), http.StatusRequestEntityTooLarge},
+		{"empty", nil, http.StatusBadRequest},
+		{"unknown format", []byte("definitely not audio"), http.StatusBadRequest},
+		{"broken wav", wavFile(make([]int16, 16))[:20], http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, Options{MaxUploadSize: 1024, StrictAudio: true})
+			alice := ts.addUser(t, "alice", db.RoleUser)
+			bob := ts.addUser(t, "bob", db.RoleUser)
+
+			contentType, body := uploadForm(t, bob.ID, tt.audio)
+			rec := ts.do(http.MethodPost, "/api/messages/", contentType, body, ts.token(t, alice))
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if ts.messages.count() != 0 {
+				t.Fatal("refused upload was stored")
+			}
+		})
+	}
+}
+
+// directObjects is an object store that hands out upload links. Uploads
+// through a link are made with upload, as a client would
+type directObjects struct {
+	*s3storage.MemoryStore
+
+	mu      sync.Mutex
+	uploads map[string][]byte
+}
+
+func (d *directObjects) GetPresignedPutURL(ctx context.Context, messageID uuid.UUID, audioFormat string, expiry time.Duration) (string, string, error) {
+	objectPath := fmt.Sprintf("messages/%s.%s", messageID, audioFormat)
+	return "https://storage.example/voice/" + objectPath, objectPath, nil
+}
+
+func (d *directObjects) upload(objectPath string, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.uploads[objectPath] = data
+}
+
+func (d *directObjects) GetObjectInfo(ctx context.Context, objectPath string) (*s3storage.ObjectInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, ok := d.uploads[objectPath]
+	if !ok {
+		return nil, fmt.Errorf("object not found")
+	}
+	return &s3storage.ObjectInfo{Key: objectPath, Size: int64(len(data))}, nil
+}
+
+func (d *directObjects) DownloadVoiceMessage(ctx context.Context, objectPath string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, ok := d.uploads[objectPath]
+	if !ok {
+		return nil, fmt.Errorf("object not found")
+	}
+	return data, nil
+}
+
+// newDirectUploadServer returns a test server whose storage supports direct uploads
+func newDirectUploadServer(t *testing.T) (*testServer, *directObjects) {
+	t.Helper()
+
+	ts := newTestServer(t, Options{StrictAudio: true})
+	objects := &directObjects{MemoryStore: ts.objects, uploads: make(map[string][]byte)}
+	ts.Server = New("", *ts.options(), ts.users, ts.messages, ts.contacts, nil, ts.sessions, objects, ts.forwarder, ts.jwt, ts.hasher, ts.mailer, nil, ts.log)
+
+	return ts, objects
+}
+
+// requestUploadURL asks for an upload link from sender to recipient
+func requestUploadURL(t *testing.T, ts *testServer, sender, recipient *db.User) UploadURLResponse {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"recipient_id":%q,"audio_format":"wav"}`, recipient.ID)
+	rec := ts.doJSON(http.MethodPost, "/api/messages/upload-url", body, ts.token(t, sender))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload url: status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp UploadURLResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestDirectUpload(t *testing.T) {
+	ts, objects := newDirectUploadServer(t)
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+
+	resp := requestUploadURL(t, ts, alice, bob)
+	if resp.UploadURL == "" || !resp.ExpiresAt.After(time.Now()) {
+		t.Fatalf("got link %q expiring %v", resp.UploadURL, resp.ExpiresAt)
+	}
+
+	msg := ts.messages.message(resp.MessageID)
+	if msg == nil || msg.Status != db.MessageStatusPending {
+		t.Fatalf("message before upload: %+v, want pending", msg)
+	}
+	if !strings.HasSuffix(resp.UploadURL, msg.FilePath) {
+		t.Fatalf("link %s does not upload to %s", resp.UploadURL, msg.FilePath)
+	}
+
+	// Only the sender may complete it, and only once it is uploaded
+	complete := "/api/messages/" + resp.MessageID.String() + "/complete"
+	if rec := ts.doJSON(http.MethodPost, complete, "", ts.token(t, bob)); rec.Code != http.StatusNotFound {
+		t.Fatalf("completed by the recipient: status %d", rec.Code)
+	}
+	if rec := ts.doJSON(http.MethodPost, complete, "", ts.token(t, alice)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("completed before the upload: status %d", rec.Code)
+	}
+
+	audio := wavFile(make([]int16, 4000))
+	objects.upload(msg.FilePath, audio)
+
+	rec := ts.doJSON(http.MethodPost, complete, "", ts.token(t, alice))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", rec.Code, rec.Body)
+	}
+
+	msg = ts.messages.message(resp.MessageID)
+	if msg.Status != db.MessageStatusTransmitted || msg.FileSize != len(audio) || msg.AudioFormat != "wav" {
+		t.Fatalf("completed message %s, %d bytes of %s", msg.Status, msg.FileSize, msg.AudioFormat)
+	}
+	if len(ts.forwarder.forwarded) != 1 || ts.forwarder.forwarded[0] != msg.ID {
+		t.Errorf("forwarded %v, want the completed message", ts.forwarder.forwarded)
+	}
+
+	if rec := ts.doJSON(http.MethodPost, complete, "", ts.token(t, alice)); rec.Code != http.StatusConflict {
+		t.Fatalf("completed twice: status %d", rec.Code)
+	}
+}
+
+func TestDirectUploadInvalidAudioIsRejected(t *testing.T) {
+	ts, objects := newDirectUploadServer(t)
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+
+	resp := requestUploadURL(t, ts, alice, bob)
+	objects.upload(ts.messages.message(resp.MessageID).FilePath, []byte("definitely not audio"))
+
+	rec := ts.doJSON(http.MethodPost, "/api/messages/"+resp.MessageID.String()+"/complete", "", ts.token(t, alice))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if msg := ts.messages.message(resp.MessageID); msg.Status != db.MessageStatusFailed {
+		t.Fatalf("status %s, want failed", msg.Status)
+	}
+	if len(ts.forwarder.forwarded) != 0 {
+		t.Fatal("rejected upload was forwarded")
+	}
+}
+
+func TestSearchMessagesStatus(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+
+	delivered := &db.VoiceMessage{ID: uuid.New(), SenderID: alice.ID, RecipientID: bob.ID, Status: db.MessageStatusDelivered}
+	for _, msg := range []*db.VoiceMessage{
+		delivered,
+		{ID: uuid.New(), SenderID: alice.ID, RecipientID: bob.ID, Status: db.MessageStatusQuarantined},
+		{ID: uuid.New(), SenderID: alice.ID, RecipientID: bob.ID, Status: db.MessageStatusPending},
+	} {
+		if err := ts.messages.CreateMessage(t.Context(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		status string
+		want   int
+		found  []uuid.UUID
+	}{
+		{db.MessageStatusDelivered, http.StatusOK, []uuid.UUID{delivered.ID}},
+		{db.MessageStatusListened, http.StatusOK, nil},
+		// Held back and half-uploaded messages can't be searched for
+		{db.MessageStatusQuarantined, http.StatusBadRequest, nil},
+		{db.MessageStatusPending, http.StatusBadRequest, nil},
+		{db.MessageStatusFailed, http.StatusBadRequest, nil},
+		{"unknown", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			rec := ts.do(http.MethodGet, "/api/messages/search?status="+tt.status, "", nil, ts.token(t, bob))
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			var resp SearchMessagesResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Messages) != len(tt.found) {
+				t.Fatalf("found %d messages, want %d", len(resp.Messages), len(tt.found))
+			}
+			for i, id := range tt.found {
+				if resp.Messages[i].ID != id {
+					t.Fatalf("found %v, want %v", resp.Messages[i].ID, id)
+				}
+			}
+		})
+	}
+}
+
+// storeMessage adds a transmitted message from sender to recipient, with its file and peaks in the object store
+func (ts *testServer) storeMessage(t *testing.T, sender, recipient *db.User) *db.VoiceMessage {
+	t.Helper()
+
+	id := uuid.New()
+	path, err := ts.objects.UploadVoiceMessage(t.Context(), id, sender.ID, recipient.ID, wavFile(make([]int16, 800)), "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.objects.UploadPeaks(t.Context(), id, []byte("[0.5]")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &db.VoiceMessage{
+		ID:          id,
+		SenderID:    sender.ID,
+		RecipientID: recipient.ID,
+		FilePath:    path,
+		AudioFormat: "wav",
+		Status:      db.MessageStatusTransmitted,
+	}
+	if err := ts.messages.CreateMessage(t.Context(), msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDeleteMessages(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+
+	own := []*db.VoiceMessage{ts.storeMessage(t, alice, bob), ts.storeMessage(t, alice, bob)}
+	others := ts.storeMessage(t, bob, alice)
+
+	ids, _ := json.Marshal([]uuid.UUID{own[0].ID, own[1].ID, others.ID, uuid.New()})
+	rec := ts.doJSON(http.MethodDelete, "/api/messages/", string(ids), ts.token(t, bob))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp DeleteMessagesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Deleted != len(own) {
+		t.Errorf("deleted %d, want %d", resp.Deleted, len(own))
+	}
+
+	for _, msg := range own {
+		if ts.messages.message(msg.ID) != nil {
+			t.Errorf("message %v was kept", msg.ID)
+		}
+		if _, err := ts.objects.DownloadVoiceMessage(t.Context(), msg.FilePath); err == nil {
+			t.Errorf("file of message %v was kept", msg.ID)
+		}
+		if _, err := ts.objects.DownloadPeaks(t.Context(), msg.ID); err == nil {
+			t.Errorf("peaks of message %v were kept", msg.ID)
+		}
+	}
+
+	// Someone else's message is skipped, not an error
+	if ts.messages.message(others.ID) == nil {
+		t.Error("message of another recipient was deleted")
+	}
+	if _, err := ts.objects.DownloadVoiceMessage(t.Context(), others.FilePath); err != nil {
+		t.Errorf("file of another recipient's message: %v", err)
+	}
+	if _, err := ts.objects.DownloadPeaks(t.Context(), others.ID); err != nil {
+		t.Errorf("peaks of another recipient's message: %v", err)
+	}
+}
+
+func TestDeleteMessagesRefused(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	bob := ts.addUser(t, "bob", db.RoleUser)
+
+	tooMany, _ := json.Marshal(make([]uuid.UUID, maxDeleteBatch+1))
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"empty", "[]"},
+		{"not a list", `{"id": "x"}`},
+		{"too many", string(tooMany)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ts.doJSON(http.MethodDelete, "/api/messages/", tt.body, ts.token(t, bob))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+			}
+		})
+	}
+}
+
+func TestGetDownloadURL(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+	carol := ts.addUser(t, "carol", db.RoleUser)
+
+	msg := ts.storeMessage(t, alice, bob)
+	quarantined := ts.storeMessage(t, alice, bob)
+	if err := ts.messages.UpdateMessageStatus(t.Context(), quarantined.ID, db.MessageStatusQuarantined); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user *db.User
+		id   uuid.UUID
+		want int
+	}{
+		{"recipient", bob, msg.ID, http.StatusOK},
+		{"sender", alice, msg.ID, http.StatusOK},
+		{"stranger", carol, msg.ID, http.StatusNotFound},
+		{"quarantined", bob, quarantined.ID, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ts.do(http.MethodGet, "/api/messages/"+tt.id.String()+"/download-url", "", nil, ts.token(t, tt.user))
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			var resp DownloadURLResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			stored := ts.messages.message(tt.id)
+			filename := s3storage.DownloadFilename(alice.ID, stored.CreatedAt, "wav")
+			if resp.Filename != filename {
+				t.Errorf("filename %q, want %q", resp.Filename, filename)
+			}
+
+			link, err := url.Parse(resp.DownloadURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "attachment; filename=" + filename
+			if got := link.Query().Get("response-content-disposition"); got != want {
+				t.Errorf("response-content-disposition %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestGetDownloadURLMarksListened(t *testing.T) {
+	tests := []struct {
+		name       string
+		auto       bool
+		status     string
+		bySender   bool
+		wantStatus string
+	}{
+		{"off", false, db.MessageStatusTransmitted, false, db.MessageStatusTransmitted},
+		{"transmitted", true, db.MessageStatusTransmitted, false, db.MessageStatusListened},
+		{"delivered", true, db.MessageStatusDelivered, false, db.MessageStatusListened},
+		{"delivered off", false, db.MessageStatusDelivered, false, db.MessageStatusDelivered},
+		{"sender", true, db.MessageStatusDelivered, true, db.MessageStatusDelivered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, Options{AutoMarkListened: tt.auto})
+			alice := ts.addUser(t, "alice", db.RoleUser)
+			bob := ts.addUser(t, "bob", db.RoleUser)
+
+			msg := ts.storeMessage(t, alice, bob)
+			if err := ts.messages.UpdateMessageStatus(t.Context(), msg.ID, tt.status); err != nil {
+				t.Fatal(err)
+			}
+
+			user := bob
+			if tt.bySender {
+				user = alice
+			}
+			rec := ts.do(http.MethodGet, "/api/messages/"+msg.ID.String()+"/download-url", "", nil, ts.token(t, user))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+
+			got := ts.messages.message(msg.ID)
+			if got.Status != tt.wantStatus {
+				t.Fatalf("message %s, want %s", got.Status, tt.wantStatus)
+			}
+			if listened := tt.wantStatus == db.MessageStatusListened; listened != (got.ListenedAt != nil) {
+				t.Fatalf("listened at %v", got.ListenedAt)
+			}
+			// Skipping straight to listened still records the delivery
+			if tt.status == db.MessageStatusTransmitted && got.ListenedAt != nil && got.DeliveredAt == nil {
+				t.Fatal("listened message has no delivery time")
+			}
+		})
+	}
+}
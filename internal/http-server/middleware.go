@@ -2,10 +2,19 @@ package httpserver
 
 import (
 	"context"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/charmbracelet/log"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/internal/session"
+	"github.com/rx3lixir/laba/pkg/jwt"
 )
 
 type contextKey string
@@ -14,8 +23,97 @@ const (
 	userIDKey    contextKey = "user_id"
 	userEmailKey contextKey = "user_email"
 	userNameKey  contextKey = "username"
+	userRoleKey  contextKey = "user_role"
+	claimsKey    contextKey = "claims"
+	loggerKey    contextKey = "logger"
 )
 
+// logFor returns the logger of a request, tagged with its trace ID
+func (s *Server) logFor(r *http.Request) *log.Logger {
+	if logger, ok := r.Context().Value(loggerKey).(*log.Logger); ok {
+		return logger
+	}
+	return s.log
+}
+
+// RequestLogger logs every HTTP request with structured fields.
+// Server errors (5xx) are logged at error level, everything else at info
+func (s *Server) RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+
+		// Every line logged for this request carries the chi request ID as trace_id
+		reqLog := s.log.With("trace_id", middleware.GetReqID(r.Context()))
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey, reqLog))
+
+		defer func() {
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			fields := []any{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", status,
+				"duration", time.Since(start),
+				"remote_addr", r.RemoteAddr,
+			}
+
+			if status >= http.StatusInternalServerError {
+				reqLog.Error("HTTP request", fields...)
+				return
+			}
+			reqLog.Info("HTTP request", fields...)
+		}()
+
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// RateLimitMiddleware limits requests per client IP with a token bucket kept in valkey,
+// so the limit holds across server instances. Scope separates buckets of different route groups.
+// The limit is looked up on every request so it can be changed at runtime
+func (s *Server) RateLimitMiddleware(scope string, limitFn func() session.RateLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := limitFn()
+			if !limit.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+
+			allowed, retryAfter, err := s.sessionManager.Allow(r.Context(), scope+":"+ip, limit)
+			if err != nil {
+				// Fail open, an unavailable limiter must not take auth down with it
+				s.logFor(r).Warn("Rate limiter unavailable", "scope", scope, "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !allowed {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+
+				s.logFor(r).Warn("Rate limit exceeded", "scope", scope, "ip", ip, "retry_after", seconds)
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				s.respondError(w, http.StatusTooManyRequests, "Too many requests")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // AuthMiddleware validates JWT tokens and adds user info to context
 func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -25,8 +123,8 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
+		parts := strings.Fields(authHeader)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
 			s.respondError(w, http.StatusUnauthorized, "Invalid authorization header format")
 			return
 		}
@@ -35,7 +133,26 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 
 		claims, err := s.jwtService.ValidateToken(tokenString)
 		if err != nil {
-			s.log.Warn("Invalid token", "error", err)
+			s.logFor(r).Warn("Invalid token", "error", err)
+			s.respondError(w, http.StatusUnauthorized, "Invalid or expired token")
+			return
+		}
+
+		// A token without an issue time can't be checked against revocations
+		if claims.IssuedAt == nil {
+			s.logFor(r).Warn("Token without issue time", "user_id", claims.UserID)
+			s.respondError(w, http.StatusUnauthorized, "Invalid or expired token")
+			return
+		}
+
+		// Revocations live in valkey. While it is down the signature and expiry
+		// checks above still hold, so the token is accepted rather than locking everyone out
+		revoked, err := s.sessionManager.IsTokenRevoked(r.Context(), claims.UserID, claims.IssuedAt.Time)
+		if err != nil {
+			s.logFor(r).Warn("Token revocation check unavailable, accepting token", "user_id", claims.UserID, "error", err)
+		}
+		if revoked {
+			s.logFor(r).Warn("Revoked token used", "user_id", claims.UserID)
 			s.respondError(w, http.StatusUnauthorized, "Invalid or expired token")
 			return
 		}
@@ -44,11 +161,41 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 		ctx = context.WithValue(ctx, userIDKey, claims.UserID)
 		ctx = context.WithValue(ctx, userEmailKey, claims.Email)
 		ctx = context.WithValue(ctx, userNameKey, claims.Username)
+		ctx = context.WithValue(ctx, userRoleKey, claims.Role)
+		ctx = context.WithValue(ctx, claimsKey, claims)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// RequireRole lets through only callers whose token carries role.
+// It has to run after AuthMiddleware
+func (s *Server) RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := GetUserIDFromContext(r.Context())
+			if !ok {
+				s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+
+			if userRole, _ := GetUserRoleFromContext(r.Context()); userRole != role {
+				s.logFor(r).Warn("Route refused for role", "user_id", userID, "role", userRole, "required", role, "path", r.URL.Path)
+				s.respondError(w, http.StatusForbidden, "Insufficient permissions")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UserFromContext returns the token claims of the calling user
+func UserFromContext(ctx context.Context) (*jwt.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*jwt.Claims)
+	return claims, ok
+}
+
 func GetUserIDFromContext(ctx context.Context) (uuid.UUID, bool) {
 	userID, ok := ctx.Value(userIDKey).(uuid.UUID)
 	return userID, ok
@@ -63,3 +210,13 @@ func GetUsernameFromContext(ctx context.Context) (string, bool) {
 	username, ok := ctx.Value(userNameKey).(string)
 	return username, ok
 }
+
+// GetUserRoleFromContext returns the role of the caller. Tokens issued
+// before roles existed carry none, those callers are plain users
+func GetUserRoleFromContext(ctx context.Context) (string, bool) {
+	role, ok := ctx.Value(userRoleKey).(string)
+	if ok && role == "" {
+		role = db.RoleUser
+	}
+	return role, ok
+}
@@ -0,0 +1,238 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/internal/session"
+	"github.com/rx3lixir/laba/pkg/jwt"
+)
+
+func TestRequestLoggerLogsRequest(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Server{log: log.New(&buf)}
+
+	handler := middleware.RequestID(s.RequestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.logFor(r).Info("handling")
+		w.WriteHeader(http.StatusTeapot)
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/ping", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), buf.String())
+	}
+
+	line := lines[1]
+	for _, field := range []string{"HTTP request", "method=GET", "path=/api/v1/ping", "status=418", "duration=", "remote_addr=", "trace_id="} {
+		if !strings.Contains(line, field) {
+			t.Errorf("log line %q is missing %q", line, field)
+		}
+	}
+
+	// The handler's own line carries the same trace ID
+	traceID := line[strings.Index(line, "trace_id="):]
+	traceID = strings.Fields(traceID)[0]
+	if !strings.Contains(lines[0], traceID) {
+		t.Errorf("handler line %q does not carry %s", lines[0], traceID)
+	}
+}
+
+func TestRateLimitRefusesOverLimit(t *testing.T) {
+	sessions, _ := newTestSessionManager(t)
+	s := &Server{sessionManager: sessions, log: log.New(io.Discard)}
+
+	limit := session.RateLimit{Rate: 0.001, Burst: 3}
+	handler := s.RateLimitMiddleware("auth", func() session.RateLimit { return limit })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/signin", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < limit.Burst; i++ {
+		if rec := request("10.0.0.1:5000"); rec.Code != http.StatusNoContent {
+			t.Fatalf("request %d: status %d within the limit", i+1, rec.Code)
+		}
+	}
+
+	rec := request("10.0.0.1:5001")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d over the limit, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+
+	// Other clients have buckets of their own
+	if rec := request("10.0.0.2:5000"); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d for another client", rec.Code)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+
+	expired, err := jwt.NewService("test-secret", -time.Minute, time.Hour).GenerateAccessToken(alice.ID, alice.Email, alice.Username, alice.Role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := jwt.NewService("other-secret", time.Hour, time.Hour).GenerateAccessToken(alice.ID, alice.Email, alice.Username, alice.Role)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob := ts.addUser(t, "bob", db.RoleUser)
+	revoked := ts.token(t, bob)
+	ts.valkey.Set("tokens_revoked_at:"+bob.ID.String(), strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"not bearer", "Basic " + ts.token(t, alice), http.StatusUnauthorized},
+		{"invalid token", "Bearer not.a.token", http.StatusUnauthorized},
+		{"wrong signature", "Bearer " + forged, http.StatusUnauthorized},
+		{"expired token", "Bearer " + expired, http.StatusUnauthorized},
+		{"revoked token", "Bearer " + revoked, http.StatusUnauthorized},
+		{"success", "Bearer " + ts.token(t, alice), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var caller *jwt.Claims
+			handler := ts.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				caller, _ = UserFromContext(r.Context())
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				if caller != nil {
+					t.Fatal("handler ran for a refused request")
+				}
+				return
+			}
+			if caller == nil || caller.UserID != alice.ID || caller.Username != "alice" || caller.Role != db.RoleUser {
+				t.Fatalf("handler saw caller %+v, want alice", caller)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleAdmin)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+
+	// Tokens from before roles existed carry none
+	legacy, err := ts.jwt.GenerateAccessToken(bob.ID, bob.Email, bob.Username, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		auth  bool
+		want  int
+	}{
+		{"admin", ts.token(t, alice), true, http.StatusOK},
+		{"user", ts.token(t, bob), true, http.StatusForbidden},
+		{"token without a role", legacy, true, http.StatusForbidden},
+		{"no authenticated caller", "", false, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			var handler http.Handler = ts.RequireRole(db.RoleAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ran = true
+				w.WriteHeader(http.StatusOK)
+			}))
+			if tt.auth {
+				handler = ts.AuthMiddleware(handler)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/admin/sessions", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+			if ran != (tt.want == http.StatusOK) {
+				t.Fatalf("handler ran %v for status %d", ran, rec.Code)
+			}
+		})
+	}
+}
+
+func TestRequestLogLinesShareTraceID(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	ts.addUser(t, "alice", db.RoleUser)
+
+	var logs bytes.Buffer
+	logger := log.NewWithOptions(&logs, log.Options{Level: log.DebugLevel, Formatter: log.JSONFormatter})
+	ts.Server = New("", *ts.options(), ts.users, ts.messages, ts.contacts, nil, ts.sessions, ts.objects, ts.forwarder, ts.jwt, ts.hasher, ts.mailer, nil, logger)
+
+	body := `{"email":"alice@example.com","password":"` + testPassword + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/signin", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(middleware.RequestIDHeader, "req-42")
+	rec := httptest.NewRecorder()
+	ts.httpServer.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n"))
+	seen := make(map[string]bool)
+	for _, raw := range lines {
+		var line map[string]any
+		if err := json.Unmarshal(raw, &line); err != nil {
+			t.Fatalf("log line %q: %v", raw, err)
+		}
+		if line["trace_id"] != "req-42" {
+			t.Errorf("line without the request ID: %s", raw)
+		}
+		seen[line["msg"].(string)] = true
+	}
+
+	// The handler's own lines and the access log line
+	if !seen["Signin attempt"] || !seen["User signed in successfully"] || len(lines) < 3 {
+		t.Fatalf("logged %v", seen)
+	}
+}
@@ -0,0 +1,154 @@
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxPresenceIDs caps how many users a single presence request may ask about
+const maxPresenceIDs = 200
+
+// Handles listing which contacts of the calling user are online.
+// Only contacts are returned so presence isn't visible to strangers.
+// With ids=a,b,c only those users are checked, non-contacts are reported offline
+func (s *Server) HandleGetPresence(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleGetPresence",
+		"user_id", userID,
+	)
+
+	// Presence lives only in valkey, so there is nothing to serve while it is down
+	if !s.sessionManager.Healthy() {
+		s.respondError(w, http.StatusServiceUnavailable, "Presence is temporarily unavailable")
+		return
+	}
+
+	if raw := r.URL.Query().Get("ids"); raw != "" {
+		ids, err := parsePresenceIDs(raw)
+		if err != nil {
+			s.respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.presenceOf(w, r, userID, ids)
+		return
+	}
+
+	onlineUsers, err := s.sessionManager.GetOnlineUsers(r.Context())
+	if err != nil {
+		s.logFor(r).Error("Failed to list online users", "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to get presence")
+		return
+	}
+
+	online := make([]uuid.UUID, 0, len(onlineUsers))
+	lastSeen := make(map[uuid.UUID]time.Time, len(onlineUsers))
+	for _, onlineID := range onlineUsers {
+		if onlineID == userID {
+			continue
+		}
+
+		isContact, err := s.contactStore.IsContact(r.Context(), userID, onlineID)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+
+		if !isContact {
+			continue
+		}
+
+		online = append(online, onlineID)
+
+		seen, err := s.sessionManager.GetLastSeen(r.Context(), onlineID)
+		if err != nil {
+			s.logFor(r).Warn("Failed to get last seen", "user_id", onlineID, "error", err)
+			continue
+		}
+		if seen != nil {
+			lastSeen[onlineID] = *seen
+		}
+	}
+
+	s.respondJSON(w, http.StatusOK, PresenceResponse{Online: online, LastSeen: lastSeen})
+}
+
+// presenceOf answers a presence request for specific users with a single presence lookup
+func (s *Server) presenceOf(w http.ResponseWriter, r *http.Request, userID uuid.UUID, ids []uuid.UUID) {
+	statuses := make(map[uuid.UUID]bool, len(ids))
+	contacts := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		statuses[id] = false
+
+		isContact, err := s.contactStore.IsContact(r.Context(), userID, id)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		if isContact {
+			contacts = append(contacts, id)
+		}
+	}
+
+	onlineContacts, err := s.sessionManager.AreUsersOnline(r.Context(), contacts)
+	if err != nil {
+		s.logFor(r).Error("Failed to check online users", "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to get presence")
+		return
+	}
+
+	online := make([]uuid.UUID, 0, len(contacts))
+	lastSeen := make(map[uuid.UUID]time.Time, len(contacts))
+	for _, id := range contacts {
+		if !onlineContacts[id] {
+			continue
+		}
+
+		statuses[id] = true
+		online = append(online, id)
+
+		seen, err := s.sessionManager.GetLastSeen(r.Context(), id)
+		if err != nil {
+			s.logFor(r).Warn("Failed to get last seen", "user_id", id, "error", err)
+			continue
+		}
+		if seen != nil {
+			lastSeen[id] = *seen
+		}
+	}
+
+	s.respondJSON(w, http.StatusOK, PresenceResponse{Online: online, LastSeen: lastSeen, Statuses: statuses})
+}
+
+// parsePresenceIDs reads a comma separated list of user IDs, ignoring repeats
+func parsePresenceIDs(raw string) ([]uuid.UUID, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) > maxPresenceIDs {
+		return nil, fmt.Errorf("too many ids, at most %d are allowed", maxPresenceIDs)
+	}
+
+	seen := make(map[uuid.UUID]struct{}, len(parts))
+	ids := make([]uuid.UUID, 0, len(parts))
+	for _, part := range parts {
+		id, err := uuid.Parse(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID format: %s", part)
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
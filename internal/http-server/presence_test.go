@@ -0,0 +1,131 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+)
+
+// connect gives user a live session
+func (ts *testServer) connect(t *testing.T, user *db.User) {
+	t.Helper()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	if err := ts.sessions.CreateSession(t.Context(), user.ID, user.Username, addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPresenceListsOnlineContacts(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+	carol := ts.addUser(t, "carol", db.RoleUser)
+	dave := ts.addUser(t, "dave", db.RoleUser)
+
+	// bob is an online contact, carol an offline one, dave online but a stranger
+	for _, contact := range []*db.User{bob, carol} {
+		ts.contacts.AddContact(t.Context(), alice.ID, contact.ID)
+	}
+	for _, user := range []*db.User{alice, bob, dave} {
+		ts.connect(t, user)
+	}
+
+	rec := ts.do(http.MethodGet, "/api/presence", "", nil, ts.token(t, alice))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp PresenceResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Online) != 1 || resp.Online[0] != bob.ID {
+		t.Fatalf("online %v, want only bob", resp.Online)
+	}
+	if _, ok := resp.LastSeen[bob.ID]; !ok {
+		t.Error("no last seen for bob")
+	}
+}
+
+func TestPresenceOfRequiresAuth(t *testing.T) {
+	ts := newTestServer(t, Options{})
+
+	rec := ts.do(http.MethodGet, "/api/presence?ids="+uuid.NewString(), "", nil, "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestPresenceOf(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+	carol := ts.addUser(t, "carol", db.RoleUser)
+	dave := ts.addUser(t, "dave", db.RoleUser)
+
+	// bob is an online contact, carol an offline one, dave online but a stranger
+	for _, contact := range []*db.User{bob, carol} {
+		ts.contacts.AddContact(t.Context(), alice.ID, contact.ID)
+	}
+	for _, user := range []*db.User{alice, bob, dave} {
+		ts.connect(t, user)
+	}
+
+	tooMany := make([]string, maxPresenceIDs+1)
+	for i := range tooMany {
+		tooMany[i] = uuid.NewString()
+	}
+
+	tests := []struct {
+		name         string
+		ids          string
+		want         int
+		wantStatuses map[uuid.UUID]bool
+	}{
+		{
+			name:         "mixed",
+			ids:          strings.Join([]string{bob.ID.String(), carol.ID.String(), dave.ID.String()}, ","),
+			want:         http.StatusOK,
+			wantStatuses: map[uuid.UUID]bool{bob.ID: true, carol.ID: false, dave.ID: false},
+		},
+		{
+			name:         "repeats and spaces",
+			ids:          bob.ID.String() + ", " + bob.ID.String(),
+			want:         http.StatusOK,
+			wantStatuses: map[uuid.UUID]bool{bob.ID: true},
+		},
+		{name: "invalid id", ids: bob.ID.String() + ",nope", want: http.StatusBadRequest},
+		{name: "too many ids", ids: strings.Join(tooMany, ","), want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ts.do(http.MethodGet, "/api/presence?ids="+url.QueryEscape(tt.ids), "", nil, ts.token(t, alice))
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var resp PresenceResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(resp.Statuses, tt.wantStatuses) {
+				t.Fatalf("statuses %v, want %v", resp.Statuses, tt.wantStatuses)
+			}
+			if len(resp.Online) != 1 || resp.Online[0] != bob.ID {
+				t.Fatalf("online %v, want only bob", resp.Online)
+			}
+		})
+	}
+}
@@ -3,26 +3,36 @@ package httpserver
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/internal/session"
 )
 
 func (s *Server) setupRoutes() *chi.Mux {
 	r := chi.NewRouter()
 
 	// Middleware block
-	// r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
+	r.Use(s.RequestLogger)
+	r.Use(middleware.Recoverer)
 	r.Use(middleware.Compress(5))
 
+	// Readiness probe, reports degraded dependencies without failing
+	r.Get("/readyz", s.HandleReadyz)
+
 	// API routes
 	r.Route("/api", func(r chi.Router) {
 		r.Get("/hello", s.HandleHello)
 
 		// Public auth routes (no auth required)
 		r.Route("/auth", func(r chi.Router) {
+			r.Use(s.RateLimitMiddleware("auth", func() session.RateLimit {
+				return s.options().AuthRateLimit
+			}))
+
 			r.Post("/signup", s.HandleSignup)
 			r.Post("/signin", s.HandleSignin)
 			r.Post("/refresh", s.HandleRefreshToken)
+			r.Get("/verify", s.HandleVerifyEmail)
 		})
 
 		// Protected user routes (auth required)
@@ -31,10 +41,54 @@ func (s *Server) setupRoutes() *chi.Mux {
 
 			r.Get("/", s.HandleGetAllUsers)
 			r.Get("/email/{email}", s.HandleGetUserByEmail)
+			r.Get("/username/{username}", s.HandleGetUserByUsername)
 			r.Get("/{id}", s.HandleGetUserByID)
 			r.Post("/", s.HandleCreateUser)
+			r.Post("/password", s.HandleChangePassword)
+			r.Post("/block/{id}", s.HandleBlockUser)
+			r.Delete("/block/{id}", s.HandleUnblockUser)
+			r.Patch("/{id}", s.HandleUpdateUser)
 			r.Delete("/{id}", s.HandleDeleteUser)
 		})
+
+		// Protected contact routes (auth required)
+		r.Route("/contacts", func(r chi.Router) {
+			r.Use(s.AuthMiddleware)
+
+			r.Get("/", s.HandleListContacts)
+			r.Post("/{id}", s.HandleAddContact)
+			r.Delete("/{id}", s.HandleRemoveContact)
+		})
+
+		// Protected presence route (auth required)
+		r.With(s.AuthMiddleware).Get("/presence", s.HandleGetPresence)
+
+		// Protected voice message routes (auth required)
+		r.Route("/messages", func(r chi.Router) {
+			r.Use(s.AuthMiddleware)
+
+			r.Get("/", s.HandleListMessages)
+			r.Get("/search", s.HandleSearchMessages)
+			r.Post("/", s.HandleUploadMessage)
+			r.Delete("/", s.HandleDeleteMessages)
+			r.Post("/upload-url", s.HandleCreateUploadURL)
+			r.Post("/{id}/complete", s.HandleCompleteUpload)
+			r.Get("/{id}/download-url", s.HandleGetDownloadURL)
+			r.Get("/{id}/peaks", s.HandleGetMessagePeaks)
+			r.Post("/{id}/archive", s.HandleArchiveMessage)
+			r.Post("/{id}/unarchive", s.HandleUnarchiveMessage)
+			r.Get("/failed", s.HandleListFailedMessages)
+		})
+
+		// Admin routes (auth and the admin role required)
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(s.AuthMiddleware)
+			r.Use(s.RequireRole(db.RoleAdmin))
+
+			r.Get("/sessions", s.HandleListSessions)
+			r.Delete("/sessions/{userID}", s.HandleDeleteSession)
+			r.Post("/messages/failed/{id}/retry", s.HandleRetryFailedMessage)
+		})
 	})
 
 	return r
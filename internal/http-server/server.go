@@ -3,28 +3,118 @@ package httpserver
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
 	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/internal/session"
 	"github.com/rx3lixir/laba/pkg/jwt"
+	"github.com/rx3lixir/laba/pkg/mailer"
+	"github.com/rx3lixir/laba/pkg/password"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+	"github.com/rx3lixir/laba/pkg/webhook"
 )
 
+// Options holds tunable HTTP server behaviour
+type Options struct {
+	// AuthRateLimit limits requests per client IP on the /auth routes
+	AuthRateLimit session.RateLimit
+
+	// MaxUploadSize caps the size of an uploaded voice message in bytes
+	MaxUploadSize int64
+
+	// AutoMarkListened marks a message as listened once its recipient fetches a download link
+	AutoMarkListened bool
+
+	// StrictAudio rejects uploads whose audio isn't structurally valid
+	StrictAudio bool
+
+	// PublicURL is the externally reachable base URL used in emailed links
+	PublicURL string
+
+	// VerificationTTL is how long an email verification link stays valid
+	VerificationTTL time.Duration
+
+	// RequireVerifiedEmail refuses uploads from users who haven't verified their email
+	RequireVerifiedEmail bool
+
+	// TLS enables HTTPS. Only read on New and Start, changing it requires a restart
+	TLS TLSOptions
+}
+
+// TLSOptions configures HTTPS for the server
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+
+	// RedirectAddr, when set, serves plain HTTP there and redirects every request to HTTPS
+	RedirectAddr string
+}
+
+// Enabled reports whether the server should serve HTTPS
+func (t TLSOptions) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// MessageForwarder pushes a stored message to its recipient if they are online
+type MessageForwarder interface {
+	ForwardMessage(messageID, senderID, recipientID uuid.UUID, data []byte)
+}
+
 type Server struct {
-	userStore  db.UserStore
-	jwtService *jwt.Service
-	log        *log.Logger
-	httpServer *http.Server
-	ctx        context.Context
+	opts           atomic.Pointer[Options]
+	userStore      db.UserStore
+	messageStore   db.MessageStore
+	contactStore   db.ContactStore
+	blockStore     db.BlockStore
+	sessionManager *session.Manager
+	s3Client       s3storage.ObjectStore
+	forwarder      MessageForwarder
+	jwtService     *jwt.Service
+	hasher         *password.Hasher
+	mailer         mailer.Mailer
+	webhooks       *webhook.Dispatcher
+	log            *log.Logger
+	httpServer     *http.Server
+	redirectServer *http.Server
+	ctx            context.Context
 }
 
-func New(addr string, userStore db.UserStore, jwtService *jwt.Service, logger *log.Logger) *Server {
+func New(
+	addr string,
+	opts Options,
+	userStore db.UserStore,
+	messageStore db.MessageStore,
+	contactStore db.ContactStore,
+	blockStore db.BlockStore,
+	sessionManager *session.Manager,
+	s3Client s3storage.ObjectStore,
+	forwarder MessageForwarder,
+	jwtService *jwt.Service,
+	hasher *password.Hasher,
+	mailer mailer.Mailer,
+	webhooks *webhook.Dispatcher,
+	logger *log.Logger,
+) *Server {
 	s := &Server{
-		userStore:  userStore,
-		jwtService: jwtService,
-		log:        logger,
+		userStore:      userStore,
+		messageStore:   messageStore,
+		contactStore:   contactStore,
+		blockStore:     blockStore,
+		sessionManager: sessionManager,
+		s3Client:       s3Client,
+		forwarder:      forwarder,
+		jwtService:     jwtService,
+		hasher:         hasher,
+		mailer:         mailer,
+		webhooks:       webhooks,
+		log:            logger,
 	}
+	s.opts.Store(&opts)
 
 	router := s.setupRoutes()
 
@@ -36,28 +126,97 @@ func New(addr string, userStore db.UserStore, jwtService *jwt.Service, logger *l
 		IdleTimeout:  60 * time.Second,
 	}
 
+	if opts.TLS.Enabled() && opts.TLS.RedirectAddr != "" {
+		s.redirectServer = &http.Server{
+			Addr:         opts.TLS.RedirectAddr,
+			Handler:      s.redirectToHTTPS(),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		}
+	}
+
 	return s
 }
 
-// Start begins listening fot HTTP requests
+// SetOptions swaps the server tunables at runtime
+func (s *Server) SetOptions(opts Options) {
+	s.opts.Store(&opts)
+}
+
+// options returns the current server tunables
+func (s *Server) options() *Options {
+	return s.opts.Load()
+}
+
+// Start begins listening fot HTTP requests.
+// Serves HTTPS when TLS is configured, plain HTTP otherwise
 func (s *Server) Start() error {
+	tlsOpts := s.options().TLS
+
+	if !tlsOpts.Enabled() {
+		s.log.Info(
+			"Starting HTTP server",
+			"addr", s.httpServer.Addr,
+		)
+
+		if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+
+	if s.redirectServer != nil {
+		go func() {
+			s.log.Info("Starting HTTP to HTTPS redirect", "addr", s.redirectServer.Addr)
+
+			if err := s.redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.log.Error("HTTPS redirect server failed", "error", err)
+			}
+		}()
+	}
+
 	s.log.Info(
-		"Starting HTTP server",
+		"Starting HTTPS server",
 		"addr", s.httpServer.Addr,
 	)
 
-	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	if err := s.httpServer.ListenAndServeTLS(tlsOpts.CertFile, tlsOpts.KeyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 
 	return nil
 }
 
+// redirectToHTTPS permanently redirects every request to the same URL on the HTTPS listener
+func (s *Server) redirectToHTTPS() http.Handler {
+	_, port, _ := net.SplitHostPort(s.httpServer.Addr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
 // Shutdown gracefully shuts down the server
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.log.Info(
 		"Server shutting down gracefully...",
 		"addr", s.httpServer.Addr,
 	)
+
+	if s.redirectServer != nil {
+		if err := s.redirectServer.Shutdown(ctx); err != nil {
+			s.log.Warn("HTTPS redirect server shutdown failed", "error", err)
+		}
+	}
+
 	return s.httpServer.Shutdown(ctx)
 }
@@ -73,3 +73,161 @@ type RefreshTokenResponse struct {
 	RefreshToken string `json:"refresh_token"`
 	TokenType    string `json:"token_type"`
 }
+
+type UploadMessageResponse struct {
+	ID          uuid.UUID `json:"id"`
+	Status      string    `json:"status"`
+	FileSize    int       `json:"file_size"`
+	AudioFormat string    `json:"audio_format"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type UploadURLRequest struct {
+	RecipientID uuid.UUID `json:"recipient_id"`
+	AudioFormat string    `json:"audio_format"`
+}
+
+type UploadURLResponse struct {
+	MessageID uuid.UUID `json:"message_id"`
+	UploadURL string    `json:"upload_url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ReceivedMessageInfo struct {
+	ID          uuid.UUID  `json:"id"`
+	SenderID    uuid.UUID  `json:"sender_id"`
+	FileSize    int        `json:"file_size"`
+	Duration    *int       `json:"duration_seconds,omitempty"`
+	AudioFormat string     `json:"audio_format"`
+	Status      string     `json:"status"`
+	Archived    bool       `json:"archived"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ListenedAt  *time.Time `json:"listened_at,omitempty"`
+}
+
+type ListMessagesResponse struct {
+	Messages []ReceivedMessageInfo `json:"messages"`
+	Folder   string                `json:"folder"`
+	Limit    int                   `json:"limit"`
+	Offset   int                   `json:"offset"`
+}
+
+type SearchMessagesResponse struct {
+	Messages []ReceivedMessageInfo `json:"messages"`
+	Limit    int                   `json:"limit"`
+	Offset   int                   `json:"offset"`
+}
+
+type ArchiveMessageResponse struct {
+	MessageID uuid.UUID `json:"message_id"`
+	Archived  bool      `json:"archived"`
+}
+
+type DeleteMessagesResponse struct {
+	Message string `json:"message"`
+	Deleted int    `json:"deleted"`
+}
+
+type DownloadURLResponse struct {
+	MessageID   uuid.UUID `json:"message_id"`
+	DownloadURL string    `json:"download_url"`
+	Filename    string    `json:"filename"`
+	Compressed  bool      `json:"compressed"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type MessagePeaksResponse struct {
+	MessageID uuid.UUID `json:"message_id"`
+	Peaks     []float32 `json:"peaks"`
+}
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type ChangePasswordResponse struct {
+	Message string `json:"message"`
+}
+
+// UpdateUserRequest only carries the fields that should change
+type UpdateUserRequest struct {
+	Username *string `json:"username,omitempty"`
+	Email    *string `json:"email,omitempty"`
+}
+
+// ContactInfo is a contact along with when they were last online
+type ContactInfo struct {
+	UserResponse
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+type ListContactsResponse struct {
+	Contacts []ContactInfo `json:"contacts"`
+	Limit    int           `json:"limit"`
+	Offset   int           `json:"offset"`
+}
+
+type ContactResponse struct {
+	Message   string    `json:"message"`
+	ContactID uuid.UUID `json:"contact_id"`
+}
+
+type PresenceResponse struct {
+	Online   []uuid.UUID             `json:"online"`
+	LastSeen map[uuid.UUID]time.Time `json:"last_seen"`
+	// Statuses answers every asked ID when specific users were asked for
+	Statuses map[uuid.UUID]bool `json:"statuses,omitempty"`
+}
+
+type BlockResponse struct {
+	Message string    `json:"message"`
+	UserID  uuid.UUID `json:"user_id"`
+}
+
+type ReadinessResponse struct {
+	Status string `json:"status"`
+	Valkey string `json:"valkey"`
+}
+
+type FailedMessageInfo struct {
+	MessageID   uuid.UUID `json:"message_id"`
+	RecipientID uuid.UUID `json:"recipient_id"`
+	Reason      string    `json:"reason"`
+	FailedAt    time.Time `json:"failed_at"`
+}
+
+type ListFailedMessagesResponse struct {
+	Messages []FailedMessageInfo `json:"messages"`
+	Limit    int                 `json:"limit"`
+	Offset   int                 `json:"offset"`
+}
+
+type RetryMessageResponse struct {
+	Message   string    `json:"message"`
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+type SessionInfo struct {
+	UserID      uuid.UUID  `json:"user_id"`
+	Username    string     `json:"username"`
+	Address     string     `json:"address"`
+	ConnectedAt time.Time  `json:"connected_at"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	Encrypted   bool       `json:"encrypted"`
+}
+
+type ListSessionsResponse struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+type DeleteSessionResponse struct {
+	Message string    `json:"message"`
+	UserID  uuid.UUID `json:"user_id"`
+}
+
+type VerifyEmailResponse struct {
+	Message string    `json:"message"`
+	UserID  uuid.UUID `json:"user_id"`
+}
@@ -3,7 +3,6 @@ package httpserver
 import (
 	"encoding/json"
 	"net/http"
-	"strconv"
 	"strings"
 
 	"github.com/charmbracelet/log"
@@ -19,7 +18,7 @@ func (s *Server) HandleHello(w http.ResponseWriter, r *http.Request) {
 		"status":  "success",
 	}
 
-	s.log.Info("Recieved", "handler", "HandleHello")
+	s.logFor(r).Info("Recieved", "handler", "HandleHello")
 
 	s.respondJSON(w, http.StatusOK, response)
 }
@@ -32,7 +31,7 @@ func (s *Server) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.log.Info(
+	s.logFor(r).Info(
 		"recieved request",
 		"handler", "HandleAddUser",
 		"email", req.Email,
@@ -51,9 +50,9 @@ func (s *Server) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Password hashing
-	hashedPassword, err := password.Hash(req.Password)
+	hashedPassword, err := s.hasher.Hash(req.Password)
 	if err != nil {
-		s.log.Error("Failed to hash password", "error", err)
+		s.logFor(r).Error("Failed to hash password", "error", err)
 		s.respondError(w, http.StatusInternalServerError, "Failed to proccess password")
 		return
 	}
@@ -67,8 +66,8 @@ func (s *Server) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
 
 	// Saving user to database
 	if err := s.userStore.CreateUser(r.Context(), newUser); err != nil {
-		s.log.Error("Failed to create user", "error", err)
-		s.respondError(w, http.StatusInternalServerError, "Failed to add user to database")
+		s.logFor(r).Error("Failed to create user", "error", err)
+		s.handleError(w, err)
 		return
 	}
 
@@ -80,7 +79,7 @@ func (s *Server) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
 		CreatedAt: newUser.CreatedAt,
 	}
 
-	s.log.Info(
+	s.logFor(r).Info(
 		"User created successfully",
 		"user_email", newUser.Email,
 		"user_id", newUser.ID,
@@ -103,7 +102,7 @@ func (s *Server) HandleGetUserByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.log.Info("Received request",
+	s.logFor(r).Info("Received request",
 		"handler", "HandleGetUserByID",
 		"id", id,
 	)
@@ -124,7 +123,7 @@ func (s *Server) HandleGetUserByID(w http.ResponseWriter, r *http.Request) {
 		UpdatedAt: user.UpdatedAt,
 	}
 
-	s.log.Info(
+	s.logFor(r).Info(
 		"User created successfully",
 		"user_email", user.Email,
 		"user_id", user.ID,
@@ -136,30 +135,9 @@ func (s *Server) HandleGetUserByID(w http.ResponseWriter, r *http.Request) {
 
 // Handles getting all users from database
 func (s *Server) HandleGetAllUsers(w http.ResponseWriter, r *http.Request) {
-	s.log.Info("Recieved request", "handler", "HandleGetAllUsers")
-
-	limitQuery := r.URL.Query().Get("limit")
-	offsetQuery := r.URL.Query().Get("offset")
-
-	// Default values
-	limit := 10
-	offset := 0
-
-	if limitQuery != "" {
-		if parsedLimit, err := strconv.Atoi(limitQuery); err == nil && parsedLimit > 0 {
-			limit = parsedLimit
-			// To prevent abuse
-			if limit > 100 {
-				limit = 100
-			}
-		}
-	}
+	s.logFor(r).Info("Recieved request", "handler", "HandleGetAllUsers")
 
-	if offsetQuery != "" {
-		if parsedOffset, err := strconv.Atoi(offsetQuery); err == nil && parsedOffset >= 0 {
-			offset = parsedOffset
-		}
-	}
+	limit, offset := parsePagination(r)
 
 	// Get users from database
 	users, err := s.userStore.GetUsers(r.Context(), limit, offset)
@@ -168,7 +146,13 @@ func (s *Server) HandleGetAllUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.log.Info("Got users", "count", len(users))
+	totalCount, err := s.userStore.CountUsers(r.Context())
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.logFor(r).Info("Got users", "count", len(users), "total", totalCount)
 
 	userResponses := make([]UserResponse, 0, len(users))
 
@@ -184,12 +168,12 @@ func (s *Server) HandleGetAllUsers(w http.ResponseWriter, r *http.Request) {
 
 	response := GetAllUsersResponse{
 		Users:      userResponses,
-		TotalCount: len(userResponses),
+		TotalCount: totalCount,
 		Limit:      limit,
 		Offset:     offset,
 	}
 
-	s.log.Info("Users retrieved successfully", "count", len(users))
+	s.logFor(r).Info("Users retrieved successfully", "count", len(users))
 
 	// Writing a response
 	s.respondJSON(w, http.StatusOK, response)
@@ -203,7 +187,7 @@ func (s *Server) HandleGetUserByEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.log.Info("Recieved request",
+	s.logFor(r).Info("Recieved request",
 		"handler", "HandleGetUsersByEmail",
 		"email", email,
 	)
@@ -228,6 +212,117 @@ func (s *Server) HandleGetUserByEmail(w http.ResponseWriter, r *http.Request) {
 	s.respondJSON(w, http.StatusOK, response)
 }
 
+// Handles resolving a username to a user, ignoring case
+func (s *Server) HandleGetUserByUsername(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	if username == "" {
+		s.respondError(w, http.StatusBadRequest, "Username is required")
+		return
+	}
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleGetUserByUsername",
+		"username", username,
+	)
+
+	user, err := s.userStore.GetUserByUsername(r.Context(), username)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	response := UserResponse{
+		ID:        user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}
+
+	s.respondJSON(w, http.StatusOK, response)
+}
+
+// Handles updating the profile of the calling user
+func (s *Server) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		s.respondError(w, http.StatusBadRequest, "User ID is required")
+		return
+	}
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid user ID format")
+		return
+	}
+
+	callerID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Users can only edit their own record
+	if callerID != userID {
+		s.logFor(r).Warn("Forbidden profile update attempt", "caller_id", callerID, "user_id", userID)
+		s.respondError(w, http.StatusForbidden, "You can only update your own profile")
+		return
+	}
+
+	req := new(UpdateUserRequest)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleUpdateUser",
+		"id", userID,
+	)
+
+	if err := validateUpdateUserRequest(req); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	user, err := s.userStore.GetUserByID(r.Context(), userID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if req.Username != nil {
+		user.Username = *req.Username
+	}
+	previousEmail := user.Email
+	if req.Email != nil {
+		user.Email = strings.ToLower(strings.TrimSpace(*req.Email))
+	}
+
+	if err := s.userStore.UpdateUser(r.Context(), user); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	// A new address is unverified until its owner confirms it
+	if user.Email != previousEmail {
+		if err := s.sendVerification(r.Context(), user); err != nil {
+			s.logFor(r).Error("Failed to send verification email", "user_id", user.ID, "error", err)
+		}
+	}
+
+	response := UserResponse{
+		ID:        user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}
+
+	s.logFor(r).Info("User updated successfully", "user_id", user.ID)
+	s.respondJSON(w, http.StatusOK, response)
+}
+
 // Handles deleting user from database
 func (s *Server) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
@@ -243,21 +338,113 @@ func (s *Server) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.log.Debug("Received request",
+	callerID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	s.logFor(r).Debug("Received request",
 		"handler", "HandleDeleteUser",
 		"id", userID,
+		"caller_id", callerID,
 	)
 
+	// Users can only delete their own account
+	if callerID != userID {
+		s.logFor(r).Warn("Forbidden account deletion attempt", "caller_id", callerID, "user_id", userID)
+		s.respondError(w, http.StatusForbidden, "You can only delete your own account")
+		return
+	}
+
 	if err := s.userStore.DeleteUser(r.Context(), userID); err != nil {
 		s.handleError(w, err)
 		return
 	}
 
+	// A deleted account must not stay logged in anywhere
+	if err := s.sessionManager.DeleteSession(r.Context(), userID); err != nil {
+		s.logFor(r).Warn("Failed to delete session of deleted user", "user_id", userID, "error", err)
+	}
+	if err := s.sessionManager.RevokeUserTokens(r.Context(), userID, s.jwtService.RefreshTokenDuration()); err != nil {
+		s.logFor(r).Error("Failed to revoke tokens of deleted user", "user_id", userID, "error", err)
+	}
+
 	response := DeleteUserResponse{
 		Message: "User deleted successfully",
 		ID:      userID,
 	}
 
-	s.log.Debug("User deleted successfully", "user_id", userID)
+	s.logFor(r).Debug("User deleted successfully", "user_id", userID)
 	s.respondJSON(w, http.StatusOK, response)
 }
+
+// Handles changing the password of the calling user
+func (s *Server) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		s.respondError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	req := new(ChangePasswordRequest)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondError(w, http.StatusBadRequest, "Invalid JSON format")
+		return
+	}
+
+	s.logFor(r).Info("Received request",
+		"handler", "HandleChangePassword",
+		"user_id", userID,
+	)
+
+	if req.OldPassword == "" {
+		s.respondError(w, http.StatusBadRequest, "Old password is required")
+		return
+	}
+
+	user, err := s.userStore.GetUserByID(r.Context(), userID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if err := password.Verify(user.Password, req.OldPassword); err != nil {
+		s.logFor(r).Warn("Password change failed - old password is invalid", "user_id", userID)
+		s.respondError(w, http.StatusForbidden, "Old password is incorrect")
+		return
+	}
+
+	if err := validatePassword(req.NewPassword); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	hashedPassword, err := s.hasher.Hash(req.NewPassword)
+	if err != nil {
+		s.logFor(r).Error("Failed to hash password", "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Failed to process password")
+		return
+	}
+
+	if err := s.userStore.UpdatePassword(r.Context(), userID, hashedPassword); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	// Log out everywhere: drop the UDP session and every issued token
+	if err := s.sessionManager.DeleteSession(r.Context(), userID); err != nil {
+		s.logFor(r).Warn("Failed to delete session after password change", "user_id", userID, "error", err)
+	}
+
+	if err := s.sessionManager.RevokeUserTokens(r.Context(), userID, s.jwtService.RefreshTokenDuration()); err != nil {
+		s.logFor(r).Error("Failed to revoke tokens after password change", "user_id", userID, "error", err)
+		s.respondError(w, http.StatusInternalServerError, "Password changed but failed to revoke existing tokens")
+		return
+	}
+
+	s.logFor(r).Info("Password changed successfully", "user_id", userID)
+	s.respondJSON(w, http.StatusOK, ChangePasswordResponse{
+		Message: "Password changed successfully",
+	})
+}
@@ -0,0 +1,263 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/pkg/password"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// duplicateUserStore refuses every new user the way the Postgres store
+// does on a unique violation
+type duplicateUserStore struct {
+	db.UserStore
+	err error
+}
+
+func (s *duplicateUserStore) CreateUser(ctx context.Context, user *db.User) error {
+	return s.err
+}
+
+func TestCreateDuplicateUserIsConflict(t *testing.T) {
+	hasher, err := password.NewHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("NewHasher: %v", err)
+	}
+
+	for _, field := range []string{"email", "username"} {
+		t.Run(field, func(t *testing.T) {
+			s := &Server{
+				userStore: &duplicateUserStore{err: fmt.Errorf("user with this %s already exists", field)},
+				hasher:    hasher,
+				log:       log.New(io.Discard),
+			}
+
+			body := `{"username":"alice","email":"alice@example.com","password":"Secret123!"}`
+			req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+
+			s.HandleCreateUser(rec, req)
+
+			if rec.Code != http.StatusConflict {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, http.StatusConflict, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), field) {
+				t.Errorf("body %s does not name the duplicate %s", rec.Body, field)
+			}
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name        string
+		oldPassword string
+		newPassword string
+		want        int
+	}{
+		{"wrong old password", "Wrong123!", "Better456!", http.StatusForbidden},
+		{"weak new password", testPassword, "weak", http.StatusBadRequest},
+		{"success", testPassword, "Better456!", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, Options{})
+			alice := ts.addUser(t, "alice", db.RoleUser)
+
+			body := fmt.Sprintf(`{"old_password":%q,"new_password":%q}`, tt.oldPassword, tt.newPassword)
+			rec := ts.doJSON(http.MethodPost, "/api/user/password", body, ts.token(t, alice))
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+
+			stored := ts.users.user(alice.ID).Password
+			changed := password.Verify(stored, tt.newPassword) == nil
+			if changed != (tt.want == http.StatusOK) {
+				t.Fatalf("password changed = %v", changed)
+			}
+			if !changed && password.Verify(stored, testPassword) != nil {
+				t.Fatal("refused change broke the old password")
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+
+	rec := ts.doJSON(http.MethodPatch, "/api/user/"+alice.ID.String(), `{"username":"alicia","email":"Alicia@Example.com"}`, ts.token(t, alice))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	stored := ts.users.user(alice.ID)
+	if stored.Username != "alicia" || stored.Email != "alicia@example.com" {
+		t.Fatalf("stored %s <%s>", stored.Username, stored.Email)
+	}
+	if stored.EmailVerified {
+		t.Error("new email counts as verified")
+	}
+	if mails := ts.mailer.mails(); len(mails) != 1 || mails[0].to != "alicia@example.com" {
+		t.Errorf("sent %v, want a verification email to the new address", mails)
+	}
+}
+
+func TestUpdateUserConflict(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	ts.addUser(t, "bob", db.RoleUser)
+
+	rec := ts.doJSON(http.MethodPatch, "/api/user/"+alice.ID.String(), `{"email":"bob@example.com"}`, ts.token(t, alice))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+	if stored := ts.users.user(alice.ID); stored.Email != alice.Email {
+		t.Fatalf("email changed to %s", stored.Email)
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	admin := ts.addUser(t, "admin", db.RoleAdmin)
+	token := ts.token(t, admin)
+
+	body := `{"username":"alice","email":" Alice@Example.com ","password":"Secret123!"}`
+	if rec := ts.doJSON(http.MethodPost, "/api/user/", body, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("created without a token: status %d", rec.Code)
+	}
+
+	rec := ts.doJSON(http.MethodPost, "/api/user/", body, token)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var created CreateUserResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Username != "alice" || created.Email != "alice@example.com" {
+		t.Fatalf("created %s <%s>", created.Username, created.Email)
+	}
+
+	stored := ts.users.user(created.ID)
+	if stored == nil || password.Verify(stored.Password, "Secret123!") != nil {
+		t.Fatal("user was not stored with a hash of the password")
+	}
+
+	rec = ts.do(http.MethodGet, "/api/user/"+created.ID.String(), "", nil, token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get: status %d: %s", rec.Code, rec.Body)
+	}
+	var fetched UserResponse
+	if err := json.NewDecoder(rec.Body).Decode(&fetched); err != nil {
+		t.Fatal(err)
+	}
+	if fetched.ID != created.ID || fetched.Username != created.Username || fetched.Email != created.Email {
+		t.Fatalf("fetched %+v, want %+v", fetched, created)
+	}
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	token := ts.token(t, ts.addUser(t, "admin", db.RoleAdmin))
+
+	for _, body := range []string{
+		`{"username":"alice","email":"alice@example.com","password":"weak"}`,
+		`{"username":"alice","email":"not an email","password":"Secret123!"}`,
+		`{"username":"","email":"alice@example.com","password":"Secret123!"}`,
+		`{"username":`,
+	} {
+		if rec := ts.doJSON(http.MethodPost, "/api/user/", body, token); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if n := len(ts.users.users); n != 1 {
+		t.Fatalf("%d users stored, want only the admin", n)
+	}
+}
+
+func TestGetAllUsersPagination(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	var token string
+	for i := 0; i < 5; i++ {
+		token = ts.token(t, ts.addUser(t, fmt.Sprintf("user%d", i), db.RoleUser))
+	}
+
+	tests := []struct {
+		query     string
+		wantUsers int
+	}{
+		{"?limit=2", 2},
+		{"?limit=2&offset=4", 1},
+		{"?offset=5", 0},
+		{"?limit=500", 5},
+	}
+
+	seen := make(map[uuid.UUID]bool)
+	for _, tt := range tests {
+		rec := ts.do(http.MethodGet, "/api/user/"+tt.query, "", nil, token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.query, rec.Code, rec.Body)
+		}
+
+		var resp GetAllUsersResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Users) != tt.wantUsers || resp.TotalCount != 5 {
+			t.Errorf("%s: %d users of %d, want %d of 5", tt.query, len(resp.Users), resp.TotalCount, tt.wantUsers)
+		}
+		if tt.query == "?limit=500" && resp.Limit != 100 {
+			t.Errorf("limit %d, want it capped at 100", resp.Limit)
+		}
+		for _, user := range resp.Users {
+			seen[user.ID] = true
+		}
+	}
+	if len(seen) != 5 {
+		t.Fatalf("pages covered %d users, want 5", len(seen))
+	}
+}
+
+func TestDeletedUserIsNotListed(t *testing.T) {
+	ts := newTestServer(t, Options{})
+	alice := ts.addUser(t, "alice", db.RoleUser)
+	bob := ts.addUser(t, "bob", db.RoleUser)
+	bobToken := ts.token(t, bob)
+
+	if rec := ts.do(http.MethodDelete, "/api/user/"+alice.ID.String(), "", nil, bobToken); rec.Code != http.StatusForbidden {
+		t.Fatalf("deleted someone else: status %d", rec.Code)
+	}
+	if rec := ts.do(http.MethodDelete, "/api/user/"+alice.ID.String(), "", nil, ts.token(t, alice)); rec.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := ts.do(http.MethodGet, "/api/user/"+alice.ID.String(), "", nil, bobToken); rec.Code != http.StatusNotFound {
+		t.Fatalf("deleted user is still found: status %d", rec.Code)
+	}
+
+	rec := ts.do(http.MethodGet, "/api/user/", "", nil, bobToken)
+	var resp GetAllUsersResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.TotalCount != 1 || len(resp.Users) != 1 || resp.Users[0].ID != bob.ID {
+		t.Fatalf("listed %+v, want only bob", resp)
+	}
+
+	// The row is kept for the messages alice already sent
+	if stored := ts.users.user(alice.ID); stored == nil || stored.DeletedAt == nil {
+		t.Fatal("deleted user was removed instead of marked deleted")
+	}
+}
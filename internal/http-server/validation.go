@@ -5,30 +5,66 @@ import (
 )
 
 func validateCreateUserRequest(req *CreateUserRequest) error {
-	if req.Username == "" {
+	if err := validateUsername(req.Username); err != nil {
+		return err
+	}
+
+	if err := validateEmail(req.Email); err != nil {
+		return err
+	}
+
+	if err := validatePassword(req.Password); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateUpdateUserRequest(req *UpdateUserRequest) error {
+	if req.Username == nil && req.Email == nil {
+		return NewValidationError("Nothing to update")
+	}
+
+	if req.Username != nil {
+		if err := validateUsername(*req.Username); err != nil {
+			return err
+		}
+	}
+
+	if req.Email != nil {
+		if err := validateEmail(*req.Email); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateUsername(username string) error {
+	if username == "" {
 		return NewValidationError("Username is required")
 	}
 
-	if len(req.Username) < 2 {
+	if len(username) < 2 {
 		return NewValidationError("Username must be at least 2 characters long")
 	}
 
-	if len(req.Username) > 28 {
+	if len(username) > 28 {
 		return NewValidationError("Username must be not more that 28 characters long")
 	}
 
-	if req.Email == "" {
+	return nil
+}
+
+func validateEmail(email string) error {
+	if email == "" {
 		return NewValidationError("Email is required")
 	}
 
-	if !strings.Contains(req.Email, "@") || !strings.Contains(req.Email, ".") {
+	if !strings.Contains(email, "@") || !strings.Contains(email, ".") {
 		return NewValidationError("Invalid email format")
 	}
 
-	if err := validatePassword(req.Password); err != nil {
-		return err
-	}
-
 	return nil
 }
 
@@ -0,0 +1,95 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+)
+
+// defaultVerificationTTL is used when no verification TTL is configured
+const defaultVerificationTTL = 24 * time.Hour
+
+// HandleVerifyEmail marks the email of the user a verification token was issued to as verified
+func (s *Server) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		s.respondError(w, http.StatusBadRequest, "Verification token is required")
+		return
+	}
+
+	userID, email, err := s.sessionManager.ConsumeVerificationToken(r.Context(), token)
+	if err != nil {
+		s.logFor(r).Warn("Email verification failed", "error", err)
+		s.handleError(w, err)
+		return
+	}
+
+	if err := s.userStore.MarkEmailVerified(r.Context(), userID, email); err != nil {
+		s.logFor(r).Error("Failed to mark email verified", "user_id", userID, "error", err)
+		s.handleError(w, err)
+		return
+	}
+
+	s.logFor(r).Info("Email verified", "user_id", userID)
+
+	s.respondJSON(w, http.StatusOK, VerifyEmailResponse{
+		Message: "Email verified successfully",
+		UserID:  userID,
+	})
+}
+
+// sendVerification issues a verification token for the user and mails them the link
+func (s *Server) sendVerification(ctx context.Context, user *db.User) error {
+	ttl := s.options().VerificationTTL
+	if ttl <= 0 {
+		ttl = defaultVerificationTTL
+	}
+
+	token, err := s.sessionManager.CreateVerificationToken(ctx, user.ID, user.Email, ttl)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf(
+		"%s/api/auth/verify?token=%s",
+		strings.TrimRight(s.options().PublicURL, "/"),
+		url.QueryEscape(token),
+	)
+
+	body := fmt.Sprintf(
+		"Hi %s,\n\nConfirm your email address by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+		user.Username, link, ttl,
+	)
+
+	if err := s.mailer.Send(ctx, user.Email, "Verify your email", body); err != nil {
+		return fmt.Errorf("failed to send verification email: %w", err)
+	}
+
+	return nil
+}
+
+// requireVerified responds with 403 and returns false when the sender has to verify their email first
+func (s *Server) requireVerified(w http.ResponseWriter, r *http.Request, senderID uuid.UUID) bool {
+	if !s.options().RequireVerifiedEmail {
+		return true
+	}
+
+	sender, err := s.userStore.GetUserByID(r.Context(), senderID)
+	if err != nil {
+		s.handleError(w, err)
+		return false
+	}
+
+	if !sender.EmailVerified {
+		s.respondError(w, http.StatusForbidden, "Verify your email before sending messages")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,145 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rx3lixir/laba/internal/db"
+)
+
+// verificationToken pulls the token out of the link in a verification email
+var verificationToken = regexp.MustCompile(`/api/auth/verify\?token=([0-9a-f]+)`)
+
+func TestSignupVerifiesEmail(t *testing.T) {
+	ts := newTestServer(t, Options{PublicURL: "https://laba.example.com/"})
+
+	rec := ts.doJSON(http.MethodPost, "/api/auth/signup", fmt.Sprintf(`{"username":"alice","email":"alice@example.com","password":%q}`, testPassword), "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("signup status %d: %s", rec.Code, rec.Body)
+	}
+	var resp SignupResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if ts.users.user(resp.User.ID).EmailVerified {
+		t.Fatal("new account counts as verified")
+	}
+
+	mails := ts.mailer.mails()
+	if len(mails) != 1 || mails[0].to != "alice@example.com" {
+		t.Fatalf("sent %v, want one verification email to alice", mails)
+	}
+	match := verificationToken.FindStringSubmatch(mails[0].body)
+	if match == nil {
+		t.Fatalf("no verification link in %q", mails[0].body)
+	}
+	link := "/api/auth/verify?token=" + match[1]
+	if !strings.Contains(mails[0].body, "https://laba.example.com"+link) {
+		t.Errorf("link is not under the public URL: %q", mails[0].body)
+	}
+
+	rec = ts.do(http.MethodGet, link, "", nil, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("verify status %d: %s", rec.Code, rec.Body)
+	}
+	if !ts.users.user(resp.User.ID).EmailVerified {
+		t.Fatal("email is not verified after following the link")
+	}
+
+	// A token works only once
+	if rec := ts.do(http.MethodGet, link, "", nil, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reused token: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestVerifyEmailRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		// token returns the token to verify with, after any setup
+		token func(t *testing.T, ts *testServer, user *db.User) string
+		want  int
+	}{
+		{
+			name:  "missing token",
+			token: func(t *testing.T, ts *testServer, user *db.User) string { return "" },
+			want:  http.StatusBadRequest,
+		},
+		{
+			name:  "unknown token",
+			token: func(t *testing.T, ts *testServer, user *db.User) string { return "deadbeef" },
+			want:  http.StatusBadRequest,
+		},
+		{
+			name: "expired token",
+			token: func(t *testing.T, ts *testServer, user *db.User) string {
+				token, err := ts.sessions.CreateVerificationToken(t.Context(), user.ID, user.Email, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ts.valkey.FastForward(2 * time.Minute)
+				return token
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "email changed since the token was issued",
+			token: func(t *testing.T, ts *testServer, user *db.User) string {
+				token, err := ts.sessions.CreateVerificationToken(t.Context(), user.ID, "old@example.com", time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token
+			},
+			want: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, Options{})
+			alice := ts.addUser(t, "alice", db.RoleUser)
+			ts.users.users[alice.ID].EmailVerified = false
+
+			rec := ts.do(http.MethodGet, "/api/auth/verify?token="+tt.token(t, ts, alice), "", nil, "")
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if ts.users.user(alice.ID).EmailVerified {
+				t.Fatal("email was verified")
+			}
+		})
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		required bool
+		verified bool
+		want     int
+	}{
+		{"verified sender", true, true, http.StatusCreated},
+		{"unverified sender", true, false, http.StatusForbidden},
+		{"unverified sender when not required", false, false, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, Options{RequireVerifiedEmail: tt.required})
+			alice := ts.addUser(t, "alice", db.RoleUser)
+			bob := ts.addUser(t, "bob", db.RoleUser)
+			ts.users.users[alice.ID].EmailVerified = tt.verified
+
+			contentType, body := uploadForm(t, bob.ID, wavFile(make([]int16, 4000)))
+			rec := ts.do(http.MethodPost, "/api/messages/", contentType, body, ts.token(t, alice))
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
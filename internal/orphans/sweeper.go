@@ -0,0 +1,100 @@
+package orphans
+
+import (
+	"context"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+)
+
+// Sweeper deletes stored voice files that no message row points at,
+// e.g. when the database insert failed after a successful upload
+type Sweeper struct {
+	messageStore db.MessageStore
+	s3Client     s3storage.ObjectStore
+	prefix       string
+	gracePeriod  time.Duration
+	interval     time.Duration
+	log          *log.Logger
+}
+
+// New creates an orphan sweeper. Objects younger than gracePeriod are never touched,
+// their message row may simply not be written yet
+func New(
+	messageStore db.MessageStore,
+	s3Client s3storage.ObjectStore,
+	prefix string,
+	gracePeriod time.Duration,
+	interval time.Duration,
+	logger *log.Logger,
+) *Sweeper {
+	return &Sweeper{
+		messageStore: messageStore,
+		s3Client:     s3Client,
+		prefix:       prefix,
+		gracePeriod:  gracePeriod,
+		interval:     interval,
+		log:          logger,
+	}
+}
+
+// Run sweeps every interval until ctx is cancelled
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.Sweep(ctx)
+			if err != nil {
+				s.log.Error("Orphan sweep failed", "error", err)
+				continue
+			}
+			if deleted > 0 {
+				s.log.Info("Orphaned voice files deleted", "count", deleted)
+			}
+		}
+	}
+}
+
+// Sweep runs a single reconciliation pass and returns how many objects were deleted
+func (s *Sweeper) Sweep(ctx context.Context) (int, error) {
+	objects, err := s.s3Client.ListVoiceMessages(ctx, s.prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-s.gracePeriod)
+	deleted := 0
+
+	for _, object := range objects {
+		if object.LastModified.After(cutoff) {
+			continue
+		}
+
+		exists, err := s.messageStore.MessageFileExists(ctx, object.Key)
+		if err != nil {
+			// Keep going, one failed lookup must not stop the whole pass
+			s.log.Warn("Failed to check voice file", "object", object.Key, "error", err)
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		if err := s.s3Client.DeleteVoiceMessage(ctx, object.Key); err != nil {
+			s.log.Warn("Failed to delete orphaned voice file", "object", object.Key, "error", err)
+			continue
+		}
+
+		s.log.Info("Orphaned voice file deleted", "object", object.Key, "size", object.Size)
+		deleted++
+	}
+
+	return deleted, nil
+}
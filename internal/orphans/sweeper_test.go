@@ -0,0 +1,75 @@
+package orphans
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+)
+
+// stubObjects lists a fixed set of objects and records deletions
+type stubObjects struct {
+	s3storage.ObjectStore
+
+	objects []s3storage.ObjectInfo
+	prefix  string
+	deleted []string
+}
+
+func (s *stubObjects) ListVoiceMessages(ctx context.Context, prefix string) ([]s3storage.ObjectInfo, error) {
+	s.prefix = prefix
+	return s.objects, nil
+}
+
+func (s *stubObjects) DeleteVoiceMessage(ctx context.Context, objectName string) error {
+	s.deleted = append(s.deleted, objectName)
+	return nil
+}
+
+// stubMessages knows which files have a message row, lookups for failing keys error out
+type stubMessages struct {
+	db.MessageStore
+
+	files   map[string]bool
+	failing map[string]bool
+}
+
+func (s *stubMessages) MessageFileExists(ctx context.Context, filePath string) (bool, error) {
+	if s.failing[filePath] {
+		return false, errors.New("database is down")
+	}
+	return s.files[filePath], nil
+}
+
+func TestSweepDeletesOldOrphans(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	objects := &stubObjects{objects: []s3storage.ObjectInfo{
+		{Key: "voice-messages/orphan.opus", LastModified: old},
+		{Key: "voice-messages/stored.opus", LastModified: old},
+		{Key: "voice-messages/uploading.opus", LastModified: time.Now()},
+		{Key: "voice-messages/unknown.opus", LastModified: old},
+	}}
+	messages := &stubMessages{
+		files:   map[string]bool{"voice-messages/stored.opus": true},
+		failing: map[string]bool{"voice-messages/unknown.opus": true},
+	}
+
+	s := New(messages, objects, "voice-messages/", time.Hour, time.Minute, log.New(io.Discard))
+	deleted, err := s.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if objects.prefix != "voice-messages/" {
+		t.Errorf("listed %q, want the configured prefix", objects.prefix)
+	}
+	if deleted != 1 || !slices.Equal(objects.deleted, []string{"voice-messages/orphan.opus"}) {
+		t.Fatalf("deleted %d: %v, want only the old orphan", deleted, objects.deleted)
+	}
+}
@@ -0,0 +1,117 @@
+package session
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FailoverStore serves from valkey while it is healthy and from a local fallback while it is down.
+// Sessions and chunks written during an outage stay in the fallback, so clients that authenticated
+// then have to authenticate again once valkey comes back
+type FailoverStore struct {
+	primary  *Manager
+	fallback Store
+}
+
+// NewFailoverStore creates a store that switches between primary and fallback based on primary health
+func NewFailoverStore(primary *Manager, fallback Store) *FailoverStore {
+	return &FailoverStore{primary: primary, fallback: fallback}
+}
+
+// Degraded reports whether requests are currently served by the fallback
+func (f *FailoverStore) Degraded() bool {
+	return !f.primary.Healthy()
+}
+
+func (f *FailoverStore) active() Store {
+	if f.primary.Healthy() {
+		return f.primary
+	}
+	return f.fallback
+}
+
+func (f *FailoverStore) CreateSession(ctx context.Context, userID uuid.UUID, username string, addr *net.UDPAddr) error {
+	return f.active().CreateSession(ctx, userID, username, addr)
+}
+
+func (f *FailoverStore) GetSession(ctx context.Context, userID uuid.UUID) (*Session, error) {
+	return f.active().GetSession(ctx, userID)
+}
+
+func (f *FailoverStore) UpdateLastSeen(ctx context.Context, userID uuid.UUID) error {
+	return f.active().UpdateLastSeen(ctx, userID)
+}
+
+func (f *FailoverStore) SetSessionEncrypted(ctx context.Context, userID uuid.UUID, encrypted bool) error {
+	return f.active().SetSessionEncrypted(ctx, userID, encrypted)
+}
+
+func (f *FailoverStore) IsUserOnline(ctx context.Context, userID uuid.UUID) (bool, error) {
+	return f.active().IsUserOnline(ctx, userID)
+}
+
+func (f *FailoverStore) SaveChunkAndCount(ctx context.Context, messageID uuid.UUID, chunkIndex, totalChunks uint32, data []byte) (int64, bool, error) {
+	return f.active().SaveChunkAndCount(ctx, messageID, chunkIndex, totalChunks, data)
+}
+
+func (f *FailoverStore) GetAllPendingChunks(ctx context.Context, messageID uuid.UUID, totalChunks uint32) ([][]byte, error) {
+	return f.active().GetAllPendingChunks(ctx, messageID, totalChunks)
+}
+
+func (f *FailoverStore) GetChunksReceivedCount(ctx context.Context, messageID uuid.UUID) (int64, error) {
+	return f.active().GetChunksReceivedCount(ctx, messageID)
+}
+
+func (f *FailoverStore) DeletePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32) error {
+	return f.active().DeletePendingMessage(ctx, messageID, totalChunks)
+}
+
+func (f *FailoverStore) ExpirePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32, ttl time.Duration) error {
+	return f.active().ExpirePendingMessage(ctx, messageID, totalChunks, ttl)
+}
+
+func (f *FailoverStore) TouchPendingMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, totalChunks uint32) error {
+	return f.active().TouchPendingMessage(ctx, messageID, senderID, recipientID, totalChunks)
+}
+
+// StalePendingMessages looks in both stores, so messages that stalled across a failover are still swept
+func (f *FailoverStore) StalePendingMessages(ctx context.Context, idleSince time.Time) ([]PendingMessage, error) {
+	stale, err := f.fallback.StalePendingMessages(ctx, idleSince)
+	if err != nil || !f.primary.Healthy() {
+		return stale, err
+	}
+
+	primaryStale, err := f.primary.StalePendingMessages(ctx, idleSince)
+	if err != nil {
+		return nil, err
+	}
+	return append(stale, primaryStale...), nil
+}
+
+// ForgetPendingMessage claims the message in whichever store tracks it
+func (f *FailoverStore) ForgetPendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error) {
+	forgotten, err := f.fallback.ForgetPendingMessage(ctx, messageID)
+	if err != nil || forgotten || !f.primary.Healthy() {
+		return forgotten, err
+	}
+	return f.primary.ForgetPendingMessage(ctx, messageID)
+}
+
+func (f *FailoverStore) FinalizePendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error) {
+	return f.active().FinalizePendingMessage(ctx, messageID)
+}
+
+func (f *FailoverStore) AllowSend(ctx context.Context, senderID, recipientID, messageID uuid.UUID, quota SendQuota) (string, error) {
+	return f.active().AllowSend(ctx, senderID, recipientID, messageID, quota)
+}
+
+func (f *FailoverStore) ClaimNonce(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	return f.active().ClaimNonce(ctx, nonce, ttl)
+}
+
+func (f *FailoverStore) IsTokenRevoked(ctx context.Context, userID uuid.UUID, issuedAt time.Time) (bool, error) {
+	return f.active().IsTokenRevoked(ctx, userID, issuedAt)
+}
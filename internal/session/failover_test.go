@@ -0,0 +1,94 @@
+package session
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// waitHealth waits for the monitor to report valkey going healthy or down
+func waitHealth(t *testing.T, changes <-chan bool, want bool) {
+	t.Helper()
+
+	select {
+	case healthy := <-changes:
+		if healthy != want {
+			t.Fatalf("valkey reported healthy = %v, want %v", healthy, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("monitor never reported healthy = %v", want)
+	}
+}
+
+func TestFailoverStoreOutageAndRecovery(t *testing.T) {
+	ctx := context.Background()
+	m, mr := newTestManager(t)
+	f := NewFailoverStore(m, NewMemoryStore(TTLOptions{}))
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+	monitorCtx, stop := context.WithCancel(ctx)
+	t.Cleanup(stop)
+	changes := make(chan bool, 4)
+	go m.Monitor(monitorCtx, 20*time.Millisecond, func(healthy bool, err error) { changes <- healthy })
+
+	alice, bob := uuid.New(), uuid.New()
+	if err := f.CreateSession(ctx, alice, "alice", addr); err != nil {
+		t.Fatal(err)
+	}
+	if !mr.Exists("session:" + alice.String()) {
+		t.Fatal("session was not stored in valkey while it was up")
+	}
+
+	mr.SetError("valkey is down")
+	waitHealth(t, changes, false)
+	if !f.Degraded() {
+		t.Fatal("not degraded during the outage")
+	}
+
+	// Auth and uploads keep working on the fallback
+	if err := f.CreateSession(ctx, bob, "bob", addr); err != nil {
+		t.Fatalf("auth during the outage: %v", err)
+	}
+	if _, err := f.GetSession(ctx, bob); err != nil {
+		t.Fatal(err)
+	}
+	messageID := uuid.New()
+	if _, _, err := f.SaveChunkAndCount(ctx, messageID, 0, 2, []byte("voice")); err != nil {
+		t.Fatalf("chunk during the outage: %v", err)
+	}
+	if err := f.TouchPendingMessage(ctx, messageID, bob, alice, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	mr.SetError("")
+	waitHealth(t, changes, true)
+	if f.Degraded() {
+		t.Fatal("still degraded after valkey came back")
+	}
+	if err := m.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Valkey serves again: alice's session is back, bob has to authenticate again
+	if _, err := f.GetSession(ctx, alice); err != nil {
+		t.Fatalf("session stored before the outage: %v", err)
+	}
+	if _, err := f.GetSession(ctx, bob); err == nil {
+		t.Fatal("session from the outage is served by valkey")
+	}
+
+	// A message left behind in the fallback is still swept
+	stale, err := f.StalePendingMessages(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].MessageID != messageID {
+		t.Fatalf("stale %+v, want the message from the outage", stale)
+	}
+	if ok, err := f.ForgetPendingMessage(ctx, messageID); err != nil || !ok {
+		t.Fatalf("forget: %v, %v", ok, err)
+	}
+}
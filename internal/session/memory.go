@@ -0,0 +1,432 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryEntry is a value that is treated as missing once it expires
+type memoryEntry[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+func (e memoryEntry[T]) alive(now time.Time) bool {
+	return now.Before(e.expiresAt)
+}
+
+type chunkKey struct {
+	messageID uuid.UUID
+	index     uint32
+}
+
+// MemoryStore is an in-process Store for tests and single instance setups.
+// Expired entries are dropped lazily when they are read
+type MemoryStore struct {
+	mu sync.Mutex
+
+	sessions map[uuid.UUID]memoryEntry[Session]
+	chunks   map[chunkKey]memoryEntry[[]byte]
+	counts   map[uuid.UUID]memoryEntry[int64]
+	meta     map[uuid.UUID]memoryEntry[PendingMessage]
+	totals   map[uuid.UUID]memoryEntry[uint32]
+	pending  map[uuid.UUID]time.Time
+	nonces   map[string]time.Time
+	revoked  map[uuid.UUID]memoryEntry[time.Time]
+
+	// Finalized messages, kept past their chunks like the valkey flag
+	finalized map[uuid.UUID]time.Time
+
+	// Send quota windows by sender: accepted messages and recipients, with when they were last used
+	sends      map[uuid.UUID]map[uuid.UUID]time.Time
+	recipients map[uuid.UUID]map[uuid.UUID]time.Time
+
+	// Lifetimes mirror the expirations used by the valkey Manager
+	ttls TTLOptions
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore(ttls TTLOptions) *MemoryStore {
+	return &MemoryStore{
+		ttls:     ttls.withDefaults(),
+		sessions: make(map[uuid.UUID]memoryEntry[Session]),
+		chunks:   make(map[chunkKey]memoryEntry[[]byte]),
+		counts:   make(map[uuid.UUID]memoryEntry[int64]),
+		meta:     make(map[uuid.UUID]memoryEntry[PendingMessage]),
+		totals:   make(map[uuid.UUID]memoryEntry[uint32]),
+		pending:  make(map[uuid.UUID]time.Time),
+		nonces:   make(map[string]time.Time),
+		revoked:  make(map[uuid.UUID]memoryEntry[time.Time]),
+
+		finalized: make(map[uuid.UUID]time.Time),
+
+		sends:      make(map[uuid.UUID]map[uuid.UUID]time.Time),
+		recipients: make(map[uuid.UUID]map[uuid.UUID]time.Time),
+	}
+}
+
+func (m *MemoryStore) CreateSession(ctx context.Context, userID uuid.UUID, username string, addr *net.UDPAddr) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sessions[userID] = memoryEntry[Session]{
+		value: Session{
+			UserID:    userID,
+			Username:  username,
+			Address:   addr.String(),
+			LastSeen:  now,
+			Status:    "online",
+			ConnectAt: now,
+		},
+		expiresAt: now.Add(m.ttls.Session),
+	}
+
+	return nil
+}
+
+// session returns a live session, the caller must hold the lock
+func (m *MemoryStore) session(userID uuid.UUID) (*Session, error) {
+	entry, ok := m.sessions[userID]
+	if !ok {
+		return nil, fmt.Errorf("session not found")
+	}
+	if !entry.alive(time.Now()) {
+		delete(m.sessions, userID)
+		return nil, fmt.Errorf("session not found")
+	}
+
+	session := entry.value
+	return &session, nil
+}
+
+func (m *MemoryStore) GetSession(ctx context.Context, userID uuid.UUID) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.session(userID)
+}
+
+func (m *MemoryStore) UpdateLastSeen(ctx context.Context, userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, err := m.session(userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	session.LastSeen = now
+	m.sessions[userID] = memoryEntry[Session]{value: *session, expiresAt: now.Add(m.ttls.Session)}
+
+	return nil
+}
+
+func (m *MemoryStore) SetSessionEncrypted(ctx context.Context, userID uuid.UUID, encrypted bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, err := m.session(userID)
+	if err != nil {
+		return err
+	}
+
+	session.Encrypted = encrypted
+	m.sessions[userID] = memoryEntry[Session]{value: *session, expiresAt: time.Now().Add(m.ttls.Session)}
+
+	return nil
+}
+
+func (m *MemoryStore) IsUserOnline(ctx context.Context, userID uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.session(userID)
+	return err == nil, nil
+}
+
+func (m *MemoryStore) SaveChunkAndCount(ctx context.Context, messageID uuid.UUID, chunkIndex, totalChunks uint32, data []byte) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	key := chunkKey{messageID: messageID, index: chunkIndex}
+
+	if total, ok := m.totals[messageID]; ok && total.alive(now) {
+		if total.value != totalChunks {
+			return 0, false, fmt.Errorf("%w: message has %d chunks, got %d", ErrTotalChunksMismatch, total.value, totalChunks)
+		}
+	} else {
+		m.totals[messageID] = memoryEntry[uint32]{value: totalChunks, expiresAt: now.Add(m.ttls.Pending)}
+	}
+
+	count := m.counts[messageID]
+	if !count.alive(now) {
+		count = memoryEntry[int64]{}
+	}
+
+	if chunk, ok := m.chunks[key]; ok && chunk.alive(now) {
+		return count.value, true, nil
+	}
+
+	m.chunks[key] = memoryEntry[[]byte]{value: append([]byte(nil), data...), expiresAt: now.Add(m.ttls.Pending)}
+	count.value++
+	count.expiresAt = now.Add(m.ttls.Pending)
+	m.counts[messageID] = count
+
+	return count.value, false, nil
+}
+
+func (m *MemoryStore) GetAllPendingChunks(ctx context.Context, messageID uuid.UUID, totalChunks uint32) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	chunks := make([][]byte, totalChunks)
+	for i := range chunks {
+		chunk, ok := m.chunks[chunkKey{messageID: messageID, index: uint32(i)}]
+		if !ok || !chunk.alive(now) {
+			return nil, fmt.Errorf("chunk %d not found", i)
+		}
+		chunks[i] = chunk.value
+	}
+
+	return chunks, nil
+}
+
+func (m *MemoryStore) GetChunksReceivedCount(ctx context.Context, messageID uuid.UUID) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count, ok := m.counts[messageID]
+	if !ok || !count.alive(time.Now()) {
+		return 0, nil
+	}
+
+	return count.value, nil
+}
+
+func (m *MemoryStore) DeletePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := uint32(0); i < totalChunks; i++ {
+		delete(m.chunks, chunkKey{messageID: messageID, index: i})
+	}
+	delete(m.counts, messageID)
+	delete(m.meta, messageID)
+	delete(m.totals, messageID)
+
+	return nil
+}
+
+func (m *MemoryStore) ExpirePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiresAt := time.Now().Add(ttl)
+
+	for i := uint32(0); i < totalChunks; i++ {
+		key := chunkKey{messageID: messageID, index: i}
+		if chunk, ok := m.chunks[key]; ok {
+			chunk.expiresAt = expiresAt
+			m.chunks[key] = chunk
+		}
+	}
+	if count, ok := m.counts[messageID]; ok {
+		count.expiresAt = expiresAt
+		m.counts[messageID] = count
+	}
+	if meta, ok := m.meta[messageID]; ok {
+		meta.expiresAt = expiresAt
+		m.meta[messageID] = meta
+	}
+	if total, ok := m.totals[messageID]; ok {
+		total.expiresAt = expiresAt
+		m.totals[messageID] = total
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) TouchPendingMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, totalChunks uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if expiresAt, ok := m.finalized[messageID]; ok && now.Before(expiresAt) {
+		return nil
+	}
+
+	m.meta[messageID] = memoryEntry[PendingMessage]{
+		value: PendingMessage{
+			MessageID:   messageID,
+			SenderID:    senderID,
+			RecipientID: recipientID,
+			TotalChunks: totalChunks,
+		},
+		expiresAt: now.Add(m.ttls.Pending),
+	}
+	m.pending[messageID] = now
+
+	return nil
+}
+
+func (m *MemoryStore) StalePendingMessages(ctx context.Context, idleSince time.Time) ([]PendingMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	stale := []PendingMessage{}
+	for messageID, touched := range m.pending {
+		if touched.After(idleSince) {
+			continue
+		}
+
+		meta, ok := m.meta[messageID]
+		if !ok || !meta.alive(now) {
+			delete(m.pending, messageID)
+			delete(m.meta, messageID)
+			continue
+		}
+
+		stale = append(stale, meta.value)
+	}
+
+	return stale, nil
+}
+
+func (m *MemoryStore) ForgetPendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pending[messageID]; !ok {
+		return false, nil
+	}
+	delete(m.pending, messageID)
+
+	return true, nil
+}
+
+func (m *MemoryStore) FinalizePendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if expiresAt, ok := m.finalized[messageID]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+	m.finalized[messageID] = now.Add(m.ttls.Pending)
+
+	for id, expiresAt := range m.finalized {
+		if !now.Before(expiresAt) {
+			delete(m.finalized, id)
+		}
+	}
+
+	return true, nil
+}
+
+func (m *MemoryStore) ClaimNonce(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if expiresAt, ok := m.nonces[nonce]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+	m.nonces[nonce] = now.Add(ttl)
+
+	// Keep the nonce map from growing without bound
+	for n, expiresAt := range m.nonces {
+		if !now.Before(expiresAt) {
+			delete(m.nonces, n)
+		}
+	}
+
+	return true, nil
+}
+
+func (m *MemoryStore) AllowSend(ctx context.Context, senderID, recipientID, messageID uuid.UUID, quota SendQuota) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	sends := m.sends[senderID]
+	if sends == nil {
+		sends = make(map[uuid.UUID]time.Time)
+		m.sends[senderID] = sends
+	}
+	recipients := m.recipients[senderID]
+	if recipients == nil {
+		recipients = make(map[uuid.UUID]time.Time)
+		m.recipients[senderID] = recipients
+	}
+
+	if _, ok := sends[messageID]; ok {
+		return QuotaOK, nil
+	}
+
+	lastMinute := 0
+	for id, at := range sends {
+		if now.Sub(at) > time.Hour {
+			delete(sends, id)
+		} else if now.Sub(at) <= time.Minute {
+			lastMinute++
+		}
+	}
+	for id, at := range recipients {
+		if now.Sub(at) > quota.RecipientWindow {
+			delete(recipients, id)
+		}
+	}
+
+	if quota.PerMinute > 0 && lastMinute >= quota.PerMinute {
+		return QuotaPerMinute, nil
+	}
+	if quota.PerHour > 0 && len(sends) >= quota.PerHour {
+		return QuotaPerHour, nil
+	}
+	if _, known := recipients[recipientID]; quota.Recipients > 0 && quota.RecipientWindow > 0 && !known && len(recipients) >= quota.Recipients {
+		return QuotaRecipients, nil
+	}
+
+	sends[messageID] = now
+	recipients[recipientID] = now
+	return QuotaOK, nil
+}
+
+// RevokeUserTokens invalidates every token issued to the user so far
+func (m *MemoryStore) RevokeUserTokens(ctx context.Context, userID uuid.UUID, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.revoked[userID] = memoryEntry[time.Time]{value: now, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+// IsTokenRevoked reports whether a token issued at issuedAt was revoked afterwards
+func (m *MemoryStore) IsTokenRevoked(ctx context.Context, userID uuid.UUID, issuedAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.revoked[userID]
+	if !ok {
+		return false, nil
+	}
+	if !time.Now().Before(entry.expiresAt) {
+		delete(m.revoked, userID)
+		return false, nil
+	}
+
+	// Same second granularity as the valkey timestamp
+	return issuedAt.Unix() < entry.value.Unix(), nil
+}
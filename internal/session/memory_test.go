@@ -0,0 +1,32 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTouchSkipsFinalizedMessage(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(TTLOptions{})
+	messageID := uuid.New()
+
+	if ok, err := store.FinalizePendingMessage(ctx, messageID); err != nil || !ok {
+		t.Fatalf("finalize: %v %v", ok, err)
+	}
+
+	// A late retransmit after the message was stored
+	if err := store.TouchPendingMessage(ctx, messageID, uuid.New(), uuid.New(), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := store.StalePendingMessages(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 0 {
+		t.Fatalf("finalized message is pending again: %v", stale)
+	}
+}
@@ -0,0 +1,31 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// ClaimNonce records a nonce as used for ttl.
+// Returns false if the nonce was already claimed, meaning the request is a replay
+func (m *Manager) ClaimNonce(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	key := fmt.Sprintf("auth_nonce:%s", nonce)
+
+	setCmd := m.client.B().Set().
+		Key(key).
+		Value("1").
+		Nx().
+		Ex(ttl).
+		Build()
+
+	if err := m.client.Do(ctx, setCmd).Error(); err != nil {
+		if valkey.IsValkeyNil(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to claim nonce: %w", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,103 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/valkey-io/valkey-go"
+)
+
+// Reasons AllowSend gives for refusing a message
+const (
+	QuotaOK         = ""
+	QuotaPerMinute  = "too many messages per minute"
+	QuotaPerHour    = "too many messages per hour"
+	QuotaRecipients = "too many distinct recipients"
+)
+
+// SendQuota caps how many messages a sender may start and to how many
+// different people. Zero leaves a limit out
+type SendQuota struct {
+	PerMinute int
+	PerHour   int
+
+	// Recipients caps the distinct recipients within RecipientWindow
+	Recipients      int
+	RecipientWindow time.Duration
+}
+
+// Enabled reports whether any limit should be enforced
+func (q SendQuota) Enabled() bool {
+	return q.PerMinute > 0 || q.PerHour > 0 || (q.Recipients > 0 && q.RecipientWindow > 0)
+}
+
+// sendQuotaScript checks and records a message against the sender's sliding windows
+// atomically. Messages already accepted pass again, so every chunk can be checked.
+// Returns the refusal reason, empty when the message is allowed
+var sendQuotaScript = valkey.NewLuaScript(`
+local perMinute = tonumber(ARGV[1])
+local perHour = tonumber(ARGV[2])
+local maxRecipients = tonumber(ARGV[3])
+local window = tonumber(ARGV[4])
+local messageID = ARGV[5]
+local recipientID = ARGV[6]
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+if redis.call('ZSCORE', KEYS[1], messageID) then
+	return ''
+end
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - 3600000)
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now - window)
+
+if perMinute > 0 and redis.call('ZCOUNT', KEYS[1], now - 60000, '+inf') >= perMinute then
+	return ARGV[7]
+end
+if perHour > 0 and redis.call('ZCARD', KEYS[1]) >= perHour then
+	return ARGV[8]
+end
+if maxRecipients > 0 and window > 0 and not redis.call('ZSCORE', KEYS[2], recipientID)
+	and redis.call('ZCARD', KEYS[2]) >= maxRecipients then
+	return ARGV[9]
+end
+
+redis.call('ZADD', KEYS[1], now, messageID)
+redis.call('PEXPIRE', KEYS[1], 3600000)
+redis.call('ZADD', KEYS[2], now, recipientID)
+redis.call('PEXPIRE', KEYS[2], math.max(window, 1000))
+
+return ''
+`)
+
+// AllowSend checks a message against the sender's quota and, if it fits, counts it.
+// Returns the reason it doesn't fit, or QuotaOK
+func (m *Manager) AllowSend(ctx context.Context, senderID, recipientID, messageID uuid.UUID, quota SendQuota) (string, error) {
+	keys := []string{
+		fmt.Sprintf("send_quota:%s:messages", senderID.String()),
+		fmt.Sprintf("send_quota:%s:recipients", senderID.String()),
+	}
+
+	result := sendQuotaScript.Exec(ctx, m.client, keys, []string{
+		strconv.Itoa(quota.PerMinute),
+		strconv.Itoa(quota.PerHour),
+		strconv.Itoa(quota.Recipients),
+		strconv.FormatInt(quota.RecipientWindow.Milliseconds(), 10),
+		messageID.String(),
+		recipientID.String(),
+		QuotaPerMinute,
+		QuotaPerHour,
+		QuotaRecipients,
+	})
+
+	reason, err := result.ToString()
+	if err != nil {
+		return QuotaOK, fmt.Errorf("failed to check send quota: %w", err)
+	}
+
+	return reason, nil
+}
@@ -0,0 +1,77 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/valkey-io/valkey-go"
+)
+
+// RateLimit describes a token bucket holding up to Burst tokens
+// that refills at Rate tokens per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Enabled reports whether the limit should be enforced at all
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// tokenBucketScript refills and takes a token atomically, so every server
+// instance sharing valkey sees the same bucket. Returns {allowed, wait_ms}
+var tokenBucketScript = valkey.NewLuaScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+
+return {allowed, wait}
+`)
+
+// Allow takes a token from the bucket stored under key.
+// When the bucket is empty it returns false and how long to wait for the next token
+func (m *Manager) Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	bucketKey := fmt.Sprintf("rate_limit:%s", key)
+
+	result := tokenBucketScript.Exec(ctx, m.client, []string{bucketKey}, []string{
+		strconv.FormatFloat(limit.Rate, 'f', -1, 64),
+		strconv.Itoa(limit.Burst),
+	})
+
+	values, err := result.AsIntSlice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to check rate limit: %w", err)
+	}
+	if len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit response: %v", values)
+	}
+
+	return values[0] == 1, time.Duration(values[1]) * time.Millisecond, nil
+}
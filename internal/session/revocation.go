@@ -0,0 +1,46 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/valkey-io/valkey-go"
+)
+
+// RevokeUserTokens invalidates every token issued to the user so far.
+// ttl should cover the lifetime of the longest-lived token
+func (m *Manager) RevokeUserTokens(ctx context.Context, userID uuid.UUID, ttl time.Duration) error {
+	key := fmt.Sprintf("tokens_revoked_at:%s", userID.String())
+
+	setCmd := m.client.B().Set().
+		Key(key).
+		Value(strconv.FormatInt(time.Now().Unix(), 10)).
+		Ex(ttl).
+		Build()
+
+	if err := m.client.Do(ctx, setCmd).Error(); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	return nil
+}
+
+// IsTokenRevoked reports whether a token issued at issuedAt was revoked afterwards
+func (m *Manager) IsTokenRevoked(ctx context.Context, userID uuid.UUID, issuedAt time.Time) (bool, error) {
+	key := fmt.Sprintf("tokens_revoked_at:%s", userID.String())
+
+	getCmd := m.client.B().Get().Key(key).Build()
+
+	revokedAt, err := m.client.Do(ctx, getCmd).AsInt64()
+	if err != nil {
+		if valkey.IsValkeyNil(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+
+	return issuedAt.Unix() < revokedAt, nil
+}
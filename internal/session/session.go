@@ -3,8 +3,11 @@ package session
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,6 +22,7 @@ type Session struct {
 	LastSeen  time.Time `json:"last_seen"`
 	Status    string    `json:"status"`
 	ConnectAt time.Time `json:"connected_at"`
+	Encrypted bool      `json:"encrypted"`
 }
 
 // PendingMessage tracks chunks being received
@@ -31,16 +35,57 @@ type PendingMessage struct {
 	CreatedAt      time.Time         `json:"created_at"`
 }
 
+// pendingIndexKey is a sorted set of messages in flight, scored by the unix time of their last chunk
+const pendingIndexKey = "pending_messages"
+
 // Manager handles key-value storage operations for sessions
 type Manager struct {
-	client valkey.Client
+	client  valkey.Client
+	healthy atomic.Bool
+	ttls    TTLOptions
+}
+
+// Defaults for TTLs left at zero
+const (
+	defaultSessionTTL = 300 * time.Second
+	defaultPendingTTL = 600 * time.Second
+)
+
+// TTLOptions sets how long data lives in valkey without being refreshed.
+// Session is extended by every packet from the user. Pending covers the chunks
+// of a message being received, the first one has to outlast the whole transfer
+type TTLOptions struct {
+	Session time.Duration
+	Pending time.Duration
+}
+
+// withDefaults fills TTLs left at zero
+func (t TTLOptions) withDefaults() TTLOptions {
+	if t.Session <= 0 {
+		t.Session = defaultSessionTTL
+	}
+	if t.Pending <= 0 {
+		t.Pending = defaultPendingTTL
+	}
+	return t
+}
+
+// PoolOptions tunes the valkey client connections.
+// Commands from all goroutines are pipelined over 2^PipelineMultiplex shared connections,
+// so packet bursts don't need a connection each. Only blocking commands take one from
+// the blocking pool, which is capped at BlockingPoolSize
+type PoolOptions struct {
+	BlockingPoolSize  int
+	PipelineMultiplex int
 }
 
 // NewManager creates a new session manager
-func NewManager(addr, password string) (*Manager, error) {
+func NewManager(addr, password string, pool PoolOptions, ttls TTLOptions) (*Manager, error) {
 	client, err := valkey.NewClient(valkey.ClientOption{
-		InitAddress: []string{addr},
-		Password:    password,
+		InitAddress:       []string{addr},
+		Password:          password,
+		BlockingPoolSize:  pool.BlockingPoolSize,
+		PipelineMultiplex: pool.PipelineMultiplex,
 		// DisableCache: false, // Enable client-side caching for better performance
 	})
 	if err != nil {
@@ -56,7 +101,68 @@ func NewManager(addr, password string) (*Manager, error) {
 		return nil, fmt.Errorf("failed to ping valkey: %w", err)
 	}
 
-	return &Manager{client: client}, nil
+	return NewManagerWithClient(client, ttls), nil
+}
+
+// NewManagerWithClient creates a session manager on a client the caller has set up,
+// e.g. one with client-side caching disabled for servers that don't support it
+func NewManagerWithClient(client valkey.Client, ttls TTLOptions) *Manager {
+	m := &Manager{client: client, ttls: ttls.withDefaults()}
+	m.healthy.Store(true)
+
+	return m
+}
+
+// pingTimeout bounds a health check, so a hung valkey reads as down instead of blocking the caller
+const pingTimeout = 2 * time.Second
+
+// Ping checks that valkey answers within pingTimeout, or ctx's deadline if that is sooner.
+// It fails once the manager is closed
+func (m *Manager) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	pingCmd := m.client.B().Ping().Build()
+	if err := m.client.Do(ctx, pingCmd).Error(); err != nil {
+		return fmt.Errorf("failed to ping valkey: %w", err)
+	}
+	return nil
+}
+
+// Healthy reports whether valkey answered the last health check
+func (m *Manager) Healthy() bool {
+	return m.healthy.Load()
+}
+
+// Monitor pings valkey every interval until ctx is done and calls onChange when it goes down or comes back.
+// While valkey is down it is retried with exponential backoff up to interval, the client reconnects on its own
+func (m *Manager) Monitor(ctx context.Context, interval time.Duration, onChange func(healthy bool, err error)) {
+	const minBackoff = 500 * time.Millisecond
+
+	wait := interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		err := m.Ping(ctx)
+
+		healthy := err == nil
+		if m.healthy.Swap(healthy) != healthy && onChange != nil {
+			onChange(healthy, err)
+		}
+
+		switch {
+		case healthy:
+			wait = interval
+		case wait >= interval:
+			wait = minBackoff
+		default:
+			wait = min(wait*2, interval)
+		}
+	}
 }
 
 func (m *Manager) CreateSession(ctx context.Context, userID uuid.UUID, username string, addr *net.UDPAddr) error {
@@ -79,7 +185,7 @@ func (m *Manager) CreateSession(ctx context.Context, userID uuid.UUID, username
 	setCmd := m.client.B().Set().
 		Key(key).
 		Value(string(data)).
-		Ex(300 * time.Second).
+		Ex(m.ttls.Session).
 		Build()
 
 	if err := m.client.Do(ctx, setCmd).Error(); err != nil {
@@ -95,7 +201,7 @@ func (m *Manager) CreateSession(ctx context.Context, userID uuid.UUID, username
 		return fmt.Errorf("failed to add to online users: %w", err)
 	}
 
-	return nil
+	return m.recordLastSeen(ctx, userID, session.LastSeen)
 }
 
 // GetSession retrieves a users's session
@@ -146,7 +252,67 @@ func (m *Manager) UpdateLastSeen(ctx context.Context, userID uuid.UUID) error {
 	setCmd := m.client.B().Set().
 		Key(key).
 		Value(string(data)).
-		Ex(300 * time.Second).
+		Ex(m.ttls.Session).
+		Build()
+
+	if err := m.client.Do(ctx, setCmd).Error(); err != nil {
+		return err
+	}
+
+	return m.recordLastSeen(ctx, userID, session.LastSeen)
+}
+
+// recordLastSeen keeps the last activity of a user under a key
+// that outlives the session, so it is still known once they go offline
+func (m *Manager) recordLastSeen(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	setCmd := m.client.B().Set().
+		Key(fmt.Sprintf("last_seen:%s", userID.String())).
+		Value(strconv.FormatInt(at.Unix(), 10)).
+		Build()
+
+	if err := m.client.Do(ctx, setCmd).Error(); err != nil {
+		return fmt.Errorf("failed to record last seen: %w", err)
+	}
+
+	return nil
+}
+
+// GetLastSeen returns when a user was last active, or nil if they never connected
+func (m *Manager) GetLastSeen(ctx context.Context, userID uuid.UUID) (*time.Time, error) {
+	getCmd := m.client.B().Get().Key(fmt.Sprintf("last_seen:%s", userID.String())).Build()
+
+	unix, err := m.client.Do(ctx, getCmd).AsInt64()
+	if err != nil {
+		if valkey.IsValkeyNil(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get last seen: %w", err)
+	}
+
+	lastSeen := time.Unix(unix, 0)
+	return &lastSeen, nil
+}
+
+// SetSessionEncrypted records whether the session runs over a secure channel
+func (m *Manager) SetSessionEncrypted(ctx context.Context, userID uuid.UUID, encrypted bool) error {
+	session, err := m.GetSession(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	session.Encrypted = encrypted
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	key := fmt.Sprintf("session:%s", userID.String())
+
+	setCmd := m.client.B().Set().
+		Key(key).
+		Value(string(data)).
+		Ex(m.ttls.Session).
 		Build()
 
 	return m.client.Do(ctx, setCmd).Error()
@@ -193,6 +359,78 @@ func (m *Manager) IsUserOnline(ctx context.Context, userID uuid.UUID) (bool, err
 	return val == 1, nil
 }
 
+// AreUsersOnline checks the presence of many users in a single round trip
+func (m *Manager) AreUsersOnline(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]bool, error) {
+	online := make(map[uuid.UUID]bool, len(userIDs))
+	if len(userIDs) == 0 {
+		return online, nil
+	}
+
+	members := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		members[i] = userID.String()
+	}
+
+	smismemberCmd := m.client.B().Smismember().
+		Key("online_users").
+		Member(members...).
+		Build()
+
+	// One 1 or 0 per member, in the order they were asked for
+	values, err := m.client.Do(ctx, smismemberCmd).AsIntSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check online status: %w", err)
+	}
+	if len(values) != len(userIDs) {
+		return nil, fmt.Errorf("unexpected online status response: %v", values)
+	}
+
+	for i, userID := range userIDs {
+		online[userID] = values[i] == 1
+	}
+
+	return online, nil
+}
+
+// GetOnlineUsers lists users with a live session. Members whose
+// session already expired are left out and dropped from the set
+func (m *Manager) GetOnlineUsers(ctx context.Context) ([]uuid.UUID, error) {
+	smembersCmd := m.client.B().Smembers().Key("online_users").Build()
+
+	members, err := m.client.Do(ctx, smembersCmd).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list online users: %w", err)
+	}
+
+	if len(members) == 0 {
+		return []uuid.UUID{}, nil
+	}
+
+	cmds := make(valkey.Commands, 0, len(members))
+	for _, member := range members {
+		cmds = append(cmds, m.client.B().Exists().Key("session:"+member).Build())
+	}
+
+	users := make([]uuid.UUID, 0, len(members))
+	for i, resp := range m.client.DoMulti(ctx, cmds...) {
+		exists, err := resp.AsInt64()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check session: %w", err)
+		}
+
+		userID, err := uuid.Parse(members[i])
+		if exists == 0 || err != nil {
+			sremCmd := m.client.B().Srem().Key("online_users").Member(members[i]).Build()
+			m.client.Do(ctx, sremCmd)
+			continue
+		}
+
+		users = append(users, userID)
+	}
+
+	return users, nil
+}
+
 // SavePendingChunk saves a received
 func (m *Manager) SavePendingChunk(ctx context.Context, messageID uuid.UUID, chunkIndex uint32, data []byte) error {
 	key := fmt.Sprintf("pending_message:%s:chunk:%d", messageID.String(), chunkIndex)
@@ -200,12 +438,68 @@ func (m *Manager) SavePendingChunk(ctx context.Context, messageID uuid.UUID, chu
 	setCmd := m.client.B().Set().
 		Key(key).
 		Value(valkey.BinaryString(data)).
-		Ex(600 * time.Second). // 10 minutes
+		Ex(m.ttls.Pending).
 		Build()
 
 	return m.client.Do(ctx, setCmd).Error()
 }
 
+// ErrTotalChunksMismatch is returned by SaveChunkAndCount when a chunk disagrees
+// with the earlier chunks of its message about how many chunks there are
+var ErrTotalChunksMismatch = errors.New("total chunks differ from earlier chunks")
+
+// saveChunkScript stores a chunk and bumps the counter in one round trip.
+// A chunk that is already stored is a retransmit and doesn't count twice.
+// The first chunk of a message fixes its total, a chunk with another total
+// is refused. Returns {stored, count}, or {-1, total} when refused
+var saveChunkScript = valkey.NewLuaScript(`
+local total = redis.call('GET', KEYS[3])
+if total and total ~= ARGV[3] then
+	return {-1, tonumber(total)}
+end
+if not total then
+	redis.call('SET', KEYS[3], ARGV[3], 'EX', ARGV[2])
+end
+
+local stored = redis.call('SET', KEYS[1], ARGV[1], 'NX', 'EX', ARGV[2])
+if not stored then
+	return {0, tonumber(redis.call('GET', KEYS[2]) or '0')}
+end
+
+local count = redis.call('INCR', KEYS[2])
+redis.call('EXPIRE', KEYS[2], ARGV[2])
+return {1, count}
+`)
+
+// SaveChunkAndCount saves a chunk and increments the chunk counter atomically.
+// It returns the number of distinct chunks received so far and whether
+// this chunk was a duplicate that was already stored. A chunk whose totalChunks
+// differs from the first chunk of its message fails with ErrTotalChunksMismatch
+func (m *Manager) SaveChunkAndCount(ctx context.Context, messageID uuid.UUID, chunkIndex, totalChunks uint32, data []byte) (int64, bool, error) {
+	chunkKey := fmt.Sprintf("pending_message:%s:chunk:%d", messageID.String(), chunkIndex)
+	countKey := fmt.Sprintf("pending_message:%s:count", messageID.String())
+	totalKey := fmt.Sprintf("pending_message:%s:total", messageID.String())
+
+	result := saveChunkScript.Exec(ctx, m.client, []string{chunkKey, countKey, totalKey}, []string{
+		valkey.BinaryString(data),
+		strconv.Itoa(int(m.ttls.Pending.Seconds())), // same as SavePendingChunk
+		strconv.FormatUint(uint64(totalChunks), 10),
+	})
+
+	values, err := result.AsIntSlice()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to save chunk: %w", err)
+	}
+	if len(values) != 2 {
+		return 0, false, fmt.Errorf("unexpected save chunk response: %v", values)
+	}
+	if values[0] == -1 {
+		return 0, false, fmt.Errorf("%w: message has %d chunks, got %d", ErrTotalChunksMismatch, values[1], totalChunks)
+	}
+
+	return values[1], values[0] == 0, nil
+}
+
 // GetPendingChunk retrieves a chunk
 func (m *Manager) GetPendingChunk(ctx context.Context, messageID uuid.UUID, chunkIndex uint32) ([]byte, error) {
 	key := fmt.Sprintf("pending_message:%s:chunk:%d", messageID.String(), chunkIndex)
@@ -229,6 +523,43 @@ func (m *Manager) GetPendingChunk(ctx context.Context, messageID uuid.UUID, chun
 	return []byte(str), nil
 }
 
+// GetAllPendingChunks retrieves every chunk of a message in index order with a single MGET
+func (m *Manager) GetAllPendingChunks(ctx context.Context, messageID uuid.UUID, totalChunks uint32) ([][]byte, error) {
+	if totalChunks == 0 {
+		return [][]byte{}, nil
+	}
+
+	keys := make([]string, totalChunks)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("pending_message:%s:chunk:%d", messageID.String(), i)
+	}
+
+	mgetCmd := m.client.B().Mget().Key(keys...).Build()
+
+	values, err := m.client.Do(ctx, mgetCmd).ToArray()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunks: %w", err)
+	}
+	if len(values) != len(keys) {
+		return nil, fmt.Errorf("expected %d chunks, got %d", len(keys), len(values))
+	}
+
+	chunks := make([][]byte, len(values))
+	for i := range values {
+		if values[i].IsNil() {
+			return nil, fmt.Errorf("chunk %d not found", i)
+		}
+
+		str, err := values[i].ToString()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse chunk %d: %w", i, err)
+		}
+		chunks[i] = []byte(str)
+	}
+
+	return chunks, nil
+}
+
 // IncrementChunksReceived increments the chunk counter
 func (m *Manager) IncrementChunksReceived(ctx context.Context, messageID uuid.UUID) (int64, error) {
 	key := fmt.Sprintf("pending_message:%s:count", messageID.String())
@@ -271,7 +602,151 @@ func (m *Manager) GetChunksReceivedCount(ctx context.Context, messageID uuid.UUI
 
 // DeletePendingMessage removes all pending message data
 func (m *Manager) DeletePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32) error {
-	keys := make([]string, 0, totalChunks+1)
+	keys := pendingMessageKeys(messageID, totalChunks)
+
+	delCmd := m.client.B().Del().Key(keys...).Build()
+
+	return m.client.Do(ctx, delCmd).Error()
+}
+
+// ExpirePendingMessage keeps all pending message data for the given ttl,
+// after which valkey evicts it on its own
+func (m *Manager) ExpirePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32, ttl time.Duration) error {
+	keys := pendingMessageKeys(messageID, totalChunks)
+
+	cmds := make(valkey.Commands, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, m.client.B().Expire().Key(key).Seconds(int64(ttl.Seconds())).Build())
+	}
+
+	for _, resp := range m.client.DoMulti(ctx, cmds...) {
+		if err := resp.Error(); err != nil {
+			return fmt.Errorf("failed to expire pending message: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// touchPendingScript records activity for a message in flight unless it was finalized.
+// Returns 1 if touched
+var touchPendingScript = valkey.NewLuaScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[1], 'EX', ARGV[2])
+redis.call('ZADD', KEYS[3], ARGV[3], ARGV[4])
+return 1
+`)
+
+// TouchPendingMessage records chunk activity for a message in flight so
+// abandoned transfers can be found later by StalePendingMessages.
+// Finalized messages are left alone, a late retransmit doesn't bring them back
+func (m *Manager) TouchPendingMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, totalChunks uint32) error {
+	meta := PendingMessage{
+		MessageID:   messageID,
+		SenderID:    senderID,
+		RecipientID: recipientID,
+		TotalChunks: totalChunks,
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending message: %w", err)
+	}
+
+	finalizedKey := fmt.Sprintf("pending_message:%s:finalized", messageID.String())
+	metaKey := fmt.Sprintf("pending_message:%s:meta", messageID.String())
+
+	err = touchPendingScript.Exec(ctx, m.client, []string{finalizedKey, metaKey, pendingIndexKey}, []string{
+		string(data),
+		strconv.Itoa(int(m.ttls.Pending.Seconds())), // same as the chunks
+		strconv.FormatInt(time.Now().Unix(), 10),
+		messageID.String(),
+	}).Error()
+	if err != nil {
+		return fmt.Errorf("failed to touch pending message: %w", err)
+	}
+
+	return nil
+}
+
+// StalePendingMessages returns messages in flight that haven't received a chunk since idleSince.
+// Entries whose data already expired are dropped from the index on the way
+func (m *Manager) StalePendingMessages(ctx context.Context, idleSince time.Time) ([]PendingMessage, error) {
+	rangeCmd := m.client.B().Zrangebyscore().
+		Key(pendingIndexKey).
+		Min("-inf").
+		Max(strconv.FormatInt(idleSince.Unix(), 10)).
+		Build()
+
+	ids, err := m.client.Do(ctx, rangeCmd).AsStrSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending messages: %w", err)
+	}
+
+	stale := make([]PendingMessage, 0, len(ids))
+	for _, id := range ids {
+		getCmd := m.client.B().Get().Key(fmt.Sprintf("pending_message:%s:meta", id)).Build()
+
+		data, err := m.client.Do(ctx, getCmd).ToString()
+		if err != nil {
+			if valkey.IsValkeyNil(err) {
+				remCmd := m.client.B().Zrem().Key(pendingIndexKey).Member(id).Build()
+				m.client.Do(ctx, remCmd)
+				continue
+			}
+			return nil, fmt.Errorf("failed to get pending message: %w", err)
+		}
+
+		var meta PendingMessage
+		if err := json.Unmarshal([]byte(data), &meta); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal pending message: %w", err)
+		}
+		stale = append(stale, meta)
+	}
+
+	return stale, nil
+}
+
+// ForgetPendingMessage removes a message from the in-flight index.
+// Returns false if it was already gone, so concurrent callers can tell who claimed it
+func (m *Manager) ForgetPendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error) {
+	remCmd := m.client.B().Zrem().Key(pendingIndexKey).Member(messageID.String()).Build()
+
+	removed, err := m.client.Do(ctx, remCmd).AsInt64()
+	if err != nil {
+		return false, fmt.Errorf("failed to forget pending message: %w", err)
+	}
+
+	return removed == 1, nil
+}
+
+// FinalizePendingMessage marks a message as complete, so its processing starts once.
+// It returns false if the message was already finalized. The flag is not one of the
+// pending message keys: it outlives their cleanup so a late retransmit can't complete
+// the message again, and expires on its own after the pending TTL
+func (m *Manager) FinalizePendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error) {
+	setCmd := m.client.B().Set().
+		Key(fmt.Sprintf("pending_message:%s:finalized", messageID.String())).
+		Value("1").
+		Nx().
+		Ex(m.ttls.Pending).
+		Build()
+
+	if err := m.client.Do(ctx, setCmd).Error(); err != nil {
+		if valkey.IsValkeyNil(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to finalize pending message: %w", err)
+	}
+
+	return true, nil
+}
+
+// pendingMessageKeys lists every chunk key of a message plus its counter and meta keys
+func pendingMessageKeys(messageID uuid.UUID, totalChunks uint32) []string {
+	keys := make([]string, 0, totalChunks+3)
 
 	// Add all chunk keys
 	for i := uint32(0); i < totalChunks; i++ {
@@ -283,12 +758,20 @@ func (m *Manager) DeletePendingMessage(ctx context.Context, messageID uuid.UUID,
 	countKey := fmt.Sprintf("pending_message:%s:count", messageID.String())
 	keys = append(keys, countKey)
 
-	delCmd := m.client.B().Del().Key(keys...).Build()
+	// Add the meta key
+	metaKey := fmt.Sprintf("pending_message:%s:meta", messageID.String())
+	keys = append(keys, metaKey)
 
-	return m.client.Do(ctx, delCmd).Error()
+	// Add the total key
+	totalKey := fmt.Sprintf("pending_message:%s:total", messageID.String())
+	keys = append(keys, totalKey)
+
+	return keys
 }
 
-// Close closes the client connection
+// Close closes the pipelined and pooled connections. Commands issued
+// afterwards fail, so the manager reports itself unhealthy from then on
 func (m *Manager) Close() {
+	m.healthy.Store(false)
 	m.client.Close()
 }
@@ -0,0 +1,312 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/valkey-io/valkey-go"
+)
+
+// newTestManager returns a Manager on an in-process valkey
+func newTestManager(t testing.TB) (*Manager, *miniredis.Miniredis) {
+	t.Helper()
+
+	return newTestManagerWithTTLs(t, TTLOptions{})
+}
+
+// newTestManagerWithTTLs is newTestManager with the given TTLs
+func newTestManagerWithTTLs(t testing.TB, ttls TTLOptions) (*Manager, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client, err := valkey.NewClient(valkey.ClientOption{
+		InitAddress:       []string{mr.Addr()},
+		DisableCache:      true,
+		ForceSingleClient: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManagerWithClient(client, ttls)
+	t.Cleanup(m.Close)
+
+	return m, mr
+}
+
+func TestPing(t *testing.T) {
+	m, mr := newTestManager(t)
+	ctx := context.Background()
+
+	if err := m.Ping(ctx); err != nil {
+		t.Fatalf("ping with valkey up: %v", err)
+	}
+
+	mr.SetError("valkey is down")
+	if err := m.Ping(ctx); err == nil {
+		t.Fatal("ping succeeded with valkey failing")
+	}
+	mr.SetError("")
+
+	m.Close()
+	if err := m.Ping(ctx); err == nil {
+		t.Fatal("ping succeeded on a closed client")
+	}
+}
+
+func TestConfiguredTTLs(t *testing.T) {
+	tests := []struct {
+		name                 string
+		ttls                 TTLOptions
+		wantSession, wantTTL time.Duration
+	}{
+		{"defaults", TTLOptions{}, defaultSessionTTL, defaultPendingTTL},
+		{"configured", TTLOptions{Session: 45 * time.Second, Pending: 30 * time.Minute}, 45 * time.Second, 30 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mr := newTestManagerWithTTLs(t, tt.ttls)
+			ctx := context.Background()
+			userID, messageID := uuid.New(), uuid.New()
+			sessionKey := "session:" + userID.String()
+
+			if err := m.CreateSession(ctx, userID, "alice", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}); err != nil {
+				t.Fatal(err)
+			}
+			if got := mr.TTL(sessionKey); got != tt.wantSession {
+				t.Errorf("session TTL %v after create, want %v", got, tt.wantSession)
+			}
+
+			mr.SetTTL(sessionKey, time.Second)
+			if err := m.UpdateLastSeen(ctx, userID); err != nil {
+				t.Fatal(err)
+			}
+			if got := mr.TTL(sessionKey); got != tt.wantSession {
+				t.Errorf("session TTL %v after activity, want %v", got, tt.wantSession)
+			}
+
+			if err := m.SavePendingChunk(ctx, messageID, 0, []byte("voice")); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := m.SaveChunkAndCount(ctx, messageID, 1, 2, []byte("voice")); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{
+				fmt.Sprintf("pending_message:%s:chunk:0", messageID),
+				fmt.Sprintf("pending_message:%s:chunk:1", messageID),
+				fmt.Sprintf("pending_message:%s:count", messageID),
+			} {
+				if got := mr.TTL(key); got != tt.wantTTL {
+					t.Errorf("%s TTL %v, want %v", key, got, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestGetAllPendingChunksInOrder(t *testing.T) {
+	ctx := context.Background()
+	messageID := uuid.New()
+	const total = 5
+
+	m, _ := newTestManager(t)
+
+	// Chunks arrive out of order, as they do over UDP
+	for _, i := range []uint32{3, 0, 4, 1, 2} {
+		if _, _, err := m.SaveChunkAndCount(ctx, messageID, i, total, []byte(fmt.Sprintf("chunk-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chunks, err := m.GetAllPendingChunks(ctx, messageID, total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != total {
+		t.Fatalf("got %d chunks, want %d", len(chunks), total)
+	}
+	for i, chunk := range chunks {
+		if want := fmt.Sprintf("chunk-%d", i); string(chunk) != want {
+			t.Errorf("chunk %d is %q, want %q", i, chunk, want)
+		}
+	}
+}
+
+func TestGetAllPendingChunksMissingChunk(t *testing.T) {
+	ctx := context.Background()
+	messageID := uuid.New()
+
+	m, _ := newTestManager(t)
+	for _, i := range []uint32{0, 2} {
+		if _, _, err := m.SaveChunkAndCount(ctx, messageID, i, 3, []byte("voice")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := m.GetAllPendingChunks(ctx, messageID, 3); err == nil {
+		t.Fatal("assembled a message with a chunk missing")
+	}
+}
+
+func TestGetOnlineUsers(t *testing.T) {
+	ctx := context.Background()
+	m, mr := newTestManager(t)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+	alice, bob := uuid.New(), uuid.New()
+	for _, userID := range []uuid.UUID{alice, bob} {
+		if err := m.CreateSession(ctx, userID, "user", addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Left behind by a session that expired
+	stale := uuid.New()
+	if _, err := mr.SAdd("online_users", stale.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	online, err := m.GetOnlineUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(online) != 2 || !slices.Contains(online, alice) || !slices.Contains(online, bob) {
+		t.Fatalf("online %v, want %v and %v", online, alice, bob)
+	}
+
+	if ok, _ := mr.SIsMember("online_users", stale.String()); ok {
+		t.Fatal("stale member was not dropped from the online set")
+	}
+}
+
+func TestAreUsersOnline(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestManager(t)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+	alice, bob, carol, dave := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	for _, userID := range []uuid.UUID{alice, carol} {
+		if err := m.CreateSession(ctx, userID, "user", addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	online, err := m.AreUsersOnline(ctx, []uuid.UUID{alice, bob, carol, dave})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uuid.UUID]bool{alice: true, bob: false, carol: true, dave: false}
+	if !maps.Equal(online, want) {
+		t.Fatalf("online %v, want %v", online, want)
+	}
+
+	if online, err := m.AreUsersOnline(ctx, nil); err != nil || len(online) != 0 {
+		t.Fatalf("no users: %v, %v", online, err)
+	}
+}
+
+func TestLastSeenSurvivesSessionExpiry(t *testing.T) {
+	ctx := context.Background()
+	m, mr := newTestManager(t)
+	userID := uuid.New()
+
+	if seen, err := m.GetLastSeen(ctx, userID); err != nil || seen != nil {
+		t.Fatalf("last seen of a user who never connected: %v, %v", seen, err)
+	}
+
+	if err := m.CreateSession(ctx, userID, "alice", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UpdateLastSeen(ctx, userID); err != nil {
+		t.Fatal(err)
+	}
+	session, err := m.GetSession(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr.FastForward(defaultSessionTTL + time.Second)
+	if _, err := m.GetSession(ctx, userID); err == nil {
+		t.Fatal("session outlived its TTL")
+	}
+
+	seen, err := m.GetLastSeen(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen == nil || seen.Unix() != session.LastSeen.Unix() {
+		t.Fatalf("last seen %v after expiry, want %v", seen, session.LastSeen)
+	}
+}
+
+func BenchmarkSaveChunk(b *testing.B) {
+	ctx := context.Background()
+	chunk := make([]byte, 1024)
+	const total = 64
+
+	// Separate round trips for the chunk and the counter against the single scripted call.
+	// The in-process valkey has no network to save and runs Lua slowly, the
+	// difference per chunk only shows against a real server
+	tests := []struct {
+		name string
+		save func(m *Manager, messageID uuid.UUID, index uint32) error
+	}{
+		{"separate", func(m *Manager, messageID uuid.UUID, index uint32) error {
+			if err := m.SavePendingChunk(ctx, messageID, index, chunk); err != nil {
+				return err
+			}
+			_, err := m.IncrementChunksReceived(ctx, messageID)
+			return err
+		}},
+		{"pipelined", func(m *Manager, messageID uuid.UUID, index uint32) error {
+			_, _, err := m.SaveChunkAndCount(ctx, messageID, index, total, chunk)
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			m, _ := newTestManager(b)
+			messageID := uuid.New()
+			i := 0
+			for b.Loop() {
+				if i%total == 0 {
+					messageID = uuid.New()
+				}
+				if err := tt.save(m, messageID, uint32(i%total)); err != nil {
+					b.Fatal(err)
+				}
+				i++
+			}
+		})
+	}
+}
+
+func BenchmarkSavePendingChunkParallel(b *testing.B) {
+	ctx := context.Background()
+	chunk := make([]byte, 1024)
+
+	// Every packet goroutine shares the one client, like the UDP server's workers do
+	m, _ := newTestManager(b)
+	b.SetBytes(int64(len(chunk)))
+
+	b.RunParallel(func(pb *testing.PB) {
+		messageID := uuid.New()
+		var index uint32
+		for pb.Next() {
+			if err := m.SavePendingChunk(ctx, messageID, index, chunk); err != nil {
+				b.Error(err)
+				return
+			}
+			index++
+		}
+	})
+}
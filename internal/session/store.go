@@ -0,0 +1,39 @@
+package session
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Store defines the session and in-flight message operations the UDP server relies on.
+// Manager is the valkey implementation, MemoryStore keeps everything in process
+type Store interface {
+	CreateSession(ctx context.Context, userID uuid.UUID, username string, addr *net.UDPAddr) error
+	GetSession(ctx context.Context, userID uuid.UUID) (*Session, error)
+	UpdateLastSeen(ctx context.Context, userID uuid.UUID) error
+	SetSessionEncrypted(ctx context.Context, userID uuid.UUID, encrypted bool) error
+	IsUserOnline(ctx context.Context, userID uuid.UUID) (bool, error)
+
+	SaveChunkAndCount(ctx context.Context, messageID uuid.UUID, chunkIndex, totalChunks uint32, data []byte) (int64, bool, error)
+	GetAllPendingChunks(ctx context.Context, messageID uuid.UUID, totalChunks uint32) ([][]byte, error)
+	GetChunksReceivedCount(ctx context.Context, messageID uuid.UUID) (int64, error)
+	DeletePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32) error
+	ExpirePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32, ttl time.Duration) error
+	TouchPendingMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, totalChunks uint32) error
+	StalePendingMessages(ctx context.Context, idleSince time.Time) ([]PendingMessage, error)
+	ForgetPendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error)
+	FinalizePendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error)
+
+	ClaimNonce(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+	IsTokenRevoked(ctx context.Context, userID uuid.UUID, issuedAt time.Time) (bool, error)
+	AllowSend(ctx context.Context, senderID, recipientID, messageID uuid.UUID, quota SendQuota) (string, error)
+}
+
+var (
+	_ Store = (*Manager)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*FailoverStore)(nil)
+)
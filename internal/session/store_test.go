@@ -0,0 +1,168 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// revoker is the part of both stores that revokes tokens, it is not on Store
+// since only the HTTP server revokes
+type revoker interface {
+	Store
+	RevokeUserTokens(ctx context.Context, userID uuid.UUID, ttl time.Duration) error
+}
+
+// forEachStore runs a test against the valkey and the in-memory store so both behave the same
+func forEachStore(t *testing.T, test func(t *testing.T, store revoker)) {
+	t.Run("valkey", func(t *testing.T) {
+		m, _ := newTestManager(t)
+		test(t, m)
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore(TTLOptions{}))
+	})
+}
+
+func TestStoreSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store revoker) {
+		ctx := context.Background()
+		userID := uuid.New()
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+		if _, err := store.GetSession(ctx, userID); err == nil {
+			t.Fatal("got a session that was never created")
+		}
+		if online, err := store.IsUserOnline(ctx, userID); err != nil || online {
+			t.Fatalf("online before connecting: %v, %v", online, err)
+		}
+
+		if err := store.CreateSession(ctx, userID, "alice", addr); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetSessionEncrypted(ctx, userID, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.UpdateLastSeen(ctx, userID); err != nil {
+			t.Fatal(err)
+		}
+
+		session, err := store.GetSession(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.UserID != userID || session.Username != "alice" || session.Address != addr.String() || !session.Encrypted {
+			t.Fatalf("session %+v", session)
+		}
+		if online, err := store.IsUserOnline(ctx, userID); err != nil || !online {
+			t.Fatalf("offline after connecting: %v, %v", online, err)
+		}
+	})
+}
+
+func TestStoreChunks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store revoker) {
+		ctx := context.Background()
+		messageID := uuid.New()
+
+		for i, chunk := range []string{"b", "a"} {
+			count, duplicate, err := store.SaveChunkAndCount(ctx, messageID, uint32(1-i), 2, []byte(chunk))
+			if err != nil || duplicate || count != int64(i+1) {
+				t.Fatalf("chunk %d: count %d, duplicate %v, %v", 1-i, count, duplicate, err)
+			}
+		}
+
+		// A retransmit is recognized and doesn't count twice
+		if count, duplicate, err := store.SaveChunkAndCount(ctx, messageID, 0, 2, []byte("a")); err != nil || !duplicate || count != 2 {
+			t.Fatalf("retransmit: count %d, duplicate %v, %v", count, duplicate, err)
+		}
+		if _, _, err := store.SaveChunkAndCount(ctx, messageID, 0, 3, []byte("a")); !errors.Is(err, ErrTotalChunksMismatch) {
+			t.Fatalf("got %v for a different total, want ErrTotalChunksMismatch", err)
+		}
+
+		chunks, err := store.GetAllPendingChunks(ctx, messageID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(chunks[0]) != "a" || string(chunks[1]) != "b" {
+			t.Fatalf("chunks %q", chunks)
+		}
+
+		if err := store.DeletePendingMessage(ctx, messageID, 2); err != nil {
+			t.Fatal(err)
+		}
+		if count, err := store.GetChunksReceivedCount(ctx, messageID); err != nil || count != 0 {
+			t.Fatalf("count %d after delete, %v", count, err)
+		}
+		if _, err := store.GetAllPendingChunks(ctx, messageID, 2); err == nil {
+			t.Fatal("chunks outlived the message")
+		}
+	})
+}
+
+func TestStorePendingMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store revoker) {
+		ctx := context.Background()
+		messageID, senderID, recipientID := uuid.New(), uuid.New(), uuid.New()
+
+		if err := store.TouchPendingMessage(ctx, messageID, senderID, recipientID, 4); err != nil {
+			t.Fatal(err)
+		}
+
+		if stale, err := store.StalePendingMessages(ctx, time.Now().Add(-time.Minute)); err != nil || len(stale) != 0 {
+			t.Fatalf("fresh message is stale: %v, %v", stale, err)
+		}
+		stale, err := store.StalePendingMessages(ctx, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stale) != 1 || stale[0].MessageID != messageID || stale[0].SenderID != senderID || stale[0].RecipientID != recipientID || stale[0].TotalChunks != 4 {
+			t.Fatalf("stale %+v, want message %s", stale, messageID)
+		}
+
+		// Only one caller gets to clean up or store a message
+		if ok, err := store.ForgetPendingMessage(ctx, messageID); err != nil || !ok {
+			t.Fatalf("forget: %v, %v", ok, err)
+		}
+		if ok, err := store.ForgetPendingMessage(ctx, messageID); err != nil || ok {
+			t.Fatalf("forgot twice: %v, %v", ok, err)
+		}
+		if ok, err := store.FinalizePendingMessage(ctx, messageID); err != nil || !ok {
+			t.Fatalf("finalize: %v, %v", ok, err)
+		}
+		if ok, err := store.FinalizePendingMessage(ctx, messageID); err != nil || ok {
+			t.Fatalf("finalized twice: %v, %v", ok, err)
+		}
+	})
+}
+
+func TestStoreNoncesAndRevocation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store revoker) {
+		ctx := context.Background()
+
+		if ok, err := store.ClaimNonce(ctx, "nonce", time.Minute); err != nil || !ok {
+			t.Fatalf("claim: %v, %v", ok, err)
+		}
+		if ok, err := store.ClaimNonce(ctx, "nonce", time.Minute); err != nil || ok {
+			t.Fatalf("replayed nonce claimed: %v, %v", ok, err)
+		}
+
+		userID := uuid.New()
+		if revoked, err := store.IsTokenRevoked(ctx, userID, time.Now()); err != nil || revoked {
+			t.Fatalf("revoked before any revocation: %v, %v", revoked, err)
+		}
+		if err := store.RevokeUserTokens(ctx, userID, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if revoked, err := store.IsTokenRevoked(ctx, userID, time.Now().Add(-time.Minute)); err != nil || !revoked {
+			t.Fatalf("older token still valid: %v, %v", revoked, err)
+		}
+		if revoked, err := store.IsTokenRevoked(ctx, userID, time.Now().Add(time.Minute)); err != nil || revoked {
+			t.Fatalf("newer token revoked: %v, %v", revoked, err)
+		}
+	})
+}
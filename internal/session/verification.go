@@ -0,0 +1,57 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/valkey-io/valkey-go"
+)
+
+// CreateVerificationToken issues a random token that verifies email for a user until ttl runs out
+func (m *Manager) CreateVerificationToken(ctx context.Context, userID uuid.UUID, email string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate verification token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+
+	setCmd := m.client.B().Set().
+		Key(fmt.Sprintf("email_verification:%s", token)).
+		Value(userID.String() + " " + email).
+		Ex(ttl).
+		Build()
+
+	if err := m.client.Do(ctx, setCmd).Error(); err != nil {
+		return "", fmt.Errorf("failed to store verification token: %w", err)
+	}
+
+	return token, nil
+}
+
+// ConsumeVerificationToken returns the user and email a verification token was issued for.
+// A token works only once
+func (m *Manager) ConsumeVerificationToken(ctx context.Context, token string) (uuid.UUID, string, error) {
+	getdelCmd := m.client.B().Getdel().Key(fmt.Sprintf("email_verification:%s", token)).Build()
+
+	value, err := m.client.Do(ctx, getdelCmd).ToString()
+	if err != nil {
+		if valkey.IsValkeyNil(err) {
+			return uuid.Nil, "", fmt.Errorf("invalid or expired verification token")
+		}
+		return uuid.Nil, "", fmt.Errorf("failed to check verification token: %w", err)
+	}
+
+	// Stored as "<user id> <email>", emails can't hold spaces
+	id, email, _ := strings.Cut(value, " ")
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("invalid verification token data: %w", err)
+	}
+
+	return userID, email, nil
+}
@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const objectKey = attribute.Key("laba.object")
+
+// objectStore records a span for every object storage call
+type objectStore struct {
+	next s3storage.ObjectStore
+}
+
+// directUploadStore is an objectStore whose backend also hands out upload URLs
+type directUploadStore struct {
+	*objectStore
+	uploader s3storage.DirectUploader
+}
+
+// ObjectStore wraps an object store so every call is traced.
+// The result only implements DirectUploader if next does
+func ObjectStore(next s3storage.ObjectStore) s3storage.ObjectStore {
+	store := &objectStore{next: next}
+	if uploader, ok := next.(s3storage.DirectUploader); ok {
+		return &directUploadStore{objectStore: store, uploader: uploader}
+	}
+	return store
+}
+
+func (t *objectStore) UploadVoiceMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, data []byte, audioFormat string) (string, error) {
+	ctx, span := tracer.Start(ctx, "s3.UploadVoiceMessage", trace.WithAttributes(
+		MessageIDKey.String(messageID.String()),
+		attribute.Int("laba.size", len(data)),
+	))
+	path, err := t.next.UploadVoiceMessage(ctx, messageID, senderID, recipientID, data, audioFormat)
+	End(span, err)
+	return path, err
+}
+
+func (t *objectStore) DownloadVoiceMessage(ctx context.Context, objectName string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "s3.DownloadVoiceMessage", trace.WithAttributes(objectKey.String(objectName)))
+	data, err := t.next.DownloadVoiceMessage(ctx, objectName)
+	End(span, err)
+	return data, err
+}
+
+func (t *objectStore) DeleteVoiceMessage(ctx context.Context, objectName string) error {
+	ctx, span := tracer.Start(ctx, "s3.DeleteVoiceMessage", trace.WithAttributes(objectKey.String(objectName)))
+	err := t.next.DeleteVoiceMessage(ctx, objectName)
+	End(span, err)
+	return err
+}
+
+func (t *objectStore) GetPresignedURL(ctx context.Context, objectName, filename string, expiry time.Duration) (string, error) {
+	ctx, span := tracer.Start(ctx, "s3.GetPresignedURL", trace.WithAttributes(objectKey.String(objectName)))
+	url, err := t.next.GetPresignedURL(ctx, objectName, filename, expiry)
+	End(span, err)
+	return url, err
+}
+
+func (t *objectStore) GetObjectInfo(ctx context.Context, objectName string) (*s3storage.ObjectInfo, error) {
+	ctx, span := tracer.Start(ctx, "s3.GetObjectInfo", trace.WithAttributes(objectKey.String(objectName)))
+	info, err := t.next.GetObjectInfo(ctx, objectName)
+	End(span, err)
+	return info, err
+}
+
+func (t *objectStore) UploadPeaks(ctx context.Context, messageID uuid.UUID, data []byte) error {
+	ctx, span := tracer.Start(ctx, "s3.UploadPeaks", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	err := t.next.UploadPeaks(ctx, messageID, data)
+	End(span, err)
+	return err
+}
+
+func (t *objectStore) DownloadPeaks(ctx context.Context, messageID uuid.UUID) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "s3.DownloadPeaks", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	data, err := t.next.DownloadPeaks(ctx, messageID)
+	End(span, err)
+	return data, err
+}
+
+func (t *objectStore) DeletePeaks(ctx context.Context, messageID uuid.UUID) error {
+	ctx, span := tracer.Start(ctx, "s3.DeletePeaks", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	err := t.next.DeletePeaks(ctx, messageID)
+	End(span, err)
+	return err
+}
+
+func (t *objectStore) ListVoiceMessages(ctx context.Context, prefix string) ([]s3storage.ObjectInfo, error) {
+	ctx, span := tracer.Start(ctx, "s3.ListVoiceMessages", trace.WithAttributes(attribute.String("laba.prefix", prefix)))
+	objects, err := t.next.ListVoiceMessages(ctx, prefix)
+	End(span, err)
+	return objects, err
+}
+
+func (t *directUploadStore) GetPresignedPutURL(ctx context.Context, messageID uuid.UUID, audioFormat string, expiry time.Duration) (string, string, error) {
+	ctx, span := tracer.Start(ctx, "s3.GetPresignedPutURL", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	url, path, err := t.uploader.GetPresignedPutURL(ctx, messageID, audioFormat, expiry)
+	End(span, err)
+	return url, path, err
+}
@@ -0,0 +1,140 @@
+package tracing
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/session"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sessionStore records a span for every session store call
+type sessionStore struct {
+	next session.Store
+}
+
+// SessionStore wraps a session store so every call is traced
+func SessionStore(next session.Store) session.Store {
+	return &sessionStore{next: next}
+}
+
+func (t *sessionStore) CreateSession(ctx context.Context, userID uuid.UUID, username string, addr *net.UDPAddr) error {
+	ctx, span := tracer.Start(ctx, "session.CreateSession")
+	err := t.next.CreateSession(ctx, userID, username, addr)
+	End(span, err)
+	return err
+}
+
+func (t *sessionStore) GetSession(ctx context.Context, userID uuid.UUID) (*session.Session, error) {
+	ctx, span := tracer.Start(ctx, "session.GetSession")
+	s, err := t.next.GetSession(ctx, userID)
+	End(span, err)
+	return s, err
+}
+
+func (t *sessionStore) UpdateLastSeen(ctx context.Context, userID uuid.UUID) error {
+	ctx, span := tracer.Start(ctx, "session.UpdateLastSeen")
+	err := t.next.UpdateLastSeen(ctx, userID)
+	End(span, err)
+	return err
+}
+
+func (t *sessionStore) SetSessionEncrypted(ctx context.Context, userID uuid.UUID, encrypted bool) error {
+	ctx, span := tracer.Start(ctx, "session.SetSessionEncrypted")
+	err := t.next.SetSessionEncrypted(ctx, userID, encrypted)
+	End(span, err)
+	return err
+}
+
+func (t *sessionStore) IsUserOnline(ctx context.Context, userID uuid.UUID) (bool, error) {
+	ctx, span := tracer.Start(ctx, "session.IsUserOnline")
+	ok, err := t.next.IsUserOnline(ctx, userID)
+	End(span, err)
+	return ok, err
+}
+
+func (t *sessionStore) SaveChunkAndCount(ctx context.Context, messageID uuid.UUID, chunkIndex, totalChunks uint32, data []byte) (int64, bool, error) {
+	ctx, span := tracer.Start(ctx, "session.SaveChunkAndCount", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	count, duplicate, err := t.next.SaveChunkAndCount(ctx, messageID, chunkIndex, totalChunks, data)
+	End(span, err)
+	return count, duplicate, err
+}
+
+func (t *sessionStore) GetAllPendingChunks(ctx context.Context, messageID uuid.UUID, totalChunks uint32) ([][]byte, error) {
+	ctx, span := tracer.Start(ctx, "session.GetAllPendingChunks", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	chunks, err := t.next.GetAllPendingChunks(ctx, messageID, totalChunks)
+	End(span, err)
+	return chunks, err
+}
+
+func (t *sessionStore) GetChunksReceivedCount(ctx context.Context, messageID uuid.UUID) (int64, error) {
+	ctx, span := tracer.Start(ctx, "session.GetChunksReceivedCount", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	n, err := t.next.GetChunksReceivedCount(ctx, messageID)
+	End(span, err)
+	return n, err
+}
+
+func (t *sessionStore) DeletePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32) error {
+	ctx, span := tracer.Start(ctx, "session.DeletePendingMessage", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	err := t.next.DeletePendingMessage(ctx, messageID, totalChunks)
+	End(span, err)
+	return err
+}
+
+func (t *sessionStore) ExpirePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32, ttl time.Duration) error {
+	ctx, span := tracer.Start(ctx, "session.ExpirePendingMessage", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	err := t.next.ExpirePendingMessage(ctx, messageID, totalChunks, ttl)
+	End(span, err)
+	return err
+}
+
+func (t *sessionStore) TouchPendingMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, totalChunks uint32) error {
+	ctx, span := tracer.Start(ctx, "session.TouchPendingMessage", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	err := t.next.TouchPendingMessage(ctx, messageID, senderID, recipientID, totalChunks)
+	End(span, err)
+	return err
+}
+
+func (t *sessionStore) StalePendingMessages(ctx context.Context, idleSince time.Time) ([]session.PendingMessage, error) {
+	ctx, span := tracer.Start(ctx, "session.StalePendingMessages")
+	stale, err := t.next.StalePendingMessages(ctx, idleSince)
+	End(span, err)
+	return stale, err
+}
+
+func (t *sessionStore) ForgetPendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error) {
+	ctx, span := tracer.Start(ctx, "session.ForgetPendingMessage", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	ok, err := t.next.ForgetPendingMessage(ctx, messageID)
+	End(span, err)
+	return ok, err
+}
+
+func (t *sessionStore) FinalizePendingMessage(ctx context.Context, messageID uuid.UUID) (bool, error) {
+	ctx, span := tracer.Start(ctx, "session.FinalizePendingMessage", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	ok, err := t.next.FinalizePendingMessage(ctx, messageID)
+	End(span, err)
+	return ok, err
+}
+
+func (t *sessionStore) ClaimNonce(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	ctx, span := tracer.Start(ctx, "session.ClaimNonce")
+	ok, err := t.next.ClaimNonce(ctx, nonce, ttl)
+	End(span, err)
+	return ok, err
+}
+
+func (t *sessionStore) IsTokenRevoked(ctx context.Context, userID uuid.UUID, issuedAt time.Time) (bool, error) {
+	ctx, span := tracer.Start(ctx, "session.IsTokenRevoked")
+	revoked, err := t.next.IsTokenRevoked(ctx, userID, issuedAt)
+	End(span, err)
+	return revoked, err
+}
+
+func (t *sessionStore) AllowSend(ctx context.Context, senderID, recipientID, messageID uuid.UUID, quota session.SendQuota) (string, error) {
+	ctx, span := tracer.Start(ctx, "session.AllowSend", trace.WithAttributes(MessageIDKey.String(messageID.String())))
+	reason, err := t.next.AllowSend(ctx, senderID, recipientID, messageID, quota)
+	End(span, err)
+	return reason, err
+}
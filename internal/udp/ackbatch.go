@@ -0,0 +1,165 @@
+package udp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultAckBatchIdle is how long the batch of a message that stopped getting chunks
+// is kept when no pending timeout is configured to sweep it earlier
+const defaultAckBatchIdle = 2 * time.Minute
+
+// ackBatch coalesces the ACKs for chunks of a message being received
+// into cumulative ACKs, a delayed-ACK scheme
+type ackBatch struct {
+	mu sync.Mutex
+
+	// last is the most recent chunk, ACKs are built from it
+	last *Packet
+	addr *net.UDPAddr
+
+	received map[uint32]struct{}
+	// next is the first chunk not received yet, everything below it was
+	next uint32
+	// unacked counts the chunks received since the last ACK went out
+	unacked int
+	timer   *time.Timer
+
+	// idle forgets the batch once its message stops getting chunks,
+	// the sender may never finish it
+	idle *time.Timer
+}
+
+// record adds a chunk to the batch and reports how many went unACKed since the last ACK
+func (b *ackBatch) record(packet *Packet, addr *net.UDPAddr) int {
+	b.last = packet
+	b.addr = addr
+
+	if _, ok := b.received[packet.ChunkIndex]; !ok {
+		b.received[packet.ChunkIndex] = struct{}{}
+		b.unacked++
+	}
+	for {
+		if _, ok := b.received[b.next]; !ok {
+			break
+		}
+		delete(b.received, b.next)
+		b.next++
+	}
+
+	return b.unacked
+}
+
+// ackChunk acknowledges a received chunk. Depending on the options it is ACKed
+// on its own or as part of a batch, which is flushed once it is full or its delay
+// runs out. The final chunk, a completed message and a retransmit, which means
+// the client is waiting for an ACK, always flush right away
+func (s *Server) ackChunk(packet *Packet, clientAddr *net.UDPAddr, duplicate, complete bool) {
+	opts := s.options()
+
+	if opts.AckBatchSize <= 1 {
+		// Send ACK with a payload to avoid EOF errors
+		ackPacket := NewAckPacket(packet)
+		ackPacket.Payload = []byte("ok")
+		s.sendPacket(ackPacket, clientAddr)
+		return
+	}
+
+	if complete {
+		s.dropAckBatch(packet.MessageID)
+		s.sendPacket(NewCumulativeAckPacket(packet, packet.TotalChunks), clientAddr)
+		return
+	}
+
+	batch := s.ackBatchFor(packet.MessageID)
+
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+
+	unacked := batch.record(packet, clientAddr)
+	batch.idle.Reset(s.ackBatchIdle())
+
+	if duplicate || unacked >= opts.AckBatchSize || packet.ChunkIndex == packet.TotalChunks-1 {
+		s.flushAckBatch(batch)
+		return
+	}
+
+	if batch.timer == nil {
+		batch.timer = time.AfterFunc(opts.AckBatchDelay, func() {
+			batch.mu.Lock()
+			defer batch.mu.Unlock()
+
+			// A flush may have beaten the timer to the lock
+			if batch.unacked > 0 {
+				s.flushAckBatch(batch)
+			}
+		})
+	}
+}
+
+// flushAckBatch sends a cumulative ACK for everything received so far.
+// The caller must hold the batch lock
+func (s *Server) flushAckBatch(batch *ackBatch) {
+	if batch.timer != nil {
+		batch.timer.Stop()
+		batch.timer = nil
+	}
+	batch.unacked = 0
+
+	s.sendPacket(NewCumulativeAckPacket(batch.last, batch.next), batch.addr)
+}
+
+// ackBatchIdle returns how long a batch may go without a chunk before it is forgotten
+func (s *Server) ackBatchIdle() time.Duration {
+	if timeout := s.options().PendingTimeout; timeout > 0 {
+		return timeout
+	}
+	return defaultAckBatchIdle
+}
+
+// ackBatchFor returns the batch of a message, starting one if needed
+func (s *Server) ackBatchFor(messageID uuid.UUID) *ackBatch {
+	s.ackBatchesMu.Lock()
+	defer s.ackBatchesMu.Unlock()
+
+	batch, ok := s.ackBatches[messageID]
+	if !ok {
+		batch = &ackBatch{received: make(map[uint32]struct{})}
+		batch.idle = time.AfterFunc(s.ackBatchIdle(), func() { s.forgetAckBatch(messageID, batch) })
+		s.ackBatches[messageID] = batch
+	}
+	return batch
+}
+
+// dropAckBatch forgets the batch of a message that is complete or abandoned
+func (s *Server) dropAckBatch(messageID uuid.UUID) {
+	s.ackBatchesMu.Lock()
+	batch, ok := s.ackBatches[messageID]
+	s.ackBatchesMu.Unlock()
+
+	if ok {
+		s.forgetAckBatch(messageID, batch)
+	}
+}
+
+// forgetAckBatch removes a batch and stops its timers. A batch started
+// for the same message since is left alone
+func (s *Server) forgetAckBatch(messageID uuid.UUID, batch *ackBatch) {
+	s.ackBatchesMu.Lock()
+	if s.ackBatches[messageID] == batch {
+		delete(s.ackBatches, messageID)
+	}
+	s.ackBatchesMu.Unlock()
+
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+
+	if batch.timer != nil {
+		batch.timer.Stop()
+		batch.timer = nil
+	}
+	batch.idle.Stop()
+}
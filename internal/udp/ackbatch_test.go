@@ -0,0 +1,160 @@
+package udp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+// sendMessage sends every chunk of a message and collects ACKs until all chunks are confirmed
+func sendMessage(t *testing.T, c *testClient, recipientID uuid.UUID, total uint32) []*Packet {
+	t.Helper()
+
+	messageID := uuid.New()
+	for i := uint32(0); i < total; i++ {
+		c.send(NewVoiceDataPacket(c.userID, recipientID, messageID, i, total, []byte("voice")))
+	}
+
+	var acks []*Packet
+	confirmed := make(map[uint32]bool)
+	for uint32(len(confirmed)) < total {
+		p := c.expect(PacketTypeAck)
+		if p.MessageID != messageID {
+			t.Fatalf("ACK for %v, want %v", p.MessageID, messageID)
+		}
+		acks = append(acks, p)
+
+		if !p.IsCumulativeAck() {
+			confirmed[p.ChunkIndex] = true
+			continue
+		}
+		for i := uint32(0); i < p.ChunkIndex; i++ {
+			confirmed[i] = true
+		}
+	}
+	return acks
+}
+
+func TestAckBatching(t *testing.T) {
+	const total = 16
+
+	tests := []struct {
+		name     string
+		size     int
+		wantAcks func(n int) bool
+	}{
+		{"every chunk", 1, func(n int) bool { return n == total }},
+		{"batched", 4, func(n int) bool { return n < total/2 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := startLoopback(t, Options{AckBatchSize: tt.size, AckBatchDelay: time.Second})
+			alice := lb.client(t, "alice")
+			alice.auth()
+
+			acks := sendMessage(t, alice, uuid.New(), total)
+			if !tt.wantAcks(len(acks)) {
+				t.Fatalf("%d ACKs for %d chunks", len(acks), total)
+			}
+
+			// The completed message takes its batch with it
+			lb.ackBatchesMu.Lock()
+			defer lb.ackBatchesMu.Unlock()
+			if len(lb.ackBatches) != 0 {
+				t.Fatalf("%d batches left after the message completed", len(lb.ackBatches))
+			}
+		})
+	}
+}
+
+func TestAckBatchDelayFlushesPartialBatch(t *testing.T) {
+	lb := startLoopback(t, Options{AckBatchSize: 4, AckBatchDelay: 50 * time.Millisecond})
+	alice := lb.client(t, "alice")
+	alice.auth()
+
+	messageID := uuid.New()
+	for i := uint32(0); i < 2; i++ {
+		alice.send(NewVoiceDataPacket(alice.userID, uuid.New(), messageID, i, 8, []byte("voice")))
+	}
+
+	p := alice.expect(PacketTypeAck)
+	if !p.IsCumulativeAck() || p.ChunkIndex != 2 {
+		t.Fatalf("ACK %q up to %d, want a cumulative ACK up to 2", p.Payload, p.ChunkIndex)
+	}
+}
+
+func TestIdleAckBatchIsForgotten(t *testing.T) {
+	// Without a pending timeout nothing sweeps abandoned messages, the batch has to go by itself
+	s := New("", Options{}, nil, nil, nil, nil, nil, nil, nil, nil, nil, log.New(io.Discard))
+	t.Cleanup(s.cancel)
+	if idle := s.ackBatchIdle(); idle != defaultAckBatchIdle {
+		t.Fatalf("idle timeout %v without a pending timeout, want %v", idle, defaultAckBatchIdle)
+	}
+
+	lb := startLoopback(t, Options{AckBatchSize: 4, AckBatchDelay: 10 * time.Millisecond, PendingTimeout: 100 * time.Millisecond})
+	alice := lb.client(t, "alice")
+	alice.auth()
+
+	// The sender gives up after one chunk
+	alice.send(NewVoiceDataPacket(alice.userID, uuid.New(), uuid.New(), 0, 8, []byte("voice")))
+	alice.expect(PacketTypeAck)
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		lb.ackBatchesMu.Lock()
+		left := len(lb.ackBatches)
+		lb.ackBatchesMu.Unlock()
+
+		if left == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("batch of an abandoned message was kept")
+		}
+	}
+}
+
+func BenchmarkAckChunk(b *testing.B) {
+	const total = 64
+
+	for _, size := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			// ACKs go to a socket nobody reads, only the server side is measured
+			sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() { sink.Close() })
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() { conn.Close() })
+
+			s := New("", Options{AckBatchSize: size, AckBatchDelay: time.Second}, nil, nil, nil, nil, nil, nil, nil, nil, nil, log.New(io.Discard))
+			b.Cleanup(s.cancel)
+			s.conn = conn
+			addr := sink.LocalAddr().(*net.UDPAddr)
+
+			senderID, recipientID := uuid.New(), uuid.New()
+			messageID := uuid.New()
+			chunks := 0
+			for b.Loop() {
+				index := uint32(chunks % total)
+				if index == 0 {
+					messageID = uuid.New()
+				}
+				packet := NewVoiceDataPacket(senderID, recipientID, messageID, index, total, []byte("voice"))
+				s.ackChunk(packet, addr, false, index == total-1)
+				chunks++
+			}
+
+			b.ReportMetric(float64(s.sendSeq.Load())/float64(chunks), "acks/chunk")
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package udp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// authAttemptTTL is how long an address is remembered after its last failed auth
+const authAttemptTTL = 10 * time.Minute
+
+// authAttempts tracks the failed auths of one address
+type authAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// authGuard throttles addresses that keep failing to authenticate,
+// before their packets reach token validation. It lives in memory only,
+// a restart forgets every address
+type authGuard struct {
+	mu        sync.Mutex
+	attempts  map[string]*authAttempts
+	nextEvict time.Time
+}
+
+func newAuthGuard() *authGuard {
+	return &authGuard{attempts: make(map[string]*authAttempts)}
+}
+
+// authKey identifies an address by IP, so changing the source port doesn't reset it
+func authKey(addr *net.UDPAddr) string {
+	return addr.IP.String()
+}
+
+// allow reports whether addr may attempt to authenticate at now,
+// and if not, how long it still has to wait
+func (g *authGuard) allow(addr *net.UDPAddr, now time.Time) (bool, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.evict(now)
+
+	entry, ok := g.attempts[authKey(addr)]
+	if !ok || !now.Before(entry.blockedUntil) {
+		return true, 0
+	}
+	return false, entry.blockedUntil.Sub(now)
+}
+
+// fail records a failed auth from addr. After maxFailures in a row the
+// address is blocked for cooldown, and it reports whether that just happened
+func (g *authGuard) fail(addr *net.UDPAddr, now time.Time, maxFailures int, cooldown time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := authKey(addr)
+	entry, ok := g.attempts[key]
+	if !ok {
+		entry = &authAttempts{}
+		g.attempts[key] = entry
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+
+	if entry.failures < maxFailures {
+		return false
+	}
+
+	entry.failures = 0
+	entry.blockedUntil = now.Add(cooldown)
+	return true
+}
+
+// succeed forgets the failures of addr once it authenticates
+func (g *authGuard) succeed(addr *net.UDPAddr) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.attempts, authKey(addr))
+}
+
+// evict drops addresses that neither failed recently nor are still blocked.
+// It runs at most once a minute, the caller must hold the lock
+func (g *authGuard) evict(now time.Time) {
+	if now.Before(g.nextEvict) {
+		return
+	}
+	g.nextEvict = now.Add(time.Minute)
+
+	for key, entry := range g.attempts {
+		if now.Sub(entry.lastFailure) > authAttemptTTL && !now.Before(entry.blockedUntil) {
+			delete(g.attempts, key)
+		}
+	}
+}
+
+// authAllowed checks the guard before a packet carrying a token is validated.
+// Throttled packets are dropped without an answer, so spoofed sources can't use us as a reflector
+func (s *Server) authAllowed(clientAddr *net.UDPAddr) bool {
+	if s.options().AuthMaxFailures <= 0 {
+		return true
+	}
+
+	ok, wait := s.authGuard.allow(clientAddr, time.Now())
+	if !ok {
+		s.logger.Debug("Dropping auth from throttled address", "from", clientAddr, "retry_in", wait)
+	}
+	return ok
+}
+
+// authFailed records a failed auth from clientAddr
+func (s *Server) authFailed(clientAddr *net.UDPAddr) {
+	opts := s.options()
+	if opts.AuthMaxFailures <= 0 {
+		return
+	}
+
+	if s.authGuard.fail(clientAddr, time.Now(), opts.AuthMaxFailures, opts.AuthCooldown) {
+		s.logger.Warn("Too many failed auths, throttling address", "from", clientAddr, "cooldown", opts.AuthCooldown)
+	}
+}
@@ -0,0 +1,117 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuthGuard(t *testing.T) {
+	const maxFailures = 3
+	const cooldown = time.Minute
+	start := time.Now()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+
+	tests := []struct {
+		name string
+		// run fails addr until it is blocked and may do more, then reports when to ask
+		run       func(g *authGuard) time.Time
+		wantAllow bool
+	}{
+		{"below the limit", func(g *authGuard) time.Time {
+			for range maxFailures - 1 {
+				g.fail(addr, start, maxFailures, cooldown)
+			}
+			return start
+		}, true},
+		{"blocked", func(g *authGuard) time.Time {
+			blockAddr(t, g, addr, start, maxFailures, cooldown)
+			return start.Add(cooldown / 2)
+		}, false},
+		{"another port of the same IP", func(g *authGuard) time.Time {
+			blockAddr(t, g, &net.UDPAddr{IP: addr.IP, Port: 5000}, start, maxFailures, cooldown)
+			return start
+		}, false},
+		{"cooldown over", func(g *authGuard) time.Time {
+			blockAddr(t, g, addr, start, maxFailures, cooldown)
+			return start.Add(cooldown)
+		}, true},
+		{"success resets the count", func(g *authGuard) time.Time {
+			for range maxFailures - 1 {
+				g.fail(addr, start, maxFailures, cooldown)
+			}
+			g.succeed(addr)
+			g.fail(addr, start, maxFailures, cooldown)
+			return start
+		}, true},
+		{"another address is served", func(g *authGuard) time.Time {
+			blockAddr(t, g, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 4000}, start, maxFailures, cooldown)
+			return start
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newAuthGuard()
+			at := tt.run(g)
+			if ok, wait := g.allow(addr, at); ok != tt.wantAllow {
+				t.Fatalf("allowed %v (wait %v), want %v", ok, wait, tt.wantAllow)
+			}
+		})
+	}
+}
+
+// blockAddr fails addr until the guard blocks it
+func blockAddr(t *testing.T, g *authGuard, addr *net.UDPAddr, now time.Time, maxFailures int, cooldown time.Duration) {
+	t.Helper()
+
+	for i := 1; i <= maxFailures; i++ {
+		if blocked := g.fail(addr, now, maxFailures, cooldown); blocked != (i == maxFailures) {
+			t.Fatalf("failure %d blocked %v", i, blocked)
+		}
+	}
+}
+
+func TestAuthGuardEvictsForgottenAddresses(t *testing.T) {
+	g := newAuthGuard()
+	start := time.Now()
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+
+	g.fail(addr, start, 3, time.Minute)
+	g.allow(addr, start.Add(authAttemptTTL/2))
+	if len(g.attempts) != 1 {
+		t.Fatal("recent failure evicted")
+	}
+
+	g.allow(addr, start.Add(authAttemptTTL+time.Minute))
+	if len(g.attempts) != 0 {
+		t.Fatalf("%d addresses kept after the TTL", len(g.attempts))
+	}
+}
+
+func TestRepeatedBadAuthIsThrottled(t *testing.T) {
+	const maxFailures = 3
+	lb := startLoopback(t, Options{AuthMaxFailures: maxFailures, AuthCooldown: time.Minute})
+
+	mallory := lb.client(t, "mallory")
+	for range maxFailures {
+		p, err := NewAuthPacket(mallory.userID, "not a token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mallory.send(p)
+		mallory.expect(PacketTypeError)
+	}
+
+	// Once throttled even a valid token goes unanswered, until the cooldown is over
+	p, err := NewAuthPacket(mallory.userID, mallory.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory.send(p)
+	mallory.expectNothing(PacketTypeAuthAck, 200*time.Millisecond)
+
+	// Another address is served as usual
+	alice := lb.clientAt(t, "alice", net.IPv4(127, 0, 0, 2))
+	alice.auth()
+}
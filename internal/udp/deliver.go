@@ -0,0 +1,96 @@
+package udp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/pkg/audio"
+	"github.com/rx3lixir/laba/pkg/webhook"
+)
+
+const (
+	// storedDeliveryBatch caps how many stored messages are pushed per login
+	storedDeliveryBatch = 20
+
+	// storedDeliveryDelay gives a client time to finish its handshake after auth,
+	// so pushed chunks don't arrive in plaintext on a channel about to be encrypted
+	storedDeliveryDelay = time.Second
+)
+
+// deliverStored forwards the messages stored while a user was offline, oldest first.
+// It stops at the first one the user doesn't take, the rest stay stored for a download.
+// A user who authenticates again meanwhile doesn't start a second run
+func (s *Server) deliverStored(userID uuid.UUID) {
+	defer s.wg.Done()
+
+	s.deliveringMu.Lock()
+	if _, busy := s.delivering[userID]; busy {
+		s.deliveringMu.Unlock()
+		return
+	}
+	s.delivering[userID] = struct{}{}
+	s.deliveringMu.Unlock()
+
+	defer func() {
+		s.deliveringMu.Lock()
+		delete(s.delivering, userID)
+		s.deliveringMu.Unlock()
+	}()
+
+	select {
+	case <-s.ctx.Done():
+		return
+	case <-time.After(storedDeliveryDelay):
+	}
+
+	messages, err := s.messageStore.GetUndeliveredMessages(s.ctx, userID, storedDeliveryBatch)
+	if err != nil {
+		s.logger.Error("Failed to fetch undelivered messages", "user_id", userID, "error", err)
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	s.logger.Info("Delivering stored messages", "user_id", userID, "count", len(messages))
+
+	for _, msg := range messages {
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		logger := s.messageLogger(msg.ID)
+
+		data, err := s.loadMessageData(s.ctx, msg)
+		if err != nil {
+			logger.Error("Failed to load stored message", "message_id", msg.ID, "error", err)
+			continue
+		}
+
+		totalChunks := uint32((len(data) + MaxPayloadSize - 1) / MaxPayloadSize)
+		if !s.forwardIfOnline(msg.ID, msg.SenderID, userID, data, totalChunks) {
+			return
+		}
+
+		if err := s.messageStore.MarkMessageDelivered(s.ctx, msg.ID, time.Now()); err != nil {
+			logger.Error("Failed to mark message delivered", "message_id", msg.ID, "error", err)
+		}
+		s.publish(webhook.EventDelivered, msg.ID, msg.SenderID, msg.RecipientID, "")
+	}
+}
+
+// loadMessageData reads the stored audio of a message, decompressing it if needed
+func (s *Server) loadMessageData(ctx context.Context, msg *db.VoiceMessage) ([]byte, error) {
+	data, err := s.s3storageClient.DownloadVoiceMessage(ctx, msg.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from s3: %w", err)
+	}
+
+	if msg.Compressed {
+		return audio.Decompress(data)
+	}
+	return data, nil
+}
@@ -0,0 +1,13 @@
+package udp
+
+import (
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/pkg/webhook"
+)
+
+// publish reports a message lifecycle event to the configured webhooks
+func (s *Server) publish(eventType string, messageID, senderID, recipientID uuid.UUID, reason string) {
+	event := webhook.NewEvent(eventType, messageID, senderID, recipientID)
+	event.Reason = reason
+	s.webhooks.Dispatch(event)
+}
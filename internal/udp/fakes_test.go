@@ -0,0 +1,339 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+)
+
+// fakeMessageStore keeps messages in memory. Methods the tests don't reach are left to the embedded nil interface
+type fakeMessageStore struct {
+	db.MessageStore
+
+	mu       sync.Mutex
+	messages map[uuid.UUID]*db.VoiceMessage
+	failed   map[uuid.UUID]*db.FailedMessage
+	updates  int
+
+	// createErr makes CreateMessage fail
+	createErr error
+}
+
+func newFakeMessageStore() *fakeMessageStore {
+	return &fakeMessageStore{
+		messages: make(map[uuid.UUID]*db.VoiceMessage),
+		failed:   make(map[uuid.UUID]*db.FailedMessage),
+	}
+}
+
+func (f *fakeMessageStore) CreateMessage(ctx context.Context, msg *db.VoiceMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.createErr != nil {
+		return f.createErr
+	}
+	if _, ok := f.messages[msg.ID]; ok {
+		return fmt.Errorf("message already exists")
+	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	stored := *msg
+	f.messages[msg.ID] = &stored
+	return nil
+}
+
+func (f *fakeMessageStore) GetMessageByID(ctx context.Context, id uuid.UUID) (*db.VoiceMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, ok := f.messages[id]
+	if !ok {
+		return nil, fmt.Errorf("message not found")
+	}
+	copied := *msg
+	return &copied, nil
+}
+
+func (f *fakeMessageStore) GetMessagesByRecipient(ctx context.Context, recipientID uuid.UUID, folder string, limit, offset int) ([]*db.VoiceMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var messages []*db.VoiceMessage
+	for _, msg := range f.messages {
+		if msg.RecipientID == recipientID && msg.Archived == (folder == db.FolderArchived) {
+			copied := *msg
+			messages = append(messages, &copied)
+		}
+	}
+	return messages, nil
+}
+
+func (f *fakeMessageStore) GetUndeliveredMessages(ctx context.Context, recipientID uuid.UUID, limit int) ([]*db.VoiceMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var messages []*db.VoiceMessage
+	for _, msg := range f.messages {
+		if msg.RecipientID == recipientID && msg.Status == db.MessageStatusTransmitted {
+			copied := *msg
+			messages = append(messages, &copied)
+		}
+	}
+	return messages, nil
+}
+
+func (f *fakeMessageStore) UpdateMessage(ctx context.Context, msg *db.VoiceMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.messages[msg.ID]; !ok {
+		return fmt.Errorf("message not found")
+	}
+	stored := *msg
+	f.messages[msg.ID] = &stored
+	f.updates++
+	return nil
+}
+
+func (f *fakeMessageStore) UpdateMessageStatus(ctx context.Context, id uuid.UUID, status string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, ok := f.messages[id]
+	if !ok {
+		return fmt.Errorf("message not found")
+	}
+	msg.Status = status
+	f.updates++
+	return nil
+}
+
+func (f *fakeMessageStore) MarkMessageDelivered(ctx context.Context, id uuid.UUID, deliveredAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, ok := f.messages[id]
+	if !ok {
+		return fmt.Errorf("message not found")
+	}
+	msg.Status = db.MessageStatusDelivered
+	msg.DeliveredAt = &deliveredAt
+	f.updates++
+	return nil
+}
+
+func (f *fakeMessageStore) DeleteMessages(ctx context.Context, ids []uuid.UUID, ownerID uuid.UUID) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	deleted := 0
+	for _, id := range ids {
+		if msg, ok := f.messages[id]; ok && msg.RecipientID == ownerID {
+			delete(f.messages, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (f *fakeMessageStore) MessageFileExists(ctx context.Context, filePath string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, msg := range f.messages {
+		if msg.FilePath == filePath {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeMessageStore) RecordFailedMessage(ctx context.Context, msg *db.FailedMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored := *msg
+	f.failed[msg.MessageID] = &stored
+	return nil
+}
+
+func (f *fakeMessageStore) DeleteFailedMessage(ctx context.Context, messageID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.failed, messageID)
+	return nil
+}
+
+func (f *fakeMessageStore) WithTx(ctx context.Context, fn func(tx db.MessageStore) error) error {
+	return fn(f)
+}
+
+// message returns a copy of a stored message, nil if there is none
+func (f *fakeMessageStore) message(id uuid.UUID) *db.VoiceMessage {
+	msg, err := f.GetMessageByID(context.Background(), id)
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// failedMessage returns a copy of a dead-lettered message, nil if there is none
+func (f *fakeMessageStore) failedMessage(id uuid.UUID) *db.FailedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	failed, ok := f.failed[id]
+	if !ok {
+		return nil
+	}
+	copied := *failed
+	return &copied
+}
+
+// fakeBlockStore holds block lists, keyed by blocker then blocked user. The zero value blocks nobody
+type fakeBlockStore struct {
+	db.BlockStore
+
+	blocked map[uuid.UUID]map[uuid.UUID]bool
+}
+
+func (f fakeBlockStore) IsBlocked(ctx context.Context, blockerID, blockedID uuid.UUID) (bool, error) {
+	return f.blocked[blockerID][blockedID], nil
+}
+
+// fakeContactStore holds contact lists, keyed by owner then contact
+type fakeContactStore struct {
+	db.ContactStore
+
+	contacts map[uuid.UUID]map[uuid.UUID]bool
+}
+
+func (f *fakeContactStore) IsContact(ctx context.Context, userID, contactID uuid.UUID) (bool, error) {
+	return f.contacts[userID][contactID], nil
+}
+
+// fakeUserStore knows users by name only
+type fakeUserStore struct {
+	db.UserStore
+
+	mu    sync.Mutex
+	names map[uuid.UUID]string
+}
+
+func (f *fakeUserStore) add(id uuid.UUID, username string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.names == nil {
+		f.names = make(map[uuid.UUID]string)
+	}
+	f.names[id] = username
+}
+
+func (f *fakeUserStore) GetUsername(ctx context.Context, id uuid.UUID) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name, ok := f.names[id]
+	if !ok {
+		return "", fmt.Errorf("user not found")
+	}
+	return name, nil
+}
+
+func (f *fakeUserStore) GetUserByID(ctx context.Context, id uuid.UUID) (*db.User, error) {
+	name, err := f.GetUsername(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &db.User{ID: id, Username: name, EmailVerified: true}, nil
+}
+
+// fakeTranscoder "transcodes" by prefixing the input, or fails with err
+type fakeTranscoder struct {
+	err error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeTranscoder) Transcode(ctx context.Context, data []byte, format string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, format)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return append([]byte("OggS"), data...), nil
+}
+
+// wavFile returns a 16-bit mono PCM WAV holding samples
+func wavFile(samples []int16) []byte {
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, samples)
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+data.Len()))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1))     // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1))     // mono
+	binary.Write(&buf, binary.LittleEndian, uint32(8000))  // sample rate
+	binary.Write(&buf, binary.LittleEndian, uint32(16000)) // byte rate
+	binary.Write(&buf, binary.LittleEndian, uint16(2))     // block align
+	binary.Write(&buf, binary.LittleEndian, uint16(16))    // bits per sample
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(data.Len()))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+// lockedBuffer collects log output written from several goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// contains reports whether anything written so far contains text
+func (b *lockedBuffer) contains(text string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Contains(b.buf.Bytes(), []byte(text))
+}
+
+// lines returns every JSON log line written so far
+func (b *lockedBuffer) lines(t *testing.T) []map[string]any {
+	t.Helper()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var lines []map[string]any
+	for _, raw := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		var line map[string]any
+		if err := json.Unmarshal(raw, &line); err != nil {
+			t.Fatalf("log line %q: %v", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
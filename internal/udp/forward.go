@@ -0,0 +1,193 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Retransmission defaults, used when the options leave them at zero
+const (
+	defaultForwardAckTimeout = time.Second
+	defaultForwardRetries    = 3
+)
+
+// errNotAcknowledged means the recipient stopped ACKing before every chunk was confirmed
+var errNotAcknowledged = errors.New("recipient did not acknowledge all chunks")
+
+// forwardState collects the ACKs a recipient sends for a message being sent to them
+type forwardState struct {
+	recipientID uuid.UUID
+
+	mu    sync.Mutex
+	acked map[uint32]struct{}
+
+	// progress is signalled whenever a new chunk is ACKed
+	progress chan struct{}
+}
+
+func (f *forwardState) ack(chunkIndex uint32) {
+	f.mu.Lock()
+	_, seen := f.acked[chunkIndex]
+	f.acked[chunkIndex] = struct{}{}
+	f.mu.Unlock()
+
+	if !seen {
+		select {
+		case f.progress <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (f *forwardState) ackedCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.acked)
+}
+
+// missing returns the chunks that weren't ACKed yet
+func (f *forwardState) missing(totalChunks uint32) []uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var missing []uint32
+	for i := uint32(0); i < totalChunks; i++ {
+		if _, ok := f.acked[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// waitAll waits until every chunk is ACKed. It gives up once no new ACK
+// arrived for timeout and reports whether everything was confirmed
+func (f *forwardState) waitAll(ctx context.Context, totalChunks uint32, timeout time.Duration) (bool, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		if f.ackedCount() == int(totalChunks) {
+			return true, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-timer.C:
+			return f.ackedCount() == int(totalChunks), nil
+		case <-f.progress:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+		}
+	}
+}
+
+// trackForward starts collecting ACKs for a message sent to recipientID.
+// The returned func stops tracking
+func (s *Server) trackForward(messageID, recipientID uuid.UUID) (*forwardState, func()) {
+	state := &forwardState{
+		recipientID: recipientID,
+		acked:       make(map[uint32]struct{}),
+		progress:    make(chan struct{}, 1),
+	}
+
+	s.forwardsMu.Lock()
+	s.forwards[messageID] = state
+	s.forwardsMu.Unlock()
+
+	return state, func() {
+		s.forwardsMu.Lock()
+		if s.forwards[messageID] == state {
+			delete(s.forwards, messageID)
+		}
+		s.forwardsMu.Unlock()
+	}
+}
+
+// handleForwardAck records a recipient's ACK for a chunk the server sent them
+func (s *Server) handleForwardAck(packet *Packet) {
+	s.forwardsMu.Lock()
+	state := s.forwards[packet.MessageID]
+	s.forwardsMu.Unlock()
+
+	// ACKs for messages no longer being sent, or from someone else, are ignored
+	if state == nil || state.recipientID != packet.SenderID || packet.ChunkIndex >= packet.TotalChunks {
+		return
+	}
+	state.ack(packet.ChunkIndex)
+}
+
+// sendChunksPaced splits data into voice chunks and sends them to addr within the configured bitrate.
+// Chunks the recipient doesn't ACK are sent again, and errNotAcknowledged is returned
+// if some are still unconfirmed after the configured number of retries
+func (s *Server) sendChunksPaced(messageID, senderID, recipientID uuid.UUID, data []byte, totalChunks uint32, addr *net.UDPAddr) error {
+	state, done := s.trackForward(messageID, recipientID)
+	defer done()
+
+	opts := s.options()
+	p := newPacer(opts)
+
+	ackTimeout := opts.ForwardAckTimeout
+	if ackTimeout <= 0 {
+		ackTimeout = defaultForwardAckTimeout
+	}
+	retries := opts.ForwardRetries
+	if retries <= 0 {
+		retries = defaultForwardRetries
+	}
+
+	send := func(i uint32) error {
+		start := int(i) * MaxPayloadSize
+		end := min(start+MaxPayloadSize, len(data))
+		chunkData := data[start:end]
+
+		if err := p.wait(s.ctx, len(chunkData)); err != nil {
+			return err
+		}
+
+		packet := NewVoiceDataPacket(senderID, recipientID, messageID, i, totalChunks, chunkData)
+		s.sendPacket(packet, addr)
+		return nil
+	}
+
+	for i := uint32(0); i < totalChunks; i++ {
+		if err := send(i); err != nil {
+			return err
+		}
+		p.adjust(int(i+1) - state.ackedCount())
+	}
+
+	for attempt := 0; ; attempt++ {
+		complete, err := state.waitAll(s.ctx, totalChunks, ackTimeout)
+		if err != nil {
+			return err
+		}
+		if complete {
+			return nil
+		}
+		if attempt == retries {
+			return errNotAcknowledged
+		}
+
+		missing := state.missing(totalChunks)
+		s.messageLogger(messageID).Debug("Retransmitting unacknowledged chunks",
+			"missing", len(missing),
+			"attempt", attempt+1,
+		)
+
+		// Everything missing is outstanding, so the rate backs off before resending
+		p.adjust(len(missing))
+		for _, i := range missing {
+			if err := send(i); err != nil {
+				return err
+			}
+		}
+	}
+}
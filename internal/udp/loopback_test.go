@@ -0,0 +1,246 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/session"
+	"github.com/rx3lixir/laba/pkg/jwt"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+)
+
+// loopback is a running server on 127.0.0.1 with in-memory stores
+type loopback struct {
+	*Server
+
+	addr     *net.UDPAddr
+	sessions *session.MemoryStore
+	messages *fakeMessageStore
+	users    *fakeUserStore
+	objects  *s3storage.MemoryStore
+	jwt      *jwt.Service
+}
+
+// startLoopback starts a server on a free loopback port and shuts it down when the test ends
+func startLoopback(t *testing.T, opts Options) *loopback {
+	t.Helper()
+
+	return startLoopbackWithSessions(t, opts, session.NewMemoryStore(session.TTLOptions{}))
+}
+
+// startLoopbackWithSessions is startLoopback on the given session store
+func startLoopbackWithSessions(t *testing.T, opts Options, sessions *session.MemoryStore) *loopback {
+	t.Helper()
+
+	return startLoopbackWithLogger(t, opts, sessions, log.New(io.Discard))
+}
+
+// startLoopbackWithLogger is startLoopback on the given session store, logging to logger
+func startLoopbackWithLogger(t *testing.T, opts Options, sessions *session.MemoryStore, logger *log.Logger) *loopback {
+	t.Helper()
+
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().(*net.UDPAddr)
+	probe.Close()
+
+	lb := &loopback{
+		addr:     addr,
+		sessions: sessions,
+		messages: newFakeMessageStore(),
+		users:    &fakeUserStore{},
+		objects:  s3storage.NewMemoryStore(),
+		jwt:      jwt.NewService("test-secret", time.Hour, time.Hour),
+	}
+	lb.Server = New(addr.String(), opts, lb.sessions, lb.jwt, lb.users, lb.messages, nil, fakeBlockStore{}, lb.objects, nil, nil, logger)
+
+	errc := make(chan error, 1)
+	go func() { errc <- lb.Start() }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		lb.Shutdown(ctx)
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	})
+
+	// The port is taken once the server listens
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start listening")
+		}
+	}
+
+	return lb
+}
+
+// testClient speaks the protocol to a loopback server from a socket of its own
+type testClient struct {
+	t       *testing.T
+	conn    *net.UDPConn
+	server  *net.UDPAddr
+	userID  uuid.UUID
+	token   string
+	seq     atomic.Uint32
+	channel *SecureChannel
+}
+
+// client returns a client for a new user with a valid access token
+func (lb *loopback) client(t *testing.T, username string) *testClient {
+	t.Helper()
+
+	return lb.clientAt(t, username, net.IPv4(127, 0, 0, 1))
+}
+
+// clientAt is client with a socket on another loopback IP
+func (lb *loopback) clientAt(t *testing.T, username string, ip net.IP) *testClient {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	userID := uuid.New()
+	token, err := lb.jwt.GenerateAccessToken(userID, username+"@example.com", username, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.users.add(userID, username)
+
+	return &testClient{t: t, conn: conn, server: lb.addr, userID: userID, token: token}
+}
+
+// addr returns the address the server sees the client at
+func (c *testClient) addr() *net.UDPAddr {
+	return c.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// send numbers a packet and sends it, sealed once a secure channel is up
+func (c *testClient) send(p *Packet) {
+	c.t.Helper()
+
+	p.Sequence = c.seq.Add(1)
+	if c.channel != nil {
+		sealed, err := c.channel.Seal(p)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		p = sealed
+	}
+	c.sendRaw(p)
+}
+
+// sendRaw sends a packet exactly as given
+func (c *testClient) sendRaw(p *Packet) {
+	c.t.Helper()
+
+	data, err := p.Marshal()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.WriteToUDP(data, c.server); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// recv reads the next packet, opening it if it is sealed
+func (c *testClient) recv(timeout time.Duration) (*Packet, error) {
+	buf := make([]byte, MaxPacketSize)
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := c.conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := Unmarshal(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	if p.Type == PacketTypeSecure {
+		if c.channel == nil {
+			return nil, errors.New("sealed packet without a secure channel")
+		}
+		return c.channel.Open(p)
+	}
+	return p, nil
+}
+
+// expect reads packets until one of type packetType arrives, failing the test after a second
+func (c *testClient) expect(packetType uint8) *Packet {
+	c.t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		p, err := c.recv(time.Until(deadline))
+		if err != nil {
+			c.t.Fatalf("waiting for packet type %#x: %v", packetType, err)
+		}
+		if p.Type == packetType {
+			return p
+		}
+	}
+}
+
+// expectNothing fails the test if a packet of type packetType arrives within timeout
+func (c *testClient) expectNothing(packetType uint8, timeout time.Duration) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		p, err := c.recv(time.Until(deadline))
+		if err != nil {
+			return
+		}
+		if p.Type == packetType {
+			c.t.Fatalf("got packet type %#x: %q", packetType, p.Payload)
+		}
+	}
+}
+
+// auth authenticates the client and waits for the ACK
+func (c *testClient) auth() {
+	c.t.Helper()
+
+	p, err := NewAuthPacket(c.userID, c.token)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.channel = nil
+	c.send(p)
+	c.expect(PacketTypeAuthAck)
+}
+
+// handshake sets up a secure channel, the client has to be authenticated
+func (c *testClient) handshake() {
+	c.t.Helper()
+
+	key, err := NewHandshakeKey()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(NewHandshakePacket(c.userID, key.PublicKey().Bytes(), c.token))
+	ack := c.expect(PacketTypeHandshakeAck)
+
+	channel, err := NewSecureChannel(key, ack.Payload, c.userID, false)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.channel = channel
+}
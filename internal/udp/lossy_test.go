@@ -0,0 +1,216 @@
+package udp
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// linkConfig describes how badly a simulated link behaves. Probabilities are between 0 and 1
+type linkConfig struct {
+	Loss    float64       // packets silently dropped
+	Reorder float64       // packets held back and sent after the next one
+	Delay   time.Duration // added to every packet that isn't dropped
+	Jitter  time.Duration // random extra delay on top of Delay
+}
+
+// lossyConn is a net.PacketConn that drops, delays and reorders what is written through it.
+// Decisions come from a seeded source, so a failing run can be replayed with the same seed
+type lossyConn struct {
+	net.PacketConn
+	cfg linkConfig
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	held *heldPacket
+}
+
+type heldPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func newLossyConn(conn net.PacketConn, cfg linkConfig, seed int64) *lossyConn {
+	return &lossyConn{PacketConn: conn, cfg: cfg, rng: rand.New(rand.NewSource(seed))}
+}
+
+// WriteTo reports every packet as sent, like a real network that loses it later
+func (c *lossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	data := bytes.Clone(p)
+
+	c.mu.Lock()
+	if c.rng.Float64() < c.cfg.Loss {
+		c.mu.Unlock()
+		return len(p), nil
+	}
+
+	delay := c.cfg.Delay
+	if c.cfg.Jitter > 0 {
+		delay += time.Duration(c.rng.Int63n(int64(c.cfg.Jitter)))
+	}
+
+	// A held packet goes out right behind this one
+	var send []heldPacket
+	if c.held == nil && c.rng.Float64() < c.cfg.Reorder {
+		c.held = &heldPacket{data: data, addr: addr}
+	} else {
+		send = append(send, heldPacket{data: data, addr: addr})
+		if c.held != nil {
+			send = append(send, *c.held)
+			c.held = nil
+		}
+	}
+	c.mu.Unlock()
+
+	for _, packet := range send {
+		c.write(packet, delay)
+	}
+	return len(p), nil
+}
+
+func (c *lossyConn) write(packet heldPacket, delay time.Duration) {
+	if delay <= 0 {
+		c.PacketConn.WriteTo(packet.data, packet.addr)
+		return
+	}
+	time.AfterFunc(delay, func() { c.PacketConn.WriteTo(packet.data, packet.addr) })
+}
+
+// newLossyLink relays datagrams between whoever writes to the returned address and target,
+// over a lossy link in both directions. Point a client or server at the returned address instead of its peer
+func newLossyLink(t *testing.T, target *net.UDPAddr, cfg linkConfig, seed int64) *net.UDPAddr {
+	t.Helper()
+
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	front := newLossyConn(listen(), cfg, seed)
+	back := newLossyConn(listen(), cfg, seed+1)
+
+	var mu sync.Mutex
+	var peer net.Addr
+
+	// Front to target, remembering who to answer
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := front.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			peer = from
+			mu.Unlock()
+			back.WriteTo(buf[:n], target)
+		}
+	}()
+
+	// Target back to the last peer
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, _, err := back.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			to := peer
+			mu.Unlock()
+			if to != nil {
+				front.WriteTo(buf[:n], to)
+			}
+		}
+	}()
+
+	return front.LocalAddr().(*net.UDPAddr)
+}
+
+func TestForwardSurvivesPacketLoss(t *testing.T) {
+	messages := newFakeMessageStore()
+	s, store, recipientID, recipient := newForwardingServer(t, messages)
+	s.SetOptions(Options{
+		ForwardAckTimeout: 100 * time.Millisecond,
+		ForwardRetries:    30,
+		ForwardBitrate:    50_000_000,
+		ForwardMinBitrate: 10_000_000,
+	})
+
+	// The server reaches the recipient only through a link losing 20% each way
+	link := newLossyLink(t, recipient.LocalAddr().(*net.UDPAddr), linkConfig{Loss: 0.2, Reorder: 0.1, Jitter: 2 * time.Millisecond}, 42)
+	if err := store.CreateSession(s.ctx, recipientID, "bob", link); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server isn't listening, ACKs coming back are handed over here
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, _, err := s.conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if packet, err := Unmarshal(buf[:n]); err == nil && packet.Type == PacketTypeAck {
+				s.handleForwardAck(packet)
+			}
+		}
+	}()
+
+	// The recipient keeps every chunk and ACKs it, retransmits included
+	data := bytes.Repeat([]byte("v"), 40*MaxPayloadSize)
+	total := uint32((len(data) + MaxPayloadSize - 1) / MaxPayloadSize)
+
+	received := make(chan []byte, 1)
+	go func() {
+		chunks := make(map[uint32][]byte)
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, from, err := recipient.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			packet, err := Unmarshal(buf[:n])
+			if err != nil || packet.Type != PacketTypeVoiceData {
+				continue
+			}
+			chunks[packet.ChunkIndex] = packet.Payload
+
+			ack, _ := NewAckPacket(packet).Marshal()
+			recipient.WriteToUDP(ack, from)
+
+			if uint32(len(chunks)) == total {
+				var assembled []byte
+				for i := uint32(0); i < total; i++ {
+					assembled = append(assembled, chunks[i]...)
+				}
+				select {
+				case received <- assembled:
+				default:
+				}
+			}
+		}
+	}()
+
+	if !s.forwardIfOnline(uuid.New(), uuid.New(), recipientID, data, total) {
+		t.Fatal("forward was not fully acknowledged")
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) {
+			t.Fatal("recipient assembled different data")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("recipient never had every chunk")
+	}
+}
@@ -0,0 +1,75 @@
+package udp
+
+import (
+	"context"
+	"time"
+)
+
+// Pacing defaults, used when the options leave them at zero
+const (
+	defaultForwardBitrate    = 2_000_000 // bits per second
+	defaultForwardMinBitrate = 128_000
+	defaultForwardAckWindow  = 32 // chunks
+)
+
+// pacer spaces out outgoing chunks to stay under a bitrate.
+// It halves the rate when the recipient falls behind on ACKs
+// and climbs back towards the cap while ACKs keep up
+type pacer struct {
+	rate    float64 // bytes per second
+	minRate float64
+	maxRate float64
+	window  int
+	next    time.Time
+}
+
+func newPacer(opts *Options) *pacer {
+	maxBitrate := opts.ForwardBitrate
+	if maxBitrate <= 0 {
+		maxBitrate = defaultForwardBitrate
+	}
+	minBitrate := opts.ForwardMinBitrate
+	if minBitrate <= 0 {
+		minBitrate = defaultForwardMinBitrate
+	}
+	minBitrate = min(minBitrate, maxBitrate)
+	window := opts.ForwardAckWindow
+	if window <= 0 {
+		window = defaultForwardAckWindow
+	}
+
+	return &pacer{
+		rate:    float64(maxBitrate) / 8,
+		minRate: float64(minBitrate) / 8,
+		maxRate: float64(maxBitrate) / 8,
+		window:  window,
+	}
+}
+
+// wait blocks until a chunk of size bytes may be sent
+func (p *pacer) wait(ctx context.Context, size int) error {
+	now := time.Now()
+	if p.next.After(now) {
+		timer := time.NewTimer(p.next.Sub(now))
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		now = p.next
+	}
+
+	p.next = now.Add(time.Duration(float64(size) / p.rate * float64(time.Second)))
+	return nil
+}
+
+// adjust reacts to the number of chunks sent but not ACKed yet
+func (p *pacer) adjust(outstanding int) {
+	if outstanding > p.window {
+		p.rate = max(p.rate/2, p.minRate)
+		return
+	}
+	p.rate = min(p.rate+p.maxRate/16, p.maxRate)
+}
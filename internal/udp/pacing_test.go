@@ -0,0 +1,95 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestForwardRespectsBitrateCap(t *testing.T) {
+	const bitrate = 896_000 // 112 KB/s, 20 full chunks take about a quarter second
+
+	s, _, recipientID, recipient := newForwardingServer(t, newFakeMessageStore())
+	s.SetOptions(Options{ForwardBitrate: bitrate, ForwardAckTimeout: time.Second, ForwardRetries: 1})
+
+	data := bytes.Repeat([]byte("v"), 20*MaxPayloadSize)
+	total := uint32(len(data) / MaxPayloadSize)
+
+	// The recipient ACKs right away, so the rate never has a reason to back off
+	arrivals := make(chan time.Time, total)
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, _, err := recipient.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			packet, err := Unmarshal(buf[:n])
+			if err != nil || packet.Type != PacketTypeVoiceData {
+				continue
+			}
+			arrivals <- time.Now()
+			s.handleForwardAck(NewAckPacket(packet))
+		}
+	}()
+
+	if !s.forwardIfOnline(uuid.New(), uuid.New(), recipientID, data, total) {
+		t.Fatal("forward was not acknowledged")
+	}
+
+	first := <-arrivals
+	last := first
+	for i := uint32(1); i < total; i++ {
+		last = <-arrivals
+	}
+
+	// Every chunk but the last was sent before the last one could go
+	elapsed := last.Sub(first)
+	rate := float64((total-1)*MaxPayloadSize*8) / elapsed.Seconds()
+	if rate > bitrate*1.1 {
+		t.Fatalf("sent at %.0f bit/s, cap is %d", rate, bitrate)
+	}
+	if rate < bitrate/4 {
+		t.Fatalf("sent at %.0f bit/s with every chunk ACKed, want close to %d", rate, bitrate)
+	}
+}
+
+func TestPacerBacksOffWhenAcksLag(t *testing.T) {
+	p := newPacer(&Options{ForwardBitrate: 800_000, ForwardMinBitrate: 200_000, ForwardAckWindow: 4})
+
+	p.adjust(5)
+	if p.rate != 50_000 {
+		t.Fatalf("rate %.0f B/s after ACKs fell behind, want it halved to 50000", p.rate)
+	}
+	p.adjust(5)
+	p.adjust(5)
+	if p.rate != 25_000 {
+		t.Fatalf("rate %.0f B/s, want the 25000 floor", p.rate)
+	}
+
+	// Back up towards the cap, never past it
+	for range 32 {
+		p.adjust(0)
+	}
+	if p.rate != 100_000 {
+		t.Fatalf("rate %.0f B/s once ACKs kept up, want the 100000 cap", p.rate)
+	}
+}
+
+func TestPacerWaitStopsWithContext(t *testing.T) {
+	p := newPacer(&Options{ForwardBitrate: 8, ForwardMinBitrate: 8})
+	if err := p.wait(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next chunk is due in ten seconds
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.wait(ctx, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait returned %v, want the context error", err)
+	}
+}
@@ -2,29 +2,77 @@ package udp
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 const (
-	PacketTypeAuth         = 0x01
-	PacketTypeAuthAck      = 0x02
-	PacketTypeVoiceData    = 0x03
-	PacketTypeAck          = 0x04
-	PacketTypeHeartbeat    = 0x05
-	PacketTypeListMessages = 0x06 // NEW: Request list of messages
-	PacketTypeMessageList  = 0x07 // NEW: Response with message list
-	PacketTypeDownloadMsg  = 0x08 // NEW: Request to download a message
-	PacketTypeError        = 0xFF
+	PacketTypeAuth               = 0x01
+	PacketTypeAuthAck            = 0x02
+	PacketTypeVoiceData          = 0x03
+	PacketTypeAck                = 0x04
+	PacketTypeHeartbeat          = 0x05
+	PacketTypeListMessages       = 0x06 // NEW: Request list of messages
+	PacketTypeMessageList        = 0x07 // NEW: Response with message list
+	PacketTypeDownloadMsg        = 0x08 // NEW: Request to download a message
+	PacketTypeHandshake          = 0x09 // Client key share, sent after auth
+	PacketTypeHandshakeAck       = 0x0A // Server key share
+	PacketTypeRecordingIndicator = 0x0B // Sender started or stopped recording
+	PacketTypeStatusQuery        = 0x0C // Sender asks for the status of a message
+	PacketTypeStatusResponse     = 0x0D // Status and timestamps of a message
+	PacketTypeSecure             = 0x0E // Encrypted envelope around any other packet
+	PacketTypeNewMessage         = 0x0F // A message was stored for an online recipient
+	PacketTypeDeleteMessage      = 0x10 // Recipient deletes a received message
+	PacketTypeError              = 0xFF
 )
 
+// ErrorSessionExpired is the error packet payload sent to a user without a session.
+// Clients match on it to re-authenticate and retry
+const ErrorSessionExpired = "session_expired"
+
+// ErrorRateLimited is the error packet payload sent when a sender is over their send quota
+const ErrorRateLimited = "rate_limited"
+
+// ErrChecksumMismatch is returned by Unmarshal when the payload doesn't match its checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// AckCumulative is the payload of ACKs that confirm a whole run of chunks
+const AckCumulative = "cumulative"
+
+// AckDeleted is the payload of ACKs that confirm a message was deleted
+const AckDeleted = "deleted"
+
 const (
-	ProtocolVersion = 0x01
+	// ProtocolVersion 3 renumbered the recording indicator, status and secure packet types
+	ProtocolVersion = 0x03
 	MaxPayloadSize  = 1400
+
+	// HeaderSize is the size of a marshaled packet without payload: version, type,
+	// message ID, chunk index, total chunks, sequence, sender ID, recipient ID,
+	// checksum and payload length. Marshal refuses to write a header of any other size
+	HeaderSize = 1 + 1 + uuidSize + 4 + 4 + 4 + uuidSize + uuidSize + 4 + 2
+
+	// uuidSize is the wire size of every ID in the header
+	uuidSize = 16
+
+	// SecureOverhead is how much larger a secure packet payload may be
+	// than MaxPayloadSize: the inner header, sequence number and GCM tag
+	SecureOverhead = HeaderSize + seqSize + 16
+
+	// MaxPacketSize is the largest datagram Marshal produces, a secure packet
+	// carrying a full payload. It is the default and the floor of Options.MaxPacketSize
+	MaxPacketSize = HeaderSize + MaxPayloadSize + SecureOverhead
+
+	// maxDatagramSize is the largest payload a UDP datagram over IPv4 can carry
+	maxDatagramSize = 65507
 )
 
 // MessageInfo represents metadata about a voice message
@@ -39,6 +87,23 @@ type MessageInfo struct {
 	CreatedAt   string    `json:"created_at"`
 }
 
+// MessageStatus is the payload of a status response
+type MessageStatus struct {
+	ID          uuid.UUID  `json:"id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ListenedAt  *time.Time `json:"listened_at,omitempty"`
+}
+
+// AuthPayload is the payload of an auth packet. The nonce and timestamp
+// make every auth packet unique so a captured one can't be replayed
+type AuthPayload struct {
+	Token     string `json:"token"`
+	Nonce     string `json:"nonce"`
+	Timestamp int64  `json:"ts"`
+}
+
 // Packet represents a UDP packet
 type Packet struct {
 	Version     uint8
@@ -46,6 +111,9 @@ type Packet struct {
 	MessageID   uuid.UUID
 	ChunkIndex  uint32
 	TotalChunks uint32
+	// Sequence is stamped by the sender on every send, retransmits included,
+	// so a duplicate made by the network can be told apart from a fresh packet
+	Sequence    uint32
 	SenderID    uuid.UUID
 	RecipientID uuid.UUID
 	Checksum    uint32
@@ -55,8 +123,17 @@ type Packet struct {
 
 // Marshal converts a Packet to bytes
 func (p *Packet) Marshal() ([]byte, error) {
-	if len(p.Payload) > MaxPayloadSize {
-		return nil, fmt.Errorf("payload size %d exceeds maximum %d", len(p.Payload), MaxPayloadSize)
+	maxPayload := MaxPayloadSize
+	if p.Type == PacketTypeSecure {
+		maxPayload += SecureOverhead
+	}
+
+	if len(p.Payload) > maxPayload {
+		return nil, fmt.Errorf("payload size %d exceeds maximum %d", len(p.Payload), maxPayload)
+	}
+
+	if err := p.validateIDs(); err != nil {
+		return nil, err
 	}
 
 	buf := new(bytes.Buffer)
@@ -86,6 +163,11 @@ func (p *Packet) Marshal() ([]byte, error) {
 		return nil, err
 	}
 
+	// Sequence
+	if err := binary.Write(buf, binary.BigEndian, p.Sequence); err != nil {
+		return nil, err
+	}
+
 	// SenderID
 	if _, err := buf.Write(p.SenderID[:]); err != nil {
 		return nil, err
@@ -108,6 +190,11 @@ func (p *Packet) Marshal() ([]byte, error) {
 		return nil, err
 	}
 
+	// Catches a header layout change that HeaderSize wasn't updated for
+	if buf.Len() != HeaderSize {
+		return nil, fmt.Errorf("marshaled header is %d bytes, expected %d", buf.Len(), HeaderSize)
+	}
+
 	if _, err := buf.Write(p.Payload); err != nil {
 		return nil, err
 	}
@@ -115,14 +202,48 @@ func (p *Packet) Marshal() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// validateIDs checks that the IDs a packet type can't do without are set.
+// A nil ID would otherwise be routed as if it were a real one.
+// Auth packets go without, the server takes the user from the token
+func (p *Packet) validateIDs() error {
+	var sender, recipient, message bool
+
+	switch p.Type {
+	case PacketTypeVoiceData, PacketTypeNewMessage:
+		sender, recipient, message = true, true, true
+	case PacketTypeRecordingIndicator:
+		sender, recipient = true, true
+	case PacketTypeDownloadMsg, PacketTypeStatusQuery, PacketTypeDeleteMessage:
+		sender, message = true, true
+	case PacketTypeHandshake, PacketTypeListMessages, PacketTypeHeartbeat:
+		sender = true
+	}
+
+	if sender && p.SenderID == uuid.Nil {
+		return fmt.Errorf("packet type %d requires a sender ID", p.Type)
+	}
+	if recipient && p.RecipientID == uuid.Nil {
+		return fmt.Errorf("packet type %d requires a recipient ID", p.Type)
+	}
+	if message && p.MessageID == uuid.Nil {
+		return fmt.Errorf("packet type %d requires a message ID", p.Type)
+	}
+	return nil
+}
+
 // Unmarshal converts bytes to a Packet
 func Unmarshal(data []byte) (*Packet, error) {
-	if len(data) < 48 {
+	if len(data) < HeaderSize {
 		return nil, fmt.Errorf("packet too small: %d bytes", len(data))
 	}
+	// The header layout changes between versions, so older packets can't be read
+	if data[0] != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version: %d", data[0])
+	}
 
 	buf := bytes.NewReader(data)
 	p := &Packet{}
+	var err error
 
 	// Read header fields
 	if err := binary.Read(buf, binary.BigEndian, &p.Version); err != nil {
@@ -133,11 +254,9 @@ func Unmarshal(data []byte) (*Packet, error) {
 	}
 
 	// MessageID
-	messageIDBytes := make([]byte, 16)
-	if _, err := buf.Read(messageIDBytes); err != nil {
-		return nil, err
+	if p.MessageID, err = readUUID(buf); err != nil {
+		return nil, fmt.Errorf("invalid message ID: %w", err)
 	}
-	p.MessageID, _ = uuid.FromBytes(messageIDBytes)
 
 	// ChunkIndex
 	if err := binary.Read(buf, binary.BigEndian, &p.ChunkIndex); err != nil {
@@ -149,19 +268,24 @@ func Unmarshal(data []byte) (*Packet, error) {
 		return nil, err
 	}
 
-	// SenderID
-	senderIDBytes := make([]byte, 16)
-	if _, err := buf.Read(senderIDBytes); err != nil {
+	// Sequence
+	if err := binary.Read(buf, binary.BigEndian, &p.Sequence); err != nil {
 		return nil, err
 	}
-	p.SenderID, _ = uuid.FromBytes(senderIDBytes)
+
+	// SenderID
+	if p.SenderID, err = readUUID(buf); err != nil {
+		return nil, fmt.Errorf("invalid sender ID: %w", err)
+	}
 
 	// RecipientID
-	recipientIDBytes := make([]byte, 16)
-	if _, err := buf.Read(recipientIDBytes); err != nil {
+	if p.RecipientID, err = readUUID(buf); err != nil {
+		return nil, fmt.Errorf("invalid recipient ID: %w", err)
+	}
+
+	if err := p.validateIDs(); err != nil {
 		return nil, err
 	}
-	p.RecipientID, _ = uuid.FromBytes(recipientIDBytes)
 
 	// Checksum
 	if err := binary.Read(buf, binary.BigEndian, &p.Checksum); err != nil {
@@ -173,17 +297,23 @@ func Unmarshal(data []byte) (*Packet, error) {
 		return nil, err
 	}
 
+	// Checked before allocating, so a bogus length can't make us allocate for bytes that never came
+	if int(p.PayloadLen) > len(data)-HeaderSize {
+		return nil, fmt.Errorf("payload length %d exceeds the %d bytes after the header", p.PayloadLen, len(data)-HeaderSize)
+	}
+
 	// Read payload (only if there is one)
 	if p.PayloadLen > 0 {
 		p.Payload = make([]byte, p.PayloadLen)
-		if _, err := buf.Read(p.Payload); err != nil {
-			return nil, err
+		// A plain Read may come up short and leave the tail zeroed, ReadFull refuses a truncated payload
+		if _, err := io.ReadFull(buf, p.Payload); err != nil {
+			return nil, fmt.Errorf("truncated payload: %w", err)
 		}
 
 		// Verify checksum
 		calculatedChecksum := crc32.ChecksumIEEE(p.Payload)
 		if calculatedChecksum != p.Checksum {
-			return nil, fmt.Errorf("checksum mismatch: expected %d, got %d", p.Checksum, calculatedChecksum)
+			return nil, fmt.Errorf("%w: expected %d, got %d", ErrChecksumMismatch, p.Checksum, calculatedChecksum)
 		}
 	} else {
 		p.Payload = []byte{}
@@ -192,6 +322,15 @@ func Unmarshal(data []byte) (*Packet, error) {
 	return p, nil
 }
 
+// readUUID reads the next 16 bytes as a UUID
+func readUUID(r io.Reader) (uuid.UUID, error) {
+	b := make([]byte, uuidSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.FromBytes(b)
+}
+
 // NewPacket creates a new Packet with default values
 func NewPacket(packetType uint8, senderID, recipientID, messageID uuid.UUID) *Packet {
 	return &Packet{
@@ -203,13 +342,70 @@ func NewPacket(packetType uint8, senderID, recipientID, messageID uuid.UUID) *Pa
 	}
 }
 
-// NewAuthPacket creates an authentication packet
-func NewAuthPacket(userID uuid.UUID, jwtToken string) *Packet {
+// NewAuthPacket creates an authentication packet with a fresh nonce and the current time
+func NewAuthPacket(userID uuid.UUID, jwtToken string) (*Packet, error) {
+	data, err := json.Marshal(AuthPayload{
+		Token:     jwtToken,
+		Nonce:     rand.Text(),
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal auth payload: %w", err)
+	}
+
 	p := NewPacket(PacketTypeAuth, userID, uuid.Nil, uuid.New())
-	p.Payload = []byte(jwtToken)
+	p.Payload = data
+	return p, nil
+}
+
+// ParseAuthPayload parses the payload of an auth packet
+func ParseAuthPayload(payload []byte) (*AuthPayload, error) {
+	var auth AuthPayload
+	if err := json.Unmarshal(payload, &auth); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal auth payload: %w", err)
+	}
+
+	if auth.Token == "" || auth.Nonce == "" {
+		return nil, fmt.Errorf("auth payload is missing token or nonce")
+	}
+
+	return &auth, nil
+}
+
+// NewHandshakePacket creates a handshake packet carrying the client public key.
+// The token is sent again so the key share is bound to the authenticated user
+func NewHandshakePacket(userID uuid.UUID, publicKey []byte, jwtToken string) *Packet {
+	p := NewPacket(PacketTypeHandshake, userID, uuid.Nil, uuid.New())
+	p.Payload = append(append([]byte{}, publicKey...), jwtToken...)
 	return p
 }
 
+// NewHandshakeAckPacket creates a handshake reply carrying the server public key
+func NewHandshakeAckPacket(userID, messageID uuid.UUID, publicKey []byte) *Packet {
+	p := NewPacket(PacketTypeHandshakeAck, uuid.Nil, userID, messageID)
+	p.Payload = publicKey
+	return p
+}
+
+// NewRecordingIndicatorPacket creates a packet telling the recipient
+// whether the sender is recording a voice message
+func NewRecordingIndicatorPacket(senderID, recipientID uuid.UUID, recording bool) *Packet {
+	p := NewPacket(PacketTypeRecordingIndicator, senderID, recipientID, uuid.New())
+	p.Payload = []byte{0}
+	if recording {
+		p.Payload[0] = 1
+	}
+	return p
+}
+
+// ParseRecordingIndicator parses the state from a recording indicator payload
+func ParseRecordingIndicator(payload []byte) (bool, error) {
+	if len(payload) != 1 || payload[0] > 1 {
+		return false, fmt.Errorf("invalid recording indicator payload")
+	}
+	return payload[0] == 1, nil
+}
+
 // NewAckPacket creates an acknowledgment packet
 func NewAckPacket(originalPacket *Packet) *Packet {
 	p := NewPacket(PacketTypeAck, originalPacket.RecipientID, originalPacket.SenderID, originalPacket.MessageID)
@@ -218,6 +414,20 @@ func NewAckPacket(originalPacket *Packet) *Packet {
 	return p
 }
 
+// NewCumulativeAckPacket creates an ACK confirming every chunk of a message below received
+func NewCumulativeAckPacket(originalPacket *Packet, received uint32) *Packet {
+	p := NewAckPacket(originalPacket)
+	p.ChunkIndex = received
+	p.Payload = []byte(AckCumulative)
+	return p
+}
+
+// IsCumulativeAck reports whether p confirms every chunk below its ChunkIndex
+// rather than only the chunk at ChunkIndex
+func (p *Packet) IsCumulativeAck() bool {
+	return p.Type == PacketTypeAck && string(p.Payload) == AckCumulative
+}
+
 // NewVoiceDataPacket creates a voice data packet
 func NewVoiceDataPacket(senderID, recipientID, messageID uuid.UUID, chunkIndex, totalChunks uint32, data []byte) *Packet {
 	p := NewPacket(PacketTypeVoiceData, senderID, recipientID, messageID)
@@ -244,6 +454,27 @@ func NewMessageListPacket(recipientID uuid.UUID, messages []MessageInfo) (*Packe
 	return p, nil
 }
 
+// NewMessageNotificationPacket tells an online recipient about a message stored for them
+func NewMessageNotificationPacket(recipientID uuid.UUID, info MessageInfo) (*Packet, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message info: %w", err)
+	}
+
+	p := NewPacket(PacketTypeNewMessage, info.SenderID, recipientID, info.ID)
+	p.Payload = data
+	return p, nil
+}
+
+// ParseMessageInfo parses a single message info from packet payload
+func ParseMessageInfo(payload []byte) (*MessageInfo, error) {
+	var info MessageInfo
+	if err := json.Unmarshal(payload, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message info: %w", err)
+	}
+	return &info, nil
+}
+
 // NewDownloadMessagePacket creates a packet requesting message download
 func NewDownloadMessagePacket(userID, messageID uuid.UUID) *Packet {
 	p := NewPacket(PacketTypeDownloadMsg, userID, uuid.Nil, messageID)
@@ -251,6 +482,53 @@ func NewDownloadMessagePacket(userID, messageID uuid.UUID) *Packet {
 	return p
 }
 
+// NewStatusQueryPacket creates a packet asking for the status of a sent message
+func NewStatusQueryPacket(userID, messageID uuid.UUID) *Packet {
+	p := NewPacket(PacketTypeStatusQuery, userID, uuid.Nil, messageID)
+	p.Payload = []byte("status") // Need payload to avoid EOF
+	return p
+}
+
+// NewDeleteMessagePacket creates a packet asking to delete a received message
+func NewDeleteMessagePacket(userID, messageID uuid.UUID) *Packet {
+	p := NewPacket(PacketTypeDeleteMessage, userID, uuid.Nil, messageID)
+	p.Payload = []byte("delete") // Need payload to avoid EOF
+	return p
+}
+
+// NewDeleteAckPacket confirms that the message a delete request named is gone
+func NewDeleteAckPacket(originalPacket *Packet) *Packet {
+	p := NewAckPacket(originalPacket)
+	p.Payload = []byte(AckDeleted)
+	return p
+}
+
+// IsDeleteAck reports whether p confirms a deleted message
+func (p *Packet) IsDeleteAck() bool {
+	return p.Type == PacketTypeAck && string(p.Payload) == AckDeleted
+}
+
+// NewStatusResponsePacket creates a packet with the status of a message
+func NewStatusResponsePacket(recipientID uuid.UUID, status MessageStatus) (*Packet, error) {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message status: %w", err)
+	}
+
+	p := NewPacket(PacketTypeStatusResponse, uuid.Nil, recipientID, status.ID)
+	p.Payload = data
+	return p, nil
+}
+
+// ParseMessageStatus parses a message status from packet payload
+func ParseMessageStatus(payload []byte) (*MessageStatus, error) {
+	var status MessageStatus
+	if err := json.Unmarshal(payload, &status); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message status: %w", err)
+	}
+	return &status, nil
+}
+
 // ParseMessageList parses message list from packet payload
 func ParseMessageList(payload []byte) ([]MessageInfo, error) {
 	var messages []MessageInfo
@@ -0,0 +1,374 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// payloadLenOffset is where PayloadLen sits in a marshaled header
+const payloadLenOffset = HeaderSize - 2
+
+func FuzzUnmarshal(f *testing.F) {
+	valid, err := NewVoiceDataPacket(uuid.New(), uuid.New(), uuid.New(), 0, 2, []byte("voice data")).Marshal()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	empty, err := NewPacket(PacketTypeHeartbeat, uuid.New(), uuid.Nil, uuid.Nil).Marshal()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	// Claims more payload than the datagram carries
+	oversized := bytes.Clone(valid)
+	binary.BigEndian.PutUint16(oversized[payloadLenOffset:], 0xFFFF)
+
+	f.Add(valid)
+	f.Add(empty)
+	f.Add(valid[:HeaderSize-1]) // truncated header
+	f.Add(valid[:len(valid)-1]) // truncated payload
+	f.Add(oversized)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := Unmarshal(data)
+		if err != nil {
+			return
+		}
+
+		if int(packet.PayloadLen) != len(packet.Payload) {
+			t.Fatalf("PayloadLen %d but %d payload bytes", packet.PayloadLen, len(packet.Payload))
+		}
+
+		// Whatever parses must survive a round trip unchanged
+		remarshaled, err := packet.Marshal()
+		if err != nil {
+			return
+		}
+		again, err := Unmarshal(remarshaled)
+		if err != nil {
+			t.Fatalf("round trip failed: %v", err)
+		}
+		if !bytes.Equal(again.Payload, packet.Payload) || again.MessageID != packet.MessageID || again.Sequence != packet.Sequence {
+			t.Fatal("round trip changed the packet")
+		}
+	})
+}
+
+func TestUnmarshalRefusesOversizedPayloadLen(t *testing.T) {
+	data, err := NewVoiceDataPacket(uuid.New(), uuid.New(), uuid.New(), 0, 1, []byte("voice")).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(data[payloadLenOffset:], 0xFFFF)
+
+	if _, err := Unmarshal(data); err == nil {
+		t.Fatal("packet claiming more payload than it carries was accepted")
+	}
+}
+
+func TestUnmarshalRefusesPayloadLenLongerThanBody(t *testing.T) {
+	data, err := NewVoiceDataPacket(uuid.New(), uuid.New(), uuid.New(), 0, 1, []byte("voice")).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		declared uint16
+		body     []byte
+	}{
+		{"one byte short", 6, data},
+		{"maximum payload", MaxPayloadSize, data},
+		{"no body", 5, data[:HeaderSize]},
+		{"truncated body", 5, data[:HeaderSize+2]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := bytes.Clone(tt.body)
+			binary.BigEndian.PutUint16(packet[payloadLenOffset:], tt.declared)
+
+			_, err := Unmarshal(packet)
+			if err == nil {
+				t.Fatal("packet claiming more payload than it carries was accepted")
+			}
+			if !strings.Contains(err.Error(), "exceeds") {
+				t.Fatalf("got %q, want an error naming the overrun", err)
+			}
+		})
+	}
+
+	// The declared length matching the body still parses
+	if p, err := Unmarshal(data); err != nil || string(p.Payload) != "voice" {
+		t.Fatalf("valid packet: %v", err)
+	}
+}
+
+// Offsets of the IDs in a marshaled header
+const (
+	messageIDOffset   = 2
+	senderIDOffset    = messageIDOffset + uuidSize + 4 + 4 + 4
+	recipientIDOffset = senderIDOffset + uuidSize
+)
+
+func TestPacketIDsAreRequired(t *testing.T) {
+	sender, recipient, message := uuid.New(), uuid.New(), uuid.New()
+
+	tests := []struct {
+		name    string
+		packet  *Packet
+		clear   int
+		wantErr bool
+	}{
+		{"voice data without sender", NewVoiceDataPacket(sender, recipient, message, 0, 1, []byte("voice")), senderIDOffset, true},
+		{"voice data without recipient", NewVoiceDataPacket(sender, recipient, message, 0, 1, []byte("voice")), recipientIDOffset, true},
+		{"voice data without message", NewVoiceDataPacket(sender, recipient, message, 0, 1, []byte("voice")), messageIDOffset, true},
+		{"recording indicator without recipient", NewRecordingIndicatorPacket(sender, recipient, true), recipientIDOffset, true},
+		{"download without message", NewDownloadMessagePacket(sender, message), messageIDOffset, true},
+		{"status query without message", NewStatusQueryPacket(sender, message), messageIDOffset, true},
+		{"delete without message", NewDeleteMessagePacket(sender, message), messageIDOffset, true},
+		{"heartbeat without sender", NewPacket(PacketTypeHeartbeat, sender, uuid.Nil, uuid.Nil), senderIDOffset, true},
+		// Only IDs a packet type routes on are required
+		{"download without recipient", NewDownloadMessagePacket(sender, message), recipientIDOffset, false},
+		{"error without IDs", NewPacket(PacketTypeError, uuid.Nil, recipient, message), recipientIDOffset, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.packet.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A zeroed ID on the wire is refused on the way in
+			copy(data[tt.clear:tt.clear+uuidSize], uuid.Nil[:])
+			if _, err := Unmarshal(data); (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal error %v, want error %v", err, tt.wantErr)
+			}
+
+			// and such a packet is never built on the way out
+			switch tt.clear {
+			case senderIDOffset:
+				tt.packet.SenderID = uuid.Nil
+			case recipientIDOffset:
+				tt.packet.RecipientID = uuid.Nil
+			case messageIDOffset:
+				tt.packet.MessageID = uuid.Nil
+			}
+			if _, err := tt.packet.Marshal(); (err != nil) != tt.wantErr {
+				t.Fatalf("Marshal error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRecordingIndicatorRoundTrip(t *testing.T) {
+	for _, recording := range []bool{true, false} {
+		data, err := NewRecordingIndicatorPacket(uuid.New(), uuid.New(), recording).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ParseRecordingIndicator(packet.Payload)
+		if err != nil || got != recording {
+			t.Fatalf("recording = %v, %v, want %v", got, err, recording)
+		}
+	}
+
+	for _, payload := range [][]byte{nil, {2}, {1, 0}} {
+		if _, err := ParseRecordingIndicator(payload); err == nil {
+			t.Errorf("parsed invalid payload %v", payload)
+		}
+	}
+}
+
+func TestSequenceRoundTrip(t *testing.T) {
+	// Sequence follows version, type, message ID, chunk index and total chunks
+	const sequenceOffset = 1 + 1 + uuidSize + 4 + 4
+
+	for _, seq := range []uint32{0, 1, 0xDEADBEEF, 0xFFFFFFFF} {
+		p := NewVoiceDataPacket(uuid.New(), uuid.New(), uuid.New(), 3, 7, []byte("voice"))
+		p.Sequence = seq
+
+		data, err := p.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.BigEndian.Uint32(data[sequenceOffset:]); got != seq {
+			t.Fatalf("sequence %#x on the wire, want %#x", got, seq)
+		}
+
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Sequence != seq {
+			t.Fatalf("sequence %#x after a round trip, want %#x", got.Sequence, seq)
+		}
+		if got.MessageID != p.MessageID || got.SenderID != p.SenderID || got.RecipientID != p.RecipientID ||
+			got.ChunkIndex != 3 || got.TotalChunks != 7 || !bytes.Equal(got.Payload, p.Payload) {
+			t.Fatal("fields around the sequence changed in the round trip")
+		}
+	}
+}
+
+func TestUnmarshalRefusesOldHeader(t *testing.T) {
+	data, err := NewVoiceDataPacket(uuid.New(), uuid.New(), uuid.New(), 0, 1, nil).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A version 1 header has no sequence and is four bytes shorter
+	if _, err := Unmarshal(data[:HeaderSize-4]); err == nil {
+		t.Fatal("header without room for a sequence was accepted")
+	}
+	for _, version := range []byte{0x01, 0x02} {
+		data[0] = version
+		if _, err := Unmarshal(data); err == nil {
+			t.Fatalf("packet of protocol version %d was accepted", version)
+		}
+	}
+}
+
+func TestPacketTypeWireValues(t *testing.T) {
+	// Clients are built against these, changing one needs a new protocol version
+	tests := []struct {
+		name       string
+		packetType uint8
+		wire       byte
+	}{
+		{"auth", PacketTypeAuth, 0x01},
+		{"auth ack", PacketTypeAuthAck, 0x02},
+		{"voice data", PacketTypeVoiceData, 0x03},
+		{"ack", PacketTypeAck, 0x04},
+		{"heartbeat", PacketTypeHeartbeat, 0x05},
+		{"list messages", PacketTypeListMessages, 0x06},
+		{"message list", PacketTypeMessageList, 0x07},
+		{"download", PacketTypeDownloadMsg, 0x08},
+		{"handshake", PacketTypeHandshake, 0x09},
+		{"handshake ack", PacketTypeHandshakeAck, 0x0A},
+		{"recording indicator", PacketTypeRecordingIndicator, 0x0B},
+		{"status query", PacketTypeStatusQuery, 0x0C},
+		{"status response", PacketTypeStatusResponse, 0x0D},
+		{"secure", PacketTypeSecure, 0x0E},
+		{"new message", PacketTypeNewMessage, 0x0F},
+		{"delete message", PacketTypeDeleteMessage, 0x10},
+		{"error", PacketTypeError, 0xFF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPacket(tt.packetType, uuid.New(), uuid.New(), uuid.New())
+			p.Payload = []byte("x")
+			data, err := p.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data[0] != 0x03 || data[1] != tt.wire {
+				t.Fatalf("version %#x type %#x on the wire, want version 0x03 type %#x", data[0], data[1], tt.wire)
+			}
+		})
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	p := NewVoiceDataPacket(uuid.New(), uuid.New(), uuid.New(), 0, 1, bytes.Repeat([]byte{0xAB}, MaxPayloadSize))
+	b.SetBytes(int64(HeaderSize + MaxPayloadSize))
+
+	for b.Loop() {
+		if _, err := p.Marshal(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	data, err := NewVoiceDataPacket(uuid.New(), uuid.New(), uuid.New(), 0, 1, bytes.Repeat([]byte{0xAB}, MaxPayloadSize)).Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+
+	for b.Loop() {
+		if _, err := Unmarshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMaxPayloadPacketFits(t *testing.T) {
+	key, err := NewHandshakeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := NewHandshakeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := uuid.New()
+	channel, err := NewSecureChannel(key, peer.PublicKey().Bytes(), userID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := NewVoiceDataPacket(userID, uuid.New(), uuid.New(), 0, 1, bytes.Repeat([]byte{0xAA}, MaxPayloadSize))
+	sealed, err := channel.Seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, p := range map[string]*Packet{"plain": plain, "secure": sealed} {
+		data, err := p.Marshal()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(data) > MaxPacketSize {
+			t.Errorf("%s packet with a full payload is %d bytes, MaxPacketSize is %d", name, len(data), MaxPacketSize)
+		}
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{1}},
+		{"full", bytes.Repeat([]byte{1}, MaxPayloadSize)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPacket(PacketTypeHeartbeat, uuid.New(), uuid.New(), uuid.New())
+			p.Payload = tt.payload
+
+			data, err := p.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != HeaderSize+len(tt.payload) {
+				t.Fatalf("marshaled %d bytes, want HeaderSize %d plus %d payload", len(data), HeaderSize, len(tt.payload))
+			}
+
+			// The header alone is the smallest packet Unmarshal accepts
+			if _, err := Unmarshal(data[:HeaderSize-1]); err == nil {
+				t.Fatal("packet shorter than the header accepted")
+			}
+			if len(tt.payload) == 0 {
+				if _, err := Unmarshal(data[:HeaderSize]); err != nil {
+					t.Fatalf("bare header refused: %v", err)
+				}
+			}
+		})
+	}
+}
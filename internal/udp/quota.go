@@ -0,0 +1,36 @@
+package udp
+
+import (
+	"net"
+
+	"github.com/rx3lixir/laba/internal/session"
+)
+
+// sendAllowed checks a voice chunk against its sender's quota. Chunks of a message
+// already accepted pass, a new message over the quota is refused with an error packet.
+// If the quota can't be checked the chunk passes, valkey trouble shouldn't stop all sending
+func (s *Server) sendAllowed(packet *Packet, clientAddr *net.UDPAddr) bool {
+	quota := s.options().SendQuota
+	if !quota.Enabled() {
+		return true
+	}
+
+	logger := s.messageLogger(packet.MessageID)
+
+	reason, err := s.sessionManager.AllowSend(s.ctx, packet.SenderID, packet.RecipientID, packet.MessageID, quota)
+	if err != nil {
+		logger.Warn("Failed to check send quota", "message_id", packet.MessageID, "error", err)
+		return true
+	}
+	if reason == session.QuotaOK {
+		return true
+	}
+
+	logger.Warn("Sender over quota, refusing message",
+		"message_id", packet.MessageID,
+		"sender_id", packet.SenderID,
+		"reason", reason,
+	)
+	s.sendErrorPacket(clientAddr, packet.MessageID, ErrorRateLimited)
+	return false
+}
@@ -0,0 +1,89 @@
+package udp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/session"
+)
+
+func TestSendQuota(t *testing.T) {
+	bob, carol := uuid.New(), uuid.New()
+
+	tests := []struct {
+		name  string
+		quota session.SendQuota
+		// recipients of the messages started in turn, the last one is over the quota
+		recipients []uuid.UUID
+	}{
+		{"per minute", session.SendQuota{PerMinute: 2}, []uuid.UUID{bob, bob, bob}},
+		{"per hour", session.SendQuota{PerHour: 1}, []uuid.UUID{bob, carol}},
+		{"recipients", session.SendQuota{Recipients: 1, RecipientWindow: time.Minute}, []uuid.UUID{bob, bob, carol}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := startLoopback(t, Options{SendQuota: tt.quota})
+			alice := lb.client(t, "alice")
+			alice.auth()
+
+			// Each message is left unfinished, so nothing but the quota is at work
+			var accepted []uuid.UUID
+			last := len(tt.recipients) - 1
+			for _, recipientID := range tt.recipients[:last] {
+				messageID := uuid.New()
+				alice.send(NewVoiceDataPacket(alice.userID, recipientID, messageID, 0, 2, []byte("voice")))
+				if p := alice.expect(PacketTypeAck); p.MessageID != messageID {
+					t.Fatalf("ACK for %v, want %v", p.MessageID, messageID)
+				}
+				accepted = append(accepted, messageID)
+			}
+
+			over := uuid.New()
+			alice.send(NewVoiceDataPacket(alice.userID, tt.recipients[last], over, 0, 2, []byte("voice")))
+			if p := alice.expect(PacketTypeError); string(p.Payload) != ErrorRateLimited || p.MessageID != over {
+				t.Fatalf("error %q for %v, want %q", p.Payload, p.MessageID, ErrorRateLimited)
+			}
+			if count, _ := lb.sessions.GetChunksReceivedCount(lb.ctx, over); count != 0 {
+				t.Fatalf("%d chunks of a refused message stored", count)
+			}
+
+			// Messages already under way still get their remaining chunks in
+			alice.send(NewVoiceDataPacket(alice.userID, tt.recipients[0], accepted[0], 1, 2, []byte("voice")))
+			if p := alice.expect(PacketTypeAck); p.MessageID != accepted[0] {
+				t.Fatalf("ACK for %v, want %v", p.MessageID, accepted[0])
+			}
+		})
+	}
+}
+
+func TestMalformedChunksDontUseQuota(t *testing.T) {
+	lb := startLoopback(t, Options{SendQuota: session.SendQuota{PerMinute: 1}})
+	alice := lb.client(t, "alice")
+	alice.auth()
+	bob := uuid.New()
+
+	malformed := []struct {
+		name   string
+		packet *Packet
+		want   string
+	}{
+		{"empty payload", NewVoiceDataPacket(alice.userID, bob, uuid.New(), 0, 2, nil), "Message is empty"},
+		{"no chunks", NewVoiceDataPacket(alice.userID, bob, uuid.New(), 0, 0, []byte("voice")), "Message is empty"},
+		{"chunk out of range", NewVoiceDataPacket(alice.userID, bob, uuid.New(), 2, 2, []byte("voice")), "Chunk index out of range"},
+	}
+	for _, tt := range malformed {
+		alice.send(tt.packet)
+		if p := alice.expect(PacketTypeError); string(p.Payload) != tt.want {
+			t.Fatalf("%s: error %q, want %q", tt.name, p.Payload, tt.want)
+		}
+	}
+
+	// The one message a minute is still there to send
+	messageID := uuid.New()
+	alice.send(NewVoiceDataPacket(alice.userID, bob, messageID, 0, 2, []byte("voice")))
+	if p := alice.expect(PacketTypeAck); p.MessageID != messageID {
+		t.Fatalf("ACK for %v, want %v", p.MessageID, messageID)
+	}
+}
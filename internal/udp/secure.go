@@ -0,0 +1,206 @@
+package udp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// HandshakeKeySize is the size of an X25519 public key
+	HandshakeKeySize = 32
+
+	// replayWindowSize is how far behind the newest sequence number
+	// a packet may arrive out of order and still be accepted
+	replayWindowSize = 64
+
+	seqSize = 8
+)
+
+// handshakeInfo separates keys derived for this protocol from any other use of the same secret
+const handshakeInfo = "laba udp secure channel v1"
+
+// SecureChannel encrypts and authenticates every packet of a UDP session
+// with AES-256-GCM, using keys agreed in an X25519 handshake after auth.
+//
+// Each direction has its own key. Sequence numbers are sent in the clear,
+// double as the GCM nonce and feed a sliding replay window on the receiving side
+type SecureChannel struct {
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq atomic.Uint64
+
+	mu     sync.Mutex
+	replay replayWindow
+}
+
+// NewHandshakeKey generates an ephemeral X25519 key for a single handshake
+func NewHandshakeKey() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate handshake key: %w", err)
+	}
+	return key, nil
+}
+
+// NewSecureChannel derives both direction keys from the local private key and the peer's public key.
+// Both sides must pass the same userID. The server passes isServer true, the client false
+func NewSecureChannel(local *ecdh.PrivateKey, peerPublic []byte, userID uuid.UUID, isServer bool) (*SecureChannel, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer public key: %w", err)
+	}
+
+	shared, err := local.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	// Binding both public keys into the derivation ties the keys to this exact handshake
+	clientPublic, serverPublic := local.PublicKey().Bytes(), peerPublic
+	if isServer {
+		clientPublic, serverPublic = serverPublic, clientPublic
+	}
+	info := handshakeInfo + string(clientPublic) + string(serverPublic)
+
+	keys, err := hkdf.Key(sha256.New, shared, userID[:], info, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive session keys: %w", err)
+	}
+
+	clientToServer, err := newAEAD(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	serverToClient, err := newAEAD(keys[32:])
+	if err != nil {
+		return nil, err
+	}
+
+	if isServer {
+		return &SecureChannel{send: serverToClient, recv: clientToServer}, nil
+	}
+	return &SecureChannel{send: clientToServer, recv: serverToClient}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return aead, nil
+}
+
+// Seal wraps a packet into an encrypted PacketTypeSecure packet.
+// The outer header only carries the sender and recipient needed to find the channel
+func (sc *SecureChannel) Seal(p *Packet) (*Packet, error) {
+	inner, err := p.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	seq := sc.sendSeq.Add(1)
+
+	header := make([]byte, seqSize)
+	binary.BigEndian.PutUint64(header, seq)
+
+	out := NewPacket(PacketTypeSecure, p.SenderID, p.RecipientID, uuid.Nil)
+	out.Payload = sc.send.Seal(header, nonceFor(seq), inner, header)
+
+	return out, nil
+}
+
+// Open decrypts a PacketTypeSecure packet and returns the packet inside.
+// Tampered, foreign and replayed packets are rejected
+func (sc *SecureChannel) Open(p *Packet) (*Packet, error) {
+	if p.Type != PacketTypeSecure {
+		return nil, fmt.Errorf("not a secure packet: type %d", p.Type)
+	}
+	if len(p.Payload) < seqSize+sc.recv.Overhead() {
+		return nil, fmt.Errorf("secure packet too small: %d bytes", len(p.Payload))
+	}
+
+	header := p.Payload[:seqSize]
+	seq := binary.BigEndian.Uint64(header)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if !sc.replay.check(seq) {
+		return nil, fmt.Errorf("replayed or stale packet: seq %d", seq)
+	}
+
+	inner, err := sc.recv.Open(nil, nonceFor(seq), p.Payload[seqSize:], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt packet: %w", err)
+	}
+
+	// Only mark the sequence number once the packet is known to be authentic,
+	// otherwise forged packets could burn sequence numbers of real ones
+	sc.replay.mark(seq)
+
+	return Unmarshal(inner)
+}
+
+// nonceFor builds the GCM nonce from a sequence number. Sequence numbers never repeat
+// within a channel, and every handshake derives fresh keys
+func nonceFor(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// replayWindow tracks the newest sequence number seen and which of
+// the replayWindowSize numbers before it have already arrived.
+// It backs both secure channels and the plain packet sequence
+type replayWindow struct {
+	top    uint64
+	bitmap uint64
+}
+
+// check reports whether seq is new and within the window
+func (w *replayWindow) check(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > w.top {
+		return true
+	}
+
+	diff := w.top - seq
+	if diff >= replayWindowSize {
+		return false
+	}
+
+	return w.bitmap&(1<<diff) == 0
+}
+
+// mark records seq as seen, sliding the window forward if needed
+func (w *replayWindow) mark(seq uint64) {
+	if seq > w.top {
+		shift := seq - w.top
+		if shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.top = seq
+	}
+
+	w.bitmap |= 1 << (w.top - seq)
+}
@@ -0,0 +1,110 @@
+package udp
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestHandshakeOverLoopback(t *testing.T) {
+	lb := startLoopback(t, Options{})
+	alice := lb.client(t, "alice")
+
+	alice.auth()
+	alice.handshake()
+
+	sess, err := lb.sessions.GetSession(lb.ctx, alice.userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sess.Encrypted {
+		t.Fatal("session not marked encrypted after the handshake")
+	}
+
+	// Replies to sealed packets come back sealed, recv fails on anything else
+	heartbeat := NewPacket(PacketTypeHeartbeat, alice.userID, uuid.Nil, uuid.New())
+	alice.send(heartbeat)
+	if ack := alice.expect(PacketTypeAck); ack.MessageID != heartbeat.MessageID {
+		t.Fatalf("ACK for %s, want %s", ack.MessageID, heartbeat.MessageID)
+	}
+
+	// Plaintext from the user is refused once the channel is up
+	plain := NewPacket(PacketTypeHeartbeat, alice.userID, uuid.Nil, uuid.New())
+	plain.Sequence = alice.seq.Add(1)
+	alice.sendRaw(plain)
+	if p := alice.expect(PacketTypeError); string(p.Payload) != "Encryption required" {
+		t.Fatalf("error %q", p.Payload)
+	}
+}
+
+func TestHandshakeFromAnotherAddressIsRefused(t *testing.T) {
+	lb := startLoopback(t, Options{})
+	alice := lb.client(t, "alice")
+	alice.auth()
+
+	// Someone holding alice's token, but not her session address
+	thief := lb.client(t, "thief")
+	thief.userID, thief.token = alice.userID, alice.token
+
+	key, err := NewHandshakeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	thief.send(NewHandshakePacket(thief.userID, key.PublicKey().Bytes(), thief.token))
+	if p := thief.expect(PacketTypeError); string(p.Payload) != "Not authenticated" {
+		t.Fatalf("error %q", p.Payload)
+	}
+	if lb.secureChannel(alice.userID) != nil {
+		t.Fatal("secure channel set up from another address")
+	}
+}
+
+func TestSecureChannelRejectsReplayAndTampering(t *testing.T) {
+	clientKey, err := NewHandshakeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := NewHandshakeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.New()
+	client, err := NewSecureChannel(clientKey, serverKey.PublicKey().Bytes(), userID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewSecureChannel(serverKey, clientKey.PublicKey().Bytes(), userID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := client.Seal(NewVoiceDataPacket(userID, uuid.New(), uuid.New(), 0, 1, []byte("voice")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := *sealed
+	tampered.Payload = append([]byte(nil), sealed.Payload...)
+	tampered.Payload[len(tampered.Payload)-1] ^= 1
+	if _, err := server.Open(&tampered); err == nil {
+		t.Fatal("tampered packet opened")
+	}
+
+	opened, err := server.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened.Payload) != "voice" {
+		t.Fatalf("opened %q", opened.Payload)
+	}
+
+	if _, err := server.Open(sealed); err == nil {
+		t.Fatal("replayed packet opened")
+	}
+
+	// A channel only opens what the other side sealed
+	if _, err := client.Open(sealed); err == nil {
+		t.Fatal("packet opened in the direction it was sent")
+	}
+}
@@ -2,65 +2,290 @@ package udp
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/google/uuid"
 	"github.com/rx3lixir/laba/internal/db"
 	"github.com/rx3lixir/laba/internal/session"
+	"github.com/rx3lixir/laba/internal/tracing"
+	"github.com/rx3lixir/laba/pkg/audio"
 	"github.com/rx3lixir/laba/pkg/jwt"
+	"github.com/rx3lixir/laba/pkg/retry"
 	"github.com/rx3lixir/laba/pkg/s3storage"
+	"github.com/rx3lixir/laba/pkg/webhook"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const MaxPacketSize = 2048
+// defaultMaxUploadSize is used when no message size limit is configured
+const defaultMaxUploadSize = 10 << 20 // 10 MB
+
+// tracer creates the packet and message spans, a no-op unless tracing is set up
+var tracer = otel.Tracer("github.com/rx3lixir/laba/internal/udp")
+
+// defaultWorkers is used when no worker count is configured
+const defaultWorkers = 64
+
+// peakBuckets is how many points a waveform preview has
+const peakBuckets = 100
+
+// sweepInterval is how often abandoned messages are looked for
+const sweepInterval = 30 * time.Second
+
+// chunksPolicy retries reading the chunks of a complete message from valkey
+var chunksPolicy = retry.Policy{
+	MaxAttempts: 3,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    200 * time.Millisecond,
+}
+
+// authClockSkew is how far an auth packet timestamp may drift from the server clock.
+// Nonces are remembered for twice as long, covering the whole acceptance window
+const authClockSkew = 30 * time.Second
+
+// Contact policies decide what happens to messages from senders
+// that aren't in the recipient's contacts
+const (
+	ContactPolicyOpen       = "open"       // accept everything
+	ContactPolicyReject     = "reject"     // drop the message and tell the sender
+	ContactPolicyQuarantine = "quarantine" // store it but never deliver or list it
+)
+
+// Options holds tunable UDP server behaviour
+type Options struct {
+	// AutoMarkListened marks a message as listened as soon as it is downloaded,
+	// for clients that can't send an explicit listened receipt
+	AutoMarkListened bool
+
+	// ChunkGracePeriod keeps buffered chunks around after a message is
+	// finalized so a failed downstream step can be retried. Zero deletes
+	// them right away
+	ChunkGracePeriod time.Duration
+
+	// ContactPolicy applies to messages from non-contacts, defaults to open
+	ContactPolicy string
+
+	// Workers caps how many packets are handled concurrently
+	Workers int
+
+	// ReadBufferSize sets the socket receive buffer, zero keeps the OS default
+	ReadBufferSize int
+
+	// MaxUploadSize caps the size of a voice message in bytes, and with it
+	// how many chunks a message may announce. Zero uses defaultMaxUploadSize
+	MaxUploadSize int64
+
+	// MaxPacketSize caps the size of accepted datagrams, zero uses MaxPacketSize.
+	// Smaller values are refused on Start, full chunks would be dropped otherwise
+	MaxPacketSize int
+
+	// RequireEncryption refuses every packet except auth and handshake
+	// that doesn't arrive over a secure channel
+	RequireEncryption bool
+
+	// PendingTimeout is how long a message may go without a new chunk before
+	// it is considered abandoned, marked failed and its chunks dropped. Zero disables it
+	PendingTimeout time.Duration
+
+	// ForwardBitrate caps how fast chunks are sent to a client, in bits per second
+	ForwardBitrate int
+
+	// ForwardMinBitrate is the floor the send rate backs off to when ACKs lag
+	ForwardMinBitrate int
+
+	// ForwardAckWindow is how many chunks may be unACKed before sending slows down
+	ForwardAckWindow int
+
+	// ForwardAckTimeout is how long to wait for a new ACK before resending unACKed chunks
+	ForwardAckTimeout time.Duration
+
+	// ForwardRetries is how many times unACKed chunks are resent before giving up
+	ForwardRetries int
+
+	// AckBatchSize is how many received chunks share one cumulative ACK.
+	// One or less ACKs every chunk on its own
+	AckBatchSize int
+
+	// AckBatchDelay is how long a partial batch waits before it is ACKed anyway
+	AckBatchDelay time.Duration
+
+	// AuthMaxFailures is how many failed auths in a row an address gets
+	// before it is throttled. Zero disables throttling
+	AuthMaxFailures int
+
+	// AuthCooldown is how long a throttled address is ignored
+	AuthCooldown time.Duration
+
+	// RequireVerifiedEmail drops messages from senders who haven't verified their email
+	RequireVerifiedEmail bool
+
+	// StrictAudio fails messages whose audio isn't structurally valid,
+	// otherwise they are stored with a warning
+	StrictAudio bool
+
+	// SendQuota caps how many messages a sender may start, and to how many people
+	SendQuota session.SendQuota
+
+	// CompressAudio stores uncompressed formats like WAV zstd-compressed.
+	// Downloads are decompressed transparently
+	CompressAudio bool
+}
 
 // Server represents a UDP server for voice messages
 type Server struct {
 	addr            string
+	opts            atomic.Pointer[Options]
 	conn            *net.UDPConn
-	sessionManager  *session.Manager
+	sessionManager  session.Store
 	jwtService      *jwt.Service
 	userStore       db.UserStore
 	messageStore    db.MessageStore
-	s3storageClient *s3storage.MinIOClient
+	contactStore    db.ContactStore
+	blockStore      db.BlockStore
+	s3storageClient s3storage.ObjectStore
+	transcoder      audio.Transcoder
+	webhooks        *webhook.Dispatcher
 	logger          *log.Logger
 	ctx             context.Context
 	cancel          context.CancelFunc
-	wg              sync.WaitGroup
+
+	// drainCtx outlives ctx on shutdown so complete messages can still be stored.
+	// It is only cancelled once the shutdown deadline runs out
+	drainCtx    context.Context
+	drainCancel context.CancelFunc
+	wg          sync.WaitGroup
+
+	// Secure channels by user ID. Keys never leave the process,
+	// the session in valkey only records that the channel exists
+	secureMu sync.RWMutex
+	secure   map[uuid.UUID]*SecureChannel
+
+	// Sequence windows by user ID, started on auth, for dropping network duplicates
+	seqMu   sync.Mutex
+	seqs    map[uuid.UUID]*replayWindow
+	sendSeq atomic.Uint32
+
+	// Messages being sent to a client, by message ID, collecting their chunk ACKs
+	forwardsMu sync.Mutex
+	forwards   map[uuid.UUID]*forwardState
+
+	// Messages being received with batched ACKs, by message ID
+	ackBatchesMu sync.Mutex
+	ackBatches   map[uuid.UUID]*ackBatch
+
+	// Failed auths by source address, checked before tokens are validated
+	authGuard *authGuard
+
+	// Users whose stored messages are being pushed to them, see deliverStored
+	deliveringMu sync.Mutex
+	delivering   map[uuid.UUID]struct{}
 }
 
 // New creates a new UDP server
 func New(
 	addr string,
-	sessionMgr *session.Manager,
+	opts Options,
+	sessionMgr session.Store,
 	jwtSvc *jwt.Service,
 	userStore db.UserStore,
 	messageStore db.MessageStore,
-	s3client *s3storage.MinIOClient,
+	contactStore db.ContactStore,
+	blockStore db.BlockStore,
+	s3client s3storage.ObjectStore,
+	transcoder audio.Transcoder,
+	webhooks *webhook.Dispatcher,
 	logger *log.Logger,
 ) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
+	drainCtx, drainCancel := context.WithCancel(context.Background())
 
 	logger.Info("Creating UDP server", "addr", addr, "context", fmt.Sprintf("%p", ctx))
 
-	return &Server{
+	s := &Server{
 		addr:            addr,
 		sessionManager:  sessionMgr,
 		jwtService:      jwtSvc,
 		userStore:       userStore,
 		messageStore:    messageStore,
+		contactStore:    contactStore,
+		blockStore:      blockStore,
 		s3storageClient: s3client,
+		transcoder:      transcoder,
+		webhooks:        webhooks,
 		logger:          logger,
 		ctx:             ctx,
 		cancel:          cancel,
+		drainCtx:        drainCtx,
+		drainCancel:     drainCancel,
+		secure:          make(map[uuid.UUID]*SecureChannel),
+		forwards:        make(map[uuid.UUID]*forwardState),
+		ackBatches:      make(map[uuid.UUID]*ackBatch),
+		authGuard:       newAuthGuard(),
+		delivering:      make(map[uuid.UUID]struct{}),
+		seqs:            make(map[uuid.UUID]*replayWindow),
+	}
+	s.opts.Store(&opts)
+
+	return s
+}
+
+// SetOptions swaps the server tunables at runtime.
+// Workers, ReadBufferSize and MaxPacketSize only take effect on the next Start
+func (s *Server) SetOptions(opts Options) {
+	s.opts.Store(&opts)
+}
+
+// options returns the current server tunables
+func (s *Server) options() *Options {
+	return s.opts.Load()
+}
+
+// maxTotalChunks is the most chunks a message within MaxUploadSize can take
+func (s *Server) maxTotalChunks() uint32 {
+	maxSize := s.options().MaxUploadSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxUploadSize
+	}
+	return uint32(min((maxSize+MaxPayloadSize-1)/MaxPayloadSize, math.MaxUint32))
+}
+
+// packetLimit returns the configured datagram size limit, checked against
+// the largest packet the protocol produces and the socket receive buffer
+func (s *Server) packetLimit() (int, error) {
+	limit := s.options().MaxPacketSize
+	if limit == 0 {
+		limit = MaxPacketSize
+	}
+
+	if limit < MaxPacketSize {
+		return 0, fmt.Errorf("max packet size %d is below the %d bytes of a full secure packet", limit, MaxPacketSize)
 	}
+	if limit > maxDatagramSize {
+		return 0, fmt.Errorf("max packet size %d exceeds the largest UDP datagram of %d bytes", limit, maxDatagramSize)
+	}
+	if buffer := s.options().ReadBufferSize; buffer > 0 && buffer < limit {
+		return 0, fmt.Errorf("read buffer size %d can't hold a single %d byte packet", buffer, limit)
+	}
+
+	return limit, nil
 }
 
 // Start starts the UDP server
 func (s *Server) Start() error {
+	packetLimit, err := s.packetLimit()
+	if err != nil {
+		return err
+	}
+
 	addr, err := net.ResolveUDPAddr("udp", s.addr)
 	if err != nil {
 		return fmt.Errorf("failed to resolve UDP address: %w", err)
@@ -71,18 +296,35 @@ func (s *Server) Start() error {
 		return fmt.Errorf("failed to listen on UDP: %w", err)
 	}
 
+	if s.options().ReadBufferSize > 0 {
+		if err := conn.SetReadBuffer(s.options().ReadBufferSize); err != nil {
+			s.logger.Warn("Failed to set UDP read buffer", "size", s.options().ReadBufferSize, "error", err)
+		}
+	}
+
 	s.conn = conn
-	s.logger.Info("UDP server listening", "address", s.addr)
+	s.logger.Info("UDP server listening", "address", s.addr, "workers", s.options().Workers, "max_packet_size", packetLimit)
+
+	s.wg.Add(1)
+	go s.sweepAbandoned()
 
 	// This blocks until context is cancelled
-	s.listen()
+	s.listen(packetLimit)
 
 	s.logger.Info("UDP server stopped")
 	return nil
 }
 
-func (s *Server) listen() {
-	buffer := make([]byte, MaxPacketSize)
+func (s *Server) listen(packetLimit int) {
+	// One spare byte tells a datagram that fits exactly from one the kernel truncated to fit
+	buffer := make([]byte, packetLimit+1)
+
+	// Bounds the number of packets handled at once
+	workers := s.options().Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	sem := make(chan struct{}, workers)
 
 	for {
 		select {
@@ -98,18 +340,32 @@ func (s *Server) listen() {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
+				// Shutdown closes the socket under the read
+				if s.ctx.Err() != nil {
+					s.logger.Info("UDP server stopping due to context cancellation")
+					return
+				}
 				s.logger.Error("Error reading from UDP", "error", err)
 				continue
 			}
 
+			if n > packetLimit {
+				s.logger.Warn("Dropping oversize datagram", "max_bytes", packetLimit, "from", clientAddr)
+				continue
+			}
+
 			s.logger.Info("Received UDP packet", "bytes", n, "from", clientAddr)
 
 			// Process packet in a goroutine to not block receiving
 			packetData := make([]byte, n)
 			copy(packetData, buffer[:n])
 
+			sem <- struct{}{}
 			s.wg.Add(1)
-			go s.handlePacket(packetData, clientAddr)
+			go func() {
+				defer func() { <-sem }()
+				s.handlePacket(packetData, clientAddr)
+			}()
 		}
 	}
 }
@@ -123,7 +379,39 @@ func (s *Server) handlePacket(data []byte, clientAddr *net.UDPAddr) {
 		return
 	}
 
-	s.logger.Debug(
+	secured := false
+	if packet.Type == PacketTypeSecure {
+		packet, err = s.openSecure(packet)
+		if err != nil {
+			s.logger.Warn("Dropping secure packet", "error", err, "from", clientAddr)
+			return
+		}
+		secured = true
+	}
+
+	// Once a channel is up, plaintext from that user can only be injected
+	if !secured && packet.Type != PacketTypeAuth && packet.Type != PacketTypeHandshake {
+		if s.options().RequireEncryption || s.secureChannel(packet.SenderID) != nil {
+			s.logger.Warn("Dropping plaintext packet", "type", packet.Type, "sender_id", packet.SenderID, "from", clientAddr)
+			s.sendErrorPacket(clientAddr, packet.MessageID, "Encryption required")
+			return
+		}
+	}
+
+	// Auth is guarded by its nonce and restarts the sequence, everything after it must be fresh.
+	// The window only advances for packets tied to the sender's session, so spoofed
+	// sender IDs can't burn sequence numbers the real client is about to use
+	if packet.Type != PacketTypeAuth && !s.freshSequence(packet.SenderID, packet.Sequence, s.fromSession(packet, clientAddr, secured)) {
+		s.logger.Debug("Dropping duplicate packet", "type", packet.Type, "sender_id", packet.SenderID, "seq", packet.Sequence)
+		return
+	}
+
+	// Packets about a message are traced with the rest of its lifecycle
+	logger := s.logger
+	if packet.MessageID != uuid.Nil {
+		logger = s.messageLogger(packet.MessageID)
+	}
+	logger.Debug(
 		"Received packet",
 		"type", packet.Type,
 		"from", clientAddr,
@@ -131,11 +419,20 @@ func (s *Server) handlePacket(data []byte, clientAddr *net.UDPAddr) {
 		"chunk", fmt.Sprintf("%d/%d", packet.ChunkIndex, packet.TotalChunks),
 	)
 
+	_, span := tracer.Start(s.ctx, "udp.handlePacket", trace.WithAttributes(
+		attribute.Int("laba.packet_type", int(packet.Type)),
+		tracing.MessageIDKey.String(packet.MessageID.String()),
+	))
+	defer span.End()
+
 	// Handle diefferent packet types
 	switch packet.Type {
 	case PacketTypeAuth:
 		s.handleAuth(packet, clientAddr)
 
+	case PacketTypeHandshake:
+		s.handleHandshake(packet, clientAddr)
+
 	case PacketTypeVoiceData:
 		s.handleVoiceData(packet, clientAddr)
 
@@ -148,6 +445,18 @@ func (s *Server) handlePacket(data []byte, clientAddr *net.UDPAddr) {
 	case PacketTypeDownloadMsg:
 		s.handleDownloadMessage(packet, clientAddr)
 
+	case PacketTypeRecordingIndicator:
+		s.handleRecordingIndicator(packet, clientAddr)
+
+	case PacketTypeAck:
+		s.handleForwardAck(packet)
+
+	case PacketTypeStatusQuery:
+		s.handleStatusQuery(packet, clientAddr)
+
+	case PacketTypeDeleteMessage:
+		s.handleDeleteMessage(packet, clientAddr, secured)
+
 	default:
 		s.logger.Warn("Unknown packet type", "type", packet.Type, "from", clientAddr)
 	}
@@ -155,15 +464,59 @@ func (s *Server) handlePacket(data []byte, clientAddr *net.UDPAddr) {
 
 // handleAuth proccesses authentication UDP packets
 func (s *Server) handleAuth(packet *Packet, clientAddr *net.UDPAddr) {
-	jwtToken := string(packet.Payload)
+	if !s.authAllowed(clientAddr) {
+		return
+	}
 
-	claims, err := s.jwtService.ValidateToken(jwtToken)
+	auth, err := ParseAuthPayload(packet.Payload)
+	if err != nil {
+		s.logger.Warn("Malformed auth packet", "error", err, "from", clientAddr)
+		s.authFailed(clientAddr)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Invalid auth packet")
+		return
+	}
+
+	skew := time.Since(time.Unix(auth.Timestamp, 0))
+	if skew > authClockSkew || skew < -authClockSkew {
+		s.logger.Warn("Auth packet outside clock skew window", "skew", skew, "from", clientAddr)
+		s.authFailed(clientAddr)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Auth timestamp out of range")
+		return
+	}
+
+	claims, err := s.jwtService.ValidateToken(auth.Token)
 	if err != nil {
 		s.logger.Warn("Invalid JWT in auth packet", "error", err, "from", clientAddr)
+		s.authFailed(clientAddr)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Invalid token")
+		return
+	}
+
+	if s.tokenRevoked(claims) {
+		s.logger.Warn("Revoked token in auth packet", "user_id", claims.UserID, "from", clientAddr)
+		s.authFailed(clientAddr)
 		s.sendErrorPacket(clientAddr, packet.MessageID, "Invalid token")
 		return
 	}
 
+	// Claimed only after the token checks out, so garbage can't fill valkey with nonces
+	fresh, err := s.sessionManager.ClaimNonce(s.ctx, auth.Nonce, 2*authClockSkew)
+	if err != nil {
+		s.logger.Error("Failed to claim auth nonce", "error", err, "user_id", claims.UserID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Failed to create session")
+		return
+	}
+	if !fresh {
+		s.logger.Warn("Replayed auth packet", "user_id", claims.UserID, "from", clientAddr)
+		s.authFailed(clientAddr)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Replayed auth packet")
+		return
+	}
+
+	// A fresh auth starts a fresh session, keys and sequence numbers from the previous one are dropped
+	s.setSecureChannel(claims.UserID, nil)
+	s.resetSequence(claims.UserID)
+
 	// Create session
 	err = s.sessionManager.CreateSession(s.ctx, claims.UserID, claims.Username, clientAddr)
 	if err != nil {
@@ -172,6 +525,8 @@ func (s *Server) handleAuth(packet *Packet, clientAddr *net.UDPAddr) {
 		return
 	}
 
+	s.authGuard.succeed(clientAddr)
+
 	s.logger.Info(
 		"User authenticated",
 		"user_id", claims.UserID,
@@ -184,52 +539,160 @@ func (s *Server) handleAuth(packet *Packet, clientAddr *net.UDPAddr) {
 
 	s.logger.Info("Sending auth ACK", "to", clientAddr, "user_id", claims.UserID)
 	s.sendPacket(ackPacket, clientAddr)
+
+	// Whatever arrived while the user was offline goes out now
+	s.wg.Add(1)
+	go s.deliverStored(claims.UserID)
+}
+
+// handleHandshake agrees on secure channel keys with an authenticated client.
+// The handshake has to come from the session address and carry a token for the same user
+func (s *Server) handleHandshake(packet *Packet, clientAddr *net.UDPAddr) {
+	if !s.authAllowed(clientAddr) {
+		return
+	}
+
+	if len(packet.Payload) <= HandshakeKeySize {
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Invalid handshake")
+		return
+	}
+
+	clientPublic := packet.Payload[:HandshakeKeySize]
+	jwtToken := string(packet.Payload[HandshakeKeySize:])
+
+	claims, err := s.jwtService.ValidateToken(jwtToken)
+	if err != nil || claims.UserID != packet.SenderID || s.tokenRevoked(claims) {
+		s.logger.Warn("Invalid token in handshake", "sender_id", packet.SenderID, "from", clientAddr)
+		s.authFailed(clientAddr)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Invalid token")
+		return
+	}
+
+	session, err := s.sessionManager.GetSession(s.ctx, claims.UserID)
+	if err != nil || session.Address != clientAddr.String() {
+		s.logger.Warn("Handshake without a matching session", "user_id", claims.UserID, "from", clientAddr)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Not authenticated")
+		return
+	}
+
+	serverKey, err := NewHandshakeKey()
+	if err != nil {
+		s.logger.Error("Failed to generate handshake key", "error", err)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Handshake failed")
+		return
+	}
+
+	channel, err := NewSecureChannel(serverKey, clientPublic, claims.UserID, true)
+	if err != nil {
+		s.logger.Warn("Failed to establish secure channel", "error", err, "user_id", claims.UserID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Handshake failed")
+		return
+	}
+
+	if err := s.sessionManager.SetSessionEncrypted(s.ctx, claims.UserID, true); err != nil {
+		s.logger.Error("Failed to update session", "error", err, "user_id", claims.UserID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Handshake failed")
+		return
+	}
+
+	// The channel is stored before the ack goes out so the client's first secure packet
+	// can't outrun it. The ack itself stays plaintext, the client has no keys before it
+	s.setSecureChannel(claims.UserID, channel)
+	s.writePacket(NewHandshakeAckPacket(claims.UserID, packet.MessageID, serverKey.PublicKey().Bytes()), clientAddr)
+
+	s.logger.Info("Secure channel established", "user_id", claims.UserID, "address", clientAddr)
 }
 
 // handleVoiceData processes voice data chunks
 func (s *Server) handleVoiceData(packet *Packet, clientAddr *net.UDPAddr) {
-	session, err := s.sessionManager.GetSession(s.ctx, packet.SenderID)
+	logger := s.messageLogger(packet.MessageID)
+
+	sess, err := s.sessionManager.GetSession(s.ctx, packet.SenderID)
 	if err != nil {
-		s.logger.Warn("Packet from unauthenticated user", "sender_id", packet.SenderID)
+		logger.Warn("Packet from unauthenticated user", "sender_id", packet.SenderID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, ErrorSessionExpired)
 		return
 	}
 
 	s.sessionManager.UpdateLastSeen(s.ctx, packet.SenderID)
 
-	// Save chunk BEFORE incrementing counter
-	err = s.sessionManager.SavePendingChunk(s.ctx, packet.MessageID, packet.ChunkIndex, packet.Payload)
-	if err != nil {
-		s.logger.Error("Failed to save a chunk", "error", err, "message_id", packet.MessageID)
+	// Empty messages are refused, with no chunks the completion check
+	// would pass straight away and an empty file would be stored
+	if packet.TotalChunks == 0 || len(packet.Payload) == 0 {
+		logger.Warn("Rejecting empty message", "message_id", packet.MessageID, "chunk", packet.ChunkIndex)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Message is empty")
+		return
+	}
+	if packet.ChunkIndex >= packet.TotalChunks {
+		logger.Warn("Rejecting chunk out of range", "message_id", packet.MessageID, "chunk", fmt.Sprintf("%d/%d", packet.ChunkIndex, packet.TotalChunks))
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Chunk index out of range")
+		return
+	}
+
+	// An absurd total would otherwise be tracked as pending, and cleaning
+	// it up walks a key per announced chunk
+	if maxChunks := s.maxTotalChunks(); packet.TotalChunks > maxChunks {
+		logger.Warn("Rejecting message over the size limit", "message_id", packet.MessageID, "total_chunks", packet.TotalChunks, "max_chunks", maxChunks)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Message is too large")
+		return
+	}
+
+	// Charged only once the chunk is known to be good, malformed ones mustn't use up the sender's quota
+	if !s.sendAllowed(packet, clientAddr) {
 		return
 	}
 
-	// NOW increment the counter - this ensures the chunk is saved first
-	count, err := s.sessionManager.IncrementChunksReceived(s.ctx, packet.MessageID)
+	// Save the chunk and count it in a single round trip
+	count, duplicate, err := s.sessionManager.SaveChunkAndCount(s.ctx, packet.MessageID, packet.ChunkIndex, packet.TotalChunks, packet.Payload)
 	if err != nil {
-		s.logger.Error("Failed to increment chunk counter", "error", err)
+		if errors.Is(err, session.ErrTotalChunksMismatch) {
+			logger.Warn("Rejecting chunk with inconsistent total", "message_id", packet.MessageID, "chunk", packet.ChunkIndex, "error", err)
+			s.sendErrorPacket(clientAddr, packet.MessageID, "Inconsistent total chunks")
+			return
+		}
+		logger.Error("Failed to save a chunk", "error", err, "message_id", packet.MessageID)
 		return
 	}
 
-	s.logger.Debug(
+	logger.Debug(
 		"Chunk received",
 		"message_id", packet.MessageID,
 		"chunk", fmt.Sprintf("%d/%d", packet.ChunkIndex, packet.TotalChunks),
 		"total_received", count,
-		"from", session.Username,
+		"from", sess.Username,
 	)
 
-	// Send ACK with a payload to avoid EOF errors
-	ackPacket := NewAckPacket(packet)
-	ackPacket.Payload = []byte("ok")
-	s.sendPacket(ackPacket, clientAddr)
+	s.ackChunk(packet, clientAddr, duplicate, uint32(count) == packet.TotalChunks)
+
+	// A retransmit only needs its ACK again, the chunk was already counted
+	if duplicate {
+		logger.Debug("Duplicate chunk", "message_id", packet.MessageID, "chunk", packet.ChunkIndex)
+		return
+	}
+
+	// Feeds the abandoned message sweeper while chunks are still missing.
+	// Finalized messages are skipped by the store, so late retransmits can't bring them back
+	if uint32(count) < packet.TotalChunks {
+		if err := s.sessionManager.TouchPendingMessage(s.ctx, packet.MessageID, packet.SenderID, packet.RecipientID, packet.TotalChunks); err != nil {
+			logger.Warn("Failed to track pending message", "message_id", packet.MessageID, "error", err)
+		}
+	}
 
 	// Check if all chunks received
 	if uint32(count) == packet.TotalChunks {
-		s.logger.Info("All chunks received", "message_id", packet.MessageID, "total", packet.TotalChunks)
+		// Only the first completion starts processing, in case the final chunk is counted twice.
+		// If the flag can't be set, processing a message twice beats never processing it
+		first, err := s.sessionManager.FinalizePendingMessage(s.ctx, packet.MessageID)
+		if err != nil {
+			logger.Warn("Failed to finalize message", "message_id", packet.MessageID, "error", err)
+		} else if !first {
+			logger.Debug("Message already finalized", "message_id", packet.MessageID)
+			return
+		}
 
-		// Add a small delay to ensure all writes are flushed to Redis
-		time.Sleep(50 * time.Millisecond)
+		logger.Info("All chunks received", "message_id", packet.MessageID, "total", packet.TotalChunks)
 
+		// No flush delay needed, every chunk is stored before its count is
 		s.wg.Add(1)
 		go s.processCompleteMessage(packet.MessageID, packet.SenderID, packet.RecipientID, packet.TotalChunks)
 	}
@@ -237,48 +700,93 @@ func (s *Server) handleVoiceData(packet *Packet, clientAddr *net.UDPAddr) {
 
 // processCompleteMessage assembles chunks and save the complete file
 func (s *Server) processCompleteMessage(messageID uuid.UUID, senderID, recipientID uuid.UUID, totalChunks uint32) {
+	logger := s.messageLogger(messageID)
+
 	defer s.wg.Done()
 
-	s.logger.Info("Proccessing complete message", "message_id", messageID)
+	// All chunks are in, so finish the message even if shutdown starts meanwhile
+	ctx, span := tracer.Start(s.drainCtx, "udp.processCompleteMessage", trace.WithAttributes(
+		tracing.MessageIDKey.String(messageID.String()),
+		attribute.Int("laba.total_chunks", int(totalChunks)),
+	))
+	defer span.End()
 
-	// 1. Retrieve all chunks from key-val storage
-	chunks := make([][]byte, totalChunks)
-	var totalSize int
+	logger.Info("Proccessing complete message", "message_id", messageID)
 
-	for i := uint32(0); i < totalChunks; i++ {
-		var chunkData []byte
-		var err error
+	// The message is no longer in flight, keep the sweeper away from it
+	if _, err := s.sessionManager.ForgetPendingMessage(ctx, messageID); err != nil {
+		logger.Warn("Failed to untrack pending message", "message_id", messageID, "error", err)
+	}
 
-		// Retry up to 3 times with exponential backoff
-		for attempt := 0; attempt < 3; attempt++ {
-			chunkData, err = s.sessionManager.GetPendingChunk(s.ctx, messageID, i)
-			if err == nil {
-				break
+	// Unverified senders may not send when verification is required
+	if s.options().RequireVerifiedEmail {
+		sender, err := s.userStore.GetUserByID(ctx, senderID)
+		if err != nil {
+			logger.Error("Failed to load sender", "message_id", messageID, "sender_id", senderID, "error", err)
+		} else if !sender.EmailVerified {
+			logger.Info("Sender email is not verified, dropping message", "message_id", messageID, "sender_id", senderID)
+			if err := s.sessionManager.DeletePendingMessage(ctx, messageID, totalChunks); err != nil {
+				logger.Warn("Failed to clean up pending message", "message_id", messageID, "error", err)
 			}
+			s.notifySender(senderID, messageID, "Verify your email before sending messages")
+			return
+		}
+	}
 
-			if attempt < 2 {
-				s.logger.Warn(
-					"Chunk is not ready, retrying...",
-					"message_id", messageID,
-					"chunk", i,
-					"attempt", attempt+1,
-				)
-				time.Sleep(time.Duration(50*(attempt+1)) * time.Millisecond)
-			}
+	// 0. Silently drop messages from blocked senders
+	blocked, err := s.blockStore.IsBlocked(ctx, recipientID, senderID)
+	if err != nil {
+		logger.Error("Failed to check block list", "message_id", messageID, "error", err)
+	} else if blocked {
+		logger.Info(
+			"Sender is blocked by recipient, dropping message",
+			"message_id", messageID,
+			"sender_id", senderID,
+			"recipient_id", recipientID,
+		)
+		if err := s.sessionManager.DeletePendingMessage(ctx, messageID, totalChunks); err != nil {
+			logger.Warn("Failed to clean up pending message", "message_id", messageID, "error", err)
 		}
+		return
+	}
 
-		if err != nil {
-			s.logger.Error(
-				"Failed to retrieve chunk",
+	// Apply the recipient's contact policy
+	status, accepted := s.checkContactPolicy(ctx, messageID, senderID, recipientID)
+	if !accepted {
+		if err := s.sessionManager.DeletePendingMessage(ctx, messageID, totalChunks); err != nil {
+			logger.Warn("Failed to clean up pending message", "message_id", messageID, "error", err)
+		}
+		s.notifySender(senderID, messageID, "Recipient does not accept messages from you")
+		return
+	}
+
+	// 1. Retrieve all chunks from key-val storage. Waits between attempts
+	// end with shutdown, only a first try is made once it started
+	var chunks [][]byte
+
+	attempt := 0
+	err = retry.Do(s.ctx, chunksPolicy, func() error {
+		attempt++
+		var err error
+		if chunks, err = s.sessionManager.GetAllPendingChunks(ctx, messageID, totalChunks); err != nil {
+			logger.Warn(
+				"Chunks are not ready",
 				"message_id", messageID,
-				"chunk", i,
+				"attempt", attempt,
 				"error", err,
 			)
-			s.updateMessageStatus(messageID, db.MessageStatusFailed)
-			return
 		}
-		chunks[i] = chunkData
-		totalSize += len(chunkData)
+		return err
+	})
+
+	if err != nil {
+		s.failMessage(ctx, messageID, senderID, recipientID, totalChunks, "failed to retrieve chunks", err)
+		return
+	}
+
+	var totalSize int
+	for _, chunk := range chunks {
+		totalSize += len(chunk)
 	}
 
 	// 2. Assemble chunks into complete file
@@ -287,132 +795,471 @@ func (s *Server) processCompleteMessage(messageID uuid.UUID, senderID, recipient
 		assembledData = append(assembledData, chunk...)
 	}
 
-	s.logger.Info("File assembled", "message_id", messageID, "size", len(assembledData))
+	logger.Info("File assembled", "message_id", messageID, "size", len(assembledData))
 
 	// 3. Upload to s3 storage
-	audioFormat := "opus" // default
+	audioFormat, err := audio.DetectFormat(assembledData)
+	if err == nil {
+		err = audio.Validate(assembledData, audioFormat)
+	}
+	if err != nil {
+		if s.options().StrictAudio {
+			s.failMessage(ctx, messageID, senderID, recipientID, totalChunks, "invalid audio", err)
+			return
+		}
+		logger.Warn("Audio failed validation, storing it anyway", "message_id", messageID, "error", err)
+		if audioFormat == "" {
+			audioFormat = audio.FormatOpus // default
+		}
+	}
+
+	// Compress raw formats unless a transcoder is about to replace them anyway
+	uploadData, uploadFormat, compressed := assembledData, audioFormat, false
+	if s.options().CompressAudio && audio.Compressible(audioFormat) && s.transcoder == nil {
+		if packed := audio.Compress(assembledData); len(packed) < len(assembledData) {
+			logger.Info("Message compressed", "message_id", messageID, "size", len(assembledData), "compressed_size", len(packed))
+			uploadData, uploadFormat, compressed = packed, audio.CompressedFormat(audioFormat), true
+		}
+	}
 
-	objectPath, err := s.s3storageClient.UploadVoiceMessage(s.ctx, messageID, assembledData, audioFormat)
+	objectPath, err := s.s3storageClient.UploadVoiceMessage(ctx, messageID, senderID, recipientID, uploadData, uploadFormat)
 	if err != nil {
-		s.logger.Error(
-			"Failed to upload to s3",
-			"message_id", messageID,
-			assembledData,
-			audioFormat,
-		)
+		s.failMessage(ctx, messageID, senderID, recipientID, totalChunks, "failed to store audio", err)
+		return
 	}
 
-	// 4. Create database record
+	// An upload that reported success may still have left nothing behind,
+	// a record pointing at it would dangle
+	if err := s.verifyStored(ctx, objectPath, len(uploadData)); err != nil {
+		s.failMessage(ctx, messageID, senderID, recipientID, totalChunks, "stored audio is missing", err)
+		return
+	}
+
+	// Waveform preview for clients, computed from the original before any transcoding
+	s.storePeaks(ctx, messageID, assembledData, audioFormat)
+
+	// Optionally store a normalized copy next to the original
+	storedData, storedPath, storedFormat := assembledData, objectPath, audioFormat
+	var originalPath *string
+
+	if s.transcoder != nil && audioFormat != audio.CanonicalFormat {
+		normalized, terr := s.transcoder.Transcode(ctx, assembledData, audioFormat)
+		if terr != nil {
+			logger.Warn("Failed to transcode, keeping original", "message_id", messageID, "format", audioFormat, "error", terr)
+		} else if normalizedPath, uerr := s.s3storageClient.UploadVoiceMessage(ctx, messageID, senderID, recipientID, normalized, audio.CanonicalFormat); uerr != nil {
+			logger.Warn("Failed to upload transcoded file, keeping original", "message_id", messageID, "error", uerr)
+		} else if verr := s.verifyStored(ctx, normalizedPath, len(normalized)); verr != nil {
+			logger.Warn("Transcoded file is missing, keeping original", "message_id", messageID, "error", verr)
+		} else {
+			logger.Info("Message transcoded", "message_id", messageID, "from", audioFormat, "to", audio.CanonicalFormat)
+			storedData, storedPath, storedFormat = normalized, normalizedPath, audio.CanonicalFormat
+			originalPath = &objectPath
+		}
+	}
+
+	// 4. Prepare database record
 	now := time.Now()
 	voiceMessage := &db.VoiceMessage{
-		ID:             messageID,
-		SenderID:       senderID,
-		RecipientID:    recipientID,
-		FilePath:       objectPath,
-		FileSize:       len(assembledData),
-		AudioFormat:    audioFormat,
-		TotalChunks:    int(totalChunks),
-		ChunksReceived: int(totalChunks),
-		Status:         db.MessageStatusTransmitted,
-		TransmittedAt:  &now,
-	}
-
-	if err := s.messageStore.CreateMessage(s.ctx, voiceMessage); err != nil {
-		s.logger.Error("Failed to create message record", "message_id", messageID, "error", err)
-		// Still mark as transmitted as file is in s3
-	} else {
-		s.logger.Info("Message record created", "message_id", messageID)
+		ID:               messageID,
+		SenderID:         senderID,
+		RecipientID:      recipientID,
+		FilePath:         storedPath,
+		FileSize:         len(storedData),
+		AudioFormat:      storedFormat,
+		TotalChunks:      int(totalChunks),
+		ChunksReceived:   int(totalChunks),
+		Status:           status,
+		TransmittedAt:    &now,
+		OriginalFilePath: originalPath,
+		Compressed:       compressed,
 	}
 
-	// 5. Forward to recipient if online
-	recipientOnline, err := s.sessionManager.IsUserOnline(s.ctx, recipientID)
-	if err != nil {
-		s.logger.Warn(
-			"Failed to check recipient status",
-			"recipient_id", recipientID,
-			"error", err,
-		)
-	} else if recipientOnline {
-		s.logger.Info(
-			"Recipient is online, forwarding message",
-			"recipient_id", recipientID,
+	// 5. Store the record first, a recipient is never handed a message the server could still lose.
+	// No transaction: the delivery update waits on the recipient below and is safe to lose
+	if err := s.messageStore.CreateMessage(ctx, voiceMessage); err != nil {
+		s.failMessage(ctx, messageID, senderID, recipientID, totalChunks, "failed to store message record", err)
+		return
+	}
+	logger.Info("Message record created", "message_id", messageID, "status", status)
+
+	s.publish(webhook.EventReceived, messageID, senderID, recipientID, "")
+
+	// 6. Forward to recipient if online
+	delivered := false
+	if status == db.MessageStatusQuarantined {
+		logger.Info(
+			"Message quarantined, not forwarding",
+			"message_id", messageID,
+			"sender_id", senderID,
 		)
-		s.forwardMessageToRecipient(messageID, senderID, recipientID, assembledData, totalChunks)
 	} else {
-		s.logger.Info(
-			"Recipient is offline, message stored for later retrieval",
-			"recipient_id", recipientID,
-		)
+		// Recipients get what is stored, so downloads and live delivery match
+		storedChunks := uint32((len(storedData) + MaxPayloadSize - 1) / MaxPayloadSize)
+		delivered = s.forwardIfOnline(messageID, senderID, recipientID, storedData, storedChunks)
+	}
 
-		// 6. Clean up key-value storage
-		if err := s.sessionManager.DeletePendingMessage(s.ctx, messageID, totalChunks); err != nil {
-			s.logger.Warn("Failed to clean up pending message", "message_id", messageID, "error", err)
+	// 7. Only then record the delivery. If this fails the message stays transmitted
+	// and is pushed again on the next auth, clients ACK a message they already saved
+	if delivered {
+		if err := s.messageStore.MarkMessageDelivered(ctx, messageID, time.Now()); err != nil {
+			logger.Error("Failed to mark message delivered", "message_id", messageID, "error", err)
 		} else {
-			s.logger.Info("Pending message cleaned up", "message_id", messageID)
+			logger.Info("Message delivered", "message_id", messageID)
+			s.publish(webhook.EventDelivered, messageID, senderID, recipientID, "")
 		}
+	}
 
-		s.logger.Info("✓ Message processing complete", "message_id", messageID)
+	if !delivered && status != db.MessageStatusQuarantined {
+		s.notifyNewMessage(ctx, voiceMessage)
 	}
+
+	// 8. Clean up key-value storage
+	s.releasePendingMessage(ctx, messageID, totalChunks)
+
+	logger.Info("✓ Message processing complete", "message_id", messageID)
 }
 
-// forwardMessageToRecipient sends the message to an online recipient
-func (s *Server) forwardMessageToRecipient(messageID uuid.UUID, senderID, recipientID uuid.UUID, data []byte, totalChunks uint32) {
-	// Get recipient session to find their UDP address
-	recipientSession, err := s.sessionManager.GetSession(s.ctx, recipientID)
+// storePeaks computes and uploads the waveform peaks of a message.
+// Failing here only costs the preview, the message itself is unaffected
+func (s *Server) storePeaks(ctx context.Context, messageID uuid.UUID, data []byte, format string) {
+	logger := s.messageLogger(messageID)
+
+	peaks, err := audio.Peaks(data, format, peakBuckets)
 	if err != nil {
-		s.logger.Error("Failed to get recipient session", "recipient_id", recipientID, "error", err)
+		if errors.Is(err, audio.ErrPeaksUnsupported) {
+			logger.Debug("No peaks for this format", "message_id", messageID, "format", format)
+			return
+		}
+		logger.Warn("Failed to compute peaks", "message_id", messageID, "error", err)
 		return
 	}
 
-	// Parse recipient UDP address
-	recipientAddr, err := net.ResolveUDPAddr("udp", recipientSession.Address)
+	encoded, err := json.Marshal(peaks)
 	if err != nil {
-		s.logger.Error(
-			"Failed to resolve recipient address",
-			"address", recipientSession.Address,
-			"error", err,
-		)
+		logger.Warn("Failed to encode peaks", "message_id", messageID, "error", err)
 		return
 	}
 
-	s.logger.Info(
-		"Forwarding message to recipient",
-		"recipient", recipientSession.Username,
-		"address", recipientAddr,
-		"chunks", totalChunks,
-	)
+	if err := s.s3storageClient.UploadPeaks(ctx, messageID, encoded); err != nil {
+		logger.Warn("Failed to store peaks", "message_id", messageID, "error", err)
+	}
+}
 
-	// Split back into chunks and send
-	chunkSize := MaxPayloadSize
+// sweepAbandoned periodically fails messages whose sender stopped sending chunks
+func (s *Server) sweepAbandoned() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
 
-	for i := uint32(0); i < totalChunks; i++ {
-		start := int(i) * chunkSize
-		end := start + chunkSize
-		if end > len(data) {
-			end = len(data)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			timeout := s.options().PendingTimeout
+			if timeout <= 0 {
+				continue
+			}
+			s.sweepAbandonedBefore(now.Add(-timeout))
 		}
+	}
+}
 
-		chunkData := data[start:end]
+// sweepAbandonedBefore fails every message in flight that received no chunk since idleSince
+func (s *Server) sweepAbandonedBefore(idleSince time.Time) {
+	stale, err := s.sessionManager.StalePendingMessages(s.ctx, idleSince)
+	if err != nil {
+		s.logger.Error("Failed to list abandoned messages", "error", err)
+		return
+	}
 
-		packet := NewVoiceDataPacket(senderID, recipientID, messageID, i, totalChunks, chunkData)
-		s.sendPacket(packet, recipientAddr)
+	for _, pending := range stale {
+		// Whoever removes it from the index owns it, a completing message may have won the race
+		claimed, err := s.sessionManager.ForgetPendingMessage(s.ctx, pending.MessageID)
+		if err != nil {
+			s.logger.Error("Failed to claim abandoned message", "message_id", pending.MessageID, "error", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
 
-		time.Sleep(5 * time.Millisecond)
+		received, err := s.sessionManager.GetChunksReceivedCount(s.ctx, pending.MessageID)
+		if err != nil {
+			s.logger.Warn("Failed to count received chunks", "message_id", pending.MessageID, "error", err)
+		}
+
+		s.logger.Warn(
+			"Message abandoned mid-transfer",
+			"message_id", pending.MessageID,
+			"sender_id", pending.SenderID,
+			"chunks", fmt.Sprintf("%d/%d", received, pending.TotalChunks),
+		)
+
+		s.dropAckBatch(pending.MessageID)
+
+		// Dead-lettered like any other failure, so the sender can see what happened to it
+		s.failMessage(s.ctx, pending.MessageID, pending.SenderID, pending.RecipientID, pending.TotalChunks, "transfer timed out", nil)
 	}
+}
 
-	s.logger.Info(
-		"Message forwarded successfully",
+// checkContactPolicy decides what happens to a message based on whether
+// the sender is one of the recipient's contacts. It returns the status
+// the message should be stored with and whether it should be stored at all
+func (s *Server) checkContactPolicy(ctx context.Context, messageID, senderID, recipientID uuid.UUID) (string, bool) {
+	logger := s.messageLogger(messageID)
+
+	policy := s.options().ContactPolicy
+
+	if policy == "" || policy == ContactPolicyOpen {
+		return db.MessageStatusTransmitted, true
+	}
+
+	isContact, err := s.contactStore.IsContact(ctx, recipientID, senderID)
+	if err != nil {
+		// Hold the message back rather than losing or delivering it
+		logger.Error(
+			"Failed to check contacts, quarantining message",
+			"message_id", messageID,
+			"error", err,
+		)
+		return db.MessageStatusQuarantined, true
+	}
+
+	if isContact {
+		return db.MessageStatusTransmitted, true
+	}
+
+	logger.Warn(
+		"Message from a non-contact",
 		"message_id", messageID,
+		"sender_id", senderID,
+		"recipient_id", recipientID,
+		"policy", policy,
+	)
+
+	if policy == ContactPolicyQuarantine {
+		return db.MessageStatusQuarantined, true
+	}
+
+	return "", false
+}
+
+// notifySender sends an error packet to the sender of a message if they are still online
+func (s *Server) notifySender(senderID, messageID uuid.UUID, errorMsg string) {
+	logger := s.messageLogger(messageID)
+
+	senderSession, err := s.sessionManager.GetSession(s.ctx, senderID)
+	if err != nil {
+		logger.Debug("Sender is offline, skipping notification", "sender_id", senderID)
+		return
+	}
+
+	senderAddr, err := net.ResolveUDPAddr("udp", senderSession.Address)
+	if err != nil {
+		logger.Error(
+			"Failed to resolve sender address",
+			"address", senderSession.Address,
+			"error", err,
+		)
+		return
+	}
+
+	s.sendErrorPacket(senderAddr, messageID, errorMsg)
+}
+
+// verifyStored checks that an uploaded object exists with the size that was written
+func (s *Server) verifyStored(ctx context.Context, objectPath string, size int) error {
+	info, err := s.s3storageClient.GetObjectInfo(ctx, objectPath)
+	if err != nil {
+		return err
+	}
+	if info.Size != int64(size) {
+		return fmt.Errorf("stored object %s has %d bytes, expected %d", objectPath, info.Size, size)
+	}
+	return nil
+}
+
+// failMessage dead-letters a message that can't be processed and tells the sender.
+// Its chunks are released like those of any finalized message, so with a grace
+// period configured the message can still be retried until they expire
+func (s *Server) failMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, totalChunks uint32, reason string, cause error) {
+	logger := s.messageLogger(messageID)
+
+	logger.Error("Message processing failed", "message_id", messageID, "reason", reason, "error", cause)
+
+	failed := &db.FailedMessage{
+		MessageID:   messageID,
+		SenderID:    senderID,
+		RecipientID: recipientID,
+		TotalChunks: int(totalChunks),
+		Reason:      reason,
+	}
+	if err := s.messageStore.RecordFailedMessage(ctx, failed); err != nil {
+		logger.Error("Failed to record failed message", "message_id", messageID, "error", err)
+	}
+
+	s.releasePendingMessage(ctx, messageID, totalChunks)
+	s.publish(webhook.EventFailed, messageID, senderID, recipientID, reason)
+	s.notifySender(senderID, messageID, "Message could not be processed: "+reason)
+}
+
+// RetryMessage processes a dead-lettered message again from its buffered chunks.
+// It fails if the chunks were already cleaned up, processing itself happens in the background
+func (s *Server) RetryMessage(ctx context.Context, messageID uuid.UUID) error {
+	failed, err := s.messageStore.GetFailedMessage(ctx, messageID)
+	if err != nil {
+		return err
+	}
+
+	totalChunks := uint32(failed.TotalChunks)
+	if _, err := s.sessionManager.GetAllPendingChunks(ctx, messageID, totalChunks); err != nil {
+		return fmt.Errorf("message chunks not found, they expired or were never buffered")
+	}
+
+	if err := s.messageStore.DeleteFailedMessage(ctx, messageID); err != nil {
+		return err
+	}
+
+	s.messageLogger(messageID).Info("Retrying failed message", "message_id", messageID, "previous_reason", failed.Reason)
+
+	// A repeated failure dead-letters the message again
+	s.wg.Add(1)
+	go s.processCompleteMessage(messageID, failed.SenderID, failed.RecipientID, totalChunks)
+
+	return nil
+}
+
+// releasePendingMessage cleans up the buffered chunks of a finalized message.
+// With a grace period configured the chunks only get a short TTL instead,
+// and valkey sweeps them once it runs out
+func (s *Server) releasePendingMessage(ctx context.Context, messageID uuid.UUID, totalChunks uint32) {
+	logger := s.messageLogger(messageID)
+
+	gracePeriod := s.options().ChunkGracePeriod
+
+	if gracePeriod > 0 {
+		if err := s.sessionManager.ExpirePendingMessage(ctx, messageID, totalChunks, gracePeriod); err != nil {
+			logger.Warn("Failed to expire pending message", "message_id", messageID, "error", err)
+			return
+		}
+
+		logger.Info(
+			"Pending message scheduled for cleanup",
+			"message_id", messageID,
+			"grace_period", gracePeriod,
+		)
+		return
+	}
+
+	if err := s.sessionManager.DeletePendingMessage(ctx, messageID, totalChunks); err != nil {
+		logger.Warn("Failed to clean up pending message", "message_id", messageID, "error", err)
+		return
+	}
+
+	logger.Info("Pending message cleaned up", "message_id", messageID)
+}
+
+// ForwardMessage pushes an already stored message to its recipient if they are online.
+// It returns immediately, forwarding happens in the background
+func (s *Server) ForwardMessage(messageID, senderID, recipientID uuid.UUID, data []byte) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		totalChunks := uint32((len(data) + MaxPayloadSize - 1) / MaxPayloadSize)
+		if s.forwardIfOnline(messageID, senderID, recipientID, data, totalChunks) {
+			if err := s.messageStore.MarkMessageDelivered(s.ctx, messageID, time.Now()); err != nil {
+				s.logger.Error("Failed to mark message delivered", "message_id", messageID, "error", err)
+			}
+			s.publish(webhook.EventDelivered, messageID, senderID, recipientID, "")
+			return
+		}
+
+		msg, err := s.messageStore.GetMessageByID(s.ctx, messageID)
+		if err != nil {
+			s.logger.Warn("Failed to load message for notification", "message_id", messageID, "error", err)
+			return
+		}
+		s.notifyNewMessage(s.ctx, msg)
+	}()
+}
+
+// forwardIfOnline forwards a stored message when its recipient is online
+// and reports whether it was delivered
+func (s *Server) forwardIfOnline(messageID, senderID, recipientID uuid.UUID, data []byte, totalChunks uint32) bool {
+	logger := s.messageLogger(messageID)
+
+	recipientOnline, err := s.sessionManager.IsUserOnline(s.ctx, recipientID)
+	if err != nil {
+		logger.Warn(
+			"Failed to check recipient status",
+			"recipient_id", recipientID,
+			"error", err,
+		)
+		return false
+	}
+
+	if !recipientOnline {
+		logger.Info(
+			"Recipient is offline, message stored for later retrieval",
+			"recipient_id", recipientID,
+		)
+		return false
+	}
+
+	logger.Info(
+		"Recipient is online, forwarding message",
+		"recipient_id", recipientID,
+	)
+	return s.forwardMessageToRecipient(messageID, senderID, recipientID, data, totalChunks)
+}
+
+// forwardMessageToRecipient sends the message to an online recipient.
+// The caller records the delivery
+func (s *Server) forwardMessageToRecipient(messageID uuid.UUID, senderID, recipientID uuid.UUID, data []byte, totalChunks uint32) bool {
+	logger := s.messageLogger(messageID)
+
+	// Get recipient session to find their UDP address
+	recipientSession, err := s.sessionManager.GetSession(s.ctx, recipientID)
+	if err != nil {
+		logger.Error("Failed to get recipient session", "recipient_id", recipientID, "error", err)
+		return false
+	}
+
+	// Parse recipient UDP address
+	recipientAddr, err := net.ResolveUDPAddr("udp", recipientSession.Address)
+	if err != nil {
+		logger.Error(
+			"Failed to resolve recipient address",
+			"address", recipientSession.Address,
+			"error", err,
+		)
+		return false
+	}
+
+	logger.Info(
+		"Forwarding message to recipient",
 		"recipient", recipientSession.Username,
+		"address", recipientAddr,
+		"chunks", totalChunks,
 	)
 
-	now := time.Now()
-	msg := &db.VoiceMessage{
-		ID:          messageID,
-		Status:      db.MessageStatusDelivered,
-		DeliveredAt: &now,
+	// Only a fully ACKed message counts as delivered, otherwise it stays stored for a later download.
+	// Clients hold back the ACK of the chunk completing a message until they saved it
+	if err := s.sendChunksPaced(messageID, senderID, recipientID, data, totalChunks, recipientAddr); err != nil {
+		logger.Warn("Forwarding incomplete, message stored for later retrieval", "message_id", messageID, "error", err)
+		return false
 	}
-	s.messageStore.UpdateMessage(s.ctx, msg)
+
+	logger.Info(
+		"Message forwarded and acknowledged",
+		"message_id", messageID,
+		"recipient", recipientSession.Username,
+	)
+
+	return true
 }
 
 // handleListMessages returns a list of unread messages for the user
@@ -420,14 +1267,14 @@ func (s *Server) handleListMessages(packet *Packet, clientAddr *net.UDPAddr) {
 	session, err := s.sessionManager.GetSession(s.ctx, packet.SenderID)
 	if err != nil {
 		s.logger.Warn("List request from unauthenticated user", "sender_id", packet.SenderID)
-		s.sendErrorPacket(clientAddr, packet.MessageID, "Not authenticated")
+		s.sendErrorPacket(clientAddr, packet.MessageID, ErrorSessionExpired)
 		return
 	}
 
 	s.logger.Info("Fetching messages...", "user_id", session.UserID)
 
-	// Get unread messages from database (transmitted but not delivered)
-	messages, err := s.messageStore.GetMessagesByRecipient(s.ctx, session.UserID, 20, 0)
+	// Get unread messages from database (transmitted but not delivered), archived ones don't count
+	messages, err := s.messageStore.GetMessagesByRecipient(s.ctx, session.UserID, db.FolderInbox, 20, 0)
 	if err != nil {
 		s.logger.Error("Failed to fetch messages", "error", err)
 		s.sendErrorPacket(clientAddr, packet.MessageID, "Failed to fetch messages")
@@ -438,23 +1285,7 @@ func (s *Server) handleListMessages(packet *Packet, clientAddr *net.UDPAddr) {
 	var unreadMessages []MessageInfo
 	for _, msg := range messages {
 		if msg.Status == db.MessageStatusTransmitted || msg.Status == db.MessageStatusDelivered {
-			sender, err := s.userStore.GetUserByID(s.ctx, msg.SenderID)
-			senderName := "Unknown"
-			if err == nil {
-				senderName = sender.Username
-			}
-
-			info := MessageInfo{
-				ID:          msg.ID,
-				SenderID:    msg.SenderID,
-				SenderName:  senderName,
-				FileSize:    msg.FileSize,
-				Duration:    msg.DurationSecs,
-				AudioFormat: msg.AudioFormat,
-				Status:      msg.Status,
-				CreatedAt:   msg.CreatedAt.Format(time.RFC3339),
-			}
-			unreadMessages = append(unreadMessages, info)
+			unreadMessages = append(unreadMessages, s.messageInfo(s.ctx, msg))
 		}
 	}
 
@@ -470,29 +1301,192 @@ func (s *Server) handleListMessages(packet *Packet, clientAddr *net.UDPAddr) {
 	s.sendPacket(responsePacket, clientAddr)
 }
 
+// messageInfo describes a message for its recipient
+func (s *Server) messageInfo(ctx context.Context, msg *db.VoiceMessage) MessageInfo {
+	// Senders who deleted their account are still named
+	senderName, err := s.userStore.GetUsername(ctx, msg.SenderID)
+	if err != nil {
+		senderName = "Unknown"
+	}
+
+	return MessageInfo{
+		ID:          msg.ID,
+		SenderID:    msg.SenderID,
+		SenderName:  senderName,
+		FileSize:    msg.FileSize,
+		Duration:    msg.DurationSecs,
+		AudioFormat: msg.AudioFormat,
+		Status:      msg.Status,
+		CreatedAt:   msg.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// notifyNewMessage tells the recipient of a stored message about it, if they are online.
+// It covers messages that weren't forwarded, so the client can refresh its list
+func (s *Server) notifyNewMessage(ctx context.Context, msg *db.VoiceMessage) {
+	logger := s.messageLogger(msg.ID)
+
+	session, err := s.sessionManager.GetSession(ctx, msg.RecipientID)
+	if err != nil {
+		// Offline, they see it on their next check
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", session.Address)
+	if err != nil {
+		logger.Warn("Failed to resolve recipient address", "address", session.Address, "error", err)
+		return
+	}
+
+	packet, err := NewMessageNotificationPacket(msg.RecipientID, s.messageInfo(ctx, msg))
+	if err != nil {
+		logger.Error("Failed to create new message notification", "message_id", msg.ID, "error", err)
+		return
+	}
+
+	logger.Info("Notifying recipient of new message", "message_id", msg.ID, "recipient", session.Username)
+	s.sendPacket(packet, addr)
+}
+
+// handleStatusQuery tells a sender how far their message got
+func (s *Server) handleStatusQuery(packet *Packet, clientAddr *net.UDPAddr) {
+	session, err := s.sessionManager.GetSession(s.ctx, packet.SenderID)
+	if err != nil {
+		s.logger.Warn("Status query from unauthenticated user", "sender_id", packet.SenderID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, ErrorSessionExpired)
+		return
+	}
+
+	messageID := packet.MessageID
+
+	msg, err := s.messageStore.GetMessageByID(s.ctx, messageID)
+	if err != nil {
+		s.logger.Warn("Status query for unknown message", "message_id", messageID, "error", err)
+		s.sendErrorPacket(clientAddr, messageID, "Message not found")
+		return
+	}
+
+	// Answered the same as a missing message, so IDs of other people's messages can't be probed
+	if msg.SenderID != session.UserID {
+		s.logger.Warn("Unauthorized status query",
+			"message_id", messageID,
+			"user", session.UserID,
+			"sender", msg.SenderID,
+		)
+		s.sendErrorPacket(clientAddr, messageID, "Message not found")
+		return
+	}
+
+	responsePacket, err := NewStatusResponsePacket(session.UserID, MessageStatus{
+		ID:          msg.ID,
+		Status:      msg.Status,
+		CreatedAt:   msg.CreatedAt,
+		DeliveredAt: msg.DeliveredAt,
+		ListenedAt:  msg.ListenedAt,
+	})
+	if err != nil {
+		s.logger.Error("Failed to create status response", "error", err)
+		s.sendErrorPacket(clientAddr, messageID, "Failed to get message status")
+		return
+	}
+
+	s.sendPacket(responsePacket, clientAddr)
+}
+
+// handleDeleteMessage deletes a received message and its files, then ACKs.
+// Only the recipient may delete a message, from their own session
+func (s *Server) handleDeleteMessage(packet *Packet, clientAddr *net.UDPAddr, secured bool) {
+	logger := s.messageLogger(packet.MessageID)
+
+	session, err := s.sessionManager.GetSession(s.ctx, packet.SenderID)
+	if err != nil {
+		logger.Warn("Delete request from unauthenticated user", "sender_id", packet.SenderID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, ErrorSessionExpired)
+		return
+	}
+
+	// The sender ID is whatever the packet claims, knowing someone's user ID mustn't be enough to delete their messages
+	if !s.fromSession(packet, clientAddr, secured) {
+		logger.Warn("Delete request from outside the sender's session", "sender_id", packet.SenderID, "from", clientAddr)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Unauthorized")
+		return
+	}
+
+	messageID := packet.MessageID
+
+	msg, err := s.messageStore.GetMessageByID(s.ctx, messageID)
+	if err != nil {
+		logger.Warn("Delete request for unknown message", "message_id", messageID, "error", err)
+		s.sendErrorPacket(clientAddr, messageID, "Message not found")
+		return
+	}
+
+	if msg.RecipientID != session.UserID {
+		logger.Warn("Unauthorized delete attempt",
+			"message_id", messageID,
+			"user", session.UserID,
+			"recipient", msg.RecipientID,
+		)
+		s.sendErrorPacket(clientAddr, messageID, "Unauthorized")
+		return
+	}
+
+	// Scoped to the recipient again, so a message can't change hands in between
+	deleted, err := s.messageStore.DeleteMessages(s.ctx, []uuid.UUID{messageID}, session.UserID)
+	if err != nil {
+		logger.Error("Failed to delete message", "message_id", messageID, "error", err)
+		s.sendErrorPacket(clientAddr, messageID, "Failed to delete message")
+		return
+	}
+	if deleted == 0 {
+		s.sendErrorPacket(clientAddr, messageID, "Message not found")
+		return
+	}
+
+	// A file left behind here is picked up by the orphan sweeper
+	paths := []string{msg.FilePath}
+	if msg.OriginalFilePath != nil {
+		paths = append(paths, *msg.OriginalFilePath)
+	}
+	for _, path := range paths {
+		if err := s.s3storageClient.DeleteVoiceMessage(s.ctx, path); err != nil {
+			logger.Warn("Failed to delete message file", "message_id", messageID, "object", path, "error", err)
+		}
+	}
+	if err := s.s3storageClient.DeletePeaks(s.ctx, messageID); err != nil {
+		logger.Warn("Failed to delete message peaks", "message_id", messageID, "error", err)
+	}
+
+	logger.Info("Message deleted", "message_id", messageID, "user", session.Username)
+
+	s.sendPacket(NewDeleteAckPacket(packet), clientAddr)
+}
+
 // handleDownloadMessage sends a specific message to the client
 func (s *Server) handleDownloadMessage(packet *Packet, clientAddr *net.UDPAddr) {
+	logger := s.messageLogger(packet.MessageID)
+
 	session, err := s.sessionManager.GetSession(s.ctx, packet.SenderID)
 	if err != nil {
-		s.logger.Warn("Download request from unauthenticated user", "sender_id", packet.SenderID)
-		s.sendErrorPacket(clientAddr, packet.MessageID, "Not authenticated")
+		logger.Warn("Download request from unauthenticated user", "sender_id", packet.SenderID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, ErrorSessionExpired)
 		return
 	}
 
 	messageID := packet.MessageID
-	s.logger.Info("Download request", "message_id", messageID, "user", session.Username)
+	logger.Info("Download request", "message_id", messageID, "user", session.Username)
 
 	// Getting message from database
 	msg, err := s.messageStore.GetMessageByID(s.ctx, messageID)
 	if err != nil {
-		s.logger.Error("Message not found", "message_id", messageID, "error", err)
+		logger.Error("Message not found", "message_id", messageID, "error", err)
 		s.sendErrorPacket(clientAddr, packet.MessageID, "Message not found")
 		return
 	}
 
 	// Verify the user is the recipient
 	if msg.RecipientID != session.UserID {
-		s.logger.Warn("Unauthorized download attempt",
+		logger.Warn("Unauthorized download attempt",
 			"message_id", messageID,
 			"user", session.UserID,
 			"recipient", msg.RecipientID,
@@ -501,59 +1495,72 @@ func (s *Server) handleDownloadMessage(packet *Packet, clientAddr *net.UDPAddr)
 		return
 	}
 
+	// Held back by the contact policy, same answer as a missing message
+	if msg.Status == db.MessageStatusQuarantined {
+		logger.Warn("Download of quarantined message", "message_id", messageID, "user", session.UserID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, "Message not found")
+		return
+	}
+
 	// Download from S3
-	data, err := s.s3storageClient.DownloadVoiceMessage(s.ctx, msg.FilePath)
+	data, err := s.loadMessageData(s.ctx, msg)
 	if err != nil {
-		s.logger.Error("Failed to download from s3", "error", err, "path", msg.FilePath)
+		logger.Error("Failed to load message data", "error", err, "path", msg.FilePath)
 		s.sendErrorPacket(clientAddr, packet.MessageID, "Failed to retrieve message")
 		return
 	}
 
-	s.logger.Info("Downloaded from S3", "message_id", messageID, "size", len(data))
+	logger.Info("Downloaded from S3", "message_id", messageID, "size", len(data))
 
 	// Split into chunks and send
 	chunkSize := MaxPayloadSize
 	totalChunks := (len(data) + chunkSize - 1) / chunkSize
 
-	s.logger.Info("Sending message",
+	logger.Info("Sending message",
 		"message_id", messageID,
 		"chunks", totalChunks,
 		"to", session.Username,
 	)
 
-	for i := 0; i < totalChunks; i++ {
-		start := i * chunkSize
-		end := start + chunkSize
-		if end > len(data) {
-			end = len(data)
-		}
+	if err := s.sendChunksPaced(messageID, msg.SenderID, session.UserID, data, uint32(totalChunks), clientAddr); err != nil {
+		logger.Warn("Message download interrupted", "message_id", messageID, "error", err)
+		return
+	}
 
-		chunkData := data[start:end]
-		chunkPacket := NewVoiceDataPacket(
-			msg.SenderID,
-			session.UserID,
-			messageID,
-			uint32(i),
-			uint32(totalChunks),
-			chunkData,
-		)
+	now := time.Now()
 
-		s.sendPacket(chunkPacket, clientAddr)
+	// Only a transmitted message becomes delivered
+	delivered := msg.Status == db.MessageStatusTransmitted
+	if delivered {
+		msg.Status = db.MessageStatusDelivered
+		msg.DeliveredAt = &now
+	}
 
-		// Small delay to not overwhelm the network
-		time.Sleep(5 * time.Millisecond)
+	// Optionally treat the download itself as a listened receipt, also for
+	// messages delivered earlier. Any other status is left as it is
+	listened := s.options().AutoMarkListened && msg.Status == db.MessageStatusDelivered && msg.ListenedAt == nil
+	if listened {
+		msg.Status = db.MessageStatusListened
+		msg.ListenedAt = &now
 	}
 
-	// Mark as delivered
-	now := time.Now()
-	msg.Status = db.MessageStatusDelivered
-	msg.DeliveredAt = &now
+	if !delivered && !listened {
+		logger.Info("Message send successfully", "message_id", messageID, "status", msg.Status)
+		return
+	}
 
 	if err := s.messageStore.UpdateMessage(s.ctx, msg); err != nil {
-		s.logger.Error("Failed to update message status", "error", err)
+		logger.Error("Failed to update message status", "error", err)
+	}
+
+	if delivered {
+		s.publish(webhook.EventDelivered, msg.ID, msg.SenderID, msg.RecipientID, "")
+	}
+	if listened {
+		s.publish(webhook.EventListened, msg.ID, msg.SenderID, msg.RecipientID, "")
 	}
 
-	s.logger.Info("Message send successfully", "message_id", messageID)
+	logger.Info("Message send successfully", "message_id", messageID)
 }
 
 // handleHeartbeat keeps the session alive
@@ -561,6 +1568,7 @@ func (s *Server) handleHeartbeat(packet *Packet, clientAddr *net.UDPAddr) {
 	err := s.sessionManager.UpdateLastSeen(s.ctx, packet.SenderID)
 	if err != nil {
 		s.logger.Warn("Heartbeat from unknown user", "sender_id", packet.SenderID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, ErrorSessionExpired)
 		return
 	}
 
@@ -568,20 +1576,71 @@ func (s *Server) handleHeartbeat(packet *Packet, clientAddr *net.UDPAddr) {
 	s.sendPacket(ackPacket, clientAddr)
 }
 
-// updateMessageStatus is a helper to update message status
-func (s *Server) updateMessageStatus(messageId uuid.UUID, status string) {
-	if err := s.messageStore.UpdateMessageStatus(s.ctx, messageId, status); err != nil {
+// handleRecordingIndicator relays a recording indicator to the recipient if they are online.
+// Nothing is stored, a lost indicator is simply not shown
+func (s *Server) handleRecordingIndicator(packet *Packet, clientAddr *net.UDPAddr) {
+	if _, err := s.sessionManager.GetSession(s.ctx, packet.SenderID); err != nil {
+		s.logger.Warn("Recording indicator from unauthenticated user", "sender_id", packet.SenderID)
+		s.sendErrorPacket(clientAddr, packet.MessageID, ErrorSessionExpired)
+		return
+	}
+
+	recording, err := ParseRecordingIndicator(packet.Payload)
+	if err != nil {
+		s.logger.Warn("Invalid recording indicator", "sender_id", packet.SenderID, "error", err)
+		return
+	}
+
+	// Whoever can't message the recipient shouldn't be able to ping them either
+	if status, _ := s.checkContactPolicy(s.ctx, packet.MessageID, packet.SenderID, packet.RecipientID); status != db.MessageStatusTransmitted {
+		return
+	}
+
+	recipientSession, err := s.sessionManager.GetSession(s.ctx, packet.RecipientID)
+	if err != nil {
+		s.logger.Debug("Recipient is offline, dropping recording indicator", "recipient_id", packet.RecipientID)
+		return
+	}
+
+	recipientAddr, err := net.ResolveUDPAddr("udp", recipientSession.Address)
+	if err != nil {
 		s.logger.Error(
-			"Failed to update message status",
-			"message_id", messageId,
-			"status", status,
+			"Failed to resolve recipient address",
+			"address", recipientSession.Address,
 			"error", err,
 		)
+		return
 	}
+
+	s.sendPacket(NewRecordingIndicatorPacket(packet.SenderID, packet.RecipientID, recording), recipientAddr)
 }
 
-// sendPacket sends a packet to a client
+// sendPacket sends a packet to a client,
+// encrypting it if the recipient has a secure channel
 func (s *Server) sendPacket(packet *Packet, addr *net.UDPAddr) {
+	packet.Sequence = s.sendSeq.Add(1)
+
+	if channel := s.secureChannel(packet.RecipientID); channel != nil {
+		sealed, err := channel.Seal(packet)
+		if err != nil {
+			s.logger.Error("Failed to seal packet", "error", err)
+			return
+		}
+		packet = sealed
+	}
+
+	s.writePacket(packet, addr)
+}
+
+// writePacket sends a packet to a client as is.
+// Once shutdown started the socket is gone, so packets still being sent
+// by draining messages are skipped instead of failing
+func (s *Server) writePacket(packet *Packet, addr *net.UDPAddr) {
+	if s.conn == nil || s.ctx.Err() != nil {
+		s.logger.Debug("Server is shutting down, not sending packet", "type", packet.Type, "to", addr)
+		return
+	}
+
 	data, err := packet.Marshal()
 	if err != nil {
 		s.logger.Error("Failed to marshal packet", "error", err)
@@ -590,10 +1649,132 @@ func (s *Server) sendPacket(packet *Packet, addr *net.UDPAddr) {
 
 	_, err = s.conn.WriteToUDP(data, addr)
 	if err != nil {
+		// Shutdown may close the socket between the check above and the write
+		if errors.Is(err, net.ErrClosed) && s.ctx.Err() != nil {
+			s.logger.Debug("Server is shutting down, packet not sent", "type", packet.Type, "to", addr)
+			return
+		}
 		s.logger.Error("Failed to send packet", "error", err, "to", addr)
 	}
 }
 
+// openSecure decrypts a secure packet with the channel of its sender.
+// The inner packet must claim the same sender as the envelope
+func (s *Server) openSecure(packet *Packet) (*Packet, error) {
+	channel := s.secureChannel(packet.SenderID)
+	if channel == nil {
+		return nil, fmt.Errorf("no secure channel for user %s", packet.SenderID)
+	}
+
+	inner, err := channel.Open(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	if inner.SenderID != packet.SenderID {
+		return nil, fmt.Errorf("sender mismatch inside secure packet")
+	}
+
+	return inner, nil
+}
+
+// secureChannel returns the secure channel of a user, nil if there is none
+func (s *Server) secureChannel(userID uuid.UUID) *SecureChannel {
+	if userID == uuid.Nil {
+		return nil
+	}
+
+	s.secureMu.RLock()
+	defer s.secureMu.RUnlock()
+
+	return s.secure[userID]
+}
+
+// DisconnectUser forgets the secure channel and sequence window of a user whose session was dropped elsewhere,
+// so packets sealed with the old keys are refused and the user has to authenticate again
+func (s *Server) DisconnectUser(userID uuid.UUID) {
+	s.setSecureChannel(userID, nil)
+
+	s.seqMu.Lock()
+	delete(s.seqs, userID)
+	s.seqMu.Unlock()
+}
+
+// setSecureChannel stores or, with a nil channel, removes the secure channel of a user
+func (s *Server) setSecureChannel(userID uuid.UUID, channel *SecureChannel) {
+	s.secureMu.Lock()
+	defer s.secureMu.Unlock()
+
+	if channel == nil {
+		delete(s.secure, userID)
+		return
+	}
+	s.secure[userID] = channel
+}
+
+// tokenRevoked reports whether a validated token was revoked since it was issued, like the HTTP auth middleware.
+// Tokens without an issue time can't be checked and count as revoked. While the store is down the token is accepted
+func (s *Server) tokenRevoked(claims *jwt.Claims) bool {
+	if claims.IssuedAt == nil {
+		return true
+	}
+
+	revoked, err := s.sessionManager.IsTokenRevoked(s.ctx, claims.UserID, claims.IssuedAt.Time)
+	if err != nil {
+		s.logger.Warn("Token revocation check unavailable, accepting token", "user_id", claims.UserID, "error", err)
+		return false
+	}
+	return revoked
+}
+
+// resetSequence starts tracking sequence numbers of a user from scratch
+func (s *Server) resetSequence(userID uuid.UUID) {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+
+	s.seqs[userID] = &replayWindow{}
+}
+
+// freshSequence reports whether a packet sequence number wasn't seen from the user yet,
+// recording it only when record is set.
+// Users that never authenticated have no window, their packets are left to the handlers to refuse
+func (s *Server) freshSequence(userID uuid.UUID, seq uint32, record bool) bool {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+
+	window, ok := s.seqs[userID]
+	if !ok {
+		return true
+	}
+	if !window.check(uint64(seq)) {
+		return false
+	}
+	if record {
+		window.mark(uint64(seq))
+	}
+	return true
+}
+
+// fromSession reports whether a packet provably comes from its sender's session:
+// it decrypted under the sender's secure channel, or arrived from the session's address
+func (s *Server) fromSession(packet *Packet, clientAddr *net.UDPAddr, secured bool) bool {
+	if secured {
+		return true
+	}
+
+	sess, err := s.sessionManager.GetSession(s.ctx, packet.SenderID)
+	if err != nil {
+		return false
+	}
+	return sess.Address == clientAddr.String()
+}
+
+// messageLogger tags log lines with a message ID as trace_id,
+// so the whole life of a message can be followed from auth to forward
+func (s *Server) messageLogger(messageID uuid.UUID) *log.Logger {
+	return s.logger.With("trace_id", messageID)
+}
+
 // sendErrorPacket sends an error UDP packet
 func (s *Server) sendErrorPacket(addr *net.UDPAddr, messageID uuid.UUID, errorMsg string) {
 	packet := NewPacket(PacketTypeError, uuid.Nil, uuid.Nil, messageID)
@@ -619,12 +1800,16 @@ func (s *Server) Shutdown(ctx context.Context) error {
 		close(done)
 	}()
 
+	// New packets are refused from here on, but messages that already
+	// have all their chunks keep uploading until done or out of time
+	defer s.drainCancel()
+
 	select {
 	case <-done:
 		s.logger.Info("UDP server shut down gracefully")
 		return nil
 	case <-ctx.Done():
-		s.logger.Warn("UDP server shutdown timeout")
+		s.logger.Warn("UDP server shutdown timeout, aborting in-flight messages")
 		return ctx.Err()
 	}
 }
@@ -0,0 +1,1671 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/db"
+	"github.com/rx3lixir/laba/internal/session"
+	"github.com/rx3lixir/laba/pkg/audio"
+	"github.com/rx3lixir/laba/pkg/jwt"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+)
+
+func TestSpoofedSenderDoesNotAdvanceReplayWindow(t *testing.T) {
+	store := session.NewMemoryStore(session.TTLOptions{})
+	s := &Server{
+		ctx:            context.Background(),
+		sessionManager: store,
+		seqs:           make(map[uuid.UUID]*replayWindow),
+	}
+
+	userID := uuid.New()
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	spoofer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 4000}
+	if err := store.CreateSession(s.ctx, userID, "alice", client); err != nil {
+		t.Fatal(err)
+	}
+	s.resetSequence(userID)
+
+	packet := NewPacket(PacketTypeHeartbeat, userID, uuid.Nil, uuid.Nil)
+	packet.Sequence = 7
+
+	if s.fromSession(packet, spoofer, false) {
+		t.Fatal("packet from another address tied to the session")
+	}
+	if !s.freshSequence(userID, packet.Sequence, s.fromSession(packet, spoofer, false)) {
+		t.Fatal("spoofed packet refused before the real one arrived")
+	}
+
+	// The real client's packet with the same sequence still gets through, once
+	if !s.freshSequence(userID, packet.Sequence, s.fromSession(packet, client, false)) {
+		t.Fatal("real packet refused after a spoofed one")
+	}
+	if s.freshSequence(userID, packet.Sequence, s.fromSession(packet, client, false)) {
+		t.Fatal("replayed packet accepted")
+	}
+}
+
+func TestRevokedTokenIsRefused(t *testing.T) {
+	store := session.NewMemoryStore(session.TTLOptions{})
+	jwtService := jwt.NewService("secret", time.Hour, time.Hour)
+	s := &Server{
+		ctx:            context.Background(),
+		sessionManager: store,
+		logger:         log.New(io.Discard),
+	}
+
+	userID := uuid.New()
+	token, err := jwtService.GenerateAccessToken(userID, "alice@example.com", "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := jwtService.ValidateToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.tokenRevoked(claims) {
+		t.Fatal("fresh token counted as revoked")
+	}
+
+	// Revocations have second granularity, a token from the same second would still pass
+	claims.IssuedAt.Time = claims.IssuedAt.Add(-time.Second)
+	if err := store.RevokeUserTokens(s.ctx, userID, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !s.tokenRevoked(claims) {
+		t.Fatal("revoked token accepted")
+	}
+}
+
+func TestDisconnectUserDropsSecureChannel(t *testing.T) {
+	s := &Server{
+		secure: make(map[uuid.UUID]*SecureChannel),
+		seqs:   make(map[uuid.UUID]*replayWindow),
+	}
+
+	userID := uuid.New()
+	s.setSecureChannel(userID, &SecureChannel{})
+	s.resetSequence(userID)
+
+	s.DisconnectUser(userID)
+
+	if s.secureChannel(userID) != nil {
+		t.Fatal("secure channel survived the disconnect")
+	}
+	if _, ok := s.seqs[userID]; ok {
+		t.Fatal("sequence window survived the disconnect")
+	}
+}
+
+func TestQuarantinedMessageIsNotDownloaded(t *testing.T) {
+	store := session.NewMemoryStore(session.TTLOptions{})
+	messages := newFakeMessageStore()
+	s := New("", Options{}, store, nil, nil, messages, nil, nil, nil, nil, nil, log.New(io.Discard))
+
+	recipientID := uuid.New()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	if err := store.CreateSession(s.ctx, recipientID, "bob", addr); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &db.VoiceMessage{
+		ID:          uuid.New(),
+		SenderID:    uuid.New(),
+		RecipientID: recipientID,
+		FilePath:    "voice/held.opus",
+		Status:      db.MessageStatusQuarantined,
+	}
+	if err := messages.CreateMessage(s.ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// With no object store set, loading the audio would panic
+	s.handleDownloadMessage(NewPacket(PacketTypeDownloadMsg, recipientID, uuid.Nil, msg.ID), addr)
+
+	if got := messages.message(msg.ID).Status; got != db.MessageStatusQuarantined {
+		t.Fatalf("status changed to %q", got)
+	}
+	if messages.updates != 0 {
+		t.Fatal("quarantined message was updated")
+	}
+}
+
+// newForwardingServer returns a server with in-memory stores and a socket of its own,
+// plus a recipient with a session pointing at the returned connection
+func newForwardingServer(t *testing.T, messages *fakeMessageStore) (*Server, *session.MemoryStore, uuid.UUID, *net.UDPConn) {
+	t.Helper()
+
+	store := session.NewMemoryStore(session.TTLOptions{})
+	opts := Options{ForwardAckTimeout: 200 * time.Millisecond, ForwardRetries: 1}
+	s := New("", opts, store, nil, nil, messages, nil, fakeBlockStore{}, s3storage.NewMemoryStore(), nil, nil, log.New(io.Discard))
+	t.Cleanup(s.cancel)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s.conn = conn
+
+	recipient, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { recipient.Close() })
+
+	recipientID := uuid.New()
+	if err := store.CreateSession(s.ctx, recipientID, "bob", recipient.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, store, recipientID, recipient
+}
+
+func TestMessageIsStoredBeforeForwarding(t *testing.T) {
+	messages := newFakeMessageStore()
+	s, store, recipientID, recipient := newForwardingServer(t, messages)
+
+	messageID, senderID := uuid.New(), uuid.New()
+	if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, []byte("voice")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recipient checks the record exists for every chunk it gets, then ACKs it
+	storedFirst := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		recipient.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := recipient.ReadFromUDP(buf)
+		if err != nil {
+			storedFirst <- false
+			return
+		}
+		packet, err := Unmarshal(buf[:n])
+		if err != nil || packet.Type != PacketTypeVoiceData {
+			storedFirst <- false
+			return
+		}
+		storedFirst <- messages.message(messageID) != nil
+		s.handleForwardAck(NewAckPacket(packet))
+	}()
+
+	s.wg.Add(1)
+	s.processCompleteMessage(messageID, senderID, recipientID, 1)
+
+	if !<-storedFirst {
+		t.Fatal("message forwarded before its record was stored")
+	}
+
+	msg := messages.message(messageID)
+	if msg.Status != db.MessageStatusDelivered || msg.DeliveredAt == nil {
+		t.Fatalf("status %q after an ACKed forward, want delivered", msg.Status)
+	}
+	if msg.TransmittedAt == nil || msg.ChunksReceived != 1 {
+		t.Fatal("marking the message delivered lost the rest of its record")
+	}
+}
+
+func TestForwardMessageKeepsRecord(t *testing.T) {
+	messages := newFakeMessageStore()
+	s, _, recipientID, recipient := newForwardingServer(t, messages)
+
+	transmittedAt := time.Now().Add(-time.Minute)
+	msg := &db.VoiceMessage{
+		ID:             uuid.New(),
+		SenderID:       uuid.New(),
+		RecipientID:    recipientID,
+		ChunksReceived: 1,
+		TotalChunks:    1,
+		Status:         db.MessageStatusTransmitted,
+		TransmittedAt:  &transmittedAt,
+	}
+	if err := messages.CreateMessage(s.ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	ackForwards(s, recipient)
+
+	s.ForwardMessage(msg.ID, msg.SenderID, recipientID, []byte("voice"))
+	s.wg.Wait()
+
+	got := messages.message(msg.ID)
+	if got.Status != db.MessageStatusDelivered || got.DeliveredAt == nil {
+		t.Fatalf("status %q after an ACKed forward, want delivered", got.Status)
+	}
+	if got.TransmittedAt == nil || !got.TransmittedAt.Equal(transmittedAt) || got.ChunksReceived != 1 {
+		t.Fatal("marking the message delivered lost the rest of its record")
+	}
+}
+
+func TestUnstoredMessageIsNotForwarded(t *testing.T) {
+	messages := newFakeMessageStore()
+	messages.createErr = errors.New("database is down")
+	s, store, recipientID, recipient := newForwardingServer(t, messages)
+
+	messageID, senderID := uuid.New(), uuid.New()
+	if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, []byte("voice")); err != nil {
+		t.Fatal(err)
+	}
+
+	s.wg.Add(1)
+	s.processCompleteMessage(messageID, senderID, recipientID, 1)
+
+	recipient.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := recipient.ReadFromUDP(make([]byte, MaxPacketSize)); err == nil {
+		t.Fatal("recipient got a message that was never stored")
+	}
+	if messages.failedMessage(messageID) == nil {
+		t.Fatal("failed message was not dead-lettered")
+	}
+}
+
+// ackForwards ACKs every voice chunk the recipient gets until its connection is closed
+func ackForwards(s *Server, recipient *net.UDPConn) {
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, _, err := recipient.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			packet, err := Unmarshal(buf[:n])
+			if err == nil && packet.Type == PacketTypeVoiceData {
+				s.handleForwardAck(NewAckPacket(packet))
+			}
+		}
+	}()
+}
+
+func TestDownloadAutoMarksListened(t *testing.T) {
+	for _, auto := range []bool{false, true} {
+		t.Run(fmt.Sprintf("auto=%v", auto), func(t *testing.T) {
+			messages := newFakeMessageStore()
+			s, _, recipientID, recipient := newForwardingServer(t, messages)
+			opts := *s.options()
+			opts.AutoMarkListened = auto
+			s.SetOptions(opts)
+			ackForwards(s, recipient)
+
+			msg := &db.VoiceMessage{
+				ID:          uuid.New(),
+				SenderID:    uuid.New(),
+				RecipientID: recipientID,
+				Status:      db.MessageStatusTransmitted,
+			}
+			path, err := s.s3storageClient.UploadVoiceMessage(s.ctx, msg.ID, msg.SenderID, recipientID, []byte("voice"), "opus")
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.FilePath = path
+			if err := messages.CreateMessage(s.ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+
+			s.handleDownloadMessage(NewPacket(PacketTypeDownloadMsg, recipientID, uuid.Nil, msg.ID), recipient.LocalAddr().(*net.UDPAddr))
+
+			got := messages.message(msg.ID)
+			if got.DeliveredAt == nil {
+				t.Fatal("downloaded message has no delivery time")
+			}
+			switch {
+			case auto && (got.Status != db.MessageStatusListened || got.ListenedAt == nil):
+				t.Fatalf("status %q, want listened", got.Status)
+			case !auto && (got.Status != db.MessageStatusDelivered || got.ListenedAt != nil):
+				t.Fatalf("status %q, want delivered", got.Status)
+			}
+		})
+	}
+}
+
+func TestDownloadTransitions(t *testing.T) {
+	messages := newFakeMessageStore()
+	s, _, recipientID, recipient := newForwardingServer(t, messages)
+	ackForwards(s, recipient)
+
+	msg := &db.VoiceMessage{
+		ID:          uuid.New(),
+		SenderID:    uuid.New(),
+		RecipientID: recipientID,
+		Status:      db.MessageStatusTransmitted,
+	}
+	path, err := s.s3storageClient.UploadVoiceMessage(s.ctx, msg.ID, msg.SenderID, recipientID, []byte("voice"), "opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.FilePath = path
+	if err := messages.CreateMessage(s.ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(auto bool) *db.VoiceMessage {
+		opts := *s.options()
+		opts.AutoMarkListened = auto
+		s.SetOptions(opts)
+		s.handleDownloadMessage(NewPacket(PacketTypeDownloadMsg, recipientID, uuid.Nil, msg.ID), recipient.LocalAddr().(*net.UDPAddr))
+		return messages.message(msg.ID)
+	}
+
+	// The first download only delivers, the message was fetched before auto marking was on
+	got := download(false)
+	if got.Status != db.MessageStatusDelivered || got.DeliveredAt == nil || got.ListenedAt != nil {
+		t.Fatalf("status %q after the first download, want delivered", got.Status)
+	}
+	deliveredAt := *got.DeliveredAt
+
+	// Fetching a delivered message again still counts as listening to it
+	got = download(true)
+	if got.Status != db.MessageStatusListened || got.ListenedAt == nil {
+		t.Fatalf("status %q after downloading a delivered message, want listened", got.Status)
+	}
+	if !got.DeliveredAt.Equal(deliveredAt) {
+		t.Fatal("listened transition moved the delivery time")
+	}
+
+	// A listened message is left as it is
+	updates := messages.updates
+	if got = download(true); got.Status != db.MessageStatusListened || messages.updates != updates {
+		t.Fatalf("status %q, %d updates after downloading a listened message", got.Status, messages.updates-updates)
+	}
+}
+
+func TestReleaseKeepsChunksForGracePeriod(t *testing.T) {
+	for _, grace := range []time.Duration{0, 100 * time.Millisecond} {
+		t.Run(fmt.Sprintf("grace=%v", grace), func(t *testing.T) {
+			store := session.NewMemoryStore(session.TTLOptions{})
+			s := New("", Options{ChunkGracePeriod: grace}, store, nil, nil, nil, nil, nil, nil, nil, nil, log.New(io.Discard))
+			t.Cleanup(s.cancel)
+
+			messageID := uuid.New()
+			for i := uint32(0); i < 2; i++ {
+				if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, i, 2, []byte("voice")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s.releasePendingMessage(s.ctx, messageID, 2)
+
+			_, err := store.GetAllPendingChunks(s.ctx, messageID, 2)
+			if grace == 0 {
+				if err == nil {
+					t.Fatal("chunks kept without a grace period")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("chunks gone within the grace period: %v", err)
+			}
+
+			time.Sleep(2 * grace)
+			if _, err := store.GetAllPendingChunks(s.ctx, messageID, 2); err == nil {
+				t.Fatal("chunks kept after the grace period")
+			}
+			if count, _ := store.GetChunksReceivedCount(s.ctx, messageID); count != 0 {
+				t.Fatalf("chunk count %d kept after the grace period", count)
+			}
+		})
+	}
+}
+
+func TestContactPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		contact   bool
+		wantSaved bool
+		status    string
+	}{
+		{"contact", ContactPolicyReject, true, true, db.MessageStatusDelivered},
+		{"stranger", ContactPolicyReject, false, false, ""},
+		{"quarantined stranger", ContactPolicyQuarantine, false, true, db.MessageStatusQuarantined},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := newFakeMessageStore()
+			s, store, recipientID, recipient := newForwardingServer(t, messages)
+			opts := *s.options()
+			opts.ContactPolicy = tt.policy
+			s.SetOptions(opts)
+			ackForwards(s, recipient)
+
+			senderID := uuid.New()
+			s.contactStore = &fakeContactStore{contacts: map[uuid.UUID]map[uuid.UUID]bool{
+				recipientID: {senderID: tt.contact},
+			}}
+
+			messageID := uuid.New()
+			if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, []byte("voice")); err != nil {
+				t.Fatal(err)
+			}
+
+			s.wg.Add(1)
+			s.processCompleteMessage(messageID, senderID, recipientID, 1)
+
+			msg := messages.message(messageID)
+			if (msg != nil) != tt.wantSaved {
+				t.Fatalf("message stored = %v, want %v", msg != nil, tt.wantSaved)
+			}
+			if msg != nil && msg.Status != tt.status {
+				t.Fatalf("status %q, want %q", msg.Status, tt.status)
+			}
+			if !tt.wantSaved {
+				if _, err := store.GetAllPendingChunks(s.ctx, messageID, 1); err == nil {
+					t.Fatal("chunks of a refused message were kept")
+				}
+			}
+		})
+	}
+}
+
+func TestBlockedSenderIsDropped(t *testing.T) {
+	tests := []struct {
+		name      string
+		blockedBy string
+		wantSaved bool
+	}{
+		{"recipient blocked sender", "recipient", false},
+		{"sender blocked recipient", "sender", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := newFakeMessageStore()
+			s, store, recipientID, recipient := newForwardingServer(t, messages)
+			ackForwards(s, recipient)
+
+			senderID := uuid.New()
+			blocker, blocked := recipientID, senderID
+			if tt.blockedBy == "sender" {
+				blocker, blocked = senderID, recipientID
+			}
+			s.blockStore = fakeBlockStore{blocked: map[uuid.UUID]map[uuid.UUID]bool{
+				blocker: {blocked: true},
+			}}
+
+			messageID := uuid.New()
+			if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, []byte("voice")); err != nil {
+				t.Fatal(err)
+			}
+
+			s.wg.Add(1)
+			s.processCompleteMessage(messageID, senderID, recipientID, 1)
+
+			if saved := messages.message(messageID) != nil; saved != tt.wantSaved {
+				t.Fatalf("message stored = %v, want %v", saved, tt.wantSaved)
+			}
+			if !tt.wantSaved {
+				if _, err := store.GetAllPendingChunks(s.ctx, messageID, 1); err == nil {
+					t.Fatal("chunks of a dropped message were kept")
+				}
+			}
+		})
+	}
+}
+
+func TestReplayedAuthIsRefused(t *testing.T) {
+	lb := startLoopback(t, Options{})
+	alice := lb.client(t, "alice")
+
+	auth, err := NewAuthPacket(alice.userID, alice.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.sendRaw(auth)
+	alice.expect(PacketTypeAuthAck)
+
+	// The same packet again, as captured off the wire
+	alice.sendRaw(auth)
+	if p := alice.expect(PacketTypeError); string(p.Payload) != "Replayed auth packet" {
+		t.Fatalf("error %q", p.Payload)
+	}
+}
+
+func TestAuthOutsideClockSkewIsRefused(t *testing.T) {
+	for _, offset := range []time.Duration{-2 * authClockSkew, 2 * authClockSkew} {
+		t.Run(fmt.Sprintf("offset=%v", offset), func(t *testing.T) {
+			lb := startLoopback(t, Options{})
+			alice := lb.client(t, "alice")
+
+			payload, err := json.Marshal(AuthPayload{
+				Token:     alice.token,
+				Nonce:     uuid.NewString(),
+				Timestamp: time.Now().Add(offset).Unix(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth := NewPacket(PacketTypeAuth, alice.userID, uuid.Nil, uuid.New())
+			auth.Payload = payload
+			alice.sendRaw(auth)
+
+			if p := alice.expect(PacketTypeError); string(p.Payload) != "Auth timestamp out of range" {
+				t.Fatalf("error %q", p.Payload)
+			}
+			if _, err := lb.sessions.GetSession(lb.ctx, alice.userID); err == nil {
+				t.Fatal("session created for a stale auth packet")
+			}
+		})
+	}
+}
+
+func TestReauthAfterSessionExpired(t *testing.T) {
+	sessions := session.NewMemoryStore(session.TTLOptions{Session: 100 * time.Millisecond})
+	lb := startLoopbackWithSessions(t, Options{}, sessions)
+	alice := lb.client(t, "alice")
+
+	alice.auth()
+	time.Sleep(200 * time.Millisecond)
+
+	alice.send(NewPacket(PacketTypeHeartbeat, alice.userID, uuid.Nil, uuid.New()))
+	if p := alice.expect(PacketTypeError); string(p.Payload) != ErrorSessionExpired {
+		t.Fatalf("error %q, want %q", p.Payload, ErrorSessionExpired)
+	}
+
+	alice.auth()
+	heartbeat := NewPacket(PacketTypeHeartbeat, alice.userID, uuid.Nil, uuid.New())
+	alice.send(heartbeat)
+	if p := alice.expect(PacketTypeAck); p.MessageID != heartbeat.MessageID {
+		t.Fatalf("ACK for %v, want the heartbeat %v", p.MessageID, heartbeat.MessageID)
+	}
+}
+
+// slowObjectStore takes delay to upload and gives up if its context ends first
+type slowObjectStore struct {
+	*s3storage.MemoryStore
+	delay time.Duration
+}
+
+func (s *slowObjectStore) UploadVoiceMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, data []byte, audioFormat string) (string, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	return s.MemoryStore.UploadVoiceMessage(ctx, messageID, senderID, recipientID, data, audioFormat)
+}
+
+func TestSendAfterShutdownIsSkipped(t *testing.T) {
+	var logs lockedBuffer
+	logger := log.NewWithOptions(&logs, log.Options{Level: log.DebugLevel, Formatter: log.JSONFormatter})
+	lb := startLoopbackWithLogger(t, Options{}, session.NewMemoryStore(session.TTLOptions{}), logger)
+	alice := lb.client(t, "alice")
+	alice.auth()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := lb.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// What draining messages still send once the socket is closed
+	lb.sendPacket(NewPacket(PacketTypeNewMessage, uuid.Nil, alice.userID, uuid.New()), alice.addr())
+	lb.sendErrorPacket(alice.addr(), uuid.New(), "Failed to store message")
+
+	for _, line := range logs.lines(t) {
+		if line["level"] == "error" {
+			t.Fatalf("error logged after shutdown: %v", line)
+		}
+	}
+	if !logs.contains("not sending packet") {
+		t.Fatal("skipped sends were not logged")
+	}
+}
+
+func TestShutdownDrainsCompleteMessage(t *testing.T) {
+	messages := newFakeMessageStore()
+	store := session.NewMemoryStore(session.TTLOptions{})
+	objects := &slowObjectStore{MemoryStore: s3storage.NewMemoryStore(), delay: 200 * time.Millisecond}
+	s := New("", Options{}, store, nil, nil, messages, nil, fakeBlockStore{}, objects, nil, nil, log.New(io.Discard))
+
+	messageID, senderID, recipientID := uuid.New(), uuid.New(), uuid.New()
+	if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, []byte("voice")); err != nil {
+		t.Fatal(err)
+	}
+
+	s.wg.Add(1)
+	go s.processCompleteMessage(messageID, senderID, recipientID, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := messages.message(messageID)
+	if msg == nil {
+		t.Fatal("message completed before shutdown was not stored")
+	}
+	if msg.Status != db.MessageStatusTransmitted {
+		t.Fatalf("status %q, want transmitted", msg.Status)
+	}
+	if data, err := objects.DownloadVoiceMessage(context.Background(), msg.FilePath); err != nil || string(data) != "voice" {
+		t.Fatalf("uploaded object %q, %v", data, err)
+	}
+}
+
+func TestAbandonedMessageIsCleanedUp(t *testing.T) {
+	lb := startLoopback(t, Options{})
+	alice := lb.client(t, "alice")
+	alice.auth()
+
+	messageID, recipientID := uuid.New(), uuid.New()
+	for i := uint32(0); i < 2; i++ {
+		alice.send(NewVoiceDataPacket(alice.userID, recipientID, messageID, i, 4, []byte("voice")))
+		alice.expect(PacketTypeAck)
+	}
+
+	// Nothing is idle yet
+	lb.sweepAbandonedBefore(time.Now().Add(-time.Minute))
+	if lb.messages.failedMessage(messageID) != nil {
+		t.Fatal("message failed while it was still being sent")
+	}
+
+	// An hour later the sender is long gone
+	lb.sweepAbandonedBefore(time.Now().Add(time.Hour))
+
+	failed := lb.messages.failedMessage(messageID)
+	if failed == nil || failed.Reason != "transfer timed out" {
+		t.Fatalf("dead-lettered %+v, want a timed out message", failed)
+	}
+	if p := alice.expect(PacketTypeError); p.MessageID != messageID {
+		t.Fatalf("sender notified about %v, want %v", p.MessageID, messageID)
+	}
+	if count, _ := lb.sessions.GetChunksReceivedCount(lb.ctx, messageID); count != 0 {
+		t.Fatalf("%d chunks left behind", count)
+	}
+	if stale, _ := lb.sessions.StalePendingMessages(lb.ctx, time.Now().Add(time.Hour)); len(stale) != 0 {
+		t.Fatalf("message still pending: %v", stale)
+	}
+}
+
+func TestTranscodeStoresBothVariants(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantFormat string
+	}{
+		{"transcoded", nil, audio.CanonicalFormat},
+		{"transcoder fails", errors.New("ffmpeg crashed"), audio.FormatWAV},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := newFakeMessageStore()
+			store := session.NewMemoryStore(session.TTLOptions{})
+			objects := s3storage.NewMemoryStore()
+			transcoder := &fakeTranscoder{err: tt.err}
+			s := New("", Options{}, store, nil, nil, messages, nil, fakeBlockStore{}, objects, transcoder, nil, log.New(io.Discard))
+			t.Cleanup(s.cancel)
+
+			original := wavFile(make([]int16, 200))
+			messageID := uuid.New()
+			if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, original); err != nil {
+				t.Fatal(err)
+			}
+
+			s.wg.Add(1)
+			s.processCompleteMessage(messageID, uuid.New(), uuid.New(), 1)
+
+			if len(transcoder.calls) != 1 || transcoder.calls[0] != audio.FormatWAV {
+				t.Fatalf("transcoder called with %v, want one wav", transcoder.calls)
+			}
+
+			msg := messages.message(messageID)
+			if msg == nil {
+				t.Fatal("message was not stored")
+			}
+			if msg.AudioFormat != tt.wantFormat {
+				t.Fatalf("stored as %s, want %s", msg.AudioFormat, tt.wantFormat)
+			}
+
+			stored, err := objects.DownloadVoiceMessage(s.ctx, msg.FilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.err != nil {
+				if msg.OriginalFilePath != nil || !bytes.Equal(stored, original) {
+					t.Fatal("failed transcode did not keep the original as the stored file")
+				}
+				return
+			}
+
+			if !bytes.Equal(stored, append([]byte("OggS"), original...)) {
+				t.Fatal("stored file is not the transcoded audio")
+			}
+			if msg.OriginalFilePath == nil {
+				t.Fatal("original upload is not recorded")
+			}
+			if kept, err := objects.DownloadVoiceMessage(s.ctx, *msg.OriginalFilePath); err != nil || !bytes.Equal(kept, original) {
+				t.Fatalf("original object: %v", err)
+			}
+		})
+	}
+}
+
+func TestRecordingIndicatorIsForwarded(t *testing.T) {
+	lb := startLoopback(t, Options{})
+	alice, bob := lb.client(t, "alice"), lb.client(t, "bob")
+	alice.auth()
+	bob.auth()
+
+	alice.send(NewRecordingIndicatorPacket(alice.userID, bob.userID, true))
+
+	p := bob.expect(PacketTypeRecordingIndicator)
+	if p.SenderID != alice.userID {
+		t.Fatalf("indicator from %v, want alice", p.SenderID)
+	}
+	if recording, err := ParseRecordingIndicator(p.Payload); err != nil || !recording {
+		t.Fatalf("recording = %v, %v", recording, err)
+	}
+}
+
+func TestRecordingIndicatorForOfflineRecipientIsDropped(t *testing.T) {
+	lb := startLoopback(t, Options{})
+	alice, carol := lb.client(t, "alice"), lb.client(t, "carol")
+	alice.auth()
+
+	// carol has no session, there is nowhere to send it
+	alice.send(NewRecordingIndicatorPacket(alice.userID, carol.userID, true))
+
+	carol.expectNothing(PacketTypeRecordingIndicator, 200*time.Millisecond)
+	alice.expectNothing(PacketTypeError, 100*time.Millisecond)
+}
+
+// brokenObjectStore refuses every upload
+type brokenObjectStore struct {
+	*s3storage.MemoryStore
+}
+
+func (s brokenObjectStore) UploadVoiceMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, data []byte, audioFormat string) (string, error) {
+	return "", errors.New("bucket is gone")
+}
+
+func TestProcessCompleteMessage(t *testing.T) {
+	messages := newFakeMessageStore()
+	store := session.NewMemoryStore(session.TTLOptions{})
+	objects := s3storage.NewMemoryStore()
+	s := New("", Options{}, store, nil, nil, messages, nil, fakeBlockStore{}, objects, nil, nil, log.New(io.Discard))
+	t.Cleanup(s.cancel)
+
+	original := wavFile(make([]int16, 300))
+	messageID, senderID, recipientID := uuid.New(), uuid.New(), uuid.New()
+
+	// Three chunks arriving out of order
+	const total = 3
+	size := (len(original) + total - 1) / total
+	for _, i := range []int{2, 0, 1} {
+		chunk := original[i*size : min((i+1)*size, len(original))]
+		if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, uint32(i), total, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.wg.Add(1)
+	s.processCompleteMessage(messageID, senderID, recipientID, total)
+
+	msg := messages.message(messageID)
+	if msg == nil {
+		t.Fatal("message was not stored")
+	}
+	if msg.SenderID != senderID || msg.RecipientID != recipientID || msg.TotalChunks != total {
+		t.Fatalf("stored %+v", msg)
+	}
+	if msg.Status != db.MessageStatusTransmitted || msg.AudioFormat != audio.FormatWAV || msg.FileSize != len(original) {
+		t.Fatalf("stored as %s %s of %d bytes", msg.Status, msg.AudioFormat, msg.FileSize)
+	}
+
+	stored, err := objects.DownloadVoiceMessage(s.ctx, msg.FilePath)
+	if err != nil || !bytes.Equal(stored, original) {
+		t.Fatalf("stored object differs from the assembled chunks: %v", err)
+	}
+	if _, err := objects.DownloadPeaks(s.ctx, messageID); err != nil {
+		t.Fatalf("no waveform peaks: %v", err)
+	}
+	if messages.failedMessage(messageID) != nil {
+		t.Fatal("stored message was dead-lettered")
+	}
+}
+
+func TestCompressedMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name           string
+		audio          []byte
+		wantCompressed bool
+		wantExt        string
+		wantType       string
+	}{
+		{"wav", wavFile(make([]int16, 4000)), true, ".wav.zst", "application/zstd"},
+		// Already compressed formats are stored as they are
+		{"opus", bytes.Repeat([]byte("voice"), 400), false, ".opus", "audio/opus"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := newFakeMessageStore()
+			store := session.NewMemoryStore(session.TTLOptions{})
+			objects := s3storage.NewMemoryStore()
+			s := New("", Options{CompressAudio: true}, store, nil, nil, messages, nil, fakeBlockStore{}, objects, nil, nil, log.New(io.Discard))
+			t.Cleanup(s.cancel)
+
+			messageID := uuid.New()
+			if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, tt.audio); err != nil {
+				t.Fatal(err)
+			}
+
+			s.wg.Add(1)
+			s.processCompleteMessage(messageID, uuid.New(), uuid.New(), 1)
+
+			msg := messages.message(messageID)
+			if msg == nil {
+				t.Fatal("message was not stored")
+			}
+			if msg.Compressed != tt.wantCompressed {
+				t.Fatalf("compressed %v, want %v", msg.Compressed, tt.wantCompressed)
+			}
+			if !strings.HasSuffix(msg.FilePath, messageID.String()+tt.wantExt) {
+				t.Fatalf("stored at %s, want a %s object", msg.FilePath, tt.wantExt)
+			}
+
+			info, err := objects.GetObjectInfo(s.ctx, msg.FilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ContentType != tt.wantType {
+				t.Fatalf("stored as %s, want %s", info.ContentType, tt.wantType)
+			}
+			if tt.wantCompressed && info.Size >= int64(len(tt.audio)) {
+				t.Fatalf("stored %d bytes of %d", info.Size, len(tt.audio))
+			}
+
+			// Downloads get the audio back as it was sent
+			data, err := s.loadMessageData(s.ctx, msg)
+			if err != nil || !bytes.Equal(data, tt.audio) {
+				t.Fatalf("downloaded audio differs from what was sent: %v", err)
+			}
+		})
+	}
+}
+
+func TestStrictAudioValidation(t *testing.T) {
+	garbage := bytes.Repeat([]byte("voice"), 400)
+
+	tests := []struct {
+		name       string
+		strict     bool
+		audio      []byte
+		wantStored bool
+	}{
+		{"valid audio is stored", true, wavFile(make([]int16, 400)), true},
+		{"garbage is failed when strict", true, garbage, false},
+		{"garbage is stored when lenient", false, garbage, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := startLoopback(t, Options{StrictAudio: tt.strict})
+			alice := lb.client(t, "alice")
+			alice.auth()
+
+			messageID := uuid.New()
+			if _, _, err := lb.sessions.SaveChunkAndCount(lb.ctx, messageID, 0, 1, tt.audio); err != nil {
+				t.Fatal(err)
+			}
+
+			lb.wg.Add(1)
+			lb.processCompleteMessage(messageID, alice.userID, uuid.New(), 1)
+
+			if !tt.wantStored {
+				if msg := lb.messages.message(messageID); msg != nil {
+					t.Fatalf("invalid audio was stored as %s", msg.FilePath)
+				}
+				if failed := lb.messages.failedMessage(messageID); failed == nil || failed.Reason != "invalid audio" {
+					t.Fatalf("failed record %+v, want reason invalid audio", failed)
+				}
+				if p := alice.expect(PacketTypeError); p.MessageID != messageID || !strings.Contains(string(p.Payload), "invalid audio") {
+					t.Fatalf("sender told %q about %s", p.Payload, p.MessageID)
+				}
+				return
+			}
+
+			if lb.messages.message(messageID) == nil {
+				t.Fatal("message was not stored")
+			}
+			if failed := lb.messages.failedMessage(messageID); failed != nil {
+				t.Fatalf("message was dead-lettered: %s", failed.Reason)
+			}
+			alice.expectNothing(PacketTypeError, 100*time.Millisecond)
+		})
+	}
+}
+
+func TestEmptyMessageIsRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		index   uint32
+		total   uint32
+		chunk   []byte
+		wantErr string
+	}{
+		{"zero chunks", 0, 0, []byte("voice"), "Message is empty"},
+		{"empty payload", 0, 1, nil, "Message is empty"},
+		{"chunk out of range", 1, 1, []byte("voice"), "Chunk index out of range"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := startLoopback(t, Options{})
+			alice := lb.client(t, "alice")
+			alice.auth()
+			messageID := uuid.New()
+
+			alice.send(NewVoiceDataPacket(alice.userID, uuid.New(), messageID, tt.index, tt.total, tt.chunk))
+			if p := alice.expect(PacketTypeError); p.MessageID != messageID || string(p.Payload) != tt.wantErr {
+				t.Fatalf("error %q for %s, want %q", p.Payload, p.MessageID, tt.wantErr)
+			}
+			alice.expectNothing(PacketTypeAck, 100*time.Millisecond)
+
+			if count, err := lb.sessions.GetChunksReceivedCount(lb.ctx, messageID); err != nil || count != 0 {
+				t.Fatalf("%d chunks saved, %v", count, err)
+			}
+			if msg := lb.messages.message(messageID); msg != nil {
+				t.Fatalf("empty message was stored at %s", msg.FilePath)
+			}
+		})
+	}
+}
+
+func TestOversizedMessageIsRejected(t *testing.T) {
+	lb := startLoopback(t, Options{MaxUploadSize: 4 * MaxPayloadSize})
+	alice := lb.client(t, "alice")
+	alice.auth()
+	messageID := uuid.New()
+
+	alice.send(NewVoiceDataPacket(alice.userID, uuid.New(), messageID, 0, math.MaxUint32, []byte("voice")))
+	if p := alice.expect(PacketTypeError); p.MessageID != messageID || string(p.Payload) != "Message is too large" {
+		t.Fatalf("error %q for %s", p.Payload, p.MessageID)
+	}
+	alice.expectNothing(PacketTypeAck, 100*time.Millisecond)
+
+	if count, err := lb.sessions.GetChunksReceivedCount(lb.ctx, messageID); err != nil || count != 0 {
+		t.Fatalf("%d chunks saved, %v", count, err)
+	}
+	stale, err := lb.sessions.StalePendingMessages(lb.ctx, time.Now().Add(time.Hour))
+	if err != nil || len(stale) != 0 {
+		t.Fatalf("pending messages %v, %v", stale, err)
+	}
+
+	// A message right at the limit still goes through
+	alice.send(NewVoiceDataPacket(alice.userID, uuid.New(), uuid.New(), 0, 4, []byte("voice")))
+	alice.expect(PacketTypeAck)
+}
+
+func TestInconsistentTotalChunksIsRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		total     uint32
+		wantError bool
+	}{
+		{"same total", 3, false},
+		{"larger total", 100, true},
+		{"smaller total", 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := startLoopback(t, Options{})
+			alice := lb.client(t, "alice")
+			alice.auth()
+			bob, messageID := uuid.New(), uuid.New()
+
+			alice.send(NewVoiceDataPacket(alice.userID, bob, messageID, 0, 3, []byte("voice")))
+			alice.expect(PacketTypeAck)
+
+			alice.send(NewVoiceDataPacket(alice.userID, bob, messageID, 1, tt.total, []byte("voice")))
+			if !tt.wantError {
+				if p := alice.expect(PacketTypeAck); p.ChunkIndex != 1 {
+					t.Fatalf("ACK for chunk %d, want 1", p.ChunkIndex)
+				}
+				return
+			}
+
+			if p := alice.expect(PacketTypeError); p.MessageID != messageID || string(p.Payload) != "Inconsistent total chunks" {
+				t.Fatalf("error %q for %s", p.Payload, p.MessageID)
+			}
+			alice.expectNothing(PacketTypeAck, 100*time.Millisecond)
+			if count, err := lb.sessions.GetChunksReceivedCount(lb.ctx, messageID); err != nil || count != 1 {
+				t.Fatalf("%d chunks counted after the rejected one, %v", count, err)
+			}
+		})
+	}
+}
+
+// recountingStore counts every chunk as new, as if deduplication missed a retransmit,
+// and counts how often processing reads the chunks back
+type recountingStore struct {
+	*session.MemoryStore
+
+	mu    sync.Mutex
+	reads int
+}
+
+func (r *recountingStore) SaveChunkAndCount(ctx context.Context, messageID uuid.UUID, chunkIndex, totalChunks uint32, data []byte) (int64, bool, error) {
+	count, _, err := r.MemoryStore.SaveChunkAndCount(ctx, messageID, chunkIndex, totalChunks, data)
+	return count, false, err
+}
+
+func (r *recountingStore) GetAllPendingChunks(ctx context.Context, messageID uuid.UUID, totalChunks uint32) ([][]byte, error) {
+	r.mu.Lock()
+	r.reads++
+	r.mu.Unlock()
+	return r.MemoryStore.GetAllPendingChunks(ctx, messageID, totalChunks)
+}
+
+func TestFinalChunkTwiceProcessesOnce(t *testing.T) {
+	store := &recountingStore{MemoryStore: session.NewMemoryStore(session.TTLOptions{})}
+	messages := newFakeMessageStore()
+	s := New("", Options{}, store, nil, nil, messages, nil, fakeBlockStore{}, s3storage.NewMemoryStore(), nil, nil, log.New(io.Discard))
+	t.Cleanup(s.cancel)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s.conn = conn
+
+	sender := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	senderID := uuid.New()
+	if err := store.CreateSession(s.ctx, senderID, "alice", sender); err != nil {
+		t.Fatal(err)
+	}
+
+	messageID := uuid.New()
+	chunk := func(index uint32) *Packet {
+		p := NewPacket(PacketTypeVoiceData, senderID, uuid.New(), messageID)
+		p.ChunkIndex, p.TotalChunks = index, 2
+		p.Payload = []byte("voice")
+		return p
+	}
+
+	s.handleVoiceData(chunk(0), sender)
+	final := chunk(1)
+	s.handleVoiceData(final, sender)
+	// The retransmit reaches the completion check again
+	s.handleVoiceData(final, sender)
+	s.wg.Wait()
+
+	if store.reads != 1 {
+		t.Fatalf("processing started %d times, want once", store.reads)
+	}
+	if messages.message(messageID) == nil {
+		t.Fatal("message was not stored")
+	}
+}
+
+// lossyObjectStore reports uploads as successful while losing or truncating what was written
+type lossyObjectStore struct {
+	*s3storage.MemoryStore
+
+	lose     bool
+	truncate bool
+}
+
+func (l *lossyObjectStore) UploadVoiceMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, data []byte, audioFormat string) (string, error) {
+	if l.truncate {
+		data = data[:len(data)/2]
+	}
+	objectPath, err := l.MemoryStore.UploadVoiceMessage(ctx, messageID, senderID, recipientID, data, audioFormat)
+	if err != nil {
+		return "", err
+	}
+	if l.lose {
+		l.MemoryStore.DeleteVoiceMessage(ctx, objectPath)
+	}
+	return objectPath, nil
+}
+
+func TestMissingUploadIsNotRecorded(t *testing.T) {
+	tests := []struct {
+		name       string
+		objects    *lossyObjectStore
+		wantStored bool
+	}{
+		{"stored", &lossyObjectStore{}, true},
+		{"lost", &lossyObjectStore{lose: true}, false},
+		{"truncated", &lossyObjectStore{truncate: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.objects.MemoryStore = s3storage.NewMemoryStore()
+			messages := newFakeMessageStore()
+			store := session.NewMemoryStore(session.TTLOptions{})
+			s := New("", Options{}, store, nil, nil, messages, nil, fakeBlockStore{}, tt.objects, nil, nil, log.New(io.Discard))
+			t.Cleanup(s.cancel)
+
+			messageID := uuid.New()
+			if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, []byte("voice")); err != nil {
+				t.Fatal(err)
+			}
+
+			s.wg.Add(1)
+			s.processCompleteMessage(messageID, uuid.New(), uuid.New(), 1)
+
+			msg, failed := messages.message(messageID), messages.failedMessage(messageID)
+			if tt.wantStored {
+				if msg == nil || failed != nil {
+					t.Fatalf("message %+v, failed %+v, want it stored", msg, failed)
+				}
+				return
+			}
+			if msg != nil {
+				t.Fatalf("recorded a message pointing at %s", msg.FilePath)
+			}
+			if failed == nil || failed.Reason != "stored audio is missing" {
+				t.Fatalf("failed record %+v, want reason stored audio is missing", failed)
+			}
+		})
+	}
+}
+
+// flakyChunkStore fails reading chunks until failures runs out, a negative count fails for good
+type flakyChunkStore struct {
+	*session.MemoryStore
+
+	mu       sync.Mutex
+	failures int
+	reads    int
+}
+
+func (f *flakyChunkStore) GetAllPendingChunks(ctx context.Context, messageID uuid.UUID, totalChunks uint32) ([][]byte, error) {
+	f.mu.Lock()
+	f.reads++
+	failing := f.failures != 0
+	if f.failures > 0 {
+		f.failures--
+	}
+	f.mu.Unlock()
+
+	if failing {
+		return nil, errors.New("chunks not there yet")
+	}
+	return f.MemoryStore.GetAllPendingChunks(ctx, messageID, totalChunks)
+}
+
+func TestProcessCompleteMessageRetriesChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		shutdown  bool
+		wantReads int
+		wantSaved bool
+	}{
+		{"ready", 0, false, 1, true},
+		{"ready on the last attempt", chunksPolicy.MaxAttempts - 1, false, chunksPolicy.MaxAttempts, true},
+		{"never ready", -1, false, chunksPolicy.MaxAttempts, false},
+		// Shutdown ends the waits, the message isn't held up by retries
+		{"shutting down", -1, true, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := newFakeMessageStore()
+			store := &flakyChunkStore{MemoryStore: session.NewMemoryStore(session.TTLOptions{}), failures: tt.failures}
+			s := New("", Options{}, store, nil, nil, messages, nil, fakeBlockStore{}, s3storage.NewMemoryStore(), nil, nil, log.New(io.Discard))
+			t.Cleanup(s.cancel)
+
+			messageID := uuid.New()
+			if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, []byte("voice")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.shutdown {
+				s.cancel()
+			}
+
+			s.wg.Add(1)
+			s.processCompleteMessage(messageID, uuid.New(), uuid.New(), 1)
+
+			if store.reads != tt.wantReads {
+				t.Fatalf("chunks read %d times, want %d", store.reads, tt.wantReads)
+			}
+			if saved := messages.message(messageID) != nil; saved != tt.wantSaved {
+				t.Fatalf("message stored = %v, want %v", saved, tt.wantSaved)
+			}
+			if !tt.wantSaved && messages.failedMessage(messageID) == nil {
+				t.Fatal("message without chunks was not dead-lettered")
+			}
+		})
+	}
+}
+
+func TestProcessCompleteMessageUploadFails(t *testing.T) {
+	messages := newFakeMessageStore()
+	store := session.NewMemoryStore(session.TTLOptions{})
+	s := New("", Options{}, store, nil, nil, messages, nil, fakeBlockStore{}, brokenObjectStore{s3storage.NewMemoryStore()}, nil, nil, log.New(io.Discard))
+	t.Cleanup(s.cancel)
+
+	messageID := uuid.New()
+	if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, wavFile(make([]int16, 100))); err != nil {
+		t.Fatal(err)
+	}
+
+	s.wg.Add(1)
+	s.processCompleteMessage(messageID, uuid.New(), uuid.New(), 1)
+
+	if messages.message(messageID) != nil {
+		t.Fatal("message recorded without its audio")
+	}
+	if failed := messages.failedMessage(messageID); failed == nil || failed.Reason != "failed to store audio" {
+		t.Fatalf("dead-lettered %+v, want a failed upload", failed)
+	}
+}
+
+func TestForwardRetransmitsUnackedChunks(t *testing.T) {
+	s, _, recipientID, recipient := newForwardingServer(t, newFakeMessageStore())
+
+	data := bytes.Repeat([]byte("v"), 5*MaxPayloadSize)
+	const total = 5
+
+	// Chunks 1 and 3 get lost the first time round
+	received := make(map[uint32]int)
+	var mu sync.Mutex
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, _, err := recipient.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			packet, err := Unmarshal(buf[:n])
+			if err != nil || packet.Type != PacketTypeVoiceData {
+				continue
+			}
+
+			mu.Lock()
+			received[packet.ChunkIndex]++
+			lost := received[packet.ChunkIndex] == 1 && packet.ChunkIndex%2 == 1
+			mu.Unlock()
+			if !lost {
+				s.handleForwardAck(NewAckPacket(packet))
+			}
+		}
+	}()
+
+	if !s.forwardIfOnline(uuid.New(), uuid.New(), recipientID, data, total) {
+		t.Fatal("forward failed although every chunk was ACKed in the end")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := uint32(0); i < total; i++ {
+		want := 1
+		if i == 1 || i == 3 {
+			want = 2
+		}
+		if received[i] != want {
+			t.Errorf("chunk %d sent %d times, want %d", i, received[i], want)
+		}
+	}
+}
+
+func TestRecipientGoneMidForwardKeepsMessageUndelivered(t *testing.T) {
+	messages := newFakeMessageStore()
+	s, store, recipientID, recipient := newForwardingServer(t, messages)
+	s.userStore = &fakeUserStore{}
+
+	messageID := uuid.New()
+	data := bytes.Repeat([]byte("v"), 5*MaxPayloadSize)
+	for i := uint32(0); i < 5; i++ {
+		if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, i, 5, data[i*MaxPayloadSize:(i+1)*MaxPayloadSize]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The recipient confirms two chunks, then goes quiet
+	quiet := make(chan struct{})
+	go func() {
+		defer close(quiet)
+		buf := make([]byte, MaxPacketSize)
+		for acked := 0; acked < 2; {
+			n, _, err := recipient.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if packet, err := Unmarshal(buf[:n]); err == nil && packet.Type == PacketTypeVoiceData {
+				s.handleForwardAck(NewAckPacket(packet))
+				acked++
+			}
+		}
+	}()
+
+	s.wg.Add(1)
+	s.processCompleteMessage(messageID, uuid.New(), recipientID, 5)
+	<-quiet
+
+	msg := messages.message(messageID)
+	if msg == nil {
+		t.Fatal("message was not stored")
+	}
+	// Left for the recipient to fetch, as if they had been offline
+	if msg.Status != db.MessageStatusTransmitted || msg.DeliveredAt != nil {
+		t.Fatalf("status %q after a partial forward, want transmitted", msg.Status)
+	}
+
+	buf := make([]byte, MaxPacketSize)
+	recipient.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := recipient.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("recipient was not told about the message: %v", err)
+		}
+		if packet, err := Unmarshal(buf[:n]); err == nil && packet.Type == PacketTypeNewMessage && packet.MessageID == messageID {
+			break
+		}
+	}
+}
+
+func TestStatusQuery(t *testing.T) {
+	lb := startLoopback(t, Options{})
+	alice, bob, carol := lb.client(t, "alice"), lb.client(t, "bob"), lb.client(t, "carol")
+	alice.auth()
+	bob.auth()
+
+	deliveredAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	msg := &db.VoiceMessage{
+		ID:          uuid.New(),
+		SenderID:    alice.userID,
+		RecipientID: bob.userID,
+		FilePath:    "voice/msg.opus",
+		Status:      db.MessageStatusDelivered,
+		DeliveredAt: &deliveredAt,
+	}
+	if err := lb.messages.CreateMessage(lb.ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.send(NewStatusQueryPacket(alice.userID, msg.ID))
+	status, err := ParseMessageStatus(alice.expect(PacketTypeStatusResponse).Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ID != msg.ID || status.Status != db.MessageStatusDelivered || status.DeliveredAt == nil || !status.DeliveredAt.Equal(deliveredAt) || status.ListenedAt != nil {
+		t.Fatalf("status %+v", status)
+	}
+
+	// Only the sender may ask, the recipient gets the same answer as for a missing message
+	bob.send(NewStatusQueryPacket(bob.userID, msg.ID))
+	if p := bob.expect(PacketTypeError); string(p.Payload) != "Message not found" {
+		t.Fatalf("recipient query answered %q", p.Payload)
+	}
+	bob.expectNothing(PacketTypeStatusResponse, 100*time.Millisecond)
+
+	alice.send(NewStatusQueryPacket(alice.userID, uuid.New()))
+	if p := alice.expect(PacketTypeError); string(p.Payload) != "Message not found" {
+		t.Fatalf("unknown message answered %q", p.Payload)
+	}
+
+	carol.send(NewStatusQueryPacket(carol.userID, msg.ID))
+	if p := carol.expect(PacketTypeError); string(p.Payload) != ErrorSessionExpired {
+		t.Fatalf("unauthenticated query answered %q", p.Payload)
+	}
+}
+
+func TestNotifyNewMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		online bool
+	}{
+		{name: "online recipient is told", online: true},
+		{name: "offline recipient is not", online: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := startLoopback(t, Options{})
+			alice, bob := lb.client(t, "alice"), lb.client(t, "bob")
+			if tt.online {
+				bob.auth()
+			}
+
+			msg := &db.VoiceMessage{
+				ID:          uuid.New(),
+				SenderID:    alice.userID,
+				RecipientID: bob.userID,
+				FilePath:    "voice/msg.opus",
+				FileSize:    1234,
+				AudioFormat: "opus",
+				Status:      db.MessageStatusTransmitted,
+			}
+			if err := lb.messages.CreateMessage(lb.ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+
+			lb.notifyNewMessage(lb.ctx, msg)
+
+			if !tt.online {
+				bob.expectNothing(PacketTypeNewMessage, 100*time.Millisecond)
+				return
+			}
+			p := bob.expect(PacketTypeNewMessage)
+			if p.MessageID != msg.ID || p.RecipientID != bob.userID {
+				t.Fatalf("notification for message %s to %s", p.MessageID, p.RecipientID)
+			}
+			info, err := ParseMessageInfo(p.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ID != msg.ID || info.SenderID != alice.userID || info.SenderName != "alice" || info.FileSize != 1234 || info.AudioFormat != "opus" {
+				t.Fatalf("notification info %+v", info)
+			}
+		})
+	}
+}
+
+func TestPacketLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		want    int
+		wantErr bool
+	}{
+		{"default", Options{}, MaxPacketSize, false},
+		{"jumbo", Options{MaxPacketSize: 9000}, 9000, false},
+		{"fits the read buffer", Options{MaxPacketSize: 9000, ReadBufferSize: 1 << 20}, 9000, false},
+		{"below a full secure packet", Options{MaxPacketSize: MaxPacketSize - 1}, 0, true},
+		{"above the largest datagram", Options{MaxPacketSize: maxDatagramSize + 1}, 0, true},
+		{"read buffer too small", Options{ReadBufferSize: MaxPacketSize - 1}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("127.0.0.1:0", tt.opts, session.NewMemoryStore(session.TTLOptions{}), nil, nil, newFakeMessageStore(), nil, fakeBlockStore{}, s3storage.NewMemoryStore(), nil, nil, log.New(io.Discard))
+			t.Cleanup(s.cancel)
+
+			limit, err := s.packetLimit()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("limit %d accepted", limit)
+				}
+				// Start refuses it before binding the socket
+				if err := s.Start(); err == nil {
+					t.Fatal("server started with an invalid packet size")
+				}
+				return
+			}
+			if err != nil || limit != tt.want {
+				t.Fatalf("limit %d, %v, want %d", limit, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOversizeDatagramIsDropped(t *testing.T) {
+	lb := startLoopback(t, Options{})
+
+	tests := []struct {
+		name    string
+		size    int
+		handled bool
+	}{
+		{"largest packet", MaxPacketSize, true},
+		{"one byte over", MaxPacketSize + 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := lb.client(t, "alice")
+			p, err := NewAuthPacket(c.userID, c.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Sequence = c.seq.Add(1)
+			data, err := p.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Bytes past the payload are ignored, only the datagram size differs
+			datagram := make([]byte, tt.size)
+			copy(datagram, data)
+			if _, err := c.conn.WriteToUDP(datagram, c.server); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.handled {
+				c.expect(PacketTypeAuthAck)
+				return
+			}
+			c.expectNothing(PacketTypeAuthAck, 200*time.Millisecond)
+			if _, err := lb.sessions.GetSession(lb.ctx, c.userID); err == nil {
+				t.Fatal("oversize datagram opened a session")
+			}
+		})
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	lb := startLoopback(t, Options{})
+	alice, bob, mallory := lb.client(t, "alice"), lb.client(t, "bob"), lb.client(t, "mallory")
+	alice.auth()
+	bob.auth()
+
+	path, err := lb.objects.UploadVoiceMessage(lb.ctx, uuid.New(), alice.userID, bob.userID, []byte("voice"), "opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &db.VoiceMessage{
+		ID:          uuid.New(),
+		SenderID:    alice.userID,
+		RecipientID: bob.userID,
+		FilePath:    path,
+		Status:      db.MessageStatusDelivered,
+	}
+	if err := lb.messages.CreateMessage(lb.ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := lb.objects.UploadPeaks(lb.ctx, msg.ID, []byte("[0.5]")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		client *testClient
+		userID uuid.UUID
+		want   string
+	}{
+		// Only the recipient may delete, not even the sender
+		{"sender", alice, alice.userID, "Unauthorized"},
+		// bob's user ID from another address, bob's session is elsewhere
+		{"forged sender ID", mallory, bob.userID, "Unauthorized"},
+		{"unauthenticated", mallory, mallory.userID, ErrorSessionExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.client.send(NewDeleteMessagePacket(tt.userID, msg.ID))
+			if p := tt.client.expect(PacketTypeError); string(p.Payload) != tt.want {
+				t.Fatalf("error %q, want %q", p.Payload, tt.want)
+			}
+			if lb.messages.message(msg.ID) == nil {
+				t.Fatal("message deleted")
+			}
+			if _, err := lb.objects.DownloadVoiceMessage(lb.ctx, path); err != nil {
+				t.Fatalf("message file deleted: %v", err)
+			}
+		})
+	}
+
+	bob.send(NewDeleteMessagePacket(bob.userID, msg.ID))
+	if p := bob.expect(PacketTypeAck); !p.IsDeleteAck() || p.MessageID != msg.ID {
+		t.Fatalf("ACK %q for %v, want a delete ACK", p.Payload, p.MessageID)
+	}
+	if lb.messages.message(msg.ID) != nil {
+		t.Fatal("message kept after the recipient deleted it")
+	}
+	if _, err := lb.objects.DownloadVoiceMessage(lb.ctx, path); err == nil {
+		t.Fatal("message file kept after the recipient deleted it")
+	}
+	if _, err := lb.objects.DownloadPeaks(lb.ctx, msg.ID); err == nil {
+		t.Fatal("message peaks kept after the recipient deleted it")
+	}
+}
+
+func TestMessageLogLinesShareTraceID(t *testing.T) {
+	var logs lockedBuffer
+	logger := log.NewWithOptions(&logs, log.Options{Level: log.DebugLevel, Formatter: log.JSONFormatter})
+	lb := startLoopbackWithLogger(t, Options{}, session.NewMemoryStore(session.TTLOptions{}), logger)
+
+	alice := lb.client(t, "alice")
+	alice.auth()
+
+	messageID := uuid.New()
+	for i := uint32(0); i < 3; i++ {
+		alice.send(NewVoiceDataPacket(alice.userID, uuid.New(), messageID, i, 3, []byte("voice")))
+		alice.expect(PacketTypeAck)
+	}
+
+	// Processing goes on in the background after the last ACK
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if logs.contains("Message processing complete") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message was never processed")
+		}
+	}
+
+	want := messageID.String()
+	seen := make(map[string]bool)
+	for _, line := range logs.lines(t) {
+		if line["trace_id"] == want {
+			seen[line["msg"].(string)] = true
+			continue
+		}
+		// Nothing about the message may be logged without its trace ID
+		if raw, _ := json.Marshal(line); bytes.Contains(raw, []byte(want)) {
+			t.Errorf("line about the message without its trace ID: %s", raw)
+		}
+	}
+
+	// From the first chunk to the end of processing
+	for _, msg := range []string{"Chunk received", "All chunks received", "File assembled", "Message record created", "✓ Message processing complete"} {
+		if !seen[msg] {
+			t.Errorf("%q was not logged with the message trace ID", msg)
+		}
+	}
+}
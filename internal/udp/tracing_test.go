@@ -0,0 +1,78 @@
+package udp
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/internal/session"
+	"github.com/rx3lixir/laba/internal/tracing"
+	"github.com/rx3lixir/laba/pkg/s3storage"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a global tracer provider recording every span. Tracers only
+// pick up the first provider set, so the recorder is shared by all tests in the package
+func recordSpans() *tracetest.SpanRecorder {
+	spansOnce.Do(func() {
+		spans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	})
+	return spans
+}
+
+// endedSpan returns the ended span called name that carries messageID, nil if there is none
+func endedSpan(recorder *tracetest.SpanRecorder, name string, messageID uuid.UUID) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() != name {
+			continue
+		}
+		for _, attr := range span.Attributes() {
+			if attr.Key == tracing.MessageIDKey && attr.Value.AsString() == messageID.String() {
+				return span
+			}
+		}
+	}
+	return nil
+}
+
+func TestProcessCompleteMessageIsTraced(t *testing.T) {
+	recorder := recordSpans()
+
+	messages := newFakeMessageStore()
+	store := session.NewMemoryStore(session.TTLOptions{})
+	objects := tracing.ObjectStore(s3storage.NewMemoryStore())
+	s := New("", Options{}, store, nil, nil, messages, nil, fakeBlockStore{}, objects, nil, nil, log.New(io.Discard))
+	t.Cleanup(s.cancel)
+
+	messageID := uuid.New()
+	if _, _, err := store.SaveChunkAndCount(s.ctx, messageID, 0, 1, []byte("voice")); err != nil {
+		t.Fatal(err)
+	}
+
+	s.wg.Add(1)
+	s.processCompleteMessage(messageID, uuid.New(), uuid.New(), 1)
+
+	process := endedSpan(recorder, "udp.processCompleteMessage", messageID)
+	if process == nil {
+		t.Fatal("no span for processCompleteMessage")
+	}
+
+	// The upload is traced as part of processing the message
+	upload := endedSpan(recorder, "s3.UploadVoiceMessage", messageID)
+	if upload == nil {
+		t.Fatal("no span for the upload")
+	}
+	if upload.Parent().SpanID() != process.SpanContext().SpanID() {
+		t.Fatal("upload span is not a child of the processing span")
+	}
+}
@@ -0,0 +1,37 @@
+package audio
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Compressible reports whether audio of format is worth compressing for storage.
+// Opus, Ogg and MP3 are already compressed, only raw PCM like WAV shrinks
+func Compressible(format string) bool {
+	return format == FormatWAV
+}
+
+// CompressedFormat is the format compressed audio of format is stored as, e.g. wav.zst
+func CompressedFormat(format string) string {
+	return format + ".zst"
+}
+
+// Compress compresses data with zstd
+func Compress(data []byte) []byte {
+	return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+}
+
+// Decompress reverses Compress
+func Decompress(data []byte) ([]byte, error) {
+	out, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress audio: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,41 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Supported audio formats
+const (
+	FormatOpus = "opus"
+	FormatOgg  = "ogg"
+	FormatMP3  = "mp3"
+	FormatWAV  = "wav"
+)
+
+// ErrUnknownFormat is returned when data doesn't look like any supported format
+var ErrUnknownFormat = errors.New("unknown audio format")
+
+// DetectFormat sniffs the audio format from the leading bytes of data
+func DetectFormat(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("OggS")):
+		// Opus streams announce themselves in the first Ogg page
+		if bytes.Contains(data[:min(len(data), 128)], []byte("OpusHead")) {
+			return FormatOpus, nil
+		}
+		return FormatOgg, nil
+
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WAVE")):
+		return FormatWAV, nil
+
+	case bytes.HasPrefix(data, []byte("ID3")):
+		return FormatMP3, nil
+
+	case len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0:
+		// Raw MPEG audio frame sync
+		return FormatMP3, nil
+	}
+
+	return "", ErrUnknownFormat
+}
@@ -0,0 +1,142 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrPeaksUnsupported is returned for formats that would need a codec to decode.
+// Only uncompressed WAV can be analysed without one
+var ErrPeaksUnsupported = errors.New("peaks are not supported for this format")
+
+// WAV sample encodings
+const (
+	wavFormatPCM   = 1
+	wavFormatFloat = 3
+)
+
+// Peaks splits the audio into buckets and returns the loudest sample of each,
+// normalized to [0, 1]. Multi-channel audio is folded into one track
+func Peaks(data []byte, format string, buckets int) ([]float32, error) {
+	if buckets <= 0 {
+		return nil, fmt.Errorf("buckets must be positive")
+	}
+	if format != FormatWAV {
+		return nil, fmt.Errorf("%w: %s", ErrPeaksUnsupported, format)
+	}
+
+	wav, err := parseWAV(data)
+	if err != nil {
+		return nil, err
+	}
+
+	frameSize := wav.channels * wav.bytesPerSample
+	frames := len(wav.samples) / frameSize
+	peaks := make([]float32, buckets)
+	if frames == 0 {
+		return peaks, nil
+	}
+
+	for frame := 0; frame < frames; frame++ {
+		bucket := frame * buckets / frames
+
+		for ch := 0; ch < wav.channels; ch++ {
+			offset := frame*frameSize + ch*wav.bytesPerSample
+			amplitude := float32(math.Abs(wav.sample(offset)))
+
+			if amplitude > peaks[bucket] {
+				peaks[bucket] = amplitude
+			}
+		}
+	}
+
+	return peaks, nil
+}
+
+// wavData is the part of a WAV file needed to read samples
+type wavData struct {
+	encoding       uint16
+	channels       int
+	bytesPerSample int
+	samples        []byte
+}
+
+// parseWAV walks the RIFF chunks for the format description and the sample data
+func parseWAV(data []byte) (*wavData, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("invalid WAV header")
+	}
+
+	wav := &wavData{}
+	haveFormat := false
+
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := data[pos+8 : min(len(data), pos+8+size)]
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, fmt.Errorf("invalid WAV fmt chunk")
+			}
+			wav.encoding = binary.LittleEndian.Uint16(body[0:2])
+			wav.channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			wav.bytesPerSample = int(binary.LittleEndian.Uint16(body[14:16])) / 8
+			haveFormat = true
+
+		case "data":
+			if !haveFormat {
+				return nil, fmt.Errorf("WAV data chunk before fmt chunk")
+			}
+			wav.samples = body
+			return wav, wav.validate()
+		}
+
+		// Chunks are padded to an even size
+		pos += 8 + size + size%2
+	}
+
+	return nil, fmt.Errorf("WAV data chunk not found")
+}
+
+func (w *wavData) validate() error {
+	if w.channels <= 0 {
+		return fmt.Errorf("invalid WAV channel count: %d", w.channels)
+	}
+
+	switch {
+	case w.encoding == wavFormatPCM && w.bytesPerSample >= 1 && w.bytesPerSample <= 4:
+	case w.encoding == wavFormatFloat && w.bytesPerSample == 4:
+	default:
+		return fmt.Errorf("%w: WAV encoding %d with %d bytes per sample",
+			ErrPeaksUnsupported, w.encoding, w.bytesPerSample)
+	}
+
+	return nil
+}
+
+// sample reads one sample at offset, scaled to [-1, 1]
+func (w *wavData) sample(offset int) float64 {
+	b := w.samples[offset : offset+w.bytesPerSample]
+
+	if w.encoding == wavFormatFloat {
+		v := float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		return math.Max(-1, math.Min(1, v))
+	}
+
+	switch w.bytesPerSample {
+	case 1:
+		// 8-bit WAV is unsigned
+		return (float64(b[0]) - 128) / 128
+	case 2:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+	case 3:
+		v := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+		return float64(v) / (1 << 23)
+	default:
+		return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+	}
+}
@@ -0,0 +1,64 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// wavFile returns a 16-bit mono PCM WAV holding samples
+func wavFile(samples []int16) []byte {
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, samples)
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+data.Len()))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(wavFormatPCM))
+	binary.Write(&buf, binary.LittleEndian, uint16(1))     // mono
+	binary.Write(&buf, binary.LittleEndian, uint32(8000))  // sample rate
+	binary.Write(&buf, binary.LittleEndian, uint32(16000)) // byte rate
+	binary.Write(&buf, binary.LittleEndian, uint16(2))     // block align
+	binary.Write(&buf, binary.LittleEndian, uint16(16))    // bits per sample
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(data.Len()))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+func TestPeaks(t *testing.T) {
+	// Four stretches of 100 samples, each quiet but for one known peak.
+	// The third has none, its loudest sample is the background
+	amplitudes := []int16{16384, -32768, 0, 8192}
+	want := []float32{0.5, 1, 100.0 / (1 << 15), 0.25}
+
+	samples := make([]int16, 0, 400)
+	for _, peak := range amplitudes {
+		stretch := make([]int16, 100)
+		stretch[10] = 100
+		stretch[50] = peak
+		samples = append(samples, stretch...)
+	}
+
+	peaks, err := Peaks(wavFile(samples), FormatWAV, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peaks) != len(want) {
+		t.Fatalf("got %d peaks, want %d", len(peaks), len(want))
+	}
+	for i := range want {
+		if peaks[i] != want[i] {
+			t.Errorf("peak %d = %v, want %v", i, peaks[i], want[i])
+		}
+	}
+}
+
+func TestPeaksUnsupportedFormat(t *testing.T) {
+	if _, err := Peaks([]byte("OggS"), FormatOpus, 4); !errors.Is(err, ErrPeaksUnsupported) {
+		t.Fatalf("error %v, want ErrPeaksUnsupported", err)
+	}
+}
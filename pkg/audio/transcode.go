@@ -0,0 +1,78 @@
+package audio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// CanonicalFormat is what transcoded messages are stored as: Opus in an Ogg container
+const CanonicalFormat = FormatOpus
+
+// ErrFFmpegNotFound is returned when no ffmpeg binary can be found
+var ErrFFmpegNotFound = errors.New("ffmpeg not found")
+
+// Transcoder converts audio of the given format to CanonicalFormat
+type Transcoder interface {
+	Transcode(ctx context.Context, data []byte, format string) ([]byte, error)
+}
+
+// FFmpeg transcodes by piping audio through an ffmpeg process
+type FFmpeg struct {
+	path    string
+	bitrate string
+}
+
+// NewFFmpeg looks up the ffmpeg binary. An empty path searches $PATH
+func NewFFmpeg(path string) (*FFmpeg, error) {
+	if path == "" {
+		path = "ffmpeg"
+	}
+
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFFmpegNotFound, err)
+	}
+
+	return &FFmpeg{path: resolved, bitrate: "32k"}, nil
+}
+
+// Transcode converts data to Opus in Ogg. Speech doesn't need more than 32 kbit/s
+func (f *FFmpeg) Transcode(ctx context.Context, data []byte, format string) ([]byte, error) {
+	args := []string{"-hide_banner", "-loglevel", "error"}
+
+	// Naming the demuxer saves ffmpeg from probing a pipe, unknown formats still get probed
+	switch format {
+	case FormatOpus, FormatOgg:
+		args = append(args, "-f", "ogg")
+	case FormatMP3:
+		args = append(args, "-f", "mp3")
+	case FormatWAV:
+		args = append(args, "-f", "wav")
+	}
+
+	args = append(args,
+		"-i", "pipe:0",
+		"-vn",
+		"-c:a", "libopus",
+		"-b:a", f.bitrate,
+		"-f", "ogg",
+		"pipe:1",
+	)
+
+	cmd := exec.CommandContext(ctx, f.path, args...)
+	cmd.Stdin = bytes.NewReader(data)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,160 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidAudio is returned when data doesn't hold together as the format it claims
+var ErrInvalidAudio = errors.New("invalid audio")
+
+// Validate checks that data is structurally sound for format. It walks the
+// container, Ogg pages, RIFF chunks or MP3 frame headers, without decoding audio
+func Validate(data []byte, format string) error {
+	var err error
+
+	switch format {
+	case FormatOpus:
+		err = validateOgg(data, true)
+	case FormatOgg:
+		err = validateOgg(data, false)
+	case FormatWAV:
+		err = validateWAV(data)
+	case FormatMP3:
+		err = validateMP3(data)
+	default:
+		return fmt.Errorf("%w: unsupported format %q", ErrInvalidAudio, format)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidAudio, format, err)
+	}
+	return nil
+}
+
+// oggPageHeaderSize is the fixed part of an Ogg page header, before the segment table
+const oggPageHeaderSize = 27
+
+// validateOgg checks that data is a whole number of well formed Ogg pages.
+// An Opus stream has to open with an OpusHead packet
+func validateOgg(data []byte, opus bool) error {
+	pages := 0
+
+	for offset := 0; offset < len(data); pages++ {
+		page := data[offset:]
+		if len(page) < oggPageHeaderSize {
+			return fmt.Errorf("truncated page header at byte %d", offset)
+		}
+		if !bytes.HasPrefix(page, []byte("OggS")) {
+			return fmt.Errorf("missing page capture pattern at byte %d", offset)
+		}
+		if page[4] != 0 {
+			return fmt.Errorf("unsupported ogg version %d", page[4])
+		}
+
+		segments := int(page[26])
+		if len(page) < oggPageHeaderSize+segments {
+			return fmt.Errorf("truncated segment table at byte %d", offset)
+		}
+
+		bodySize := 0
+		for _, lacing := range page[oggPageHeaderSize : oggPageHeaderSize+segments] {
+			bodySize += int(lacing)
+		}
+
+		pageSize := oggPageHeaderSize + segments + bodySize
+		if len(page) < pageSize {
+			return fmt.Errorf("truncated page body at byte %d", offset)
+		}
+
+		if pages == 0 && opus && !bytes.HasPrefix(page[oggPageHeaderSize+segments:pageSize], []byte("OpusHead")) {
+			return fmt.Errorf("first page carries no OpusHead")
+		}
+
+		offset += pageSize
+	}
+
+	if pages == 0 {
+		return fmt.Errorf("no pages")
+	}
+	return nil
+}
+
+// validateWAV checks the RIFF chunk layout and that fmt and data chunks are present
+func validateWAV(data []byte) error {
+	if len(data) < 12 || !bytes.HasPrefix(data, []byte("RIFF")) || !bytes.Equal(data[8:12], []byte("WAVE")) {
+		return fmt.Errorf("missing RIFF/WAVE header")
+	}
+
+	var hasFormat, hasData bool
+
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+
+		body := offset + 8
+		if size > len(data)-body {
+			// Streaming writers may leave the data size unset, it runs to the end then
+			if id != "data" {
+				return fmt.Errorf("chunk %q overruns the file", id)
+			}
+			size = len(data) - body
+		}
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return fmt.Errorf("fmt chunk too small: %d bytes", size)
+			}
+			hasFormat = true
+		case "data":
+			hasData = true
+		}
+
+		// Chunks are padded to an even size
+		offset = body + size + size%2
+	}
+
+	if !hasFormat {
+		return fmt.Errorf("no fmt chunk")
+	}
+	if !hasData {
+		return fmt.Errorf("no data chunk")
+	}
+	return nil
+}
+
+// validateMP3 skips an ID3v2 tag and checks that a valid MPEG frame header follows
+func validateMP3(data []byte) error {
+	offset := 0
+
+	if bytes.HasPrefix(data, []byte("ID3")) {
+		if len(data) < 10 {
+			return fmt.Errorf("truncated ID3 tag")
+		}
+		// The tag size is syncsafe, seven bits per byte
+		size := int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9])
+		offset = 10 + size
+	}
+
+	if offset+4 > len(data) {
+		return fmt.Errorf("no audio frame after the tag")
+	}
+
+	header := data[offset : offset+4]
+	switch {
+	case header[0] != 0xFF || header[1]&0xE0 != 0xE0:
+		return fmt.Errorf("missing frame sync at byte %d", offset)
+	case header[1]>>3&0x03 == 0x01:
+		return fmt.Errorf("reserved MPEG version")
+	case header[1]>>1&0x03 == 0x00:
+		return fmt.Errorf("reserved layer")
+	case header[2]>>4 == 0x0F:
+		return fmt.Errorf("invalid bitrate index")
+	case header[2]>>2&0x03 == 0x03:
+		return fmt.Errorf("reserved sample rate")
+	}
+	return nil
+}
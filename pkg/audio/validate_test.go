@@ -0,0 +1,74 @@
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// oggPage returns a single Ogg page carrying body, which must fit in one segment
+func oggPage(body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("OggS")
+	buf.WriteByte(0)            // version
+	buf.WriteByte(0)            // header type
+	buf.Write(make([]byte, 20)) // granule position, serial, sequence, checksum
+	buf.WriteByte(1)            // one segment
+	buf.WriteByte(byte(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// mp3Frame is an MPEG-1 layer III frame header, 128 kbps at 44.1 kHz
+var mp3Frame = []byte{0xFF, 0xFB, 0x90, 0x00}
+
+func TestValidate(t *testing.T) {
+	opus := append(oggPage([]byte("OpusHead\x01\x01")), oggPage([]byte("OpusTags"))...)
+	wav := wavFile(make([]int16, 100))
+
+	// A streaming writer leaves the data size at its maximum
+	streamed := bytes.Clone(wav)
+	copy(streamed[40:44], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+
+	tests := []struct {
+		name    string
+		data    []byte
+		format  string
+		wantErr bool
+	}{
+		{"opus", opus, FormatOpus, false},
+		{"ogg", oggPage([]byte("vorbis")), FormatOgg, false},
+		{"wav", wav, FormatWAV, false},
+		{"streamed wav", streamed, FormatWAV, false},
+		{"mp3", append(bytes.Clone(mp3Frame), make([]byte, 100)...), FormatMP3, false},
+		{"mp3 behind an id3 tag", append([]byte("ID3\x04\x00\x00\x00\x00\x00\x02xx"), mp3Frame...), FormatMP3, false},
+
+		{"garbage as opus", bytes.Repeat([]byte("voice"), 40), FormatOpus, true},
+		{"empty", nil, FormatOpus, true},
+		{"opus without OpusHead", oggPage([]byte("vorbis")), FormatOpus, true},
+		{"truncated ogg page", opus[:len(opus)-3], FormatOpus, true},
+		{"trailing bytes after the last page", append(bytes.Clone(opus), "junk"...), FormatOpus, true},
+		{"wav without data", wav[:36], FormatWAV, true},
+		{"wav fmt chunk overruns", wav[:30], FormatWAV, true},
+		{"wav header only", []byte("RIFF\x00\x00\x00\x00WAVE"), FormatWAV, true},
+		{"mp3 without frame sync", []byte("ID3\x04\x00\x00\x00\x00\x00\x00abcd"), FormatMP3, true},
+		{"mp3 tag without audio", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), FormatMP3, true},
+		{"mp3 bad bitrate", []byte{0xFF, 0xFB, 0xF0, 0x00}, FormatMP3, true},
+		{"unsupported format", wav, "flac", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.data, tt.format)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidAudio) {
+					t.Fatalf("error %v, want ErrInvalidAudio", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -12,9 +12,17 @@ type Claims struct {
 	UserID   uuid.UUID `json:"user_id"`
 	Email    string    `json:"email"`
 	Username string    `json:"username"`
+	// Role decides which restricted routes the user may use
+	Role string `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// RefreshClaims holds the validated contents of a refresh token
+type RefreshClaims struct {
+	UserID   uuid.UUID
+	IssuedAt time.Time
+}
+
 type Service struct {
 	secretKey []byte
 	// Token validity duration
@@ -31,12 +39,18 @@ func NewService(secretKey string, accessDuration, refreshDuration time.Duration)
 	}
 }
 
+// RefreshTokenDuration returns how long refresh tokens stay valid
+func (s *Service) RefreshTokenDuration() time.Duration {
+	return s.refreshTokenDuration
+}
+
 // GenerateAccessToken creates a short-lived access token
-func (s *Service) GenerateAccessToken(userID uuid.UUID, email, username string) (string, error) {
+func (s *Service) GenerateAccessToken(userID uuid.UUID, email, username, role string) (string, error) {
 	claims := Claims{
 		UserID:   userID,
 		Email:    email,
 		Username: username,
+		Role:     role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.accessTokenDuration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -93,8 +107,8 @@ func (s *Service) ValidateToken(tokenStirng string) (*Claims, error) {
 	return claims, nil
 }
 
-// ValidateRefreshToken validates token and returns the user ID
-func (s *Service) ValidateRefreshToken(tokenString string) (uuid.UUID, error) {
+// ValidateRefreshToken validates token and returns its claims
+func (s *Service) ValidateRefreshToken(tokenString string) (*RefreshClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(t *jwt.Token) (any, error) {
 		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
@@ -102,22 +116,27 @@ func (s *Service) ValidateRefreshToken(tokenString string) (uuid.UUID, error) {
 		return s.secretKey, nil
 	})
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("failed to parse refresh token: %w", err)
+		return nil, fmt.Errorf("failed to parse refresh token: %w", err)
 	}
 
 	claims, ok := token.Claims.(*jwt.RegisteredClaims)
 	if !ok || !token.Valid {
-		return uuid.Nil, fmt.Errorf("invalid refresh token")
+		return nil, fmt.Errorf("invalid refresh token")
 	}
 
 	if claims.Subject == "" {
-		return uuid.Nil, fmt.Errorf("invalid refresh token: missing subject")
+		return nil, fmt.Errorf("invalid refresh token: missing subject")
 	}
 
 	userID, err := uuid.Parse(claims.Subject)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID in token: %w", err)
+		return nil, fmt.Errorf("invalid user ID in token: %w", err)
+	}
+
+	refreshClaims := &RefreshClaims{UserID: userID}
+	if claims.IssuedAt != nil {
+		refreshClaims.IssuedAt = claims.IssuedAt.Time
 	}
 
-	return userID, nil
+	return refreshClaims, nil
 }
@@ -0,0 +1,22 @@
+package mailer
+
+import (
+	"context"
+
+	"github.com/charmbracelet/log"
+)
+
+// LogMailer logs emails instead of sending them, for development
+type LogMailer struct {
+	log *log.Logger
+}
+
+func NewLogMailer(logger *log.Logger) *LogMailer {
+	return &LogMailer{log: logger}
+}
+
+// Send logs the email and never fails
+func (m *LogMailer) Send(ctx context.Context, to, subject, body string) error {
+	m.log.Info("Email not sent, mail backend is log", "to", to, "subject", subject, "body", body)
+	return nil
+}
@@ -0,0 +1,17 @@
+package mailer
+
+import (
+	"context"
+)
+
+// Mailer delivers plain text emails.
+// SMTPMailer sends them through an SMTP server, LogMailer only logs them
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// Mail backends selectable in config
+const (
+	BackendLog  = "log"
+	BackendSMTP = "smtp"
+)
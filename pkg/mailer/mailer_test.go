@@ -0,0 +1,147 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// received is what a fake SMTP server was handed
+type received struct {
+	from, to string
+	data     string
+}
+
+// fakeSMTP accepts a single session on a loopback port and reports what it received.
+// It offers no extensions, so the client sends in plain text without auth
+func fakeSMTP(t *testing.T) (host string, port int, got <-chan received) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	out := make(chan received, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		var msg received
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimRight(line, "\r\n")
+
+			switch strings.ToUpper(strings.Fields(cmd + " ")[0]) {
+			case "EHLO", "HELO", "NOOP", "RSET":
+				reply("250 fake")
+			case "MAIL":
+				msg.from = strings.TrimSuffix(strings.TrimPrefix(cmd, "MAIL FROM:<"), ">")
+				reply("250 ok")
+			case "RCPT":
+				msg.to = strings.TrimSuffix(strings.TrimPrefix(cmd, "RCPT TO:<"), ">")
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				msg.data = data.String()
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				out <- msg
+				return
+			default:
+				reply("502 unknown command")
+			}
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, out
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	host, port, got := fakeSMTP(t)
+	m := NewSMTPMailer(host, port, "", "", "laba@example.com")
+
+	if err := m.Send(context.Background(), "alice@example.com", "Verify your email", "Hi alice,\nopen the link"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-got
+	if msg.from != "laba@example.com" || msg.to != "alice@example.com" {
+		t.Fatalf("sent from %q to %q", msg.from, msg.to)
+	}
+	for _, want := range []string{
+		"From: laba@example.com\r\n",
+		"To: alice@example.com\r\n",
+		"Subject: Verify your email\r\n",
+		"Content-Type: text/plain; charset=UTF-8\r\n",
+		"\r\n\r\nHi alice,\r\nopen the link",
+	} {
+		if !strings.Contains(msg.data, want) {
+			t.Errorf("message is missing %q:\n%s", want, msg.data)
+		}
+	}
+}
+
+func TestSMTPMailerRefusesHeaderInjection(t *testing.T) {
+	tests := []struct {
+		name, to, subject string
+	}{
+		{"recipient", "alice@example.com\r\nBcc: eve@example.com", "Hello"},
+		{"subject", "alice@example.com", "Hello\nBcc: eve@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Refused before dialing, nothing listens here
+			m := NewSMTPMailer("127.0.0.1", 1, "", "", "laba@example.com")
+			if err := m.Send(context.Background(), tt.to, tt.subject, "body"); err == nil || !strings.Contains(err.Error(), "invalid email header") {
+				t.Fatalf("error %v, want invalid email header", err)
+			}
+		})
+	}
+}
+
+func TestLogMailerSend(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewLogMailer(log.New(&buf))
+
+	if err := m.Send(context.Background(), "alice@example.com", "Verify your email", "open the link"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"to=alice@example.com", `subject="Verify your email"`, `body="open the link"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log %q is missing %q", buf.String(), want)
+		}
+	}
+}
@@ -1,16 +1,66 @@
 package password
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"errors"
+	"fmt"
 
-func Hash(pass string) (string, error) {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrMismatch is returned for any password that doesn't match its hash,
+// so callers can't tell a wrong password from a broken hash
+var ErrMismatch = errors.New("password does not match")
+
+// Hasher hashes passwords with a configurable bcrypt cost.
+// The cost is stored in every hash, so hashes made with an older cost still verify
+type Hasher struct {
+	cost  int
+	dummy []byte
+}
+
+// NewHasher creates a hasher using the given bcrypt cost
+func NewHasher(cost int) (*Hasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy password"), cost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dummy hash: %w", err)
+	}
+
+	return &Hasher{cost: cost, dummy: dummy}, nil
+}
+
+// Hash hashes a password with the hasher cost
+func (h *Hasher) Hash(pass string) (string, error) {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(pass), h.cost)
 	if err != nil {
 		return "", err
 	}
 	return string(hashedBytes), nil
 }
 
-func Verify(pass, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
-	return err == nil
+// NeedsRehash reports whether a hash was made with a weaker cost than
+// the current one and should be replaced on the next successful login
+func (h *Hasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost < h.cost
+}
+
+// CompareDummy takes as long as checking a real password. It is meant for logins
+// with an unknown user, so response times don't reveal which users exist
+func (h *Hasher) CompareDummy(pass string) {
+	bcrypt.CompareHashAndPassword(h.dummy, []byte(pass))
+}
+
+// Verify checks a plaintext password against its hash in constant time.
+// Any failure, a malformed hash included, is reported as ErrMismatch
+func Verify(hash, plaintext string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintext)); err != nil {
+		return ErrMismatch
+	}
+	return nil
 }
@@ -0,0 +1,113 @@
+package password
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerify(t *testing.T) {
+	hasher, err := NewHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(hash, "correct horse"); err != nil {
+		t.Fatalf("matching password refused: %v", err)
+	}
+	if err := Verify(hash, "wrong horse"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("got %v for a wrong password, want ErrMismatch", err)
+	}
+	// A broken hash looks the same as a wrong password
+	if err := Verify("not a hash", "correct horse"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("got %v for a malformed hash, want ErrMismatch", err)
+	}
+}
+
+func TestHasherCost(t *testing.T) {
+	hasher, err := NewHasher(bcrypt.MinCost + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := hasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, _ := bcrypt.Cost([]byte(hash)); cost != bcrypt.MinCost+1 {
+		t.Fatalf("hashed with cost %d, want %d", cost, bcrypt.MinCost+1)
+	}
+
+	if _, err := NewHasher(bcrypt.MaxCost + 1); err == nil {
+		t.Fatal("cost above the bcrypt maximum accepted")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	weak, err := NewHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strong, err := NewHasher(bcrypt.MinCost + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := weak.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if weak.NeedsRehash(hash) {
+		t.Fatal("hash with the current cost needs a rehash")
+	}
+	if !strong.NeedsRehash(hash) {
+		t.Fatal("hash with an older cost doesn't need a rehash")
+	}
+	// Still verifies with the cost stored in the hash
+	if err := Verify(hash, "password"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAcrossCostChanges(t *testing.T) {
+	costs := []int{bcrypt.MinCost, bcrypt.MinCost + 1, bcrypt.MinCost + 2}
+
+	hashes := make(map[int]string)
+	for _, cost := range costs {
+		hasher, err := NewHasher(cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashes[cost], err = hasher.Hash("password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every hash keeps verifying whatever cost the deployment moved to
+	for cost, hash := range hashes {
+		if err := Verify(hash, "password"); err != nil {
+			t.Errorf("hash with cost %d: %v", cost, err)
+		}
+		if err := Verify(hash, "Password"); !errors.Is(err, ErrMismatch) {
+			t.Errorf("hash with cost %d accepted a wrong password", cost)
+		}
+	}
+
+	// Lowering the cost never asks for a downgrade
+	weakest, err := NewHasher(bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cost, hash := range hashes {
+		if weakest.NeedsRehash(hash) {
+			t.Errorf("hash with cost %d needs a rehash at cost %d", cost, bcrypt.MinCost)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package retry
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy describes how an operation is retried
+type Policy struct {
+	// MaxAttempts caps how often fn runs, including the first try. Less than one means once
+	MaxAttempts int
+
+	// BaseDelay is the wait after the first failure, it doubles with every further one
+	BaseDelay time.Duration
+
+	// MaxDelay caps the wait between attempts, zero leaves it uncapped
+	MaxDelay time.Duration
+
+	// Retryable decides whether an error is worth another attempt, nil retries every error
+	Retryable func(error) bool
+}
+
+// Do runs fn until it succeeds, returns an error the policy won't retry or runs
+// out of attempts. The last error of fn is returned. Waits are jittered and cut
+// short by ctx, in which case the context error is returned
+func Do(ctx context.Context, policy Policy, fn func() error) error {
+	attempts := max(policy.MaxAttempts, 1)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		if attempt >= attempts || (policy.Retryable != nil && !policy.Retryable(err)) {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// delay is the jittered wait after the given failed attempt,
+// somewhere between half and all of the exponential backoff
+func (p Policy) delay(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+
+	backoff := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if p.MaxDelay > 0 && backoff >= p.MaxDelay {
+			backoff = p.MaxDelay
+			break
+		}
+	}
+	if p.MaxDelay > 0 {
+		backoff = min(backoff, p.MaxDelay)
+	}
+
+	half := backoff / 2
+	return half + rand.N(backoff-half+1)
+}
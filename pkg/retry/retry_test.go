@@ -0,0 +1,106 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errFlaky = errors.New("flaky")
+
+func TestDo(t *testing.T) {
+	errPermanent := errors.New("permanent")
+
+	tests := []struct {
+		name      string
+		policy    Policy
+		errs      []error // returned by fn in turn, nil once they run out
+		wantCalls int
+		wantErr   error
+	}{
+		{"first try", Policy{MaxAttempts: 3}, nil, 1, nil},
+		{"success after two failures", Policy{MaxAttempts: 3}, []error{errFlaky, errFlaky}, 3, nil},
+		{"exhausted", Policy{MaxAttempts: 3}, []error{errFlaky, errFlaky, errFlaky, errFlaky}, 3, errFlaky},
+		{"no attempts means once", Policy{}, []error{errFlaky}, 1, errFlaky},
+		{
+			"not retryable",
+			Policy{MaxAttempts: 3, Retryable: func(err error) bool { return err != errPermanent }},
+			[]error{errFlaky, errPermanent, errFlaky},
+			2,
+			errPermanent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.BaseDelay = time.Millisecond
+
+			calls := 0
+			err := Do(context.Background(), tt.policy, func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Fatalf("fn ran %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDoStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Cancelled during the first wait, which would otherwise last an hour
+	calls := 0
+	start := time.Now()
+	err := Do(ctx, Policy{MaxAttempts: 3, BaseDelay: time.Hour}, func() error {
+		calls++
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return errFlaky
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the context error", err)
+	}
+	if calls != 1 || time.Since(start) > time.Second {
+		t.Fatalf("fn ran %d times in %v after the context ended", calls, time.Since(start))
+	}
+
+	// An already cancelled context still gets one try, but no retry
+	calls = 0
+	if err := Do(ctx, Policy{MaxAttempts: 3}, func() error { calls++; return errFlaky }); !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("got %v after %d calls, want the context error after one", err, calls)
+	}
+}
+
+func TestDelayBackoff(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+
+	for _, tt := range tests {
+		// Jittered into the upper half of the backoff
+		for range 20 {
+			if d := p.delay(tt.attempt); d < tt.max/2 || d > tt.max {
+				t.Fatalf("attempt %d waited %v, want between %v and %v", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package s3storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileStore is an ObjectStore that keeps objects as files under a base directory,
+// laid out with the same paths as in the bucket. Meant for local development
+type FileStore struct {
+	baseDir   string
+	keyPrefix string
+}
+
+// NewFileStore creates a file store rooted at baseDir, creating the directory if needed.
+// New objects are named under keyPrefix like in the bucket
+func NewFileStore(baseDir, keyPrefix string) (*FileStore, error) {
+	keyPrefix, err := CleanKeyPrefix(keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	absDir, err := filepath.Abs(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage directory: %w", err)
+	}
+
+	if err := os.MkdirAll(absDir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	return &FileStore{baseDir: absDir, keyPrefix: keyPrefix}, nil
+}
+
+// path maps an object name to its file, refusing names that would escape the base directory
+func (f *FileStore) path(objectName string) (string, error) {
+	name := filepath.FromSlash(objectName)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid object name: %s", objectName)
+	}
+	return filepath.Join(f.baseDir, name), nil
+}
+
+// put writes an object through a temporary file so readers never see it half written
+func (f *FileStore) put(objectName string, data []byte) error {
+	path, err := f.path(objectName)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("failed to create object directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create object file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store object: %w", err)
+	}
+
+	return nil
+}
+
+func (f *FileStore) UploadVoiceMessage(
+	ctx context.Context,
+	messageID uuid.UUID,
+	senderID uuid.UUID,
+	recipientID uuid.UUID,
+	data []byte,
+	audioFormat string,
+) (string, error) {
+	objectName := voiceObjectName(f.keyPrefix, messageID, audioFormat, time.Now())
+
+	if err := f.put(objectName, data); err != nil {
+		return "", err
+	}
+
+	return objectName, nil
+}
+
+func (f *FileStore) DownloadVoiceMessage(ctx context.Context, objectName string) ([]byte, error) {
+	path, err := f.path(objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+
+	return data, nil
+}
+
+// DeleteVoiceMessage removes an object. Like S3, deleting a missing object is not an error
+func (f *FileStore) DeleteVoiceMessage(ctx context.Context, objectName string) error {
+	path, err := f.path(objectName)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+
+	return nil
+}
+
+// GetPresignedURL returns a file:// link to the object. It never expires,
+// only works on the machine running the server and can't carry a filename
+func (f *FileStore) GetPresignedURL(ctx context.Context, objectName, filename string, expiry time.Duration) (string, error) {
+	path, err := f.path(objectName)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("failed to generate presigned url: %w", err)
+	}
+
+	return "file://" + filepath.ToSlash(path), nil
+}
+
+func (f *FileStore) GetObjectInfo(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	path, err := f.path(objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object info: %w", err)
+	}
+
+	return &ObjectInfo{
+		Key:          objectName,
+		Size:         stat.Size(),
+		ContentType:  contentTypeFor(strings.TrimPrefix(filepath.Ext(path), ".")),
+		LastModified: stat.ModTime(),
+	}, nil
+}
+
+func (f *FileStore) UploadPeaks(ctx context.Context, messageID uuid.UUID, data []byte) error {
+	return f.put(peaksObjectName(f.keyPrefix, messageID), data)
+}
+
+func (f *FileStore) DownloadPeaks(ctx context.Context, messageID uuid.UUID) ([]byte, error) {
+	data, err := f.DownloadVoiceMessage(ctx, peaksObjectName(f.keyPrefix, messageID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("peaks not found")
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (f *FileStore) DeletePeaks(ctx context.Context, messageID uuid.UUID) error {
+	return f.DeleteVoiceMessage(ctx, peaksObjectName(f.keyPrefix, messageID))
+}
+
+func (f *FileStore) ListVoiceMessages(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	prefix = f.keyPrefix + prefix
+
+	err := filepath.WalkDir(f.baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.baseDir, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         stat.Size(),
+			ContentType:  contentTypeFor(strings.TrimPrefix(filepath.Ext(path), ".")),
+			LastModified: stat.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	return objects, nil
+}
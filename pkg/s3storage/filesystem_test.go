@@ -0,0 +1,104 @@
+package s3storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objectName, err := store.UploadVoiceMessage(ctx, uuid.New(), uuid.New(), uuid.New(), []byte("voice"), "opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := store.DownloadVoiceMessage(ctx, objectName); err != nil || string(data) != "voice" {
+		t.Fatalf("read back %q, %v", data, err)
+	}
+	info, err := store.GetObjectInfo(ctx, objectName)
+	if err != nil || info.Size != int64(len("voice")) || info.Key != objectName {
+		t.Fatalf("object info %+v, %v", info, err)
+	}
+
+	link, err := store.GetPresignedURL(ctx, objectName, "voice.opus", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "file://" + filepath.ToSlash(filepath.Join(dir, objectName)); link != want {
+		t.Fatalf("link %s, want %s", link, want)
+	}
+
+	if err := store.DeleteVoiceMessage(ctx, objectName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DownloadVoiceMessage(ctx, objectName); err == nil {
+		t.Fatal("deleted object is still readable")
+	}
+	// Deleting again is fine, as with S3
+	if err := store.DeleteVoiceMessage(ctx, objectName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreLayout(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messageID := uuid.New()
+	day := time.Now().Format("2006/01/02")
+	objectName, err := store.UploadVoiceMessage(ctx, messageID, uuid.New(), uuid.New(), []byte("voice"), "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same date partitioned names as in the bucket
+	if want := "dev/messages/" + day + "/" + messageID.String() + ".wav"; objectName != want {
+		t.Fatalf("object name %s, want %s", objectName, want)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(objectName))); err != nil || string(data) != "voice" {
+		t.Fatalf("file at the object path: %q, %v", data, err)
+	}
+
+	// No temporary files are left next to the object
+	entries, err := os.ReadDir(filepath.Dir(filepath.Join(dir, filepath.FromSlash(objectName))))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("object directory holds %v, %v", entries, err)
+	}
+
+	listed, err := store.ListVoiceMessages(ctx, "messages/")
+	if err != nil || len(listed) != 1 || listed[0].Key != objectName {
+		t.Fatalf("listed %+v, %v", listed, err)
+	}
+}
+
+func TestFileStoreRefusesEscapingNames(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileStore(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../outside.opus", "/etc/passwd", "messages/../../outside.opus"} {
+		if _, err := store.DownloadVoiceMessage(ctx, name); err == nil {
+			t.Errorf("read %s outside the base directory", name)
+		}
+		if err := store.DeleteVoiceMessage(ctx, name); err == nil {
+			t.Errorf("deleted %s outside the base directory", name)
+		}
+	}
+}
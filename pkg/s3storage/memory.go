@@ -0,0 +1,142 @@
+package s3storage
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type memoryObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+// MemoryStore is an in-process ObjectStore for tests and local runs.
+// Objects use the same paths as in the bucket
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+// NewMemoryStore creates an empty in-memory object store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		objects: make(map[string]memoryObject),
+	}
+}
+
+func (m *MemoryStore) put(objectName string, data []byte, contentType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects[objectName] = memoryObject{
+		data: append([]byte(nil), data...),
+		info: ObjectInfo{
+			Key:          objectName,
+			Size:         int64(len(data)),
+			ContentType:  contentType,
+			LastModified: time.Now(),
+		},
+	}
+}
+
+func (m *MemoryStore) get(objectName string) (memoryObject, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	object, ok := m.objects[objectName]
+	if !ok {
+		return memoryObject{}, fmt.Errorf("object not found: %s", objectName)
+	}
+	return object, nil
+}
+
+func (m *MemoryStore) UploadVoiceMessage(
+	ctx context.Context,
+	messageID uuid.UUID,
+	senderID uuid.UUID,
+	recipientID uuid.UUID,
+	data []byte,
+	audioFormat string,
+) (string, error) {
+	objectName := voiceObjectName("", messageID, audioFormat, time.Now())
+	m.put(objectName, data, contentTypeFor(audioFormat))
+	return objectName, nil
+}
+
+func (m *MemoryStore) DownloadVoiceMessage(ctx context.Context, objectName string) ([]byte, error) {
+	object, err := m.get(objectName)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), object.data...), nil
+}
+
+func (m *MemoryStore) DeleteVoiceMessage(ctx context.Context, objectName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, objectName)
+	return nil
+}
+
+// GetPresignedURL returns a memory:// link, there is nothing to serve it.
+// A filename is carried in the same query parameter S3 links use
+func (m *MemoryStore) GetPresignedURL(ctx context.Context, objectName, filename string, expiry time.Duration) (string, error) {
+	if _, err := m.get(objectName); err != nil {
+		return "", err
+	}
+
+	link := "memory://" + objectName
+	if filename != "" {
+		params := url.Values{"response-content-disposition": {mime.FormatMediaType(DispositionAttachment, map[string]string{"filename": filename})}}
+		link += "?" + params.Encode()
+	}
+	return link, nil
+}
+
+func (m *MemoryStore) GetObjectInfo(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	object, err := m.get(objectName)
+	if err != nil {
+		return nil, err
+	}
+	info := object.info
+	return &info, nil
+}
+
+func (m *MemoryStore) UploadPeaks(ctx context.Context, messageID uuid.UUID, data []byte) error {
+	m.put(peaksObjectName("", messageID), data, "application/json")
+	return nil
+}
+
+func (m *MemoryStore) DownloadPeaks(ctx context.Context, messageID uuid.UUID) ([]byte, error) {
+	object, err := m.get(peaksObjectName("", messageID))
+	if err != nil {
+		return nil, fmt.Errorf("peaks not found")
+	}
+	return append([]byte(nil), object.data...), nil
+}
+
+func (m *MemoryStore) DeletePeaks(ctx context.Context, messageID uuid.UUID) error {
+	return m.DeleteVoiceMessage(ctx, peaksObjectName("", messageID))
+}
+
+func (m *MemoryStore) ListVoiceMessages(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var objects []ObjectInfo
+	for name, object := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, object.info)
+		}
+	}
+
+	return objects, nil
+}
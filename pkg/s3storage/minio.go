@@ -3,23 +3,119 @@ package s3storage
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/rx3lixir/laba/pkg/retry"
 )
 
+// requestPolicy retries object reads and writes that failed on the network or the server side
+var requestPolicy = retry.Policy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    time.Second,
+	Retryable:   retryable,
+}
+
+// retryable reports whether a failed request may succeed when repeated.
+// Client errors like a missing key or denied access won't
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var resp minio.ErrorResponse
+	if !errors.As(err, &resp) {
+		// No answer from the server at all
+		return true
+	}
+	return resp.StatusCode == 0 || resp.StatusCode == 429 || resp.StatusCode >= 500
+}
+
+// Keys of the audit metadata and tags attached to every voice message object
+const (
+	metaMessageID   = "Message-Id"
+	metaSenderID    = "Sender-Id"
+	metaRecipientID = "Recipient-Id"
+	metaUploadedAt  = "Uploaded-At"
+)
+
+// ObjectMetadata is the audit information stored with a voice message object
+type ObjectMetadata struct {
+	MessageID   uuid.UUID
+	SenderID    uuid.UUID
+	RecipientID uuid.UUID
+	UploadedAt  time.Time
+}
+
+// Server-side encryption modes
+const (
+	SSEModeNone = ""
+	SSEModeS3   = "sse-s3" // keys managed by the storage server
+	SSEModeC    = "sse-c"  // key supplied by us with every request
+)
+
+// NewSSE builds server-side encryption settings for mode.
+// SSE-C needs a base64 encoded 32 byte key, other modes ignore it. Returns nil for no encryption
+func NewSSE(mode, base64Key string) (encrypt.ServerSide, error) {
+	switch mode {
+	case SSEModeNone:
+		return nil, nil
+
+	case SSEModeS3:
+		return encrypt.NewSSE(), nil
+
+	case SSEModeC:
+		key, err := base64.StdEncoding.DecodeString(base64Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSE-C key: %w", err)
+		}
+
+		sse, err := encrypt.NewSSEC(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSE-C key: %w", err)
+		}
+		return sse, nil
+	}
+
+	return nil, fmt.Errorf("unknown server-side encryption mode: %s", mode)
+}
+
 // MinIOClient wraps the MinIO client for voice message storage
 type MinIOClient struct {
-	client     *minio.Client
-	bucketName string
+	client      *minio.Client
+	bucketName  string
+	sse         encrypt.ServerSide
+	keyPrefix   string
+	disposition string
 }
 
-// NewMinIOClient creates a new MinIO client and ensures bucket exists
-func NewMinIOClient(endpoint, accessKey, secretKey, bucketName string, useSSL bool) (*MinIOClient, error) {
+// NewMinIOClient creates a new MinIO client and ensures bucket exists.
+// With sse set every object is encrypted at rest, nil stores them as is.
+// New objects are named under keyPrefix, e.g. env/tenant/. Downloads carry a
+// Content-Disposition of the given type with a readable filename, empty leaves it out
+func NewMinIOClient(endpoint, accessKey, secretKey, bucketName string, useSSL bool, sse encrypt.ServerSide, keyPrefix, disposition string) (*MinIOClient, error) {
+	keyPrefix, err := CleanKeyPrefix(keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	switch disposition {
+	case "", DispositionAttachment, DispositionInline:
+	default:
+		return nil, fmt.Errorf("unknown content disposition: %s", disposition)
+	}
+
 	client, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
 		Secure: useSSL,
@@ -29,8 +125,11 @@ func NewMinIOClient(endpoint, accessKey, secretKey, bucketName string, useSSL bo
 	}
 
 	mc := &MinIOClient{
-		client:     client,
-		bucketName: bucketName,
+		client:      client,
+		bucketName:  bucketName,
+		sse:         sse,
+		keyPrefix:   keyPrefix,
+		disposition: disposition,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -43,6 +142,23 @@ func NewMinIOClient(endpoint, accessKey, secretKey, bucketName string, useSSL bo
 	return mc, nil
 }
 
+// readSSE returns the encryption settings reads have to repeat.
+// Only SSE-C does, the server decrypts SSE-S3 objects on its own
+func (m *MinIOClient) readSSE() encrypt.ServerSide {
+	if m.sse != nil && m.sse.Type() == encrypt.SSEC {
+		return m.sse
+	}
+	return nil
+}
+
+// contentDisposition builds the Content-Disposition value for filename, empty when disabled
+func (m *MinIOClient) contentDisposition(filename string) string {
+	if m.disposition == "" || filename == "" {
+		return ""
+	}
+	return mime.FormatMediaType(m.disposition, map[string]string{"filename": filename})
+}
+
 // ensureBucket creates the bucket if it doesn't exist
 func (m *MinIOClient) ensureBucket(ctx context.Context) error {
 	exists, err := m.client.BucketExists(ctx, m.bucketName)
@@ -60,71 +176,175 @@ func (m *MinIOClient) ensureBucket(ctx context.Context) error {
 	return nil
 }
 
+// voiceObjectName builds the object path of a voice message
+func voiceObjectName(keyPrefix string, messageID uuid.UUID, audioFormat string, now time.Time) string {
+	// Format: [prefix/]messages/YYYY/MM/DD/messageID.format
+	return fmt.Sprintf(
+		"%smessages/%d/%02d/%02d/%s.%s",
+		keyPrefix,
+		now.Year(),
+		now.Month(),
+		now.Day(),
+		messageID.String(),
+		audioFormat,
+	)
+}
+
+// GetPresignedPutURL generates a temporary link a client can PUT a voice message to directly.
+// Returns the link and the object path it uploads to. Direct uploads carry no audit
+// metadata and aren't encrypted with SSE-C, the client never sees the key
+func (m *MinIOClient) GetPresignedPutURL(
+	ctx context.Context,
+	messageID uuid.UUID,
+	audioFormat string,
+	expiry time.Duration,
+) (string, string, error) {
+	objectName := voiceObjectName(m.keyPrefix, messageID, audioFormat, time.Now())
+
+	url, err := m.client.PresignedPutObject(ctx, m.bucketName, objectName, expiry)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate presigned put url: %w", err)
+	}
+
+	return url.String(), objectName, nil
+}
+
 // UploadVoiceMessage uploads a voice message file to MinIO
 // Returns the object path in MinIO
 func (m *MinIOClient) UploadVoiceMessage(
 	ctx context.Context,
 	messageID uuid.UUID,
+	senderID uuid.UUID,
+	recipientID uuid.UUID,
 	data []byte,
 	audioFormat string,
 ) (string, error) {
-	// Format: messages/YYYY/MM/DD/messageID.format
 	now := time.Now()
-	objectName := fmt.Sprintf(
-		"messages/%d/%02d/%02d/%s.%s",
-		now.Year(),
-		now.Day(),
-		now.Month(),
-		messageID.String(),
-		audioFormat,
-	)
+	objectName := voiceObjectName(m.keyPrefix, messageID, audioFormat, now)
 
-	// Determine content type based on format
-	contentType := "audio/opus"
-	switch audioFormat {
-	case "mp3":
-		contentType = "audio/mpeg"
-	case "ogg":
-		contentType = "audio/ogg"
-	case "wav":
-		contentType = "audio/wav"
+	// Upload the file, every attempt gets a fresh reader
+	err := retry.Do(ctx, requestPolicy, func() error {
+		_, err := m.client.PutObject(
+			ctx,
+			m.bucketName,
+			objectName,
+			bytes.NewReader(data),
+			int64(len(data)),
+			minio.PutObjectOptions{
+				ContentType:          contentTypeFor(audioFormat),
+				ContentDisposition:   m.contentDisposition(DownloadFilename(senderID, now, audioFormat)),
+				ServerSideEncryption: m.sse,
+				// Metadata comes back with StatObject, tags can drive bucket policies and lifecycle rules
+				UserMetadata: map[string]string{
+					metaMessageID:   messageID.String(),
+					metaSenderID:    senderID.String(),
+					metaRecipientID: recipientID.String(),
+					metaUploadedAt:  now.UTC().Format(time.RFC3339),
+				},
+				UserTags: map[string]string{
+					"message-id":   messageID.String(),
+					"sender-id":    senderID.String(),
+					"recipient-id": recipientID.String(),
+				},
+			},
+		)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload to minio: %w", err)
 	}
 
-	// Upload the file
-	reader := bytes.NewReader(data)
+	return objectName, nil
+}
+
+// peaksObjectName is where the waveform peaks of a message are kept
+func peaksObjectName(keyPrefix string, messageID uuid.UUID) string {
+	return fmt.Sprintf("%speaks/%s.json", keyPrefix, messageID.String())
+}
+
+// UploadPeaks stores the JSON encoded waveform peaks of a message
+func (m *MinIOClient) UploadPeaks(ctx context.Context, messageID uuid.UUID, data []byte) error {
 	_, err := m.client.PutObject(
 		ctx,
 		m.bucketName,
-		objectName,
-		reader,
+		peaksObjectName(m.keyPrefix, messageID),
+		bytes.NewReader(data),
 		int64(len(data)),
 		minio.PutObjectOptions{
-			ContentType: contentType,
+			ContentType:          "application/json",
+			ServerSideEncryption: m.sse,
 		},
 	)
 	if err != nil {
-		return "", fmt.Errorf("failed to upload to minio: %w", err)
+		return fmt.Errorf("failed to upload peaks to minio: %w", err)
 	}
 
-	return objectName, nil
+	return nil
 }
 
-// DownloadVoiceMessage downloads a voice message from MinIO
-func (m *MinIOClient) DownloadVoiceMessage(ctx context.Context, objectName string) ([]byte, error) {
-	object, err := m.client.GetObject(ctx, m.bucketName, objectName, minio.GetObjectOptions{})
+// DownloadPeaks retrieves the JSON encoded waveform peaks of a message
+func (m *MinIOClient) DownloadPeaks(ctx context.Context, messageID uuid.UUID) ([]byte, error) {
+	data, err := m.DownloadVoiceMessage(ctx, peaksObjectName(m.keyPrefix, messageID))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get object: %w", err)
+		if minio.ToErrorResponse(errors.Unwrap(err)).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("peaks not found")
+		}
+		return nil, err
 	}
-	defer object.Close()
 
-	data, err := io.ReadAll(object)
+	return data, nil
+}
+
+// DeletePeaks removes the waveform peaks of a message, missing peaks are not an error
+func (m *MinIOClient) DeletePeaks(ctx context.Context, messageID uuid.UUID) error {
+	return m.DeleteVoiceMessage(ctx, peaksObjectName(m.keyPrefix, messageID))
+}
+
+// DownloadVoiceMessage downloads a voice message from MinIO
+func (m *MinIOClient) DownloadVoiceMessage(ctx context.Context, objectName string) ([]byte, error) {
+	var data []byte
+
+	// The request only goes out once the object is read, so retry both together
+	err := retry.Do(ctx, requestPolicy, func() error {
+		object, err := m.client.GetObject(ctx, m.bucketName, objectName, minio.GetObjectOptions{
+			ServerSideEncryption: m.readSSE(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get object: %w", err)
+		}
+		defer object.Close()
+
+		data, err = io.ReadAll(object)
+		if err != nil {
+			return fmt.Errorf("failed to read object: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read object: %w", err)
+		return nil, err
 	}
 
 	return data, nil
 }
 
+// ListVoiceMessages lists every object under prefix, recursively.
+// The prefix is taken below the key prefix, returned keys are full object names
+func (m *MinIOClient) ListVoiceMessages(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	for object := range m.client.ListObjects(ctx, m.bucketName, minio.ListObjectsOptions{
+		Prefix:    m.keyPrefix + prefix,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", object.Err)
+		}
+		objects = append(objects, toObjectInfo(object))
+	}
+
+	return objects, nil
+}
+
 // DeleteVoiceMessage deletes a voice message from MinIO
 func (m *MinIOClient) DeleteVoiceMessage(ctx context.Context, objectName string) error {
 	err := m.client.RemoveObject(ctx, m.bucketName, objectName, minio.RemoveObjectOptions{})
@@ -134,20 +354,84 @@ func (m *MinIOClient) DeleteVoiceMessage(ctx context.Context, objectName string)
 	return nil
 }
 
-// DeleteVoiceMessage deletes a voice message from MinIO
-func (m *MinIOClient) GetPresignedURL(ctx context.Context, objectName string, expiry time.Duration) (string, error) {
-	url, err := m.client.PresignedGetObject(ctx, m.bucketName, objectName, expiry, nil)
+// GetPresignedURL generates a temporary download link for an object.
+// With a filename set the response is served with a Content-Disposition naming it,
+// whatever the object was stored with. Links to SSE-C objects only work if the
+// caller also sends the key headers
+func (m *MinIOClient) GetPresignedURL(ctx context.Context, objectName, filename string, expiry time.Duration) (string, error) {
+	params := make(url.Values)
+	if disposition := m.contentDisposition(filename); disposition != "" {
+		params.Set("response-content-disposition", disposition)
+	}
+
+	link, err := m.client.PresignedGetObject(ctx, m.bucketName, objectName, expiry, params)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate presigned url: %w", err)
 	}
-	return url.String(), nil
+	return link.String(), nil
 }
 
 // GetObjectInfo retrieves metadata about a stored object
-func (m *MinIOClient) GetObjectInfo(ctx context.Context, objectName string) (*minio.ObjectInfo, error) {
-	info, err := m.client.StatObject(ctx, m.bucketName, objectName, minio.StatObjectOptions{})
+func (m *MinIOClient) GetObjectInfo(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	info, err := m.statObject(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	object := toObjectInfo(info)
+	return &object, nil
+}
+
+func (m *MinIOClient) statObject(ctx context.Context, objectName string) (minio.ObjectInfo, error) {
+	info, err := m.client.StatObject(ctx, m.bucketName, objectName, minio.StatObjectOptions{
+		ServerSideEncryption: m.readSSE(),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get object info: %w", err)
+		return minio.ObjectInfo{}, fmt.Errorf("failed to get object info: %w", err)
+	}
+	return info, nil
+}
+
+func toObjectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
 	}
-	return &info, nil
+}
+
+// GetVoiceMessageMetadata reads back the audit metadata of a voice message object
+func (m *MinIOClient) GetVoiceMessageMetadata(ctx context.Context, objectName string) (*ObjectMetadata, error) {
+	info, err := m.statObject(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header canonicalization may change the case of user metadata keys
+	get := func(key string) string {
+		for k, v := range info.UserMetadata {
+			if strings.EqualFold(k, key) {
+				return v
+			}
+		}
+		return ""
+	}
+
+	meta := &ObjectMetadata{}
+
+	if meta.MessageID, err = uuid.Parse(get(metaMessageID)); err != nil {
+		return nil, fmt.Errorf("invalid message id metadata: %w", err)
+	}
+	if meta.SenderID, err = uuid.Parse(get(metaSenderID)); err != nil {
+		return nil, fmt.Errorf("invalid sender id metadata: %w", err)
+	}
+	if meta.RecipientID, err = uuid.Parse(get(metaRecipientID)); err != nil {
+		return nil, fmt.Errorf("invalid recipient id metadata: %w", err)
+	}
+	if meta.UploadedAt, err = time.Parse(time.RFC3339, get(metaUploadedAt)); err != nil {
+		return nil, fmt.Errorf("invalid upload time metadata: %w", err)
+	}
+
+	return meta, nil
 }
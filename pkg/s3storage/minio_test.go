@@ -0,0 +1,385 @@
+package s3storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// fakeObject is an object held by fakeS3 with the headers it was uploaded with
+type fakeObject struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+}
+
+// fakeS3 is the bit of the S3 API the MinIO client uses, served over TLS
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+
+	// client trusts the server certificate, for requests made outside a MinIOClient
+	client *http.Client
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" {
+		// Bucket requests: it always exists
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = &fakeObject{data: data, header: r.Header.Clone(), modified: time.Now()}
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+
+	case http.MethodHead, http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		// SSE-C objects are only readable with the key they were written with
+		const keyMD5 = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+		if want := object.header.Get(keyMD5); want != "" && r.Header.Get(keyMD5) != want {
+			s3Error(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+
+		for name, values := range object.header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") || name == "Content-Type" || name == "Content-Disposition" {
+				w.Header()[name] = values
+			}
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(object.data))+`"`)
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(object.data)
+		}
+
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>`+code+`</Code><Message>`+code+`</Message></Error>`)
+}
+
+// object returns a stored object, nil if there is none
+func (f *fakeS3) object(key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.objects[key]
+}
+
+// newTestMinIO returns a client for a fake S3 server, the way NewMinIOClient would set it up
+func newTestMinIO(t *testing.T, sse encrypt.ServerSide, keyPrefix, disposition string) (*MinIOClient, *fakeS3) {
+	t.Helper()
+
+	fake := &fakeS3{objects: make(map[string]*fakeObject)}
+	srv := httptest.NewTLSServer(fake)
+	t.Cleanup(srv.Close)
+	fake.client = srv.Client()
+
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "https://"), &minio.Options{
+		Creds:     credentials.NewStaticV4("access", "secret", ""),
+		Secure:    true,
+		Region:    "us-east-1",
+		Transport: srv.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPrefix, err = CleanKeyPrefix(keyPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &MinIOClient{
+		client:      client,
+		bucketName:  "voice",
+		sse:         sse,
+		keyPrefix:   keyPrefix,
+		disposition: disposition,
+	}, fake
+}
+
+func TestVoiceMessageMetadataRoundTrip(t *testing.T) {
+	m, fake := newTestMinIO(t, nil, "", "")
+	ctx := t.Context()
+	messageID, senderID, recipientID := uuid.New(), uuid.New(), uuid.New()
+
+	before := time.Now().Truncate(time.Second)
+	objectName, err := m.UploadVoiceMessage(ctx, messageID, senderID, recipientID, []byte("voice"), "opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := m.GetVoiceMessageMetadata(ctx, objectName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.MessageID != messageID || meta.SenderID != senderID || meta.RecipientID != recipientID {
+		t.Fatalf("metadata %+v does not match the upload", meta)
+	}
+	if meta.UploadedAt.Before(before) || meta.UploadedAt.After(time.Now()) {
+		t.Fatalf("uploaded at %v", meta.UploadedAt)
+	}
+
+	tags, err := url.ParseQuery(fake.object(objectName).header.Get("X-Amz-Tagging"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags.Get("message-id") != messageID.String() || tags.Get("sender-id") != senderID.String() || tags.Get("recipient-id") != recipientID.String() {
+		t.Fatalf("object tagged %v", tags)
+	}
+}
+
+func TestVoiceObjectName(t *testing.T) {
+	messageID := uuid.New()
+	// The day is past 12 so a swapped month and day can't pass for a date
+	now := time.Date(2026, time.January, 2, 23, 59, 0, 0, time.UTC)
+
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "messages/2026/01/02/" + messageID.String() + ".wav"},
+		{"dev/", "dev/messages/2026/01/02/" + messageID.String() + ".wav"},
+	}
+	for _, tt := range tests {
+		if got := voiceObjectName(tt.prefix, messageID, "wav", now); got != tt.want {
+			t.Errorf("object name %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	m, fake := newTestMinIO(t, nil, "staging/tenant-a", "")
+	ctx := t.Context()
+	messageID := uuid.New()
+
+	objectName, err := m.UploadVoiceMessage(ctx, messageID, uuid.New(), uuid.New(), []byte("voice"), "opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(objectName, "staging/tenant-a/messages/") || fake.object(objectName) == nil {
+		t.Fatalf("stored as %s", objectName)
+	}
+	if err := m.UploadPeaks(ctx, messageID, []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	if fake.object("staging/tenant-a/peaks/"+messageID.String()+".json") == nil {
+		t.Fatal("peaks were not stored under the prefix")
+	}
+
+	// Stored paths are used as they are, including ones from before the prefix was set
+	unprefixed := *m
+	unprefixed.keyPrefix = ""
+	oldName, err := unprefixed.UploadVoiceMessage(ctx, uuid.New(), uuid.New(), uuid.New(), []byte("old voice"), "opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{objectName: "voice", oldName: "old voice"} {
+		if data, err := m.DownloadVoiceMessage(ctx, name); err != nil || string(data) != want {
+			t.Fatalf("%s read back %q, %v", name, data, err)
+		}
+	}
+
+	if err := m.DeleteVoiceMessage(ctx, objectName); err != nil {
+		t.Fatal(err)
+	}
+	if fake.object(objectName) != nil {
+		t.Fatal("object was not deleted")
+	}
+}
+
+func TestSSECRoundTrip(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	sse, err := NewSSE(SSEModeC, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, fake := newTestMinIO(t, sse, "", "")
+	ctx := t.Context()
+
+	objectName, err := m.UploadVoiceMessage(ctx, uuid.New(), uuid.New(), uuid.New(), []byte("voice"), "opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.object(objectName).header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "AES256" {
+		t.Fatal("object was uploaded without SSE-C")
+	}
+
+	data, err := m.DownloadVoiceMessage(ctx, objectName)
+	if err != nil || string(data) != "voice" {
+		t.Fatalf("read back %q, %v", data, err)
+	}
+
+	otherKey, err := NewSSE(SSEModeC, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, readSSE := range map[string]encrypt.ServerSide{"no key": nil, "wrong key": otherKey} {
+		reader := *m
+		reader.sse = readSSE
+		if _, err := reader.DownloadVoiceMessage(ctx, objectName); err == nil {
+			t.Errorf("read with %s succeeded", name)
+		}
+	}
+}
+
+func TestSSES3Upload(t *testing.T) {
+	sse, err := NewSSE(SSEModeS3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, fake := newTestMinIO(t, sse, "", "")
+	objectName, err := m.UploadVoiceMessage(t.Context(), uuid.New(), uuid.New(), uuid.New(), []byte("voice"), "opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.object(objectName).header.Get("X-Amz-Server-Side-Encryption") != "AES256" {
+		t.Fatal("object was uploaded without SSE-S3")
+	}
+
+	// The server decrypts on its own, reads don't repeat anything
+	if data, err := m.DownloadVoiceMessage(t.Context(), objectName); err != nil || string(data) != "voice" {
+		t.Fatalf("read back %q, %v", data, err)
+	}
+}
+
+func TestNewSSE(t *testing.T) {
+	tests := []struct {
+		mode, key string
+		wantErr   bool
+	}{
+		{SSEModeNone, "", false},
+		{SSEModeS3, "", false},
+		{SSEModeC, base64.StdEncoding.EncodeToString(make([]byte, 32)), false},
+		{SSEModeC, base64.StdEncoding.EncodeToString(make([]byte, 16)), true},
+		{SSEModeC, "not base64!", true},
+		{"sse-kms", "", true},
+	}
+
+	for _, tt := range tests {
+		_, err := NewSSE(tt.mode, tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewSSE(%q, %q) error = %v, want error %v", tt.mode, tt.key, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPresignedPutURL(t *testing.T) {
+	m, fake := newTestMinIO(t, nil, "", "")
+	ctx := t.Context()
+	messageID := uuid.New()
+
+	link, objectName, err := m.GetPresignedPutURL(ctx, messageID, "wav", 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(objectName, "messages/") || !strings.HasSuffix(objectName, messageID.String()+".wav") {
+		t.Fatalf("object name %s", objectName)
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/voice/"+objectName {
+		t.Fatalf("link uploads to %s, want %s in the bucket", u.Path, objectName)
+	}
+	if got := u.Query().Get("X-Amz-Expires"); got != "900" {
+		t.Fatalf("link expires in %ss, want 900", got)
+	}
+
+	// A client uploads straight to storage, the server then finds the object
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, link, strings.NewReader("voice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := fake.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload status %d", resp.StatusCode)
+	}
+
+	info, err := m.GetObjectInfo(ctx, objectName)
+	if err != nil || info.Size != int64(len("voice")) {
+		t.Fatalf("uploaded object %+v, %v", info, err)
+	}
+}
+
+func TestPresignedURLContentDisposition(t *testing.T) {
+	filename := DownloadFilename(uuid.New(), time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC), "opus")
+
+	tests := []struct {
+		name        string
+		disposition string
+		filename    string
+		want        string
+	}{
+		{"attachment", DispositionAttachment, filename, "attachment; filename=" + filename},
+		{"inline", DispositionInline, filename, "inline; filename=" + filename},
+		{"disabled", "", filename, ""},
+		{"no filename", DispositionAttachment, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestMinIO(t, nil, "", tt.disposition)
+
+			link, err := m.GetPresignedURL(t.Context(), "messages/voice.opus", tt.filename, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Query().Get("response-content-disposition"); got != tt.want {
+				t.Fatalf("response-content-disposition %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
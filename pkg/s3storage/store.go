@@ -0,0 +1,103 @@
+package s3storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ObjectStore defines the voice message storage operations the servers rely on.
+// MinIOClient is the S3 implementation, FileStore keeps objects on local disk
+// and MemoryStore keeps them in process
+type ObjectStore interface {
+	UploadVoiceMessage(ctx context.Context, messageID, senderID, recipientID uuid.UUID, data []byte, audioFormat string) (string, error)
+	DownloadVoiceMessage(ctx context.Context, objectName string) ([]byte, error)
+	DeleteVoiceMessage(ctx context.Context, objectName string) error
+	GetPresignedURL(ctx context.Context, objectName, filename string, expiry time.Duration) (string, error)
+	GetObjectInfo(ctx context.Context, objectName string) (*ObjectInfo, error)
+	UploadPeaks(ctx context.Context, messageID uuid.UUID, data []byte) error
+	DownloadPeaks(ctx context.Context, messageID uuid.UUID) ([]byte, error)
+	DeletePeaks(ctx context.Context, messageID uuid.UUID) error
+	ListVoiceMessages(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// DirectUploader is implemented by stores clients can upload to without going through the server
+type DirectUploader interface {
+	GetPresignedPutURL(ctx context.Context, messageID uuid.UUID, audioFormat string, expiry time.Duration) (string, string, error)
+}
+
+// Storage backends selectable in config
+const (
+	BackendMinIO      = "minio"
+	BackendFilesystem = "filesystem"
+)
+
+// Content-Disposition types for downloaded voice messages
+const (
+	DispositionAttachment = "attachment" // browsers save the file
+	DispositionInline     = "inline"     // browsers play it in place
+)
+
+// DownloadFilename is the name a voice message is saved under when downloaded,
+// e.g. voice_<sender>_20260102-150405.opus
+func DownloadFilename(senderID uuid.UUID, sentAt time.Time, audioFormat string) string {
+	return fmt.Sprintf("voice_%s_%s.%s", senderID.String(), sentAt.UTC().Format("20060102-150405"), audioFormat)
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+var (
+	_ ObjectStore = (*MinIOClient)(nil)
+	_ ObjectStore = (*FileStore)(nil)
+	_ ObjectStore = (*MemoryStore)(nil)
+
+	_ DirectUploader = (*MinIOClient)(nil)
+)
+
+// CleanKeyPrefix checks a key prefix and returns it with a trailing slash.
+// Segments may hold letters, digits, dots, dashes and underscores, an empty prefix stays empty
+func CleanKeyPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+
+	for _, segment := range strings.Split(strings.TrimSuffix(prefix, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid key prefix: %s", prefix)
+		}
+		for _, r := range segment {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+				return "", fmt.Errorf("invalid key prefix: %s", prefix)
+			}
+		}
+	}
+
+	return strings.TrimSuffix(prefix, "/") + "/", nil
+}
+
+// contentTypeFor returns the MIME type stored with a voice message of the given format.
+// zstd-compressed audio, e.g. wav.zst, is stored as what it is rather than as audio
+func contentTypeFor(audioFormat string) string {
+	if audioFormat == "zst" || strings.HasSuffix(audioFormat, ".zst") {
+		return "application/zstd"
+	}
+
+	switch audioFormat {
+	case "mp3":
+		return "audio/mpeg"
+	case "ogg":
+		return "audio/ogg"
+	case "wav":
+		return "audio/wav"
+	}
+	return "audio/opus"
+}
@@ -0,0 +1,37 @@
+package s3storage
+
+import "testing"
+
+func TestCleanKeyPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"staging", "staging/", false},
+		{"staging/", "staging/", false},
+		{"prod/tenant-a_1.eu", "prod/tenant-a_1.eu/", false},
+		{"/staging", "", true},
+		{"staging//tenant", "", true},
+		{"staging/../prod", "", true},
+		{"./staging", "", true},
+		{"staging tenant", "", true},
+		{"staging/tenant?", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			got, err := CleanKeyPrefix(tt.prefix)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("prefix accepted as %q", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
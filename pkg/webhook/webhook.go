@@ -0,0 +1,215 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/rx3lixir/laba/pkg/retry"
+)
+
+// Message lifecycle events
+const (
+	EventReceived  = "message.received"
+	EventDelivered = "message.delivered"
+	EventListened  = "message.listened"
+	EventFailed    = "message.failed"
+)
+
+// Headers sent with every delivery. The signature is the hex HMAC-SHA256
+// of the timestamp, a dot and the body, keyed with the shared secret
+const (
+	HeaderEvent     = "X-Laba-Event"
+	HeaderTimestamp = "X-Laba-Timestamp"
+	HeaderSignature = "X-Laba-Signature"
+)
+
+// queueSize caps how many events may wait for delivery, further ones are dropped
+const queueSize = 1024
+
+// workers is how many deliveries run at once
+const workers = 4
+
+// Event is the JSON payload posted to every endpoint
+type Event struct {
+	ID          uuid.UUID `json:"id"`
+	Type        string    `json:"type"`
+	MessageID   uuid.UUID `json:"message_id"`
+	SenderID    uuid.UUID `json:"sender_id"`
+	RecipientID uuid.UUID `json:"recipient_id"`
+	Reason      string    `json:"reason,omitempty"`
+	OccurredAt  time.Time `json:"occurred_at"`
+}
+
+// NewEvent creates an event of the given type for a message
+func NewEvent(eventType string, messageID, senderID, recipientID uuid.UUID) Event {
+	return Event{
+		ID:          uuid.New(),
+		Type:        eventType,
+		MessageID:   messageID,
+		SenderID:    senderID,
+		RecipientID: recipientID,
+		OccurredAt:  time.Now().UTC(),
+	}
+}
+
+// Dispatcher posts events to the configured endpoints in the background.
+// A nil Dispatcher or one without endpoints drops every event
+type Dispatcher struct {
+	endpoints []string
+	secret    []byte
+	client    *http.Client
+	policy    retry.Policy
+	queue     chan Event
+	log       *log.Logger
+}
+
+// New creates a dispatcher. Every delivery attempt is bound by timeout,
+// a failed delivery is tried up to attempts times
+func New(endpoints []string, secret string, timeout time.Duration, attempts int, logger *log.Logger) *Dispatcher {
+	return &Dispatcher{
+		endpoints: endpoints,
+		secret:    []byte(secret),
+		client:    &http.Client{Timeout: timeout},
+		policy: retry.Policy{
+			MaxAttempts: attempts,
+			BaseDelay:   500 * time.Millisecond,
+			MaxDelay:    30 * time.Second,
+			Retryable:   retryable,
+		},
+		queue: make(chan Event, queueSize),
+		log:   logger,
+	}
+}
+
+// Enabled reports whether events are delivered anywhere
+func (d *Dispatcher) Enabled() bool {
+	return d != nil && len(d.endpoints) > 0
+}
+
+// Dispatch queues an event for delivery without blocking.
+// Events are dropped when the queue is full
+func (d *Dispatcher) Dispatch(event Event) {
+	if !d.Enabled() {
+		return
+	}
+
+	select {
+	case d.queue <- event:
+	default:
+		d.log.Warn("Webhook queue is full, dropping event", "event", event.Type, "message_id", event.MessageID)
+	}
+}
+
+// Run delivers queued events until ctx is cancelled. Events still queued then are lost
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event := <-d.queue:
+					d.deliver(ctx, event)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// deliver posts an event to every endpoint
+func (d *Dispatcher) deliver(ctx context.Context, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		d.log.Error("Failed to encode webhook event", "event", event.Type, "error", err)
+		return
+	}
+
+	for _, endpoint := range d.endpoints {
+		err := retry.Do(ctx, d.policy, func() error {
+			return d.post(ctx, endpoint, event.Type, body)
+		})
+		if err != nil {
+			d.log.Warn(
+				"Webhook delivery failed",
+				"endpoint", endpoint,
+				"event", event.Type,
+				"message_id", event.MessageID,
+				"error", err,
+			)
+			continue
+		}
+
+		d.log.Debug("Webhook delivered", "endpoint", endpoint, "event", event.Type, "message_id", event.MessageID)
+	}
+}
+
+// post sends one signed delivery attempt
+func (d *Dispatcher) post(ctx context.Context, endpoint, eventType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, eventType)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(d.secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// Sign computes the signature of a delivery, receivers use it to verify one
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// statusError is a delivery the endpoint answered with a non 2xx status
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("webhook endpoint responded with status %d", e.code)
+}
+
+// retryable retries network errors, throttling and server errors.
+// Other statuses mean the endpoint rejected the event and won't change its mind
+func retryable(err error) bool {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+	}
+	return true
+}
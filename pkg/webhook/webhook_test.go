@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+)
+
+// delivery is a request a test endpoint received
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// endpoint is a test webhook receiver answering with statuses in turn, 200 once they run out
+type endpoint struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	received []delivery
+}
+
+func newEndpoint(t *testing.T, statuses ...int) *endpoint {
+	t.Helper()
+
+	e := &endpoint{statuses: statuses}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		e.received = append(e.received, delivery{header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(e.statuses) > 0 {
+			status, e.statuses = e.statuses[0], e.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *endpoint) deliveries() []delivery {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]delivery(nil), e.received...)
+}
+
+func TestDispatchSignsPayload(t *testing.T) {
+	e := newEndpoint(t)
+	d := New([]string{e.URL}, "shared-secret", time.Second, 3, log.New(io.Discard))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	event := NewEvent(EventDelivered, uuid.New(), uuid.New(), uuid.New())
+	d.Dispatch(event)
+
+	var got []delivery
+	for deadline := time.Now().Add(2 * time.Second); len(got) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("event was not delivered")
+		}
+		got = e.deliveries()
+	}
+
+	h := got[0].header
+	if h.Get("Content-Type") != "application/json" || h.Get(HeaderEvent) != EventDelivered {
+		t.Fatalf("headers %v", h)
+	}
+	if want := "sha256=" + Sign([]byte("shared-secret"), h.Get(HeaderTimestamp), got[0].body); h.Get(HeaderSignature) != want {
+		t.Fatalf("signature %q, want %q", h.Get(HeaderSignature), want)
+	}
+	if h.Get(HeaderSignature) == "sha256="+Sign([]byte("other-secret"), h.Get(HeaderTimestamp), got[0].body) {
+		t.Fatal("signature doesn't depend on the secret")
+	}
+
+	var payload Event
+	if err := json.Unmarshal(got[0].body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != event.ID || payload.Type != EventDelivered || payload.MessageID != event.MessageID ||
+		payload.SenderID != event.SenderID || payload.RecipientID != event.RecipientID || !payload.OccurredAt.Equal(event.OccurredAt) {
+		t.Fatalf("payload %+v, want %+v", payload, event)
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantPosts int
+	}{
+		{"first try", nil, 1},
+		{"server errors are retried", []int{http.StatusInternalServerError, http.StatusBadGateway}, 3},
+		{"throttling is retried", []int{http.StatusTooManyRequests}, 2},
+		{"gives up after the last attempt", []int{500, 500, 500, 500}, 3},
+		{"rejections are not retried", []int{http.StatusBadRequest}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEndpoint(t, tt.statuses...)
+			d := New([]string{e.URL}, "shared-secret", time.Second, 3, log.New(io.Discard))
+			d.policy.BaseDelay = time.Millisecond
+
+			d.deliver(context.Background(), NewEvent(EventFailed, uuid.New(), uuid.New(), uuid.New()))
+
+			if got := len(e.deliveries()); got != tt.wantPosts {
+				t.Fatalf("posted %d times, want %d", got, tt.wantPosts)
+			}
+		})
+	}
+}
+
+func TestDisabledDispatcherDropsEvents(t *testing.T) {
+	var nilDispatcher *Dispatcher
+	for name, d := range map[string]*Dispatcher{
+		"nil":          nilDispatcher,
+		"no endpoints": New(nil, "shared-secret", time.Second, 3, log.New(io.Discard)),
+	} {
+		if d.Enabled() {
+			t.Errorf("%s dispatcher is enabled", name)
+		}
+		// Must not block or panic
+		d.Dispatch(NewEvent(EventReceived, uuid.New(), uuid.New(), uuid.New()))
+	}
+}